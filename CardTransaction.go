@@ -1,6 +1,8 @@
 package main
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"strconv"
@@ -30,6 +32,136 @@ const	USER_HOLDER = "user_holder"
 const	CARD_TEMPLATE_HOLDER = "card_template_holder"
 const	CARD_HOLDER = "card_holder"
 
+//==============================================================================================================================
+//	 Staff roles - A SHOP user is linked to a Shop record by Shopid and acts for that shop with one of these roles.
+//				   A SHOP user without role is an old style single identity shop and is treated as its owner
+//==============================================================================================================================
+const	STAFF_OWNER = "owner"
+const	STAFF_MANAGER = "manager"
+const	STAFF_CASHIER = "cashier"
+
+const	PERM_ISSUE_CARD = "issue_card"
+const	PERM_DEPOSIT = "deposit"
+const	PERM_REFUND = "refund"
+const	PERM_ADJUST = "adjust"
+const	PERM_VIEW_LEDGER = "view_ledger"
+const	PERM_MANAGE_STAFF = "manage_staff"
+const	PERM_MANAGE_TEMPLATE = "manage_template"
+const	PERM_SETTLEMENT = "settlement"
+
+const	ADMIN_AUDIT_HOLDER = "admin_audit_holder"
+
+//==============================================================================================================================
+//	 Shop status - a registered shop is pending until KAKACENTER approves or rejects it. Shops created before
+//				   the approval workflow have no status and are treated as approved
+//==============================================================================================================================
+const	SHOP_PENDING = "pending"
+const	SHOP_APPROVED = "approved"
+const	SHOP_REJECTED = "rejected"
+const	SHOP_SUSPENDED = "suspended"		// no new cards or deposits, consumers can still spend down and transfer
+const	SHOP_TERMINATED = "terminated"		// retired after its outstanding card balances were settled
+
+//	settlement plans of outstanding card balances when a shop is terminated
+const	SETTLE_REFUND = "refund"			// balances are refunded to the consumers and the cards scrapped
+const	SETTLE_TRANSFER = "transfer"		// templates, cards and ledgers are taken over by another shop
+const	TIME_FORMAT = "2006-01-02 03:04:05 PM"
+const	ALLIANCE_HOLDER = "alliance_holder"
+const	SETTLEMENT_HOLDER = "settlement_holder"
+const	DAY_FORMAT = "2006-01-02"
+
+//==============================================================================================================================
+//	 Currencies - money is kept as int64 in minor units of the ISO 4217 currency of the template. Exponent is the
+//				  number of decimals of the currency
+//==============================================================================================================================
+const	DEFAULT_CURRENCY = "CNY"
+
+var currency_exponents = map[string]int{
+	"CNY": 2,
+	"HKD": 2,
+	"USD": 2,
+	"EUR": 2,
+	"GBP": 2,
+	"JPY": 0,
+	"KRW": 0,
+}
+
+//	card age buckets of the liability report, upper bounds in days since the card was released
+var liability_age_buckets = []int{ 30, 90, 180, 365, 730 }
+const	AGE_UNKNOWN = "unknown"				// cards never released to a consumer
+const	AGE_ESCROW = "escrow"				// amounts of open gifts and pending transfers
+
+//	commission rule scope
+const	COMMISSION_SHOP = "shop"
+const	COMMISSION_TEMPLATE = "template"			// rule of a template wins over the rule of its shop
+
+//	coupon kinds
+const	COUPON_DISCOUNT = "discount"			// Value percent off the spend
+const	COUPON_VOUCHER = "voucher"				// Value in minor units off the spend
+const	COUPON_TEMPLATE_HOLDER = "coupon_template_holder"
+const	COUPON_HOLDER = "coupon_holder"
+
+//	campaign triggers and status
+const	CAMPAIGN_DEPOSIT = "deposit"
+const	CAMPAIGN_SPEND = "spend"
+const	CAMPAIGN_ACTIVE = "active"
+const	CAMPAIGN_EXHAUSTED = "exhausted"			// budget used up
+const	CAMPAIGN_STOPPED = "stopped"
+const	CAMPAIGN_HOLDER = "campaign_holder"
+
+//	gift offer status
+const	GIFT_OPEN = "open"
+const	GIFT_CLAIMED = "claimed"
+const	GIFT_REVOKED = "revoked"
+const	GIFT_EXPIRED = "expired"
+const	GIFT_RETURNED = "returned"				// the shop of the card was terminated
+const	GIFT_HOLDER = "gift_holder"
+
+//	pending transfer status
+const	TRANSFER_PENDING = "pending"
+const	TRANSFER_ACCEPTED = "accepted"
+const	TRANSFER_DECLINED = "declined"
+const	TRANSFER_CANCELLED = "cancelled"
+const	TRANSFER_EXPIRED = "expired"
+const	TRANSFER_RETURNED = "returned"			// the shop of the card was terminated
+const	PENDING_TRANSFER_HOLDER = "pending_transfer_holder"
+
+//	fraud flag status
+const	FLAG_OPEN = "open"
+const	FLAG_CLEARED = "cleared"				// false alarm, the card is unfrozen
+const	FLAG_CONFIRMED = "confirmed"			// fraud, the card stays frozen
+const	FRAUD_RULES = "fraud_rules"
+const	FRAUD_FLAG_HOLDER = "fraud_flag_holder"
+
+//	card activity kept for the fraud rules
+const	ACTIVITY_DEPOSIT = "deposit"
+const	ACTIVITY_SPEND = "spend"
+const	ACTIVITY_TRANSFER_OUT = "transfer_out"
+const	ACTIVITY_TRANSFER_IN = "transfer_in"
+const	ACTIVITY_GIFT_OUT = "gift_out"
+const	ACTIVITY_GIFT_IN = "gift_in"
+
+//	dispute status and rulings
+const	DISPUTE_OPEN = "open"
+const	DISPUTE_RESPONDED = "responded"			// the shop answered, waiting for KAKACENTER
+const	DISPUTE_REFUNDED = "refunded"			// ruled for the consumer, the spend is reversed
+const	DISPUTE_RELEASED = "released"			// ruled for the shop, the held amount is released
+const	DISPUTE_HOLDER = "dispute_holder"
+
+//	journal accounts, an account id is the kind followed by the card, the shop and currency or the escrow
+const	ACCOUNT_CARD = "card"					// consumer card liability, money and bonus money and points of the card
+const	ACCOUNT_SHOP_CASH = "shopcash"			// stored value taken in by the shop and not yet discharged
+const	ACCOUNT_PROMOTION = "promotion"			// points and bonus money given away by the shop
+const	ACCOUNT_BREAKAGE = "breakage"			// expired and forfeited value
+const	ACCOUNT_COMMISSION = "commission"		// commission the shop owes KAKACENTER
+const	ACCOUNT_ADJUSTMENT = "adjustment"		// balances set by the shop by hand
+const	ACCOUNT_ESCROW = "escrow"				// amounts of open gifts and pending transfers
+const	JOURNAL_COUNTER = "journal_counter"	// number of journal entries posted
+
+//	settlement batch status
+const	SETTLEMENT_OPEN = "open"
+const	SETTLEMENT_CONFIRMED = "confirmed"			// payer agreed the amount
+const	SETTLEMENT_PAID = "paid"					// payee received the payment
+
 
 //==============================================================================================================================
 //	 Status types - Asset lifecycle is broken down into 5 statuses, this is part of the business logic to determine what can 
@@ -40,6 +172,7 @@ const   STATE_SHOP  					=  1		//STATE_MANUFACTURE
 const   STATE_CONSUMER_OWNERSHIP 		=  2		//STATE_PRIVATE_OWNERSHIP
 const   STATE_MAILBOX_OWNERSHIP 		=  3		//STATE_LEASED_OUT
 //const   STATE_BEING_SCRAPPED  			=  4
+const   STATE_ESCROW 					=  5		// card locked in a gift offer or pending transfer
 
 //==============================================================================================================================
 //	 Structure Definitions 
@@ -65,7 +198,10 @@ type Card struct {
 	Owner			string `json:"owner"`
 	Tel				string `json:"tel"`
 	Password		string `json:"password"`
-	Money			int `json:"money"`
+	Money			int64 `json:"money"`		// minor units of Currency
+	Currency		string `json:"currency"`		// ISO 4217 code
+	Bonusmoney		int64 `json:"bonusmoney"`		// campaign bonus, kept apart from the principal in Money
+	Frozen			bool `json:"frozen"`		// no value can leave a frozen card until KAKACENTER clears its fraud flag
 	Point			int `json:"point"`
 	Expdate			string `json:"expdate"`
 	Getdate			string `json:"getdate"`
@@ -73,8 +209,321 @@ type Card struct {
 	Expired			bool `json:"expired"`
 	Scrapped       	bool `json:"scrapped"`
 	Status       	int `json:"status"`
+	Totalspend		int64 `json:"totalspend"`
+	Earnrule		*EarnRule `json:"earnrule,omitempty"`		// template only
+	Tierrules		[]TierRule `json:"tierrules,omitempty"`		// template only
+	Pointexpiredays	int `json:"pointexpiredays,omitempty"`		// template only, 0 means points never expire
+	Limits			*SpendLimits `json:"limits,omitempty"`		// template limits on a template, owner-set limits on a card
+}
+
+//==============================================================================================================================
+//	SpendLimits - most money that can leave a card by spend, transfer or gift per transaction, per day and per month,
+//				  in minor units. 0 means no limit. Limits set by the owner on a card can only be lower than the template's
+//==============================================================================================================================
+type SpendLimits struct {
+	Pertransaction	int64 `json:"pertransaction"`
+	Daily			int64 `json:"daily"`
+	Monthly			int64 `json:"monthly"`
+}
+
+//==============================================================================================================================
+//	SpendCounter - money that left the cards of a template owned by one consumer in the last 30 days, counted over
+//				   rolling windows: daily is the last 24 hours, monthly the last 30 days
+//==============================================================================================================================
+type SpendCounter struct {
+	Owner			string `json:"owner"`
+	Templateid		string `json:"templateid"`
+	Spends			[]CountedSpend `json:"spends"`
+}
+
+type CountedSpend struct {
+	Timestamp		string `json:"timestamp"`
+	Money			int64 `json:"money"`
+}
+
+//==============================================================================================================================
+//	EarnRule - points a consumer earns on spend: Points for every Moneyunit spent, multiplied by the percent rate
+//			   of the card level in Levelrates and capped to Maxpoints per transaction (0 means no cap)
+//==============================================================================================================================
+type EarnRule struct {
+	Moneyunit		int64 `json:"moneyunit"`
+	Points			int `json:"points"`
+	Levelrates		map[string]int `json:"levelrates"`
+	Maxpoints		int `json:"maxpoints"`
+}
+
+
+//==============================================================================================================================
+//	TierRule - a card reaches Level when its cumulative spend is at least Minspend and its points at least Minpoint.
+//			   Rules are listed from the lowest to the highest level, the highest matching rule wins
+//==============================================================================================================================
+type TierRule struct {
+	Level			string `json:"level"`
+	Minspend		int64 `json:"minspend"`
+	Minpoint		int `json:"minpoint"`
+}
+
+//==============================================================================================================================
+//	Card_PointLots - the points of a card as dated lots, oldest first. Points consumed from the oldest lots first.
+//					 Points without lot (issued with the card or before lots were kept) have no expiry date
+//==============================================================================================================================
+type PointLot struct {
+	Points			int `json:"points"`
+	Getdate			string `json:"getdate"`
+	Expdate			string `json:"expdate"`
+}
+
+type Card_PointLots struct {
+	Cardid			string `json:"cardid"`
+	Lots			[]PointLot `json:"lots"`
+}
+
+//==============================================================================================================================
+//	Card_History - events in the life of a card, kept in state at get_cardHistoryID(cardid)
+//==============================================================================================================================
+type CardEvent struct {
+	Action			string `json:"action"`
+	Detail			string `json:"detail"`
+	Timestamp		string `json:"timestamp"`
+	Eventid			string `json:"eventid,omitempty"`		// transactions only: deposits and spends
+	Shopid			string `json:"shopid,omitempty"`
+	Money			int64 `json:"money,omitempty"`
+	Point			int `json:"point,omitempty"`
+	Principal		int64 `json:"principal,omitempty"`		// spends: money taken from principal, the rest from bonus money
+	Bonusspent		int64 `json:"bonusspent,omitempty"`
+	Earnpoint		int `json:"earnpoint,omitempty"`			// spends: points earned and campaign bonus granted
+	Bonusmoney		int64 `json:"bonusmoney,omitempty"`
+	Bonuspoint		int `json:"bonuspoint,omitempty"`
+	Commission		int64 `json:"commission,omitempty"`
+	Disputeid		string `json:"disputeid,omitempty"`
+}
+
+type Card_History struct {
+	Cardid			string `json:"cardid"`
+	Events			[]CardEvent `json:"events"`
+}
+
+//==============================================================================================================================
+//	Coupon - single-use discount coupon or fixed-value voucher of a shop, issued from a coupon template like a card
+//			 from a card template. Valid from Startdate to Enddate (DAY_FORMAT, both included) on a spend of at least
+//			 Minspend. Perconsumer limits how many coupons of the template a consumer can receive, 0 means no limit
+//==============================================================================================================================
+type Coupon struct {
+	Templateid		string `json:"templateid"`
+	Couponid		string `json:"couponid"`
+	Shopid			string `json:"shopid"`
+	Name			string `json:"name"`
+	Kind			string `json:"kind"`
+	Value			int64 `json:"value"`
+	Currency		string `json:"currency"`
+	Minspend		int64 `json:"minspend"`
+	Startdate		string `json:"startdate"`
+	Enddate			string `json:"enddate"`
+	Perconsumer		int `json:"perconsumer"`
+	Owner			string `json:"owner"`
+	Issuedate		string `json:"issuedate"`
+	Redeemed		bool `json:"redeemed"`
+	Redeemdate		string `json:"redeemdate"`
+	Redeemcard		string `json:"redeemcard"`
+	Counts			map[string]int `json:"counts,omitempty"`		// template only, coupons received per consumer
+}
+
+//==============================================================================================================================
+//	Campaign - promotion of a shop: a deposit or spend of at least Threshold on a card of the shop (or only of
+//			   Templateid) between Startdate and Enddate earns Rewardmoney bonus money and Rewardpoint points, for
+//			   every full Threshold when Repeat is set. Spent bonus money does not count towards Threshold. Rewards
+//			   come out of Budget (money) and Pointbudget, the campaign is exhausted once either is used up
+//==============================================================================================================================
+type Campaign struct {
+	Campaignid		string `json:"campaignid"`
+	Shopid			string `json:"shopid"`
+	Templateid		string `json:"templateid"`
+	Name			string `json:"name"`
+	Trigger			string `json:"trigger"`
+	Threshold		int64 `json:"threshold"`
+	Repeat			bool `json:"repeat"`
+	Rewardmoney		int64 `json:"rewardmoney"`
+	Rewardpoint		int `json:"rewardpoint"`
+	Currency		string `json:"currency"`
+	Startdate		string `json:"startdate"`
+	Enddate			string `json:"enddate"`
+	Budget			int64 `json:"budget"`
+	Pointbudget		int `json:"pointbudget"`
+	Usedmoney		int64 `json:"usedmoney"`
+	Usedpoint		int `json:"usedpoint"`
+	Status			string `json:"status"`
+}
+
+type Campaign_Holder struct {
+	Campaigns 	[]string `json:"campaigns"`
 }
 
+//==============================================================================================================================
+//	GiftOffer - a whole card or an amount of a card offered by Sender to whoever knows the claim code. Only the
+//				sha256 hash of the code is kept. The card or the amount stays in escrow until the gift is claimed,
+//				revoked by the sender or expired at Expdate, then the value goes back to the sender's card
+//==============================================================================================================================
+type GiftOffer struct {
+	Giftid			string `json:"giftid"`
+	Sender			string `json:"sender"`
+	Cardid			string `json:"cardid"`
+	Templateid		string `json:"templateid"`
+	Wholecard		bool `json:"wholecard"`
+	Money			int64 `json:"money"`
+	Currency		string `json:"currency"`
+	Point			int `json:"point"`
+	Lots			[]PointLot `json:"lots"`
+	Codehash		string `json:"codehash"`
+	Createdate		string `json:"createdate"`
+	Expdate			string `json:"expdate"`
+	Status			string `json:"status"`
+	Claimer			string `json:"claimer"`
+	Claimcard		string `json:"claimcard"`
+	Closedate		string `json:"closedate"`
+}
+
+type Gift_Holder struct {
+	Gifts 		[]string `json:"gifts"`
+}
+
+//==============================================================================================================================
+//	PendingTransfer - a card or an amount of a card proposed by Sender to Receiver. The value is held in escrow
+//					  until the receiver accepts or declines, the sender cancels or it expires at Expdate
+//==============================================================================================================================
+type PendingTransfer struct {
+	Transferid		string `json:"transferid"`
+	Sender			string `json:"sender"`
+	Receiver		string `json:"receiver"`
+	Cardid			string `json:"cardid"`
+	Wholecard		bool `json:"wholecard"`
+	Money			int64 `json:"money"`
+	Currency		string `json:"currency"`
+	Point			int `json:"point"`
+	Lots			[]PointLot `json:"lots"`
+	Createdate		string `json:"createdate"`
+	Expdate			string `json:"expdate"`
+	Status			string `json:"status"`
+	Targetcard		string `json:"targetcard"`
+	Closedate		string `json:"closedate"`
+}
+
+type PendingTransfer_Holder struct {
+	Transfers 		[]string `json:"transfers"`
+}
+
+//==============================================================================================================================
+//	FraudRules - velocity rules evaluated on every movement of value out of a card by transfer, gift or spend, set by
+//				 KAKACENTER. A rule with 0 minutes is off. Burst: Burstcount movements out within Burstminutes.
+//				 Roundtrip: a transfer back to a consumer the card received from within Roundtripminutes. Deposit: a
+//				 transfer or gift out within Depositminutes of a deposit. With Autofreeze the flagged card is frozen as well
+//==============================================================================================================================
+type FraudRules struct {
+	Burstcount			int `json:"burstcount"`
+	Burstminutes		int `json:"burstminutes"`
+	Roundtripminutes	int `json:"roundtripminutes"`
+	Depositminutes		int `json:"depositminutes"`
+	Autofreeze			bool `json:"autofreeze"`
+}
+
+type CardActivity struct {
+	Action			string `json:"action"`
+	Counterparty	string `json:"counterparty"`
+	Money			int64 `json:"money"`
+	Point			int `json:"point"`
+	Timestamp		string `json:"timestamp"`
+}
+
+type Card_Activity struct {
+	Cardid			string `json:"cardid"`
+	Activities		[]CardActivity `json:"activities"`
+}
+
+type FraudFlag struct {
+	Flagid			string `json:"flagid"`
+	Cardid			string `json:"cardid"`
+	Owner			string `json:"owner"`
+	Rule			string `json:"rule"`
+	Detail			string `json:"detail"`
+	Timestamp		string `json:"timestamp"`
+	Frozen			bool `json:"frozen"`
+	Status			string `json:"status"`
+	Reviewer		string `json:"reviewer"`
+	Reviewdate		string `json:"reviewdate"`
+	Reason			string `json:"reason"`
+}
+
+type FraudFlag_Holder struct {
+	Flags 		[]string `json:"flags"`
+}
+
+//==============================================================================================================================
+//	Dispute - a consumer contests a spend of a card, referenced by the event id in the card history. The amount is
+//			  held on the shop ledger, and a spend at an allied shop is taken out of the clearing, until KAKACENTER
+//			  rules for a refund to the card or a release to the shop
+//==============================================================================================================================
+type Dispute struct {
+	Disputeid		string `json:"disputeid"`
+	Cardid			string `json:"cardid"`
+	Eventid			string `json:"eventid"`
+	Consumer		string `json:"consumer"`
+	Shopid			string `json:"shopid"`
+	Templateid		string `json:"templateid"`
+	Money			int64 `json:"money"`
+	Currency		string `json:"currency"`
+	Point			int `json:"point"`
+	Spend			CardEvent `json:"spend"`			// the disputed spend with its principal, bonus, earned points and commission
+	Reason			string `json:"reason"`
+	Opendate		string `json:"opendate"`
+	Response		string `json:"response"`
+	Responder		string `json:"responder"`
+	Responsedate	string `json:"responsedate"`
+	Status			string `json:"status"`
+	Ruler			string `json:"ruler"`
+	Ruling			string `json:"ruling"`
+	Closedate		string `json:"closedate"`
+}
+
+type Dispute_Holder struct {
+	Disputes 		[]string `json:"disputes"`
+}
+
+//==============================================================================================================================
+//	TemplateReport - cards and balances of one card template, or of all templates of a shop in one currency in
+//					 ShopReport.Totals. Outstanding balances are those of active cards, as in the liability report.
+//					 Range totals count the deposits and spends logged in the card histories in the report period,
+//					 scrapped cards included
+//==============================================================================================================================
+type TemplateReport struct {
+	Templateid			string `json:"templateid"`
+	Currency			string `json:"currency"`
+	Issued				int `json:"issued"`
+	Active				int `json:"active"`
+	Expired				int `json:"expired"`
+	Scrapped			int `json:"scrapped"`
+	DepositMoney		int64 `json:"depositMoney"`
+	DepositPoint		int `json:"depositPoint"`
+	ConsumeMoney		int64 `json:"consumeMoney"`
+	ConsumePoint		int `json:"consumePoint"`
+	OutstandingMoney	int64 `json:"outstandingMoney"`
+	OutstandingBonus	int64 `json:"outstandingBonus"`
+	OutstandingPoint	int `json:"outstandingPoint"`
+	RangeDepositMoney	int64 `json:"rangeDepositMoney"`
+	RangeDepositPoint	int `json:"rangeDepositPoint"`
+	RangeConsumeMoney	int64 `json:"rangeConsumeMoney"`
+	RangeConsumePoint	int `json:"rangeConsumePoint"`
+}
+
+type ShopReport struct {
+	Shopid			string `json:"shopid"`
+	Periodstart		string `json:"periodstart"`
+	Periodend		string `json:"periodend"`
+	Templates		[]TemplateReport `json:"templates"`
+	Totals			map[string]TemplateReport `json:"totals"`		// by currency
+}
+
+type Coupon_Holder struct {
+	Coupons 	[]string `json:"coupons"`
+}
 
 //==============================================================================================================================
 //	Card_Holder - Defines the structure that holds all the Card for cards that have been created.
@@ -96,6 +545,13 @@ type Shop struct {
 	Address			string `json:"address"`
 	Category		string `json:"category"`
 	Contact			string `json:"contact"`
+	Status			string `json:"status"`
+	Applicant		string `json:"applicant"`
+	Reviewer		string `json:"reviewer"`
+	Reviewdate		string `json:"reviewdate"`
+	Reason			string `json:"reason"`
+	Settlement		string `json:"settlement"`
+	Version			int `json:"version"`
 }	
 
 type Shop_Holder struct {
@@ -108,12 +564,133 @@ type User struct {
 	ECert 			string `json:"ecert"`
 	Affiliation 	int `json:"affiliation"`
 	AuthId			string  `json:"authid"`
+	Shopid			string  `json:"shopid"`
+	Role			string  `json:"role"`
+	Tel				string  `json:"tel"`
+	Version			int  `json:"version"`
 }	
 
+//==============================================================================================================================
+//	User_Update / Shop_Update - partial updates, only the fields present in the JSON are changed
+//==============================================================================================================================
+type User_Update struct {
+	Name			*string `json:"name"`
+	ECert 			*string `json:"ecert"`
+	Affiliation 	*int `json:"affiliation"`
+	AuthId			*string  `json:"authid"`
+	Shopid			*string  `json:"shopid"`
+	Role			*string  `json:"role"`
+	Tel				*string  `json:"tel"`
+}
+
+type Shop_Update struct {
+	ShopName 		*string `json:"shopname"`
+	LicenseNum 		*string `json:"licensenum"`
+	Address			*string `json:"address"`
+	Category		*string `json:"category"`
+	Contact			*string `json:"contact"`
+}
+
 type User_Holder struct {
 	Users 		[]string `json:"users"`
 }	
 
+//==============================================================================================================================
+//	Alliance - shops whose cards accept each other's points. Rates holds for every member shop the value of one of
+//			   its points in alliance units. Clearing holds the netted alliance units a shop owes another one,
+//			   keyed by "payer>payee"
+//==============================================================================================================================
+type Alliance struct {
+	Allianceid		string `json:"allianceid"`
+	Name			string `json:"name"`
+	Rates			map[string]int `json:"rates"`
+	Clearing		map[string]int `json:"clearing"`
+}
+
+type Alliance_Holder struct {
+	Alliances 		[]string `json:"alliances"`
+}
+
+//==============================================================================================================================
+//	ClearingEntry - one cross-shop movement of value, kept per alliance until it is netted into a settlement batch
+//==============================================================================================================================
+type ClearingEntry struct {
+	Payer			string `json:"payer"`
+	Payee			string `json:"payee"`
+	Value			int `json:"value"`
+	Day				string `json:"day"`
+	Batchid			string `json:"batchid"`
+}
+
+type Clearing_Entries struct {
+	Allianceid		string `json:"allianceid"`
+	Entries			[]ClearingEntry `json:"entries"`
+}
+
+//==============================================================================================================================
+//	SettlementBatch - netted cross-shop value of one shop pair over a period, open -> confirmed -> paid
+//==============================================================================================================================
+type SettlementBatch struct {
+	Batchid			string `json:"batchid"`
+	Allianceid		string `json:"allianceid"`
+	Payer			string `json:"payer"`
+	Payee			string `json:"payee"`
+	Amount			int `json:"amount"`
+	Periodstart		string `json:"periodstart"`
+	Periodend		string `json:"periodend"`
+	Status			string `json:"status"`
+	Createdate		string `json:"createdate"`
+	Confirmdate		string `json:"confirmdate"`
+	Paiddate		string `json:"paiddate"`
+}
+
+type Settlement_Holder struct {
+	Batches 		[]string `json:"batches"`
+}
+
+type SettlementStatement struct {
+	Shopid			string `json:"shopid"`
+	Payable			int `json:"payable"`			// not paid yet
+	Receivable		int `json:"receivable"`		// not received yet
+	Batches			[]SettlementBatch `json:"batches"`
+}
+
+//==============================================================================================================================
+//	CommissionRule - KAKACENTER commission on each spend: Rate in basis points (1/100 percent) of the money spent
+//					 plus a Fixed fee in minor units of Currency, set for a shop or a template
+//==============================================================================================================================
+type CommissionRule struct {
+	Scope			string `json:"scope"`
+	Id				string `json:"id"`
+	Rate			int `json:"rate"`
+	Fixed			int64 `json:"fixed"`
+	Currency		string `json:"currency"`
+}
+
+//==============================================================================================================================
+//	CommissionLedger - commission accumulated per shop
+//==============================================================================================================================
+type CommissionLedger struct {
+	Shopid			string `json:"shopid"`
+	Spendnum		int `json:"spendnum"`
+	Currency		string `json:"currency"`
+	Spendmoney		int64 `json:"spendmoney"`
+	Commission		int64 `json:"commission"`
+	Minorunits		bool `json:"minorunits"`		// false on ledgers kept in whole units before currencies
+}
+
+type AdminAudit struct {
+	Actor			string `json:"actor"`
+	Action			string `json:"action"`
+	Target			string `json:"target"`
+	Detail			string `json:"detail"`
+	Timestamp		string `json:"timestamp"`
+}
+
+type AdminAudit_Holder struct {
+	Audits 		[]string `json:"audits"`
+}
+
 type ShopLedger struct {
 	Templateid 		string `json:"templateid"`
 	Shopid			string `json:"shopid"`
@@ -122,14 +699,178 @@ type ShopLedger struct {
 	ExpiredNum		int `json:"expiredNum"`
 	ScrapNum		int  `json:"scrapNum"`
 	BackNum			int  `json:"backNum"`
-	InitMoney 		int `json:"initmoney"`
+	InitMoney 		int64 `json:"initmoney"`
 	InitPoint 		int `json:"initpoint"`
-	DepositMoney 	int `json:"depositMoney"`
+	DepositMoney 	int64 `json:"depositMoney"`
 	DepositPoint 	int `json:"tdepositPoint"`
-	ConsumeMoney 	int `json:"consumeMoney"`
+	ConsumeMoney 	int64 `json:"consumeMoney"`
 	ConsumePoint 	int `json:"consumePoint"`
+	RefundMoney 	int64 `json:"refundMoney"`
+	RefundPoint 	int `json:"refundPoint"`
+	EarnPoint 		int `json:"earnPoint"`
+	ExpiredPoint 	int `json:"expiredPoint"`		// breakage
+	CouponIssued 	int `json:"couponIssued"`		// ledgers of coupon templates
+	CouponTransferred int `json:"couponTransferred"`
+	CouponRedeemed 	int `json:"couponRedeemed"`
+	CouponDiscount 	int64 `json:"couponDiscount"`
+	BonusMoney 		int64 `json:"bonusMoney"`			// campaign bonuses granted
+	BonusPoint 		int `json:"bonusPoint"`
+	ConsumeBonus 	int64 `json:"consumeBonus"`			// bonus money spent, ConsumeMoney is principal only
+	ForfeitBonus 	int64 `json:"forfeitBonus"`			// bonus money of cards scrapped on termination
+	HeldMoney 		int64 `json:"heldMoney"`			// consumed money under open dispute
+	HeldPoint 		int `json:"heldPoint"`
+	ReversedMoney 	int64 `json:"reversedMoney"`		// consumed money given back to cards by dispute rulings
+	ReversedPoint 	int `json:"reversedPoint"`
+	TransferInMoney 	int64 `json:"transferInMoney"`	// moved from cards of other templates
+	TransferInPoint 	int `json:"transferInPoint"`
+	TransferOutMoney 	int64 `json:"transferOutMoney"`	// moved to cards of other templates
+	TransferOutPoint 	int `json:"transferOutPoint"`
+	AdjustMoney 	int64 `json:"adjustMoney"`			// balances set by the shop
+	AdjustPoint 	int `json:"adjustPoint"`
+	Minorunits 		bool `json:"minorunits"`			// false on ledgers kept in whole units before currencies
 }	
 
+//==============================================================================================================================
+//	LedgerBucket - changes posted to the shop ledger of a template in one day, as a ShopLedger of differences.
+//				   A bucket is closed, and can not change any more, once its day is in a closed period
+//==============================================================================================================================
+type LedgerBucket struct {
+	Templateid		string `json:"templateid"`
+	Shopid			string `json:"shopid"`
+	Day				string `json:"day"`
+	Closed			bool `json:"closed"`
+	Postings		ShopLedger `json:"postings"`
+}
+
+//==============================================================================================================================
+//	LedgerPeriods - first day with postings of a shop and the last day of its closed periods
+//==============================================================================================================================
+type LedgerPeriods struct {
+	Shopid			string `json:"shopid"`
+	Firstday		string `json:"firstday"`
+	Closedthrough	string `json:"closedthrough"`
+}
+
+type TemplateStatement struct {
+	Templateid		string `json:"templateid"`
+	Days			[]LedgerBucket `json:"days"`
+	Total			ShopLedger `json:"total"`
+}
+
+type LedgerStatement struct {
+	Shopid			string `json:"shopid"`
+	Periodstart		string `json:"periodstart"`
+	Periodend		string `json:"periodend"`
+	Closedthrough	string `json:"closedthrough"`
+	Templates		[]TemplateStatement `json:"templates"`
+}
+
+//==============================================================================================================================
+//	JournalEntry - a balanced double-entry record of one value movement. Debits are positive and credits negative,
+//				   money of each currency and points each sum to 0 over the lines. Reference is the card event, gift,
+//				   transfer or dispute the entry was posted for
+//==============================================================================================================================
+type JournalLine struct {
+	Account			string `json:"account"`
+	Templateid		string `json:"templateid"`
+	Currency		string `json:"currency"`
+	Money			int64 `json:"money"`
+	Point			int `json:"point"`
+}
+
+type JournalEntry struct {
+	Entryid			string `json:"entryid"`
+	Action			string `json:"action"`
+	Reference		string `json:"reference"`
+	Timestamp		string `json:"timestamp"`
+	Lines			[]JournalLine `json:"lines"`
+}
+
+//==============================================================================================================================
+//	JournalAccount - balance of a journal account and the number of entries posted to it. The entry ids are kept in
+//					 one posting record each. Liabilities like card accounts have credit, negative, balances. Opened is
+//					 set once the balance from before the journal was posted
+//==============================================================================================================================
+type JournalAccount struct {
+	Accountid		string `json:"accountid"`
+	Templateid		string `json:"templateid"`
+	Currency		string `json:"currency"`
+	Money			int64 `json:"money"`
+	Point			int `json:"point"`
+	Opened			bool `json:"opened"`
+	Postings		int `json:"postings"`
+}
+
+//==============================================================================================================================
+//	JournalCheck - balances of the cards of a template checked against the journal, and the journal against the shop
+//				   ledger. Money and points are liabilities, the journal counts the card accounts and the escrow of the
+//				   template. Unbalanced lists the cards whose balance, account or entries disagree
+//==============================================================================================================================
+type JournalCheck struct {
+	Templateid		string `json:"templateid"`
+	Cards			int `json:"cards"`
+	CardMoney		int64 `json:"cardmoney"`
+	CardPoint		int `json:"cardpoint"`
+	EscrowMoney		int64 `json:"escrowmoney"`
+	EscrowPoint		int `json:"escrowpoint"`
+	JournalMoney	int64 `json:"journalmoney"`
+	JournalPoint	int `json:"journalpoint"`
+	LedgerMoney		int64 `json:"ledgermoney"`
+	LedgerPoint		int `json:"ledgerpoint"`
+	Unbalanced		[]string `json:"unbalanced"`
+	Balanced		bool `json:"balanced"`
+}
+
+type ShopJournalCheck struct {
+	Shopid			string `json:"shopid"`
+	Templates		[]JournalCheck `json:"templates"`
+	Balanced		bool `json:"balanced"`
+}
+
+type JournalStatement struct {
+	Account			JournalAccount `json:"account"`
+	Entries			[]JournalEntry `json:"entries"`
+}
+
+//==============================================================================================================================
+//	TemplateLiability - money, bonus money included, and points still owed on the cards of a template by card age.
+//						Scrapped and expired cards are left out of the buckets but count in Excluded, so that the
+//						buckets and Excluded together reconcile with the outstanding balance of the shop ledger
+//==============================================================================================================================
+type LiabilityBucket struct {
+	Bucket			string `json:"bucket"`
+	Cards			int `json:"cards"`
+	Money			int64 `json:"money"`
+	Point			int `json:"point"`
+}
+
+type TemplateLiability struct {
+	Templateid		string `json:"templateid"`
+	Currency		string `json:"currency"`
+	Buckets			[]LiabilityBucket `json:"buckets"`
+	Money			int64 `json:"money"`
+	Point			int `json:"point"`
+	ExcludedMoney	int64 `json:"excludedmoney"`
+	ExcludedPoint	int `json:"excludedpoint"`
+	LedgerMoney		int64 `json:"ledgermoney"`
+	LedgerPoint		int `json:"ledgerpoint"`
+	Reconciled		bool `json:"reconciled"`
+}
+
+type ShopLiability struct {
+	Shopid			string `json:"shopid"`
+	Templates		[]TemplateLiability `json:"templates"`
+	Money			map[string]int64 `json:"money"`			// by currency
+	Point			int `json:"point"`
+	Reconciled		bool `json:"reconciled"`
+}
+
+type LiabilityReport struct {
+	Asof			string `json:"asof"`
+	Shops			[]ShopLiability `json:"shops"`
+	Money			map[string]int64 `json:"money"`			// by currency, points of different shops are not added up
+}
+
 type ShopLedger_Holder struct {
 	ShopLedgers 		[]string `json:"shopLedgers"`
 }	
@@ -163,6 +904,12 @@ func (t *CardTransactionChaincode) Init(stub shim.ChaincodeStubInterface, functi
 	if err != nil { return nil, errors.New("Error creating Card_Holder record") }														
 	err = stub.PutState(CARD_HOLDER, bytes)
 
+	// create and put admin_audit_holder
+	var audit_holder AdminAudit_Holder
+	bytes, err = json.Marshal(audit_holder)
+	if err != nil { return nil, errors.New("Error creating AdminAudit_Holder record") }														
+	err = stub.PutState(ADMIN_AUDIT_HOLDER, bytes)
+
 	//add admin users
 	var adminUser User
 	adminUser.Identity = "admin"
@@ -170,7 +917,7 @@ func (t *CardTransactionChaincode) Init(stub shim.ChaincodeStubInterface, functi
 	adminUser.Affiliation = 1
 	adminUser.Name = "KaKa Blockchain Administrator"
 	adminUser.AuthId = "kakacenter"
-	t.add_user(stub, adminUser)	
+	t.add_user_Internal(stub, adminUser)	
 
 	//add init users
 	/*
@@ -259,7 +1006,7 @@ func (t *CardTransactionChaincode) save_user_holder(stub shim.ChaincodeStubInter
 }
 
 
-func (t *CardTransactionChaincode) add_user(stub shim.ChaincodeStubInterface, user User) ([]byte, error) {
+func (t *CardTransactionChaincode) add_user_Internal(stub shim.ChaincodeStubInterface, user User) ([]byte, error) {
 	
 	ubytes, err := stub.GetState(user.Identity)
 		if err != nil {	fmt.Printf("query user " + string(ubytes) + " from state error: %s", err); 
@@ -267,7 +1014,15 @@ func (t *CardTransactionChaincode) add_user(stub shim.ChaincodeStubInterface, us
 	
 		if ubytes != nil {	fmt.Printf("user " + user.Identity + " already exists"); 
 					return ubytes, errors.New("user " + user.Identity + " already exists")	}
+
+	//shop staff must be linked to an existing shop with a known role
+	if user.Affiliation == SHOP && user.Shopid != "" {
+		_, err = t.get_shop_detail_Internal(stub, user.Shopid)
+			if err != nil { return nil, errors.New("shop " + user.Shopid + " of user " + user.Identity + " not exists") }
+		if t.check_staff_role(user.Role) == false { return nil, errors.New("Invalid staff role: " + user.Role) }
+	}
 	
+	user.Version = 1
 	ubytes, err = json.Marshal(user)
 	if err != nil { return nil, errors.New("Error creating User bytes") }
 	
@@ -297,15 +1052,92 @@ func (t *CardTransactionChaincode) add_user(stub shim.ChaincodeStubInterface, us
 
 
 
-func (t *CardTransactionChaincode) update_user(stub shim.ChaincodeStubInterface, caller string, caller_affiliation int, user User) ([]byte, error) {
+//==============================================================================================================================
+//	 save_user - Writes a changed user to state in place, bumps its version and replaces its copy in user_holder
+//==============================================================================================================================
+func (t *CardTransactionChaincode) save_user(stub shim.ChaincodeStubInterface, user User) ([]byte, error) {
+
+	user.Version = user.Version + 1
+
+	ubytes, err := json.Marshal(user)
+	if err != nil { return nil, errors.New("Error creating User bytes") }
+
+	err = stub.PutState(user.Identity, ubytes)
+	if err != nil { fmt.Printf("Error storing user " + user.Identity + ": %s", err); 
+					return nil, errors.New("Error storing user: " + user.Identity) }
+
+	user_holder, err := t.get_user_holder(stub)
+	if err != nil { return nil, err }
+
+	var u User
+	for index, userStr := range user_holder.Users {
+		err = json.Unmarshal([]byte(userStr), &u);						
+		if err != nil {	fmt.Printf("Unmarshal_userStr: Corrupt user record "+userStr+": %s", err); 
+						return nil, errors.New("Unmarshal_userStr: Corrupt user record"+userStr)	}
 	
-	_, err := t.delete_user(stub, caller, caller_affiliation, user.Identity)
-	if err != nil {
-		fmt.Printf("Error update user: %s", err)
-		return nil, errors.New("Error update user: ")
+		if u.Identity == user.Identity {
+			user_holder.Users[index] = string(ubytes)
+			break
+		}
 	}
 
-	return t.add_user(stub, user)
+	_, err = t.save_user_holder(stub, user_holder)
+	if err != nil { return nil, err }
+
+	return ubytes, nil
+}
+
+//==============================================================================================================================
+//	 register_consumer - self registration. The new consumer is bound to the submitting identity and is always
+//						 a CONSUMER, the registrant cannot choose another affiliation
+//==============================================================================================================================
+func (t *CardTransactionChaincode) register_consumer(stub shim.ChaincodeStubInterface, caller string, name string, tel string) ([]byte, error) {
+
+	if t.is_registrable_id(caller) == false { return nil, errors.New("register_consumer: invalid user id " + caller) }
+
+	err := t.check_tel(stub, tel, caller)
+	if err != nil { return nil, err }
+
+	var user User
+	user.Identity = caller
+	user.Name = name
+	user.ECert = caller
+	user.Affiliation = CONSUMER
+	user.AuthId = caller
+	user.Tel = tel
+
+	_, err = t.add_user_Internal(stub, user)
+	if err != nil { return nil, err }
+
+	_, err = t.add_admin_audit(stub, caller, "register_consumer", caller, "tel " + tel)
+	if err != nil { return nil, err }
+
+	return nil, nil
+}
+
+//==============================================================================================================================
+//	 check_tel - tel must be a phone number not used by any other user
+//==============================================================================================================================
+func (t *CardTransactionChaincode) check_tel(stub shim.ChaincodeStubInterface, tel string, userId string) (error) {
+
+	matched, err := regexp.Match("^[+]?[0-9]{5,20}$", []byte(tel))
+	if err != nil || matched == false { return errors.New("Invalid tel: " + tel) }
+
+	user_holder, err := t.get_user_holder(stub)
+	if err != nil { return err }
+
+	var u User
+	for _, userStr := range user_holder.Users {
+		err = json.Unmarshal([]byte(userStr), &u);						
+		if err != nil {	fmt.Printf("Unmarshal_userStr: Corrupt user record "+userStr+": %s", err); 
+						return errors.New("Unmarshal_userStr: Corrupt user record"+userStr)	}
+
+		if u.Tel == tel && u.Identity != userId {
+			fmt.Printf("tel " + tel + " already used by " + u.Identity)
+			return errors.New("tel " + tel + " is already registered")
+		}
+	}
+	return nil
 }
 
 //==============================================================================================================================
@@ -403,9 +1235,9 @@ func (t *CardTransactionChaincode) get_user_detail_Internal(stub shim.ChaincodeS
 
 
 //==============================================================================================================================
-//	 delete_user - debugging, not released yet
+//	 delete_user_Internal - removes user from state and user_holder without permission check
 //==============================================================================================================================
-func (t *CardTransactionChaincode) delete_user(stub shim.ChaincodeStubInterface, caller string, caller_affiliation int, userId string) ([]byte, error) {
+func (t *CardTransactionChaincode) delete_user_Internal(stub shim.ChaincodeStubInterface, caller string, caller_affiliation int, userId string) ([]byte, error) {
 	
 	ubytes, err := t.get_user_detail(stub, caller, caller_affiliation, userId)
 	if err != nil {	fmt.Printf("query user from state error: %s", err); 
@@ -473,6 +1305,65 @@ func (t *CardTransactionChaincode) check_user(stub shim.ChaincodeStubInterface,
 	return 0, nil
 }
 
+//==============================================================================================================================
+//	 Shop staff - roles and permissions of the users working for a shop
+//==============================================================================================================================
+//	 check_staff_role - true if role is one of the known staff roles
+//==============================================================================================================================
+func (t *CardTransactionChaincode) check_staff_role(role string) (bool) {
+	return role == STAFF_OWNER || role == STAFF_MANAGER || role == STAFF_CASHIER
+}
+
+//==============================================================================================================================
+//	 get_staff_role - role of a shop user. Users created before staff roles existed are the shop itself, so owner
+//==============================================================================================================================
+func (t *CardTransactionChaincode) get_staff_role(user User) (string) {
+	if user.Role == "" {
+		return STAFF_OWNER
+	}
+	return user.Role
+}
+
+//==============================================================================================================================
+//	 role_has_permission - permission table of the staff roles
+//		owner   : everything, including managing the shop staff
+//		manager : issue card, deposit, refund, adjust balances, view ledger, manage template
+//		cashier : deposit, refund
+//==============================================================================================================================
+func (t *CardTransactionChaincode) role_has_permission(role string, permission string) (bool) {
+	
+	if role == STAFF_OWNER {
+		return true
+	} else if role == STAFF_MANAGER {
+		return permission == PERM_ISSUE_CARD || permission == PERM_DEPOSIT || permission == PERM_REFUND || permission == PERM_ADJUST || permission == PERM_VIEW_LEDGER || permission == PERM_MANAGE_TEMPLATE
+	} else if role == STAFF_CASHIER {
+		return permission == PERM_DEPOSIT || permission == PERM_REFUND
+	}
+	return false
+}
+
+//==============================================================================================================================
+//	 check_shop_permission - checks the caller is staff of a shop and its role allows permission.
+//							 Returns the shop id the caller works for
+//==============================================================================================================================
+func (t *CardTransactionChaincode) check_shop_permission(stub shim.ChaincodeStubInterface, caller string, caller_affiliation int, permission string) (string, error) {
+	
+	if caller_affiliation != SHOP {
+		return "", errors.New("Permission denied: " + caller + " is not shop staff")
+	}
+
+	user, err := t.get_user_detail_Internal(stub, caller)
+	if err != nil { return "", err }
+
+	role := t.get_staff_role(user)
+	if t.role_has_permission(role, permission) == false {
+		fmt.Printf("Permission denied: role " + role + " cannot " + permission)
+		return "", errors.New("Permission denied: role " + role + " cannot " + permission)
+	}
+
+	return t.get_Shopid(stub, caller), nil
+}
+
 //==============================================================================================================================
 //	 add_shop - Adds a new shop to both sjop_holder and state(by shop.ShopdId)
 //==============================================================================================================================
@@ -512,7 +1403,7 @@ func (t *CardTransactionChaincode) save_shop_holder(stub shim.ChaincodeStubInter
 }
 
 
-func (t *CardTransactionChaincode) add_shop(stub shim.ChaincodeStubInterface, shop Shop) ([]byte, error) {
+func (t *CardTransactionChaincode) add_shop_Internal(stub shim.ChaincodeStubInterface, shop Shop) ([]byte, error) {
 	
 	shopbytes, err := stub.GetState(shop.ShopId)
 		if err != nil {	fmt.Printf("query user " + string(shopbytes) + " from state error: %s", err); 
@@ -521,6 +1412,7 @@ func (t *CardTransactionChaincode) add_shop(stub shim.ChaincodeStubInterface, sh
 		if shopbytes != nil {	fmt.Printf("shop " + shop.ShopId + " already exists"); 
 					return shopbytes, errors.New("shop " + shop.ShopId + " already exists")	}
 	
+	shop.Version = 1
 	shopbytes, err = json.Marshal(shop)
 	if err != nil { return nil, errors.New("Error creating shop bytes") }
 	
@@ -550,17 +1442,6 @@ func (t *CardTransactionChaincode) add_shop(stub shim.ChaincodeStubInterface, sh
 
 
 
-func (t *CardTransactionChaincode) update_shop(stub shim.ChaincodeStubInterface, caller string, caller_affiliation int, shop Shop) ([]byte, error) {
-	
-	_, err := t.delete_shop(stub, caller, caller_affiliation, shop.ShopId)
-	if err != nil {
-		fmt.Printf("Error update shop: %s", err)
-		return nil, errors.New("Error update shop: ")
-	}
-
-	return t.add_shop(stub, shop)
-}
-
 //==============================================================================================================================
 //	 get_shops - query shop_holder for all shops
 //        para - caller: for check permission. Not used now
@@ -627,9 +1508,9 @@ func (t *CardTransactionChaincode) get_shop_detail_Internal(stub shim.ChaincodeS
 
 
 //==============================================================================================================================
-//	 delete_shop - 
+//	 delete_shop_Internal - removes shop from state and shop_holder without permission check
 //==============================================================================================================================
-func (t *CardTransactionChaincode) delete_shop(stub shim.ChaincodeStubInterface, caller string, caller_affiliation int, shopId string) ([]byte, error) {
+func (t *CardTransactionChaincode) delete_shop_Internal(stub shim.ChaincodeStubInterface, caller string, caller_affiliation int, shopId string) ([]byte, error) {
 	
 	shopbytes, err := t.get_shop_detail(stub, caller, caller_affiliation, shopId)
 	if err != nil {	fmt.Printf("query shop from state error: %s", err); 
@@ -674,1824 +1555,7674 @@ func (t *CardTransactionChaincode) delete_shop(stub shim.ChaincodeStubInterface,
 }
 
 
-// end manage user and shop
-//////////////////////////////////////////////////////////////////////////////////////////////
+//==============================================================================================================================
+//	 Admin Functions - user and shop management with permission check. KAKACENTER manages all users and shops,
+//					   a shop owner manages only the staff of its own shop. Every action goes to the admin audit log
+//==============================================================================================================================
+//	 check_user_manage_permission
+//==============================================================================================================================
+func (t *CardTransactionChaincode) check_user_manage_permission(stub shim.ChaincodeStubInterface, caller string, caller_affiliation int, user User) (error) {
 
-func (t *CardTransactionChaincode) get_shopLedgerID(shop string, templateID string) (string) {
-	return "shopledger-" + templateID
-}
+	if caller_affiliation == KAKACENTER {
+		return nil
+	}
 
-func (t *CardTransactionChaincode) add_new_shopLedger(stub shim.ChaincodeStubInterface, shopid string, templateID string) ([]byte, error) {
-	
-	shopLedgerId := t.get_shopLedgerID(shopid, templateID)
-	shopLedgerBytes, err := stub.GetState(shopLedgerId)
-	if err != nil {	fmt.Printf("add_new_shopLedger ERROR: %s", err); 
-					return nil, errors.New("add_new_shopLedger ERROR")	}
-	if shopLedgerBytes != nil || len(shopLedgerBytes) > 0 {				
-		if err != nil {	fmt.Printf("shop ledger already exist, error: %s", err); 
-					return nil, errors.New("shop ledger already exist")	}
+	shopid, err := t.check_shop_permission(stub, caller, caller_affiliation, PERM_MANAGE_STAFF)
+	if err != nil { return err }
+
+	if user.Affiliation != SHOP || user.Shopid != shopid {
+		fmt.Printf("Permission denied: shop " + shopid + " can only manage its own staff")
+		return errors.New("Permission denied: shop " + shopid + " can only manage its own staff")
 	}
-	
-	var shopLedger ShopLedger																																									
+	return nil
+}
 
-	Templateid          	:= "\"Templateid\":\""+templateID+"\", "	
-	Shopid          		:= "\"Shopid\":\""+shopid+"\", "
-	CardIdIndex          	:= "\"CardIdIndex\":0, "	
-	Qty          			:= "\"Qty\":0, "							
-	ExpiredNum            	:= "\"ExpiredNum\":0, "
-	ScrapNum        		:= "\"ScrapNum\":0, "
-	BackNum       			:= "\"BackNum\":0, "
-	InitMoney       		:= "\"InitMoney\":0, "
-	InitPoint           	:= "\"InitPoint\":0, "
-	DepositMoney       		:= "\"DepositMoney\":0, "
-	TotalDepositPoint  	    := "\"TotalDepositPoint\":0, "
-	ConsumeMoney        	:= "\"ConsumeMoney\":0, "
-	ConsumePoint           	:= "\"ConsumePoint\":0 "
-	
+func (t *CardTransactionChaincode) add_user(stub shim.ChaincodeStubInterface, caller string, caller_affiliation int, user User) ([]byte, error) {
 
-	shopLedger_json := "{"+Templateid+Shopid+CardIdIndex+Qty+ExpiredNum+ScrapNum+BackNum+InitMoney+InitPoint+DepositMoney+TotalDepositPoint+ConsumeMoney+ConsumePoint+"}" 	// Concatenates the variables to create the total JSON object
-	
-	fmt.Printf("shopLedger_json : %s ",shopLedger_json);
+	err := t.check_user_manage_permission(stub, caller, caller_affiliation, user)
+	if err != nil { return nil, err }
 
-	err = json.Unmarshal([]byte(shopLedger_json), &shopLedger)	
+	ubytes, err := t.add_user_Internal(stub, user)
+	if err != nil { return ubytes, err }
 
-	err = stub.PutState(shopLedgerId, []byte(shopLedger_json))
-		if err != nil { fmt.Printf("SAVE_CHANGES: Error storing  card record: %s", err); return nil, errors.New("Error storing card record") }
-	
-	return []byte(shopLedger_json), nil
+	_, err = t.add_admin_audit(stub, caller, "add_user", user.Identity, "affiliation " + strconv.Itoa(user.Affiliation) + " shop " + user.Shopid + " role " + user.Role)
+	if err != nil { return nil, err }
+
+	return ubytes, nil
 }
 
-func (t *CardTransactionChaincode) get_shopLedger(stub shim.ChaincodeStubInterface,  caller string, caller_affiliation int, shopid string, templateID string) ([]byte, error) {
-	
-	authed := 0
-	if 		caller_affiliation	== KAKACENTER {
-		authed = 1
-		
-	}else if 	caller_affiliation	== SHOP {
-			template, err := t.retrieve_card(stub, templateID)
-				if err != nil {return nil, errors.New("Failed to retrieve card template: " + templateID)}
-		
-			if template.Owner == caller {
-				authed = 1
-			}
+//==============================================================================================================================
+//	 update_user - partial in place update. version must be the version the caller read, so concurrent admins
+//				   cannot overwrite each other
+//==============================================================================================================================
+func (t *CardTransactionChaincode) update_user(stub shim.ChaincodeStubInterface, caller string, caller_affiliation int, userId string, version int, updateJson string) ([]byte, error) {
+
+	var update User_Update
+	err := json.Unmarshal([]byte(updateJson), &update)
+	if err != nil { return nil, errors.New("Invalid user update JSON object") }
+
+	user, err := t.get_user_detail_Internal(stub, userId)
+	if err != nil { return nil, err }
+
+	if user.Version != version {
+		fmt.Printf("update_user: version conflict on " + userId)
+		return nil, errors.New("update_user: user " + userId + " was changed, current version " + strconv.Itoa(user.Version))
 	}
-	
-	if authed== 0 {
-		fmt.Printf("Permission denied"); 
-		return nil, errors.New("Permission denied")
+
+	// both the user as it is and as it will be must be manageable by the caller
+	err = t.check_user_manage_permission(stub, caller, caller_affiliation, user)
+	if err != nil { return nil, err }
+
+	changed := ""
+	if update.Name != nil			{ user.Name = *update.Name; changed += " name" }
+	if update.ECert != nil			{ user.ECert = *update.ECert; changed += " ecert" }
+	if update.Affiliation != nil	{ user.Affiliation = *update.Affiliation; changed += " affiliation" }
+	if update.AuthId != nil			{ user.AuthId = *update.AuthId; changed += " authid" }
+	if update.Shopid != nil			{ user.Shopid = *update.Shopid; changed += " shopid" }
+	if update.Role != nil			{ user.Role = *update.Role; changed += " role" }
+	if update.Tel != nil			{
+		err = t.check_tel(stub, *update.Tel, userId)
+		if err != nil { return nil, err }
+		user.Tel = *update.Tel; changed += " tel"
 	}
-																																			
-	return t.get_shopLedger_internal(stub, shopid , templateID )
-}
 
-func (t *CardTransactionChaincode) get_shopLedger_internal(stub shim.ChaincodeStubInterface, shopid string, templateID string) ([]byte, error) {
-	
-	shopLedgerId := t.get_shopLedgerID(shopid, templateID)
-	shopLedgerBytes, err := stub.GetState(shopLedgerId)
-	if err != nil {	fmt.Printf("get_shopLedger ERROR: %s", err); 
-					return nil, errors.New("get_shopLedger ERROR")	}
-																																							
-	return shopLedgerBytes, nil
-}
+	err = t.check_user_manage_permission(stub, caller, caller_affiliation, user)
+	if err != nil { return nil, err }
 
-func (t *CardTransactionChaincode) update_shopLedger(stub shim.ChaincodeStubInterface, shopid string, templateID string, shopLedger ShopLedger) ([]byte, error) {
-	
-	shopLedgerId := t.get_shopLedgerID(shopid, templateID)
-																															
-	shopLedgersBytes, err := json.Marshal(shopLedger)	
-	if err != nil {	fmt.Printf("Unmarshal shopLedgersBytes error: %s", err); 
-					return nil, errors.New("Unmarshal shopLedgersBytes error")	}
+	if user.Affiliation == SHOP && user.Shopid != "" {
+		_, err = t.get_shop_detail_Internal(stub, user.Shopid)
+			if err != nil { return nil, errors.New("shop " + user.Shopid + " of user " + user.Identity + " not exists") }
+		if t.check_staff_role(user.Role) == false { return nil, errors.New("Invalid staff role: " + user.Role) }
+	}
 
-	err = stub.PutState(shopLedgerId, shopLedgersBytes)
-		if err != nil { fmt.Printf("PutState shopLedgersBytes: Error : %s", err); 
-						return nil, errors.New("PutState shopLedgersBytes: Error") }
-	
-	return shopLedgersBytes, nil
+	ubytes, err := t.save_user(stub, user)
+	if err != nil { return nil, err }
+
+	_, err = t.add_admin_audit(stub, caller, "update_user", userId, "changed:" + changed)
+	if err != nil { return nil, err }
+
+	return ubytes, nil
 }
 
-/*
-func (t *CardTransactionChaincode) get_shopLedger_holder(stub shim.ChaincodeStubInterface, shop string) (ShopLedger_Holder, error) {
-	
-	shopLedgersBytes, err := stub.GetState(shop)
-	if err != nil {	fmt.Printf("RETRIEVE_USER_HOLDER ERROR: Corrupt users record "+string(usersBytes)+": %s", err); 
-					return usersBytes, errors.New("RETRIEVE_USER_HOLDER ERROR: Corrupt users record"+string(usersBytes))	}
+func (t *CardTransactionChaincode) delete_user(stub shim.ChaincodeStubInterface, caller string, caller_affiliation int, userId string) ([]byte, error) {
 
-	var shopLedger_holder ShopLedger_Holder
-	if shopLedgersBytes != nil || len(shopLedgersBytes) > 0 {
-		err = json.Unmarshal(shopLedgersBytes, &shopLedger_holder);						
-		if err != nil {	fmt.Printf("Unmarshal_USER_HOLDER ERROR: Corrupt users record "+string(usersBytes)+": %s", err); 
-					return usersBytes, errors.New("Unmarshal_USER_HOLDER ERROR: Corrupt users record"+string(usersBytes))	}
-	
-	}
+	user, err := t.get_user_detail_Internal(stub, userId)
+	if err != nil { return nil, err }
 
-	return shopLedger_holder, nil
+	err = t.check_user_manage_permission(stub, caller, caller_affiliation, user)
+	if err != nil { return nil, err }
+
+	ubytes, err := t.delete_user_Internal(stub, caller, caller_affiliation, userId)
+	if err != nil { return ubytes, err }
+
+	_, err = t.add_admin_audit(stub, caller, "delete_user", userId, "")
+	if err != nil { return nil, err }
+
+	return ubytes, nil
 }
-*/
 
+func (t *CardTransactionChaincode) add_shop(stub shim.ChaincodeStubInterface, caller string, caller_affiliation int, shop Shop) ([]byte, error) {
 
+	if caller_affiliation != KAKACENTER {
+		return nil, errors.New("Permission denied: only KAKACENTER can add shop")
+	}
 
-//==============================================================================================================================
-//	 get_caller - Retrieves the username of the user who invoked the chaincode.
-//				  Returns the username as a string.
-//==============================================================================================================================
-/*
-func (t *CardTransactionChaincode) get_username(stub shim.ChaincodeStubInterface) (string, error) {
+	timestamp, err := t.get_timestamp(stub)
+	if err != nil { return nil, err }
 
-	bytes, err := stub.GetCallerCertificate();
-															if err != nil { return "", errors.New("Couldn't retrieve caller certificate") }
-	x509Cert, err := x509.ParseCertificate(bytes);				// Extract Certificate from result of GetCallerCertificate						
-															if err != nil { return "", errors.New("Couldn't parse certificate")	}
-															
-	return x509Cert.Subject.CommonName, nil
-}
-*/
-//==============================================================================================================================
-//	 check_affiliation - Takes an ecert as a string, decodes it to remove html encoding then parses it and checks the
-// 				  		certificates common name. The affiliation is stored as part of the common name.
-//==============================================================================================================================
-/*
-func (t *CardTransactionChaincode) check_affiliation(stub shim.ChaincodeStubInterface, cert string) (int, error) {																																																					
-	
+	// shops added by KAKACENTER need no review
+	shop.Status = SHOP_APPROVED
+	shop.Reviewer = caller
+	shop.Reviewdate = timestamp
 
-	decodedCert, err := url.QueryUnescape(cert);    				// make % etc normal //
-	
-		if err != nil { return -1, errors.New("Could not decode certificate") }
-	
-	pem, _ := pem.Decode([]byte(decodedCert))           				// Make Plain text   //
+	sbytes, err := t.add_shop_Internal(stub, shop)
+	if err != nil { return sbytes, err }
 
-	x509Cert, err := x509.ParseCertificate(pem.Bytes);				// Extract Certificate from argument //
-														
-		if err != nil { return -1, errors.New("Couldn't parse certificate")	}
+	_, err = t.add_admin_audit(stub, caller, "add_shop", shop.ShopId, shop.ShopName + " license " + shop.LicenseNum)
+	if err != nil { return nil, err }
 
-	cn := x509Cert.Subject.CommonName
-	
-	res := strings.Split(cn,"\\")
-	
-	affiliation, _ := strconv.Atoi(res[2])
-	
-	return affiliation, nil
-		
+	return sbytes, nil
 }
 
 //==============================================================================================================================
-//	 get_caller_data - Calls the get_ecert and check_role functions and returns the ecert and role for the
-//					 name passed.
+//	 update_shop - partial in place update with the same version check as update_user. Status is only changed
+//				   by the onboarding, suspension and termination functions
 //==============================================================================================================================
+func (t *CardTransactionChaincode) update_shop(stub shim.ChaincodeStubInterface, caller string, caller_affiliation int, shopId string, version int, updateJson string) ([]byte, error) {
 
-func (t *CardTransactionChaincode) get_caller_data(stub shim.ChaincodeStubInterface) (string, int, error){	
+	if caller_affiliation != KAKACENTER {
+		return nil, errors.New("Permission denied: only KAKACENTER can update shop")
+	}
 
-	user, err := t.get_username(stub)
-	if err != nil { return "", -1, err }
-																		
-	ecert, err := t.get_ecert(stub, user);					
-	if err != nil { return "", -1, err }
+	var update Shop_Update
+	err := json.Unmarshal([]byte(updateJson), &update)
+	if err != nil { return nil, errors.New("Invalid shop update JSON object") }
 
-	affiliation, err := t.check_affiliation(stub,string(ecert));			
-	if err != nil { return "", -1, err }
+	shop, err := t.get_shop_detail_Internal(stub, shopId)
+	if err != nil { return nil, err }
 
-	return user, affiliation, nil
-}
-*/
+	if shop.Version != version {
+		fmt.Printf("update_shop: version conflict on " + shopId)
+		return nil, errors.New("update_shop: shop " + shopId + " was changed, current version " + strconv.Itoa(shop.Version))
+	}
 
+	changed := ""
+	if update.ShopName != nil		{ shop.ShopName = *update.ShopName; changed += " shopname" }
+	if update.LicenseNum != nil		{ shop.LicenseNum = *update.LicenseNum; changed += " licensenum" }
+	if update.Address != nil		{ shop.Address = *update.Address; changed += " address" }
+	if update.Category != nil		{ shop.Category = *update.Category; changed += " category" }
+	if update.Contact != nil		{ shop.Contact = *update.Contact; changed += " contact" }
 
+	sbytes, err := t.save_shop(stub, shop)
+	if err != nil { return nil, err }
 
-//==============================================================================================================================
-//	 Router Functions
-//==============================================================================================================================
-//	Invoke - Called on chaincode invoke. Takes a function name passed and calls that function. Converts some
-//		  initial arguments passed to other things for use in the called function e.g. name -> ecert
-//==============================================================================================================================
-/*
-func (t *CardTransactionChaincode) invoke(stub shim.ChaincodeStubInterface) ([]byte, error) {
-	function, args := stub.GetFunctionAndParameters()
-	if strings.HasPrefix(function,"get_") {
-		return t.Query(stub , function , args) 
-	}
-	return t.Invoke(stub , function , args) 
+	_, err = t.add_admin_audit(stub, caller, "update_shop", shopId, "changed:" + changed)
+	if err != nil { return nil, err }
+
+	return sbytes, nil
 }
-*/
 
-func (t *CardTransactionChaincode) Invoke(stub shim.ChaincodeStubInterface, function string, args []string) ([]byte, error) {
-	
-	//caller, caller_affiliation, err := t.get_caller_data(stub)
-	caller := args[0]
-	ifuserAuthed, err := t.check_user(stub, caller)
-	if (err != nil  || ifuserAuthed < 1){
-		return nil, errors.New("cannot find this user:" + caller)
+func (t *CardTransactionChaincode) delete_shop(stub shim.ChaincodeStubInterface, caller string, caller_affiliation int, shopId string) ([]byte, error) {
+
+	if caller_affiliation != KAKACENTER {
+		return nil, errors.New("Permission denied: only KAKACENTER can delete shop")
 	}
- 	caller_affiliation , err := t.check_affiliation(stub, caller)
-	if err != nil  { return nil, errors.New("Invalid caller_affiliation value passed") }
-	
-	cardIDPos := 1
 
+	// a shop still referenced by templates must be retired with terminate_shop
+	templates, err := t.get_shop_templates(stub, shopId)
+	if err != nil { return nil, err }
+	if len(templates) > 0 {
+		return nil, errors.New("shop " + shopId + " still has card templates, use terminate_shop")
+	}
 
-	if function == "add_user" { 
-		var user User
-		user.Identity = args[cardIDPos]
-		user.Name = args[cardIDPos + 1]
-		user.ECert = args[cardIDPos + 2]
-		user.Affiliation, err = strconv.Atoi(args[cardIDPos + 3])
-			if err != nil { fmt.Printf("Error, affiliation is not int : ", err); 
-							return nil, errors.New("Error, affiliation is not int ") }
-		user.AuthId = args[cardIDPos + 4]
-		return t.add_user(stub, user)
+	sbytes, err := t.delete_shop_Internal(stub, caller, caller_affiliation, shopId)
+	if err != nil { return sbytes, err }
 
-	} else if function == "update_user" {  // same with add_user
-		var user User
-		user.Identity = args[cardIDPos]
-		user.Name = args[cardIDPos + 1]
-		user.ECert = args[cardIDPos + 2]
-		user.Affiliation, err = strconv.Atoi(args[cardIDPos + 3])
-			if err != nil { fmt.Printf("Error, affiliation is not int : ", err); 
-							return nil, errors.New("Error, affiliation is not int ") }
-		user.AuthId = args[cardIDPos + 4]
-		return t.update_user(stub, caller, caller_affiliation, user)
+	_, err = t.add_admin_audit(stub, caller, "delete_shop", shopId, "")
+	if err != nil { return nil, err }
 
-	} else if function == "delete_user" {  // same with add_user
-		delUserId := args[cardIDPos]
-		return t.delete_user(stub, caller, caller_affiliation, delUserId)
+	return sbytes, nil
+}
+
+//==============================================================================================================================
+//	 save_shop - Writes a changed shop to state in place, bumps its version and replaces its copy in shop_holder
+//==============================================================================================================================
+func (t *CardTransactionChaincode) save_shop(stub shim.ChaincodeStubInterface, shop Shop) ([]byte, error) {
+
+	shop.Version = shop.Version + 1
+
+	sbytes, err := json.Marshal(shop)
+	if err != nil { return nil, errors.New("Error creating shop bytes") }
+
+	err = stub.PutState(shop.ShopId, sbytes)
+	if err != nil { fmt.Printf("Error storing shop " + shop.ShopId + ": %s", err); 
+					return nil, errors.New("Error storing shop: " + shop.ShopId) }
+
+	shop_holder, err := t.get_shop_holder(stub)
+	if err != nil { return nil, err }
+
+	var u Shop
+	for index, shopStr := range shop_holder.Shops {
+		err = json.Unmarshal([]byte(shopStr), &u);						
+		if err != nil {	fmt.Printf("Unmarshal_shopStr: Corrupt shop record "+shopStr+": %s", err); 
+						return nil, errors.New("Unmarshal_shopStr: Corrupt shop record"+shopStr)	}
+	
+		if u.ShopId == shop.ShopId {
+			shop_holder.Shops[index] = string(sbytes)
+			break
+		}
+	}
+
+	_, err = t.save_shop_holder(stub, shop_holder)
+	if err != nil { return nil, err }
+
+	return sbytes, nil
+}
+
+//==============================================================================================================================
+//	 is_registrable_id - whether a self-registered shop or user id may become a state key. Ids share the key space with
+//						 everything else: generated keys like card ids and record keys have a "-", holders and settings
+//						 an "_", so such ids are never free to register. Existing keys are refused when adding
+//==============================================================================================================================
+func (t *CardTransactionChaincode) is_registrable_id(id string) (bool) {
+
+	matched, err := regexp.Match("^[A-Za-z0-9.@]+$", []byte(id))
+	return err == nil && matched
+}
+
+//==============================================================================================================================
+//	 Shop onboarding - register_shop is submitted by the prospective shop, KAKACENTER approves or rejects it
+//==============================================================================================================================
+func (t *CardTransactionChaincode) register_shop(stub shim.ChaincodeStubInterface, caller string, shop Shop) ([]byte, error) {
+
+	if shop.ShopId == "" || shop.ShopName == "" || shop.LicenseNum == "" {
+		return nil, errors.New("register_shop: shopid, shopname and licensenum are required")
+	}
+	if t.is_registrable_id(shop.ShopId) == false { return nil, errors.New("register_shop: invalid shop id " + shop.ShopId) }
+
+	shop.Status = SHOP_PENDING
+	shop.Applicant = caller
+	shop.Reviewer = ""
+	shop.Reviewdate = ""
+	shop.Reason = ""
+
+	sbytes, err := t.add_shop_Internal(stub, shop)
+	if err != nil { return sbytes, err }
+
+	_, err = t.add_admin_audit(stub, caller, "register_shop", shop.ShopId, shop.ShopName + " license " + shop.LicenseNum)
+	if err != nil { return nil, err }
+
+	return nil, nil
+}
+
+func (t *CardTransactionChaincode) review_shop(stub shim.ChaincodeStubInterface, caller string, caller_affiliation int, shopId string, newStatus string, reason string) (Shop, error) {
+
+	var shop Shop
+	if caller_affiliation != KAKACENTER {
+		return shop, errors.New("Permission denied: only KAKACENTER can review shop")
+	}
+	if reason == "" {
+		return shop, errors.New("A reason is required to review shop " + shopId)
+	}
+
+	shop, err := t.get_shop_detail_Internal(stub, shopId)
+	if err != nil { return shop, err }
+
+	if shop.Status != SHOP_PENDING {
+		return shop, errors.New("shop " + shopId + " is not pending review, status: " + shop.Status)
+	}
+
+	shop.Status = newStatus
+	shop.Reviewer = caller
+	shop.Reviewdate, err = t.get_timestamp(stub)
+	if err != nil { return shop, err }
+	shop.Reason = reason
+
+	_, err = t.save_shop(stub, shop)
+	if err != nil { return shop, err }
+
+	_, err = t.add_admin_audit(stub, caller, "review_shop", shopId, newStatus + ": " + reason)
+	return shop, err
+}
+
+//==============================================================================================================================
+//	 approve_shop - approves a pending shop and makes its applicant the shop owner, an existing user is linked
+//==============================================================================================================================
+func (t *CardTransactionChaincode) approve_shop(stub shim.ChaincodeStubInterface, caller string, caller_affiliation int, shopId string, reason string) ([]byte, error) {
+
+	shop, err := t.review_shop(stub, caller, caller_affiliation, shopId, SHOP_APPROVED, reason)
+	if err != nil { return nil, err }
+
+	// an applicant who is already a user becomes the owner if it is a shop user not working for another shop
+	ifuserExist, _ := t.check_user(stub, shop.Applicant)
+	if ifuserExist > 0 {
+		owner, err := t.get_user_detail_Internal(stub, shop.Applicant)
+		if err != nil { return nil, err }
+
+		if owner.Affiliation != SHOP || owner.Shopid != "" && owner.Shopid != shopId {
+			return nil, errors.New("applicant " + shop.Applicant + " cannot become the owner of shop " + shopId)
+		}
+		owner.Shopid = shop.ShopId
+		owner.Role = STAFF_OWNER
+		_, err = t.save_user(stub, owner)
+		if err != nil { return nil, err }
+
+		_, err = t.add_admin_audit(stub, caller, "update_user", owner.Identity, "owner of approved shop " + shopId)
+		if err != nil { return nil, err }
+
+		return nil, nil
+	}
+
+	var owner User
+	owner.Identity = shop.Applicant
+	owner.Name = shop.ShopName
+	owner.ECert = shop.Applicant
+	owner.Affiliation = SHOP
+	owner.AuthId = shop.Applicant
+	owner.Shopid = shop.ShopId
+	owner.Role = STAFF_OWNER
+
+	_, err = t.add_user_Internal(stub, owner)
+	if err != nil { return nil, err }
+
+	_, err = t.add_admin_audit(stub, caller, "add_user", owner.Identity, "owner of approved shop " + shopId)
+	if err != nil { return nil, err }
+
+	return nil, nil
+}
+
+func (t *CardTransactionChaincode) reject_shop(stub shim.ChaincodeStubInterface, caller string, caller_affiliation int, shopId string, reason string) ([]byte, error) {
+
+	_, err := t.review_shop(stub, caller, caller_affiliation, shopId, SHOP_REJECTED, reason)
+	if err != nil { return nil, err }
+
+	return nil, nil
+}
+
+//==============================================================================================================================
+//	 suspend_shop / resume_shop
+//==============================================================================================================================
+func (t *CardTransactionChaincode) suspend_shop(stub shim.ChaincodeStubInterface, caller string, caller_affiliation int, shopId string, reason string) ([]byte, error) {
+
+	if caller_affiliation != KAKACENTER {
+		return nil, errors.New("Permission denied: only KAKACENTER can suspend shop")
+	}
+
+	shop, err := t.get_shop_detail_Internal(stub, shopId)
+	if err != nil { return nil, err }
+
+	if shop.Status != "" && shop.Status != SHOP_APPROVED {
+		return nil, errors.New("shop " + shopId + " can not be suspended, status: " + shop.Status)
+	}
+
+	shop.Status = SHOP_SUSPENDED
+	shop.Reason = reason
+	_, err = t.save_shop(stub, shop)
+	if err != nil { return nil, err }
+
+	_, err = t.add_admin_audit(stub, caller, "suspend_shop", shopId, reason)
+	if err != nil { return nil, err }
+
+	return nil, nil
+}
+
+func (t *CardTransactionChaincode) resume_shop(stub shim.ChaincodeStubInterface, caller string, caller_affiliation int, shopId string, reason string) ([]byte, error) {
+
+	if caller_affiliation != KAKACENTER {
+		return nil, errors.New("Permission denied: only KAKACENTER can resume shop")
+	}
+
+	shop, err := t.get_shop_detail_Internal(stub, shopId)
+	if err != nil { return nil, err }
+
+	if shop.Status != SHOP_SUSPENDED {
+		return nil, errors.New("shop " + shopId + " is not suspended, status: " + shop.Status)
+	}
+
+	shop.Status = SHOP_APPROVED
+	shop.Reason = reason
+	_, err = t.save_shop(stub, shop)
+	if err != nil { return nil, err }
+
+	_, err = t.add_admin_audit(stub, caller, "resume_shop", shopId, reason)
+	if err != nil { return nil, err }
+
+	return nil, nil
+}
+
+//==============================================================================================================================
+//	 terminate_shop - retires a suspended shop. Outstanding card balances need a settlement plan:
+//					  refund     - open gifts and transfers go back to their senders, balances are refunded and recorded on the shop
+//								   ledgers, cards and templates scrapped
+//					  transfer   - templates, cards and ledgers are handed over to the target shop
+//==============================================================================================================================
+func (t *CardTransactionChaincode) terminate_shop(stub shim.ChaincodeStubInterface, caller string, caller_affiliation int, shopId string, plan string, targetShopId string, reason string) ([]byte, error) {
+
+	if caller_affiliation != KAKACENTER {
+		return nil, errors.New("Permission denied: only KAKACENTER can terminate shop")
+	}
+
+	shop, err := t.get_shop_detail_Internal(stub, shopId)
+	if err != nil { return nil, err }
+
+	if shop.Status != SHOP_SUSPENDED {
+		return nil, errors.New("shop " + shopId + " must be suspended before termination, status: " + shop.Status)
+	}
+
+	templates, err := t.get_shop_templates(stub, shopId)
+	if err != nil { return nil, err }
+
+	err = t.check_no_open_disputes(stub, shopId, templates)
+	if err != nil { return nil, err }
+
+	// outstanding balances of the shop
+	var outstandingMoney int64
+	outstandingPoint := 0
+	for _, template := range templates {
+		cards, err := t.get_template_cards(stub, template.Kakaid)
+		if err != nil { return nil, err }
+		for _, card := range cards {
+			if card.Scrapped == false {
+				outstandingMoney = outstandingMoney + card.Money + card.Bonusmoney
+				outstandingPoint = outstandingPoint + card.Point
+			}
+		}
+
+		gifts, transfers, err := t.get_template_escrows(stub, template.Kakaid)
+		if err != nil { return nil, err }
+		for _, gift := range gifts {
+			outstandingMoney = outstandingMoney + gift.Money
+			outstandingPoint = outstandingPoint + gift.Point
+		}
+		for _, transfer := range transfers {
+			outstandingMoney = outstandingMoney + transfer.Money
+			outstandingPoint = outstandingPoint + transfer.Point
+		}
+	}
+	fmt.Printf("terminate_shop " + shopId + " outstanding money %d point %d", outstandingMoney, outstandingPoint)
+
+	if plan == SETTLE_REFUND {
+		_, err = t.settle_shop_by_refund(stub, templates)
+	} else if plan == SETTLE_TRANSFER {
+		_, err = t.settle_shop_by_transfer(stub, templates, targetShopId)
+		plan = plan + ":" + targetShopId
+	} else if outstandingMoney > 0 || outstandingPoint > 0 {
+		return nil, errors.New("shop " + shopId + " has outstanding card balances, a settlement plan (refund or transfer) is required")
+	}
+	if err != nil { return nil, err }
+
+	shop.Status = SHOP_TERMINATED
+	shop.Settlement = plan
+	shop.Reason = reason
+	_, err = t.save_shop(stub, shop)
+	if err != nil { return nil, err }
+
+	_, err = t.add_admin_audit(stub, caller, "terminate_shop", shopId, "settlement " + plan + ": " + reason)
+	if err != nil { return nil, err }
+
+	return nil, nil
+}
+
+func (t *CardTransactionChaincode) settle_shop_by_refund(stub shim.ChaincodeStubInterface, templates []Card) ([]byte, error) {
+
+	for _, template := range templates {
+		// gifts and transfers could not be taken any more, their value is refunded with the sender's card
+		_, err := t.return_template_escrows(stub, template.Kakaid)
+		if err != nil { return nil, err }
+
+		shopLedger, err := t.retrieve_shopLedger(stub, template.Shopid, template.Kakaid)
+		if err != nil { return nil, err }
+
+		cards, err := t.get_template_cards(stub, template.Kakaid)
+		if err != nil { return nil, err }
+
+		for _, card := range cards {
+			if card.Scrapped == true { continue }
+
+			if card.Status == STATE_SHOP {
+				// unsold stock was never paid for, its issue is reversed instead of refunded
+				_, err = t.post_journal(stub, "unissue", card.Cardid, []JournalLine{
+					t.card_line(card, card.Money, card.Point),
+					t.shop_line(ACCOUNT_SHOP_CASH, card.Shopid, card.Currency, -card.Money, 0),
+					t.shop_line(ACCOUNT_PROMOTION, card.Shopid, card.Currency, 0, -card.Point),
+				})
+				if err != nil { return nil, err }
+
+				shopLedger.InitMoney = shopLedger.InitMoney - card.Money
+				shopLedger.InitPoint = shopLedger.InitPoint - card.Point
+			} else {
+				_, err = t.post_journal(stub, "refund", card.Cardid, []JournalLine{
+					t.card_line(card, card.Money + card.Bonusmoney, card.Point),
+					t.shop_line(ACCOUNT_SHOP_CASH, card.Shopid, card.Currency, -card.Money, 0),
+					t.shop_line(ACCOUNT_BREAKAGE, card.Shopid, card.Currency, -card.Bonusmoney, -card.Point),
+				})
+				if err != nil { return nil, err }
+
+				shopLedger.RefundMoney = shopLedger.RefundMoney + card.Money
+				shopLedger.RefundPoint = shopLedger.RefundPoint + card.Point
+				shopLedger.ForfeitBonus = shopLedger.ForfeitBonus + card.Bonusmoney
+			}
+			shopLedger.ScrapNum = shopLedger.ScrapNum + 1
+			card.Money = 0
+			card.Bonusmoney = 0
+			card.Point = 0
+			card.Scrapped = true
+
+			_, err = t.save_card(stub, card)
+			if err != nil { return nil, err }
+		}
+
+		_, err = t.update_shopLedger(stub, template.Shopid, template.Kakaid, shopLedger)
+		if err != nil { return nil, err }
+
+		template.Scrapped = true
+		_, err = t.save_template(stub, template, template.Kakaid)
+		if err != nil { return nil, err }
+	}
+	return nil, nil
+}
+
+func (t *CardTransactionChaincode) settle_shop_by_transfer(stub shim.ChaincodeStubInterface, templates []Card, targetShopId string) ([]byte, error) {
+
+	err := t.check_shop_active(stub, targetShopId)
+	if err != nil { return nil, err }
+
+	target, err := t.get_shop_detail_Internal(stub, targetShopId)
+	if err != nil { return nil, err }
+
+	for _, template := range templates {
+		shopLedger, err := t.retrieve_shopLedger(stub, template.Shopid, template.Kakaid)
+		if err != nil { return nil, err }
+
+		cards, err := t.get_template_cards(stub, template.Kakaid)
+		if err != nil { return nil, err }
+
+		// the target shop takes over the stored value and the points of the cards
+		var money int64
+		point := 0
+		for _, card := range cards {
+			if card.Scrapped == true { continue }
+			money = money + card.Money + card.Bonusmoney
+			point = point + card.Point
+		}
+		_, err = t.post_journal(stub, "shop_transfer", template.Kakaid, []JournalLine{
+			t.shop_line(ACCOUNT_SHOP_CASH, targetShopId, template.Currency, money, 0),
+			t.shop_line(ACCOUNT_SHOP_CASH, template.Shopid, template.Currency, -money, 0),
+			t.shop_line(ACCOUNT_PROMOTION, targetShopId, template.Currency, 0, point),
+			t.shop_line(ACCOUNT_PROMOTION, template.Shopid, template.Currency, 0, -point),
+		})
+		if err != nil { return nil, err }
+
+		for _, card := range cards {
+			if card.Owner == template.Shopid || card.Owner == template.Owner {		// cards still in the shop
+				card.Owner = targetShopId
+			}
+			card.Shopid = targetShopId
+			card.Shop = target.ShopName
+			_, err = t.save_card(stub, card)
+			if err != nil { return nil, err }
+		}
+
+		shopLedger.Shopid = targetShopId
+		_, err = t.update_shopLedger(stub, targetShopId, template.Kakaid, shopLedger)
+		if err != nil { return nil, err }
+
+		template.Owner = targetShopId
+		template.Shopid = targetShopId
+		template.Shop = target.ShopName
+		_, err = t.save_template(stub, template, template.Kakaid)
+		if err != nil { return nil, err }
+	}
+	return nil, nil
+}
+
+//==============================================================================================================================
+//	 check_shop_open - shops which are not active any more but whose cards can still be spent down
+//==============================================================================================================================
+func (t *CardTransactionChaincode) check_shop_open(stub shim.ChaincodeStubInterface, shopId string) (error) {
+
+	shop, err := t.get_shop_detail_Internal(stub, shopId)
+	if err != nil { return errors.New("shop " + shopId + " is not registered") }
+
+	if shop.Status != "" && shop.Status != SHOP_APPROVED && shop.Status != SHOP_SUSPENDED {
+		fmt.Printf("shop " + shopId + " is closed, status: " + shop.Status)
+		return errors.New("shop " + shopId + " is closed, status: " + shop.Status)
+	}
+	return nil
+}
+
+//==============================================================================================================================
+//	 check_shop_active - only approved shops can own templates and issue cards
+//==============================================================================================================================
+func (t *CardTransactionChaincode) check_shop_active(stub shim.ChaincodeStubInterface, shopId string) (error) {
+
+	shop, err := t.get_shop_detail_Internal(stub, shopId)
+	if err != nil { return errors.New("shop " + shopId + " is not registered") }
+
+	if shop.Status != "" && shop.Status != SHOP_APPROVED {
+		fmt.Printf("shop " + shopId + " is not active, status: " + shop.Status)
+		return errors.New("shop " + shopId + " is not active, status: " + shop.Status)
+	}
+	return nil
+}
+
+//==============================================================================================================================
+//	 Admin audit log
+//==============================================================================================================================
+func (t *CardTransactionChaincode) get_admin_audit_holder(stub shim.ChaincodeStubInterface) (AdminAudit_Holder, error) {
+
+	var audit_holder AdminAudit_Holder
+	auditBytes, err := stub.GetState(ADMIN_AUDIT_HOLDER)
+	if err != nil {	fmt.Printf("RETRIEVE_ADMIN_AUDIT_HOLDER ERROR: %s", err); 
+					return audit_holder, errors.New("RETRIEVE_ADMIN_AUDIT_HOLDER ERROR")	}
+
+	if len(auditBytes) != 0 {
+		err = json.Unmarshal(auditBytes, &audit_holder);						
+		if err != nil {	fmt.Printf("Unmarshal_ADMIN_AUDIT_HOLDER ERROR: Corrupt audit record "+string(auditBytes)+": %s", err); 
+						return audit_holder, errors.New("Unmarshal_ADMIN_AUDIT_HOLDER ERROR: Corrupt audit record")	}
+	}
+	return audit_holder, nil
+}
+
+func (t *CardTransactionChaincode) add_admin_audit(stub shim.ChaincodeStubInterface, actor string, action string, target string, detail string) ([]byte, error) {
+
+	timestamp, err := t.get_timestamp(stub)
+	if err != nil { return nil, err }
+
+	var audit AdminAudit
+	audit.Actor = actor
+	audit.Action = action
+	audit.Target = target
+	audit.Detail = detail
+	audit.Timestamp = timestamp
+
+	abytes, err := json.Marshal(audit)
+	if err != nil { return nil, errors.New("Error creating admin audit bytes") }
+
+	audit_holder, err := t.get_admin_audit_holder(stub)
+	if err != nil { return nil, err }
+
+	audit_holder.Audits = append(audit_holder.Audits, string(abytes))
+
+	auditBytes, err := json.Marshal(audit_holder)
+	if err != nil { return nil, errors.New("Error creating AdminAudit_Holder record") }
+
+	err = stub.PutState(ADMIN_AUDIT_HOLDER, auditBytes)
+	if err != nil { fmt.Printf("Error storing admin audit: %s", err); 
+					return nil, errors.New("Error storing admin audit") }
+
+	fmt.Printf("admin audit: " + string(abytes))
+	return abytes, nil
+}
+
+//==============================================================================================================================
+//	 get_admin_audit - KAKACENTER only
+//==============================================================================================================================
+func (t *CardTransactionChaincode) get_admin_audit(stub shim.ChaincodeStubInterface, caller string, caller_affiliation int) ([]byte, error) {
+
+	if caller_affiliation != KAKACENTER {
+		return nil, errors.New("Permission denied: you are not KAKACENTER users ")
+	}
+
+	audit_holder, err := t.get_admin_audit_holder(stub)
+	if err != nil { return nil, err }
+
+	return json.Marshal(audit_holder)
+}
+
+// end manage user and shop
+//////////////////////////////////////////////////////////////////////////////////////////////
+
+func (t *CardTransactionChaincode) get_shopLedgerID(shop string, templateID string) (string) {
+	return "shopledger-" + templateID
+}
+
+func (t *CardTransactionChaincode) add_new_shopLedger(stub shim.ChaincodeStubInterface, shopid string, templateID string) ([]byte, error) {
+	
+	shopLedgerId := t.get_shopLedgerID(shopid, templateID)
+	shopLedgerBytes, err := stub.GetState(shopLedgerId)
+	if err != nil {	fmt.Printf("add_new_shopLedger ERROR: %s", err); 
+					return nil, errors.New("add_new_shopLedger ERROR")	}
+	if shopLedgerBytes != nil || len(shopLedgerBytes) > 0 {				
+		if err != nil {	fmt.Printf("shop ledger already exist, error: %s", err); 
+					return nil, errors.New("shop ledger already exist")	}
+	}
+	
+	var shopLedger ShopLedger																																									
+
+	Templateid          	:= "\"Templateid\":\""+templateID+"\", "	
+	Shopid          		:= "\"Shopid\":\""+shopid+"\", "
+	CardIdIndex          	:= "\"CardIdIndex\":0, "	
+	Qty          			:= "\"Qty\":0, "							
+	ExpiredNum            	:= "\"ExpiredNum\":0, "
+	ScrapNum        		:= "\"ScrapNum\":0, "
+	BackNum       			:= "\"BackNum\":0, "
+	InitMoney       		:= "\"InitMoney\":0, "
+	InitPoint           	:= "\"InitPoint\":0, "
+	DepositMoney       		:= "\"DepositMoney\":0, "
+	TotalDepositPoint  	    := "\"TotalDepositPoint\":0, "
+	ConsumeMoney        	:= "\"ConsumeMoney\":0, "
+	ConsumePoint           	:= "\"ConsumePoint\":0, "
+	Minorunits           	:= "\"Minorunits\":true "
+	
+
+	shopLedger_json := "{"+Templateid+Shopid+CardIdIndex+Qty+ExpiredNum+ScrapNum+BackNum+InitMoney+InitPoint+DepositMoney+TotalDepositPoint+ConsumeMoney+ConsumePoint+Minorunits+"}" 	// Concatenates the variables to create the total JSON object
+	
+	fmt.Printf("shopLedger_json : %s ",shopLedger_json);
+
+	err = json.Unmarshal([]byte(shopLedger_json), &shopLedger)	
+
+	err = stub.PutState(shopLedgerId, []byte(shopLedger_json))
+		if err != nil { fmt.Printf("SAVE_CHANGES: Error storing  card record: %s", err); return nil, errors.New("Error storing card record") }
+	
+	return []byte(shopLedger_json), nil
+}
+
+func (t *CardTransactionChaincode) get_shopLedger(stub shim.ChaincodeStubInterface,  caller string, caller_affiliation int, shopid string, templateID string) ([]byte, error) {
+	
+	authed := 0
+	if 		caller_affiliation	== KAKACENTER {
+		authed = 1
+		
+	}else if 	caller_affiliation	== SHOP {
+			callerShopid, err := t.check_shop_permission(stub, caller, caller_affiliation, PERM_VIEW_LEDGER)
+				if err != nil {return nil, err}
+
+			template, err := t.retrieve_card(stub, templateID)
+			if err != nil {
+				coupon, cerr := t.retrieve_coupon(stub, templateID)		// ledger of a coupon template
+				if cerr != nil {return nil, errors.New("Failed to retrieve card template: " + templateID)}
+				template.Shopid = coupon.Shopid
+			}
+		
+			if template.Owner == caller || template.Shopid == callerShopid {
+				authed = 1
+			}
+	}
+	
+	if authed== 0 {
+		fmt.Printf("Permission denied"); 
+		return nil, errors.New("Permission denied")
+	}
+																																			
+	return t.get_shopLedger_internal(stub, shopid , templateID )
+}
+
+func (t *CardTransactionChaincode) get_shopLedger_internal(stub shim.ChaincodeStubInterface, shopid string, templateID string) ([]byte, error) {
+	
+	shopLedgerId := t.get_shopLedgerID(shopid, templateID)
+	shopLedgerBytes, err := stub.GetState(shopLedgerId)
+	if err != nil {	fmt.Printf("get_shopLedger ERROR: %s", err); 
+					return nil, errors.New("get_shopLedger ERROR")	}
+																																							
+	return shopLedgerBytes, nil
+}
+
+//==============================================================================================================================
+//	 retrieve_shopLedger - shop ledger of a template as struct, a new ledger is created if the template has none yet
+//==============================================================================================================================
+func (t *CardTransactionChaincode) retrieve_shopLedger(stub shim.ChaincodeStubInterface, shopid string, templateID string) (ShopLedger, error) {
+
+	var	shopLedger ShopLedger
+	shopLedgerBytes, err := t.get_shopLedger_internal(stub, shopid, templateID)
+	if err != nil { return shopLedger, err }
+
+	if shopLedgerBytes == nil {
+		shopLedgerBytes, err = t.add_new_shopLedger(stub, shopid, templateID)
+		if err != nil { return shopLedger, err }
+	}
+
+	err = json.Unmarshal(shopLedgerBytes, &shopLedger)	
+	if err != nil { return shopLedger, errors.New("------------Invalid shopLedgerBytes JSON object") }
+
+	return shopLedger, nil
+}
+
+//==============================================================================================================================
+//	 update_shopLedger - saves the shop ledger and posts the change to the ledger bucket of the day
+//==============================================================================================================================
+func (t *CardTransactionChaincode) update_shopLedger(stub shim.ChaincodeStubInterface, shopid string, templateID string, shopLedger ShopLedger) ([]byte, error) {
+
+	_, err := t.post_ledger_bucket(stub, shopid, templateID, shopLedger)
+	if err != nil { return nil, err }
+
+	return t.save_shopLedger(stub, shopid, templateID, shopLedger)
+}
+
+func (t *CardTransactionChaincode) save_shopLedger(stub shim.ChaincodeStubInterface, shopid string, templateID string, shopLedger ShopLedger) ([]byte, error) {
+	
+	shopLedgerId := t.get_shopLedgerID(shopid, templateID)
+																															
+	shopLedgersBytes, err := json.Marshal(shopLedger)	
+	if err != nil {	fmt.Printf("Unmarshal shopLedgersBytes error: %s", err); 
+					return nil, errors.New("Unmarshal shopLedgersBytes error")	}
+
+	err = stub.PutState(shopLedgerId, shopLedgersBytes)
+		if err != nil { fmt.Printf("PutState shopLedgersBytes: Error : %s", err); 
+						return nil, errors.New("PutState shopLedgersBytes: Error") }
+	
+	return shopLedgersBytes, nil
+}
+
+/*
+func (t *CardTransactionChaincode) get_shopLedger_holder(stub shim.ChaincodeStubInterface, shop string) (ShopLedger_Holder, error) {
+	
+	shopLedgersBytes, err := stub.GetState(shop)
+	if err != nil {	fmt.Printf("RETRIEVE_USER_HOLDER ERROR: Corrupt users record "+string(usersBytes)+": %s", err); 
+					return usersBytes, errors.New("RETRIEVE_USER_HOLDER ERROR: Corrupt users record"+string(usersBytes))	}
+
+	var shopLedger_holder ShopLedger_Holder
+	if shopLedgersBytes != nil || len(shopLedgersBytes) > 0 {
+		err = json.Unmarshal(shopLedgersBytes, &shopLedger_holder);						
+		if err != nil {	fmt.Printf("Unmarshal_USER_HOLDER ERROR: Corrupt users record "+string(usersBytes)+": %s", err); 
+					return usersBytes, errors.New("Unmarshal_USER_HOLDER ERROR: Corrupt users record"+string(usersBytes))	}
+	
+	}
+
+	return shopLedger_holder, nil
+}
+*/
+
+
+
+//==============================================================================================================================
+//	 get_caller - Retrieves the username of the user who invoked the chaincode.
+//				  Returns the username as a string.
+//==============================================================================================================================
+/*
+func (t *CardTransactionChaincode) get_username(stub shim.ChaincodeStubInterface) (string, error) {
+
+	bytes, err := stub.GetCallerCertificate();
+															if err != nil { return "", errors.New("Couldn't retrieve caller certificate") }
+	x509Cert, err := x509.ParseCertificate(bytes);				// Extract Certificate from result of GetCallerCertificate						
+															if err != nil { return "", errors.New("Couldn't parse certificate")	}
+															
+	return x509Cert.Subject.CommonName, nil
+}
+*/
+//==============================================================================================================================
+//	 check_affiliation - Takes an ecert as a string, decodes it to remove html encoding then parses it and checks the
+// 				  		certificates common name. The affiliation is stored as part of the common name.
+//==============================================================================================================================
+/*
+func (t *CardTransactionChaincode) check_affiliation(stub shim.ChaincodeStubInterface, cert string) (int, error) {																																																					
+	
+
+	decodedCert, err := url.QueryUnescape(cert);    				// make % etc normal //
+	
+		if err != nil { return -1, errors.New("Could not decode certificate") }
+	
+	pem, _ := pem.Decode([]byte(decodedCert))           				// Make Plain text   //
+
+	x509Cert, err := x509.ParseCertificate(pem.Bytes);				// Extract Certificate from argument //
+														
+		if err != nil { return -1, errors.New("Couldn't parse certificate")	}
+
+	cn := x509Cert.Subject.CommonName
+	
+	res := strings.Split(cn,"\\")
+	
+	affiliation, _ := strconv.Atoi(res[2])
+	
+	return affiliation, nil
+		
+}
+
+//==============================================================================================================================
+//	 get_caller_data - Calls the get_ecert and check_role functions and returns the ecert and role for the
+//					 name passed.
+//==============================================================================================================================
+
+func (t *CardTransactionChaincode) get_caller_data(stub shim.ChaincodeStubInterface) (string, int, error){	
+
+	user, err := t.get_username(stub)
+	if err != nil { return "", -1, err }
+																		
+	ecert, err := t.get_ecert(stub, user);					
+	if err != nil { return "", -1, err }
+
+	affiliation, err := t.check_affiliation(stub,string(ecert));			
+	if err != nil { return "", -1, err }
+
+	return user, affiliation, nil
+}
+*/
+
+
+
+//==============================================================================================================================
+//	 Router Functions
+//==============================================================================================================================
+//	Invoke - Called on chaincode invoke. Takes a function name passed and calls that function. Converts some
+//		  initial arguments passed to other things for use in the called function e.g. name -> ecert
+//==============================================================================================================================
+/*
+func (t *CardTransactionChaincode) invoke(stub shim.ChaincodeStubInterface) ([]byte, error) {
+	function, args := stub.GetFunctionAndParameters()
+	if strings.HasPrefix(function,"get_") {
+		return t.Query(stub , function , args) 
+	}
+	return t.Invoke(stub , function , args) 
+}
+*/
+
+func (t *CardTransactionChaincode) Invoke(stub shim.ChaincodeStubInterface, function string, args []string) ([]byte, error) {
+	
+	//caller, caller_affiliation, err := t.get_caller_data(stub)
+	caller := args[0]
+
+	// self service, the caller does not need to be a registered user
+	if function == "register_shop" {		//(caller, shopid, shopname, licensenum, category, address, contact)
+		if len(args) < 7 { return nil, errors.New("register_shop: expects shopid, shopname, licensenum, category, address and contact") }
+		var shop Shop
+		shop.ShopId = args[1]
+		shop.ShopName = args[2]
+		shop.LicenseNum = args[3]
+		shop.Category = args[4]
+		shop.Address = args[5]
+		shop.Contact = args[6]
+		return t.register_shop(stub, caller, shop)
+
+	} else if function == "register_consumer" {		//(caller, name, tel)
+		if len(args) < 3 { return nil, errors.New("register_consumer: expects name and tel") }
+		return t.register_consumer(stub, caller, args[1], args[2])
+	}
+
+	ifuserAuthed, err := t.check_user(stub, caller)
+	if (err != nil  || ifuserAuthed < 1){
+		return nil, errors.New("cannot find this user:" + caller)
+	}
+ 	caller_affiliation , err := t.check_affiliation(stub, caller)
+	if err != nil  { return nil, errors.New("Invalid caller_affiliation value passed") }
+	
+	cardIDPos := 1
+
+
+	if function == "add_user" { 
+		var user User
+		user.Identity = args[cardIDPos]
+		user.Name = args[cardIDPos + 1]
+		user.ECert = args[cardIDPos + 2]
+		user.Affiliation, err = strconv.Atoi(args[cardIDPos + 3])
+			if err != nil { fmt.Printf("Error, affiliation is not int : ", err); 
+							return nil, errors.New("Error, affiliation is not int ") }
+		user.AuthId = args[cardIDPos + 4]
+		if len(args) > cardIDPos + 6 {		// shop staff: shopid and role
+			user.Shopid = args[cardIDPos + 5]
+			user.Role = args[cardIDPos + 6]
+		}
+		return t.add_user(stub, caller, caller_affiliation, user)
+
+	} else if function == "update_user" {  //(caller, userid, version, updateJson)
+		version, err := strconv.Atoi(args[cardIDPos + 1])
+			if err != nil { return nil, errors.New("Error, version is not int ") }
+		return t.update_user(stub, caller, caller_affiliation, args[cardIDPos], version, args[cardIDPos + 2])
+
+	} else if function == "delete_user" {  // same with add_user
+		delUserId := args[cardIDPos]
+		return t.delete_user(stub, caller, caller_affiliation, delUserId)
 
 
 
 	} else if function == "add_shop" { 
 		var shop Shop
-		shop.ShopId = args[cardIDPos]
-		shop.ShopName = args[cardIDPos + 1]
-		shop.LicenseNum = args[cardIDPos + 2]
-		shop.Category = args[cardIDPos + 3]
-		shop.Address = args[cardIDPos + 4]
-		shop.Contact = args[cardIDPos + 5]
-		return t.add_shop(stub, shop)
+		shop.ShopId = args[cardIDPos]
+		shop.ShopName = args[cardIDPos + 1]
+		shop.LicenseNum = args[cardIDPos + 2]
+		shop.Category = args[cardIDPos + 3]
+		shop.Address = args[cardIDPos + 4]
+		shop.Contact = args[cardIDPos + 5]
+		return t.add_shop(stub, caller, caller_affiliation, shop)
+
+	} else if function == "update_shop" {  //(caller, shopid, version, updateJson)
+		version, err := strconv.Atoi(args[cardIDPos + 1])
+			if err != nil { return nil, errors.New("Error, version is not int ") }
+		return t.update_shop(stub, caller, caller_affiliation, args[cardIDPos], version, args[cardIDPos + 2])
+
+	} else if function == "delete_shop" {  // same with add_shop
+		delShopId := args[cardIDPos]
+		return t.delete_shop(stub, caller, caller_affiliation, delShopId)
+
+	} else if function == "approve_shop" {
+		return t.approve_shop(stub, caller, caller_affiliation, args[cardIDPos], args[cardIDPos + 1])
+
+	} else if function == "reject_shop" {
+		return t.reject_shop(stub, caller, caller_affiliation, args[cardIDPos], args[cardIDPos + 1])
+
+	} else if function == "suspend_shop" {
+		return t.suspend_shop(stub, caller, caller_affiliation, args[cardIDPos], args[cardIDPos + 1])
+
+	} else if function == "resume_shop" {
+		return t.resume_shop(stub, caller, caller_affiliation, args[cardIDPos], args[cardIDPos + 1])
+
+	} else if function == "terminate_shop" {		//(caller, shopid, plan, targetshopid, reason)
+		return t.terminate_shop(stub, caller, caller_affiliation, args[cardIDPos], args[cardIDPos + 1], args[cardIDPos + 2], args[cardIDPos + 3])
+
+
+
+
+
+	} else if function == "create_alliance" { 
+		return t.create_alliance(stub, caller, caller_affiliation, args[cardIDPos], args[cardIDPos + 1])
+
+	} else if function == "set_alliance_shop" { 		//(caller, allianceid, shopid, rate)
+		rate, err := strconv.Atoi(args[cardIDPos + 2])
+			if err != nil { return nil, errors.New("Error, exchange rate is not int ") }
+		return t.set_alliance_shop(stub, caller, caller_affiliation, args[cardIDPos], args[cardIDPos + 1], rate)
+
+	} else if function == "create_settlement_batches" { 		//(caller, allianceid, periodstart, periodend)
+		return t.create_settlement_batches(stub, caller, caller_affiliation, args[cardIDPos], args[cardIDPos + 1], args[cardIDPos + 2])
+
+	} else if function == "confirm_settlement" { 
+		return t.confirm_settlement(stub, caller, caller_affiliation, args[cardIDPos])
+
+	} else if function == "pay_settlement" { 
+		return t.pay_settlement(stub, caller, caller_affiliation, args[cardIDPos])
+
+	} else if function == "set_commission_rule" { 		//(caller, scope, id, rate, fixed, currency)
+		rate, err := strconv.Atoi(args[cardIDPos + 2])
+			if err != nil { return nil, errors.New("Error, commission rate is not int ") }
+		return t.set_commission_rule(stub, caller, caller_affiliation, args[cardIDPos], args[cardIDPos + 1], rate, args[cardIDPos + 3], args[cardIDPos + 4])
+
+	} else if function == "create_coupon_template" { 		//(caller, templateid, templateJson)
+		return t.create_coupon_template(stub, caller, caller_affiliation, args[cardIDPos], args[cardIDPos + 1])
+
+	} else if function == "issue_coupon" { 		//(caller, templateid, consumer)
+		return t.issue_coupon(stub, caller, caller_affiliation, args[cardIDPos], args[cardIDPos + 1])
+
+	} else if function == "transfer_coupon" { 		//(caller, couponid, receiver)
+		return t.transfer_coupon(stub, caller, caller_affiliation, args[cardIDPos], args[cardIDPos + 1])
+
+	} else if function == "redeem_coupon" { 		//(caller, couponid, money, point, sccardid, shopid)
+		point, err := strconv.Atoi(args[cardIDPos + 2])
+			if err != nil { return nil, errors.New("Error, point is not int ") }
+		scard, err := t.retrieve_card(stub, args[cardIDPos + 3])
+			if err != nil { return nil, errors.New("Error retrieving card " + args[cardIDPos + 3]) }
+		money, err := t.parse_money(args[cardIDPos + 1], scard.Currency)
+			if err != nil { return nil, err }
+		return t.redeem_coupon(stub, caller, caller_affiliation, args[cardIDPos], money, point, scard, args[cardIDPos + 4])
+
+	} else if function == "create_campaign" { 		//(caller, campaignid, campaignJson)
+		return t.create_campaign(stub, caller, caller_affiliation, args[cardIDPos], args[cardIDPos + 1])
+
+	} else if function == "stop_campaign" { 
+		return t.stop_campaign(stub, caller, caller_affiliation, args[cardIDPos])
+
+	} else if function == "create_gift" { 		//(caller, giftid, cardid, money, point, codehash, days)
+		card, err := t.retrieve_card(stub, args[cardIDPos + 1])
+			if err != nil { return nil, errors.New("Error retrieving card " + args[cardIDPos + 1]) }
+		money, err := t.parse_money(args[cardIDPos + 2], card.Currency)
+			if err != nil { return nil, err }
+		point, err := strconv.Atoi(args[cardIDPos + 3])
+			if err != nil { return nil, errors.New("Error, point is not int ") }
+		days, err := strconv.Atoi(args[cardIDPos + 5])
+			if err != nil { return nil, errors.New("Error, gift validity days is not int ") }
+		return t.create_gift(stub, caller, caller_affiliation, args[cardIDPos], card, money, point, args[cardIDPos + 4], days)
+
+	} else if function == "claim_gift" { 		//(caller, giftid, code [, cardid])
+		cardId := ""
+		if len(args) > cardIDPos + 2 { cardId = args[cardIDPos + 2] }
+		return t.claim_gift(stub, caller, caller_affiliation, args[cardIDPos], args[cardIDPos + 1], cardId)
+
+	} else if function == "revoke_gift" { 
+		return t.revoke_gift(stub, caller, caller_affiliation, args[cardIDPos])
+
+	} else if function == "expire_gifts" { 
+		return t.expire_gifts(stub, caller, caller_affiliation)
+
+	} else if function == "propose_transfer" { 		//(caller, transferid, cardid, receiver, money, point, days)
+		card, err := t.retrieve_card(stub, args[cardIDPos + 1])
+			if err != nil { return nil, errors.New("Error retrieving card " + args[cardIDPos + 1]) }
+		money, err := t.parse_money(args[cardIDPos + 3], card.Currency)
+			if err != nil { return nil, err }
+		point, err := strconv.Atoi(args[cardIDPos + 4])
+			if err != nil { return nil, errors.New("Error, point is not int ") }
+		days, err := strconv.Atoi(args[cardIDPos + 5])
+			if err != nil { return nil, errors.New("Error, transfer validity days is not int ") }
+		return t.propose_transfer(stub, caller, caller_affiliation, args[cardIDPos], card, args[cardIDPos + 2], money, point, days)
+
+	} else if function == "accept_transfer" { 		//(caller, transferid [, tcardid])
+		cardId := ""
+		if len(args) > cardIDPos + 1 { cardId = args[cardIDPos + 1] }
+		return t.accept_transfer(stub, caller, caller_affiliation, args[cardIDPos], cardId)
+
+	} else if function == "decline_transfer" { 
+		return t.decline_transfer(stub, caller, caller_affiliation, args[cardIDPos])
+
+	} else if function == "cancel_transfer" { 
+		return t.cancel_transfer(stub, caller, caller_affiliation, args[cardIDPos])
+
+	} else if function == "expire_transfers" { 
+		return t.expire_transfers(stub, caller, caller_affiliation)
+
+	} else if function == "merge_cards" { 		//(caller, tcardid, scardids separated by ",")
+		return t.merge_cards(stub, caller, caller_affiliation, args[cardIDPos], strings.Split(args[cardIDPos + 1], ","))
+
+	} else if function == "split_card" { 		//(caller, cardid, money, point)
+		card, err := t.retrieve_card(stub, args[cardIDPos])
+			if err != nil { return nil, errors.New("Error retrieving card " + args[cardIDPos]) }
+		money, err := t.parse_money(args[cardIDPos + 1], card.Currency)
+			if err != nil { return nil, err }
+		point, err := strconv.Atoi(args[cardIDPos + 2])
+			if err != nil { return nil, errors.New("Error, point is not int ") }
+		return t.split_card(stub, caller, caller_affiliation, card, money, point)
+
+	} else if function == "set_template_limits" { 		//(caller, templateid, limitsJson)
+		return t.set_template_limits(stub, caller, caller_affiliation, args[cardIDPos], args[cardIDPos + 1])
+
+	} else if function == "set_card_limits" { 		//(caller, cardid, limitsJson)
+		card, err := t.retrieve_card(stub, args[cardIDPos])
+			if err != nil { return nil, errors.New("Error retrieving card " + args[cardIDPos]) }
+		return t.set_card_limits(stub, caller, caller_affiliation, card, args[cardIDPos + 1])
+
+	} else if function == "set_fraud_rules" { 		//(caller, rulesJson)
+		return t.set_fraud_rules(stub, caller, caller_affiliation, args[cardIDPos])
+
+	} else if function == "review_fraud_flag" { 		//(caller, flagid, decision cleared|confirmed, reason)
+		return t.review_fraud_flag(stub, caller, caller_affiliation, args[cardIDPos], args[cardIDPos + 1], args[cardIDPos + 2])
+
+	} else if function == "open_dispute" { 		//(caller, disputeid, cardid, eventid, reason)
+		return t.open_dispute(stub, caller, caller_affiliation, args[cardIDPos], args[cardIDPos + 1], args[cardIDPos + 2], args[cardIDPos + 3])
+
+	} else if function == "respond_dispute" { 		//(caller, disputeid, response)
+		return t.respond_dispute(stub, caller, caller_affiliation, args[cardIDPos], args[cardIDPos + 1])
+
+	} else if function == "resolve_dispute" { 		//(caller, disputeid, ruling refunded|released, reason)
+		return t.resolve_dispute(stub, caller, caller_affiliation, args[cardIDPos], args[cardIDPos + 1], args[cardIDPos + 2])
+
+	} else if function == "close_period" { 		//(caller, shopid, throughday)
+		return t.close_period(stub, caller, caller_affiliation, args[cardIDPos], args[cardIDPos + 1])
+
+	} else if function == "open_journal" { 		//(caller, templateid)
+		return t.open_journal(stub, caller, caller_affiliation, args[cardIDPos])
+
+	} else if function == "migrate_money_minor_units" { 
+		return t.migrate_money_minor_units(stub, caller, caller_affiliation, args[cardIDPos])
+
+	} else if function == "create_card_template_by_shop" { 
+		fmt.Printf("------------create create_card_template_by_shop function----------");
+		templateId := args[cardIDPos]
+		templateJson := args[cardIDPos + 1]
+		return t.create_card_template_by_shop(stub, caller, caller_affiliation, templateId, templateJson)
+
+	} else if function == "request_card_by_template" { 
+		fmt.Printf("------------request_card_by_template function----------");
+		templateId := args[cardIDPos]
+		return t.request_card_by_template(stub, caller, caller_affiliation, templateId)
+
+	} else if function == "push_card_by_template" { 
+		fmt.Printf("------------push_card_by_template function----------");
+		ownerId := args[cardIDPos]
+		templateId := args[cardIDPos + 1]
+		return t.push_card_by_template(stub, caller, caller_affiliation, ownerId, templateId)
+
+
+
+	} else if function == "set_earn_rule" { 
+		templateId := args[cardIDPos]
+		ruleJson := args[cardIDPos + 1]
+		return t.set_earn_rule(stub, caller, caller_affiliation, templateId, ruleJson)
+
+	} else if function == "set_tier_rules" { 
+		templateId := args[cardIDPos]
+		rulesJson := args[cardIDPos + 1]
+		return t.set_tier_rules(stub, caller, caller_affiliation, templateId, rulesJson)
+
+	} else if function == "set_point_expiry" { 
+		templateId := args[cardIDPos]
+		days, err := strconv.Atoi(args[cardIDPos + 1])
+			if err != nil { return nil, errors.New("Error, point expiry days is not int ") }
+		return t.set_point_expiry(stub, caller, caller_affiliation, templateId, days)
+
+	} else if function == "expire_points" { 
+		return t.expire_points(stub, caller, caller_affiliation, args[cardIDPos])
+
+	} else if function == "create_card_template" { 
+		fmt.Printf("------------create template function----------");
+		return t.create_card_template(stub, caller, caller_affiliation, args[cardIDPos])
+
+	} else if function == "transfer_template_to_shop" {
+
+		cardTemplateId := args[1]
+		cardTemplate, err := t.retrieve_card(stub, cardTemplateId)
+		if err != nil { fmt.Printf("INVOKE: Error retrieving v5c: %s", err); 
+						return nil, errors.New("Error retrieving v5c") }
+
+		rec_user := args[2]
+		rec_affiliation , err := t.check_affiliation(stub, rec_user)
+			if err != nil  { return nil, errors.New("Invalid rec_affiliation value passed") }
+		return t.transfer_template_to_shop(stub, cardTemplate, caller, caller_affiliation, rec_user, rec_affiliation)
+
+	//} else if function == "update_template" {
+	//	cardTemplateId := args[1]
+	//	updatedCardJson := args[2]
+
+	//	return t.update_template(stub, caller, caller_affiliation, cardTemplateId, updatedCardJson)
+
+	} else if function == "create_batch_card_by_template" { 
+		cardTemplateId := args[1]
+		cardNum, err := strconv.Atoi(args[2])
+		if err != nil { fmt.Printf("strconv.Atoi(args[2]) card number error: ", err); 
+						return nil, errors.New("strconv.Atoi(args[3]) card number error") }
+
+		//create_batch_card_by_template(stub , caller string, caller_affiliation int, 
+		//							cardTemplate_KakaIDs string, initCard Card, cardIDPrefix string, cardNum int)
+		return t.create_batch_card_by_template(stub, caller, caller_affiliation, cardTemplateId, cardNum)
+
+	} else if function == "scrap_card" {
+		
+		cardid := args[1]
+		card, err := t.retrieve_card(stub, cardid)
+		if err != nil { fmt.Printf("INVOKE: Error retrieving v5c: %s", err); 
+						return nil, errors.New("Error retrieving v5c") }
+		return t.scrap_card(stub, card, caller)
+
+	} else if strings.Contains(function, "update") == true{
+
+		cardid := args[1]
+		newValue := args[2]
+		card, err := t.retrieve_card(stub, cardid)
+		if err != nil { fmt.Printf("INVOKE: Error retrieving v5c: %s", err); 
+						return nil, errors.New("Error retrieving v5c") }
+
+		if function == "update_ct_shopname"  	    { return t.update_ct_shopname(stub, card, caller, caller_affiliation, newValue)
+		} else if function == "update_ct_shopid"       { return t.update_ct_shopid(stub, card, caller, caller_affiliation, newValue)
+		} else if function == "update_ct_cardid"       { return t.update_ct_cardid(stub, card, caller, caller_affiliation, newValue)
+		} else if function == "update_ct_category" 	{ return t.update_ct_category(stub, card, caller, caller_affiliation, newValue)
+		} else if function == "update_ct_cardlevel" 	{ return t.update_ct_cardlevel(stub, card, caller, caller_affiliation, newValue)
+		} else if function == "update_ct_cardclass" 	{ return t.update_ct_cardclass(stub, card, caller, caller_affiliation, newValue)
+		} else if function == "update_ct_tel" 			{ return t.update_ct_tel(stub, card, caller, caller_affiliation, newValue)
+		} else if function == "update_ct_password" 	{ return t.update_ct_password(stub, card, caller, caller_affiliation, newValue)
+		} else if function == "update_ct_money" 		{ return t.update_ct_money(stub, card, caller, caller_affiliation, newValue)
+		} else if function == "update_ct_point" 		{ return t.update_ct_point(stub, card, caller, caller_affiliation, newValue)
+		} else if function == "update_ct_expdate" 		{ return t.update_ct_expdate(stub, card, caller, caller_affiliation, newValue)
+		} else if function == "update_ct_expired" 		{ return t.update_ct_expired(stub, card, caller, caller_affiliation, newValue)}
+
+	} else if strings.Contains(function, "transfer_card") == true{
+		
+		cardid := args[1]
+		card, err := t.retrieve_card(stub, cardid)
+		if err != nil { fmt.Printf("INVOKE: Error retrieving v5c: %s", err); 
+						return nil, errors.New("Error retrieving v5c") }
+
+		rec_user := args[2]
+		rec_affiliation , err := t.check_affiliation(stub, rec_user)
+			if err != nil  { return nil, errors.New("Invalid rec_affiliation value passed") }
+												
+		vbytes, err := json.Marshal(card)
+			if err != nil { return nil, errors.New("ERROR: Invalid card object,cannot Marshal to bytes") }
+		fmt.Printf("Card Content: %s", string(vbytes)); 
+
+
+		if  function == "transfer_card_shop_to_consumer"   { return t.transfer_card_shop_to_consumer(stub, card, caller, caller_affiliation, rec_user, rec_affiliation)
+		} else if  function == "transfer_card_consumer_to_consumer" 	   { return t.transfer_card_consumer_to_consumer(stub, card, caller, caller_affiliation, rec_user, rec_affiliation)
+		} else if  function == "transfer_card_consumer_to_shop"  { return t.transfer_card_consumer_to_shop(stub, card, caller, caller_affiliation, rec_user, rec_affiliation) }
+	
+	} else if strings.Contains(function, "_mp_") == true{
+
+		// money is a decimal string in the currency of the source card, parsed once the card is known
+		moneyStr := args[1]
+
+		point, err := strconv.Atoi(args[2])
+		if err != nil { fmt.Printf("strconv.Atoi args4 point error: ", err); 
+						return nil, errors.New("strconv.Atoi args4 point error") }
+		if point < 0 { return nil, errors.New("Invalid point amount: " + args[2]) }
+
+		fmt.Printf("transfer mp start ")
+		if  function == "transfer_mp_consumer_to_consumer"   {    //(caller, money, point, sccardid, receiver, tcardid)
+				
+			sccardid := args[3]
+			scard, err := t.retrieve_card(stub, sccardid)
+			if err != nil { fmt.Printf("INVOKE: Error retrieving v5c: %s", err); 
+							return nil, errors.New("Error retrieving v5c") }
+
+			receiver := args[4]		
+			tcardid := args[5]
+			tcard, err := t.retrieve_card(stub, tcardid)
+			if err != nil { fmt.Printf("INVOKE: Error retrieving v5c: %s", err); 
+							return nil, errors.New("Error retrieving v5c") }
+
+			money, err := t.parse_money(moneyStr, scard.Currency)
+			if err != nil { return nil, err }
+			
+			return t.transfer_mp_consumer_to_consumer(stub, money , point , caller , scard, receiver , tcard )
+
+		} else if  function == "deposit_mp_shop_to_consumer" 	   { //(caller, money, point, receiver, tcardid)
+
+			fmt.Printf("deposit_mp_shop_to_consumer 1")
+			receiver := args[3]		
+			tcardid := args[4]
+			tcard, err := t.retrieve_card(stub, tcardid)
+			fmt.Printf("deposit_mp_shop_to_consumer 2")
+			if err != nil { fmt.Printf("INVOKE: Error retrieving v5c: %s", err); 
+							return nil, errors.New("Error retrieving v5c") }
+
+			money, err := t.parse_money(moneyStr, tcard.Currency)
+			if err != nil { return nil, err }
+
+			fmt.Printf("get into deposit_mp_shop_to_consumer 3");
+			return t.deposit_mp_shop_to_consumer(stub, money , point , caller, receiver , tcard)
+
+		} else if  function == "spend_mp_consumer_to_shop"  {  //(caller, money, point, sccardid, shopid)
+			
+			fmt.Printf("spend_mp_consumer_to_shop 1")
+			sccardid := args[3]
+			scard, err := t.retrieve_card(stub, sccardid)
+			fmt.Printf("spend_mp_consumer_to_shop 2")
+			if err != nil { fmt.Printf("INVOKE: Error retrieving v5c: %s", err); 
+							return nil, errors.New("Error retrieving v5c") }
+fmt.Printf("spend_mp_consumer_to_shop 13")
+
+			money, err := t.parse_money(moneyStr, scard.Currency)
+			if err != nil { return nil, err }
+
+			shopid := args[4]
+			fmt.Printf("get into spend_mp_consumer_to_shop");
+			return t.spend_mp_consumer_to_shop(stub, money , point , caller , scard, shopid) }
+	
+	} 
+
+	return nil, errors.New("Function of that name doesn't exist.")
+
+}
+
+//=================================================================================================================================	
+//	Query - Called on chaincode query. Takes a function name passed and calls that function. Passes the
+//  		initial arguments passed are passed on to the called function.
+//=================================================================================================================================	
+func (t *CardTransactionChaincode) Query(stub shim.ChaincodeStubInterface, function string, args []string) ([]byte, error) {
+													
+	//caller, caller_affiliation, err := t.get_caller_data(stub)
+	//if err != nil { fmt.Printf("QUERY: Error retrieving caller details", err); return nil, errors.New("QUERY: Error retrieving caller details: "+err.Error()) }
+	caller := args[0]
+ 	caller_affiliation , err := t.check_affiliation(stub, caller)
+	if err != nil  { return nil, errors.New("Invalid caller_affiliation value") }
+															
+	if function == "get_users" { 
+		fmt.Printf("exec function:  get_users "); 
+		return t.get_users(stub, caller)
+
+	} else if function == "get_user_detail" { 
+		fmt.Printf("exec function:  get_user_detail "); 
+		userId := args[1]
+		ubytes,err :=  t.get_user_detail(stub, caller, caller_affiliation, userId)
+		if err != nil { fmt.Printf("get_user_detail error: ", err); 
+						return nil, errors.New("get_user_detail error") }
+
+		return ubytes, nil
+
+
+
+
+	} else if function == "get_admin_audit" { 
+		fmt.Printf("exec function:  get_admin_audit "); 
+		return t.get_admin_audit(stub, caller, caller_affiliation)
+
+
+
+
+	} else if function == "get_shops" { 
+		fmt.Printf("exec function:  get_shops "); 
+		return t.get_shops(stub, caller)
+
+	} else if function == "get_shop_detail" { 
+		fmt.Printf("exec function:  get_shop_detail "); 
+		shopId := args[1]
+		shopbytes,err :=  t.get_shop_detail(stub, caller, caller_affiliation, shopId)
+		if err != nil { fmt.Printf("get_shop_detail error: ", err); 
+						return nil, errors.New("get_shop_detail error") }
+
+		return shopbytes, nil
+
+
+
+
+	} else if function == "get_alliances" { 
+		return t.get_alliances(stub, caller, caller_affiliation)
+
+	} else if function == "get_settlement_statement" { 
+		return t.get_settlement_statement(stub, caller, caller_affiliation, args[1])
+
+	} else if function == "get_commission_report" { 
+		shopId := ""
+		if len(args) > 1 { shopId = args[1] }
+		return t.get_commission_report(stub, caller, caller_affiliation, shopId)
+
+	} else if function == "get_card_details" { 
+		fmt.Printf("exec function:  get_user_detail "); 
+		
+			if len(args) != 2 { fmt.Printf("Incorrect number of arguments passed"); 
+				return nil, errors.New("QUERY: Incorrect number of arguments passed") }
+	
+			v, err := t.retrieve_card(stub, args[1])
+			if err != nil { fmt.Printf("QUERY: Error retrieving v5c: %s", err); 
+				return nil, errors.New("QUERY: Error retrieving v5c "+err.Error()) }
+	
+			return t.get_card_details(stub, v, caller, caller_affiliation)
+			
+	} else if function == "get_card_history" {
+			v, err := t.retrieve_card(stub, args[1])
+			if err != nil { fmt.Printf("QUERY: Error retrieving card: %s", err); 
+				return nil, errors.New("QUERY: Error retrieving card "+err.Error()) }
+
+			return t.get_card_history(stub, v, caller, caller_affiliation)
+
+	} else if function == "get_cards" {
+			return t.get_cards(stub, caller, caller_affiliation)
+
+	} else if function == "get_campaigns" {
+			return t.get_campaigns(stub, caller, caller_affiliation)
+
+	} else if function == "get_pending_transfers" {
+			return t.get_pending_transfers(stub, caller, caller_affiliation)
+
+	} else if function == "get_fraud_flags" {
+			status := ""
+			if len(args) > 1 { status = args[1] }
+			return t.get_fraud_flags(stub, caller, caller_affiliation, status)
+
+	} else if function == "get_disputes" {
+			return t.get_disputes(stub, caller, caller_affiliation)
+
+	} else if function == "get_gifts" {
+			return t.get_gifts(stub, caller, caller_affiliation)
+
+	} else if function == "get_coupons" {
+			return t.get_coupons(stub, caller, caller_affiliation)
+
+	} else if function == "get_card_templates" {
+			return t.get_card_templates(stub, caller, caller_affiliation)
+	} else if function == "get_shop_report" {		//(caller, shopid, periodstart, periodend)
+			return t.get_shop_report(stub, caller, caller_affiliation, args[1], args[2], args[3])
+
+	} else if function == "get_liability_report" {		//(caller)
+			return t.get_liability_report(stub, caller, caller_affiliation)
+
+	} else if function == "get_journal_account" {		//(caller, accountid)
+			return t.get_journal_account(stub, caller, caller_affiliation, args[1])
+
+	} else if function == "get_journal_check" {		//(caller, shopid)
+			return t.get_journal_check(stub, caller, caller_affiliation, args[1])
+
+	} else if function == "get_ledger_statement" {		//(caller, shopid, periodstart, periodend)
+			return t.get_ledger_statement(stub, caller, caller_affiliation, args[1], args[2], args[3])
+
+	} else if function == "get_shopLedger" {
+			shopid := args[1]
+			templateid := args[2]
+			return t.get_shopLedger(stub, caller, caller_affiliation, shopid, templateid)
+	}   
+
+	return nil, errors.New("Received unknown function invocation")
+}
+
+
+//=================================================================================================================================
+//	 Transfer Functions
+//=================================================================================================================================
+//	 authority_to_manufacturer
+//=================================================================================================================================
+/*
+func (t *CardTransactionChaincode) kakacenter_to_shop(stub shim.ChaincodeStubInterface, v Card, caller string, caller_affiliation int, recipient_name string, recipient_affiliation int) ([]byte, error) {
+	
+	if     	v.status				== STATE_TEMPLATE	&&
+			v.owner					== caller			&&
+			caller_affiliation		== KAKACENTER		&&
+			recipient_affiliation	== SHOP				&&
+			v.scrapped				== false			{		// If the roles and users are ok 
+	
+					v.owner  = recipient_name		// then make the owner the new owner
+					v.status = STATE_SHOP			// and mark it in the state of manufacture
+	
+	} else {									// Otherwise if there is an error
+	
+															fmt.Printf("KAKACENTER_TO_SHOP: Permission Denied");
+															return nil, errors.New("Permission Denied")
+	
+	}
+	
+	_, err := t.save_card(stub, v)						// Write new state
+
+															if err != nil {	fmt.Printf("KAKACENTER_TO_SHOP: Error saving changes: %s", err); return nil, errors.New("Error saving changes")	}
+														
+	return nil, nil									// We are Done
+	
+}
+*/
+
+
+//=================================================================================================================================
+//	 card base functions
+//=================================================================================================================================
+//   save_card - Writes to the ledger the Card struct passed in a JSON format. Uses the shim file's 
+//				  method 'PutState'.
+//==============================================================================================================================
+func (t *CardTransactionChaincode) save_template(stub shim.ChaincodeStubInterface, v Card, templateId string) (bool, error) {
+	 
+	bytes, err := json.Marshal(v)
+	if err != nil { fmt.Printf("SAVE_CHANGES: Error converting card card record: %s", err); return false, errors.New("Error converting card record") }
+
+	err = stub.PutState(templateId, bytes)
+	if err != nil { fmt.Printf("SAVE_CHANGES: Error storing  card record: %s", err); return false, errors.New("Error storing card record") }
+
+	return true, nil
+}
+
+//==============================================================================================================================
+// save_card - Writes to the ledger the Card struct passed in a JSON format. Uses the shim file's 
+//				  method 'PutState'.
+//==============================================================================================================================
+func (t *CardTransactionChaincode) save_card(stub shim.ChaincodeStubInterface, v Card) (bool, error) {
+	 
+	bytes, err := json.Marshal(v)
+	if err != nil { fmt.Printf("SAVE_CHANGES: Error converting card card record: %s", err); return false, errors.New("Error converting card record") }
+
+	if( t.checkCardId(v.Cardid) == false ){
+		err = stub.PutState(v.Kakaid, bytes)
+	}else{
+		err = stub.PutState(v.Cardid, bytes)
+	}
+	
+	if err != nil { fmt.Printf("SAVE_CHANGES: Error storing  card record: %s", err); return false, errors.New("Error storing card record") }
+
+	return true, nil
+}
+
+//==============================================================================================================================
+//	 retrieve_card - Gets the state of the data at v5cID in the ledger then converts it from the stored 
+//					JSON into the Card struct for use in the contract. Returns the Card struct.
+//					Returns empty v if it errors.
+//==============================================================================================================================
+func (t *CardTransactionChaincode) retrieve_card(stub shim.ChaincodeStubInterface, cardID string) (Card, error) {
+	
+	var v Card
+
+	bytes, err := stub.GetState(cardID);					
+	if err != nil {	fmt.Printf("RETRIEVE_CARD: Failed to invoke Card_code_cardID: %s", err); return v, errors.New("RETRIEVE_CARD: Error retrieving card with v5cID = " + cardID) }
+
+	err = json.Unmarshal(bytes, &v);						
+	if err != nil {	fmt.Printf("RETRIEVE_CARD: Corrupt card record "+string(bytes)+": %s", err); return v, errors.New("RETRIEVE_CARD: Corrupt card record"+string(bytes))	}
+	
+	return v, nil
+}
+
+//==============================================================================================================================
+//	 Card history
+//==============================================================================================================================
+func (t *CardTransactionChaincode) get_cardHistoryID(cardID string) (string) {
+	return "cardhistory-" + cardID
+}
+
+func (t *CardTransactionChaincode) retrieve_card_history(stub shim.ChaincodeStubInterface, cardID string) (Card_History, error) {
+
+	var history Card_History
+	history.Cardid = cardID
+
+	bytes, err := stub.GetState(t.get_cardHistoryID(cardID))
+	if err != nil { fmt.Printf("RETRIEVE_CARD_HISTORY: %s", err); return history, errors.New("RETRIEVE_CARD_HISTORY: Error retrieving history of card " + cardID) }
+
+	if len(bytes) != 0 {
+		err = json.Unmarshal(bytes, &history)
+		if err != nil { fmt.Printf("RETRIEVE_CARD_HISTORY: Corrupt history record "+string(bytes)+": %s", err); return history, errors.New("RETRIEVE_CARD_HISTORY: Corrupt history record") }
+	}
+	return history, nil
+}
+
+func (t *CardTransactionChaincode) add_card_history(stub shim.ChaincodeStubInterface, cardID string, action string, detail string) ([]byte, error) {
+
+	history, err := t.retrieve_card_history(stub, cardID)
+	if err != nil { return nil, err }
+
+	var event CardEvent
+	event.Action = action
+	event.Detail = detail
+	event.Timestamp, err = t.get_timestamp(stub)
+	if err != nil { return nil, err }
+	history.Events = append(history.Events, event)
+
+	return t.save_card_history(stub, history)
+}
+
+//==============================================================================================================================
+//	 add_card_transaction - logs a deposit or spend in the card history with an event id it can be referenced by
+//==============================================================================================================================
+func (t *CardTransactionChaincode) add_card_transaction(stub shim.ChaincodeStubInterface, card Card, event CardEvent) (string, error) {
+
+	history, err := t.retrieve_card_history(stub, card.Cardid)
+	if err != nil { return "", err }
+
+	event.Detail = t.format_money(event.Money, card.Currency) + " and " + strconv.Itoa(event.Point) + " points at " + event.Shopid
+	event.Timestamp, err = t.get_timestamp(stub)
+	if err != nil { return "", err }
+	event.Eventid = card.Cardid + "-E" + strconv.Itoa(len(history.Events) + 1)
+	history.Events = append(history.Events, event)
+
+	_, err = t.save_card_history(stub, history)
+	if err != nil { return "", err }
+
+	return event.Eventid, nil
+}
+
+func (t *CardTransactionChaincode) save_card_history(stub shim.ChaincodeStubInterface, history Card_History) ([]byte, error) {
+
+	bytes, err := json.Marshal(history)
+	if err != nil { return nil, errors.New("Error converting card history record") }
+
+	err = stub.PutState(t.get_cardHistoryID(history.Cardid), bytes)
+	if err != nil { fmt.Printf("SAVE_CARD_HISTORY: Error storing history: %s", err); return nil, errors.New("Error storing card history") }
+
+	return bytes, nil
+}
+
+//==============================================================================================================================
+//	 Point lots
+//==============================================================================================================================
+func (t *CardTransactionChaincode) get_pointLotsID(cardKey string) (string) {
+	return "pointlots-" + cardKey
+}
+
+//==============================================================================================================================
+//	 retrieve_point_lots - point lots of a card, brought in line with card.Point. Missing points are added as a lot
+//						   without expiry in front, surplus lots are consumed oldest first
+//==============================================================================================================================
+func (t *CardTransactionChaincode) retrieve_point_lots(stub shim.ChaincodeStubInterface, card Card) (Card_PointLots, error) {
+
+	var pointLots Card_PointLots
+
+	bytes, err := stub.GetState(t.get_pointLotsID(t.get_card_key(card)))
+	if err != nil { fmt.Printf("RETRIEVE_POINT_LOTS: %s", err); return pointLots, errors.New("RETRIEVE_POINT_LOTS: Error retrieving point lots of card " + card.Cardid) }
+
+	if len(bytes) != 0 {
+		err = json.Unmarshal(bytes, &pointLots)
+		if err != nil { fmt.Printf("RETRIEVE_POINT_LOTS: Corrupt point lots record "+string(bytes)+": %s", err); return pointLots, errors.New("RETRIEVE_POINT_LOTS: Corrupt point lots record") }
+	}
+	pointLots.Cardid = t.get_card_key(card)
+
+	total := 0
+	for _, lot := range pointLots.Lots {
+		total = total + lot.Points
+	}
+
+	if total < card.Point {
+		var lot PointLot
+		lot.Points = card.Point - total
+		pointLots.Lots = append([]PointLot{lot}, pointLots.Lots...)
+	} else if total > card.Point {
+		pointLots.Lots, _ = t.take_point_lots(pointLots.Lots, total - card.Point)
+	}
+	return pointLots, nil
+}
+
+func (t *CardTransactionChaincode) save_point_lots(stub shim.ChaincodeStubInterface, pointLots Card_PointLots) ([]byte, error) {
+
+	bytes, err := json.Marshal(pointLots)
+	if err != nil { return nil, errors.New("Error converting point lots record") }
+
+	err = stub.PutState(t.get_pointLotsID(pointLots.Cardid), bytes)
+	if err != nil { fmt.Printf("SAVE_POINT_LOTS: Error storing point lots: %s", err); return nil, errors.New("Error storing point lots") }
+
+	return bytes, nil
+}
+
+//==============================================================================================================================
+//	 take_point_lots - takes points from the oldest lots first. Returns the lots left and the lots taken
+//==============================================================================================================================
+func (t *CardTransactionChaincode) take_point_lots(lots []PointLot, points int) ([]PointLot, []PointLot) {
+
+	var taken []PointLot
+	for len(lots) > 0 && points > 0 {
+		lot := lots[0]
+		if lot.Points <= points {
+			taken = append(taken, lot)
+			points = points - lot.Points
+			lots = lots[1:]
+		} else {
+			part := lot
+			part.Points = points
+			taken = append(taken, part)
+			lots[0].Points = lot.Points - points
+			points = 0
+		}
+	}
+	return lots, taken
+}
+
+//==============================================================================================================================
+//	 credit_points - adds points to the card as a new lot expiring after the template's Pointexpiredays
+//==============================================================================================================================
+func (t *CardTransactionChaincode) credit_points(stub shim.ChaincodeStubInterface, template Card, card Card, points int) (Card, error) {
+
+	if points <= 0 { return card, nil }
+
+	now, err := t.get_tx_time(stub)
+	if err != nil { return card, err }
+
+	var lot PointLot
+	lot.Points = points
+	lot.Getdate = now.Format(TIME_FORMAT)
+	if template.Pointexpiredays > 0 {
+		lot.Expdate = now.AddDate(0, 0, template.Pointexpiredays).Format(TIME_FORMAT)
+	}
+	return t.credit_point_lots(stub, card, []PointLot{lot})
+}
+
+//==============================================================================================================================
+//	 credit_point_lots - adds lots taken from another card, they keep their dates
+//==============================================================================================================================
+func (t *CardTransactionChaincode) credit_point_lots(stub shim.ChaincodeStubInterface, card Card, lots []PointLot) (Card, error) {
+
+	pointLots, err := t.retrieve_point_lots(stub, card)
+	if err != nil { return card, err }
+
+	for _, lot := range lots {
+		pointLots.Lots = append(pointLots.Lots, lot)
+		card.Point = card.Point + lot.Points
+	}
+
+	_, err = t.save_point_lots(stub, pointLots)
+	return card, err
+}
+
+//==============================================================================================================================
+//	 debit_points - takes points from the oldest lots of the card first. Returns the lots taken
+//==============================================================================================================================
+func (t *CardTransactionChaincode) debit_points(stub shim.ChaincodeStubInterface, card Card, points int) (Card, []PointLot, error) {
+
+	if points <= 0 { return card, nil, nil }
+	if card.Point < points { return card, nil, errors.New("card asset is not enough") }
+
+	pointLots, err := t.retrieve_point_lots(stub, card)
+	if err != nil { return card, nil, err }
+
+	var taken []PointLot
+	pointLots.Lots, taken = t.take_point_lots(pointLots.Lots, points)
+	card.Point = card.Point - points
+
+	_, err = t.save_point_lots(stub, pointLots)
+	return card, taken, err
+}
+
+//==============================================================================================================================
+//	 get_tx_time - time of the transaction as proposed by the client, the same on every endorsing peer. All dates
+//				   written to the ledger and all expiry decisions use it instead of the clock of the peer, so a
+//				   transaction without a timestamp fails rather than being dated 0001-01-01
+//==============================================================================================================================
+func (t *CardTransactionChaincode) get_tx_time(stub shim.ChaincodeStubInterface) (time.Time, error) {
+
+	ts, err := stub.GetTxTimestamp()
+	if err != nil || ts == nil { return time.Time{}, errors.New("Unable to get the transaction timestamp") }
+	return time.Unix(ts.Seconds, int64(ts.Nanos)), nil
+}
+
+//==============================================================================================================================
+//	 get_timestamp - transaction time in TIME_FORMAT, the format of all dates kept on the ledger
+//==============================================================================================================================
+func (t *CardTransactionChaincode) get_timestamp(stub shim.ChaincodeStubInterface) (string, error) {
+
+	now, err := t.get_tx_time(stub)
+	if err != nil { return "", err }
+	return now.Format(TIME_FORMAT), nil
+}
+
+//==============================================================================================================================
+//	 get_Shopid - Resolves the shop a user works for through the user's Shopid link. Users without link are
+//				  old style shops whose identity is the shop id.
+//==============================================================================================================================
+func (t *CardTransactionChaincode) get_Shopid(stub shim.ChaincodeStubInterface, caller string) (string) {
+
+	user, err := t.get_user_detail_Internal(stub, caller)
+	if err != nil || user.Shopid == "" {
+		return caller
+	}
+	return user.Shopid
+}
+
+//=================================================================================================================================
+//	 Create Function
+//=================================================================================================================================									
+//	 Create Card Template- 								
+//=================================================================================================================================
+
+func (t *CardTransactionChaincode) create_card_template(stub shim.ChaincodeStubInterface, caller string, caller_affiliation int, templateID string) ([]byte, error) {								
+
+	fmt.Printf("start  create_card_template \n ");
+
+	// build Card obejct by json
+	var v Card																																									
+
+	kakaid          := "\"Kakaid\":\""+templateID+"\", "	
+	cardid          := "\"Cardid\":\"\", "							
+	shop            := "\"Shop\":\"\", "
+	shopid          := "\"Shopid\":\"\", "
+	category        := "\"Category\":\"\", "
+	cardlevel       := "\"Cardlevel\":\"\", "
+	cardclass       := "\"Cardclass\":\"\", "
+	owner           := "\"Owner\":\""+caller+"\", "
+	tel             := "\"Tel\":\"\", "
+	password   	    := "\"Password\":\"\", "
+	money           := "\"Money\":0, "
+	currency        := "\"Currency\":\""+DEFAULT_CURRENCY+"\", "
+	point           := "\"Point\":0, "
+	releasedate     := "\"Releasedate\":\"\", "
+	expdate         := "\"Expdate\":\"\", "
+	getdate         := "\"Getdate\":\"\", "
+	expired			:= "\"Expired\":false, "
+	scrapped       	:= "\"Scrapped\":false, "
+	status       	:= "\"Status\":0 "
+
+	card_json := "{"+kakaid+cardid+shop+shopid+category+cardlevel+cardclass+owner+tel+password+money+currency+point+releasedate+expdate+getdate+expired+scrapped+status+"}" 	// Concatenates the variables to create the total JSON object
+	
+	fmt.Printf("test json: %s ",card_json);
+
+	err := json.Unmarshal([]byte(card_json), &v)		//  new card json -> Card Object
+	fmt.Printf("test 04 ");
+		if err != nil { 
+			fmt.Printf("test err is not nil , err is : %s",err);
+			return nil, errors.New("Invalid JSON object") 
+			
+			}
+
+	fmt.Printf("json to card tempalte object ");
+	fmt.Printf("json to card tempalte object :  kakaid = %s", v.Kakaid);
+	fmt.Printf("json to card tempalte object :  cardid = %s", v.Cardid);
+	fmt.Printf("json to card tempalte object :  owner = %s", v.Owner);
+
+	//if auth to create template
+	if 	caller_affiliation != KAKACENTER {							// Only the regulator can create a new v5c
+		return nil, errors.New("Permission Denied")
+	}
+
+	matched, err := regexp.Match("^[A-z][A-z][A-z]", []byte(templateID))  	// 2 char + 5 digits
+		if err != nil  || matched ==false { fmt.Printf("CREATE_CARD: Invalid cardID: %s", err); return nil, errors.New("Invalid v5cID") }
+	
+	fmt.Printf("test 0 : %s",templateID);
+	fmt.Printf("test 0 ");
+	record, err := stub.GetState(templateID) 			// check if card already exists
+	fmt.Printf("test 1 ");
+		if record != nil { return nil, errors.New("Card already exists") }
+	fmt.Printf("test 2 ");
+
+	//save template
+	_, err  = t.save_template(stub, v, templateID)									
+		if err != nil { fmt.Printf("CREATE_CARD_TEMPLATE: Error saving changes: %s", err); 
+						return nil, errors.New("Error saving changes") }
+	
+	fmt.Printf("save tamplate ok");
+
+	//save cardID in CARD_TEMPLATE_HOLDER
+	bytes, err := stub.GetState(CARD_TEMPLATE_HOLDER)
+		if err != nil { return nil, errors.New("Unable to get cardKakaIDs") }
+	
+	fmt.Print("get state this template  : %s", string(bytes))
+																	
+	var card_template_holder Card_Holder
+	
+	if len(bytes)!=0 {
+		fmt.Print(" template holder have data : %s", string(bytes))
+		
+		err = json.Unmarshal(bytes, &card_template_holder)
+		if err != nil {	return nil, errors.New("Corrupt Card_Template_Holder record") }
+	}
+	
+
+	card_template_holder.Cards = append(card_template_holder.Cards, templateID)
+	
+	fmt.Print("Marshal, holder num: %s ", string(len(card_template_holder.Cards)))
+	bytes, err = json.Marshal(card_template_holder)
+		if err != nil { fmt.Print("Error creating Card_Template_Holder record") }
+
+	fmt.Print("put state this template : %s", string(bytes))
+
+	err = stub.PutState(CARD_TEMPLATE_HOLDER, bytes)
+		if err != nil { return nil, errors.New("Unable to put the CARD_TEMPLATE_HOLDER state") }
+	
+	return nil, nil
+
+}
+
+
+//=================================================================================================================================
+//	 transfer temaplte from kakacenter to shop
+//=================================================================================================================================
+func (t *CardTransactionChaincode) transfer_template_to_shop(stub shim.ChaincodeStubInterface, v Card, caller string, caller_affiliation int, recipient_name string, recipient_affiliation int) ([]byte, error) {
+
+
+	if      v.Kakaid	== "" {					//If key part of the card is empty it has not been fully manufacturered so cannot be sent
+					fmt.Printf("SHOP_TO_CONSUMER: Car not fully defined")
+					return nil, errors.New("Car not fully defined")
+	}
+
+	err := t.check_shop_active(stub, t.get_Shopid(stub, recipient_name))
+	if err != nil { return nil, err }
+	
+	if 		v.Status				== STATE_TEMPLATE	&& 
+			v.Owner					== caller		&& 
+			caller_affiliation		== KAKACENTER	&&
+			recipient_affiliation	== SHOP			&& 
+			v.Scrapped     == false							{
+			
+					v.Owner = recipient_name
+					v.Status = STATE_SHOP
+
+					now, err := t.get_tx_time(stub)
+					if err != nil { return nil, err }
+					timestamp := now.Unix()
+					tm := time.Unix(timestamp, 0)
+					v.Releasedate = tm.Format("2006-01-02 03:04:05 PM")  //  str to timestmap: tm2, _ := time.Parse("01/02/2006", releasedate)
+					v.Getdate = v.Releasedate
+	} else {
+															return nil, errors.New("Permission denied")
+	}
+	
+	_, err = t.save_template(stub, v, v.Kakaid)
+	
+															if err != nil { fmt.Printf("SHOP_TO_CONSUMER: Error saving changes: %s", err); return nil, errors.New("Error saving changes") }
+	
+	return nil, nil
+	
+}
+
+
+//=================================================================================================================================									
+//	 Create Card Template  by Shop						
+//=================================================================================================================================
+
+func (t *CardTransactionChaincode) create_card_template_by_shop(stub shim.ChaincodeStubInterface, caller string, caller_affiliation int, templateID string, templateJson string) ([]byte, error) {								
+
+	fmt.Printf("start  create_card_template_by_shop \n ");
+
+	// build Card obejct by json
+	var v Card																																									
+	
+	fmt.Printf("test json: %s ",templateJson);
+
+	err := json.Unmarshal([]byte(templateJson), &v)		//  new card json -> Card Object
+	fmt.Printf("test 04 ");
+		if err != nil { 
+			fmt.Printf("test err is not nil , err is : %s",err);
+			return nil, errors.New("Invalid JSON object") 
+			
+			}
+
+	fmt.Printf("json to card tempalte object ");
+	fmt.Printf("json to card tempalte object :  kakaid = %s", v.Kakaid);
+	fmt.Printf("json to card tempalte object :  cardid = %s", v.Cardid);
+	fmt.Printf("json to card tempalte object :  owner = %s", v.Owner);
+
+	//if auth to create template
+	if 	caller_affiliation != KAKACENTER && caller_affiliation != SHOP{							// Only the regulator can create a new v5c
+		return nil, errors.New("Permission Denied")
+	}
+
+	// only approved shops can own templates
+	if caller_affiliation == SHOP {
+		err = t.check_shop_active(stub, t.get_Shopid(stub, caller))
+		if err != nil { return nil, err }
+	}
+	if v.Shopid != "" {
+		err = t.check_shop_active(stub, v.Shopid)
+		if err != nil { return nil, err }
+	}
+
+	// money of the template and its cards is kept in minor units of its currency
+	if v.Currency == "" { v.Currency = DEFAULT_CURRENCY }
+	err = t.check_currency(v.Currency)
+	if err != nil { return nil, err }
+
+	//matched, err := regexp.Match("^[A-z][A-z][A-z]", []byte(templateID))  	// 2 char + 5 digits
+	//	if err != nil  || matched ==false { fmt.Printf("CREATE_CARD: Invalid cardID: %s", err); return nil, errors.New("Invalid v5cID") }
+	
+	fmt.Printf("test 0 : %s",templateID);
+	record, err := stub.GetState(templateID) 			// check if template already exists
+	fmt.Printf("test 1 ");
+		if record != nil { return nil, errors.New("template already exists") }
+	fmt.Printf("test 2 ");
+
+	//save template
+	_, err  = t.save_template(stub, v, templateID)									
+		if err != nil { fmt.Printf("CREATE_CARD_TEMPLATE: Error saving changes: %s", err); 
+						return nil, errors.New("Error saving changes") }
+	
+	fmt.Printf("save tamplate ok");
+
+	//save cardID in CARD_TEMPLATE_HOLDER
+	bytes, err := stub.GetState(CARD_TEMPLATE_HOLDER)
+		if err != nil { return nil, errors.New("Unable to get cardKakaIDs") }
+	
+	fmt.Print("get state this template  : %s", string(bytes))
+																	
+	var card_template_holder Card_Holder
+	
+	if len(bytes)!=0 {
+		fmt.Print(" template holder have data : %s", string(bytes))
+		
+		err = json.Unmarshal(bytes, &card_template_holder)
+		if err != nil {	return nil, errors.New("Corrupt Card_Template_Holder record") }
+	}
+	
+
+	card_template_holder.Cards = append(card_template_holder.Cards, templateID)
+	
+	fmt.Print("Marshal, holder num: %s ", string(len(card_template_holder.Cards)))
+	bytes, err = json.Marshal(card_template_holder)
+		if err != nil { fmt.Print("Error creating Card_Template_Holder record") }
+
+	fmt.Print("put state this template : %s", string(bytes))
+
+	err = stub.PutState(CARD_TEMPLATE_HOLDER, bytes)
+		if err != nil { return nil, errors.New("Unable to put the CARD_TEMPLATE_HOLDER state") }
+	
+	return nil, nil
+
+}
+
+/*
+func (t *CardTransactionChaincode) update_template(stub shim.ChaincodeStubInterface, caller string, caller_affiliation int,cardTemplateId string, updatedCardJson string)([]byte, error) {
+	
+	if 		v.Status				== STATE_TEMPLATE	&& 
+			v.Owner					== caller		&& 
+			(caller_affiliation		== KAKACENTER || caller_affiliation		== SHOP	) 	&&
+			v.Scrapped     == false							{
+			
+			
+			cardTemplate, err := t.retrieve_card(stub, cardTemplateId)
+		
+				if err != nil {return nil, errors.New("Failed to retrieve V5C")}
+
+			err = json.Unmarshal([]byte(updatedCardJson), &cardTemplate)		//  new card json -> Card Object
+				if err != nil { return nil, errors.New("Invalid JSON object") }
+
+			_, err  = t.save_template(stub, cardTemplate)									
+				if err != nil { fmt.Printf("CREATE_CARD_TEMPLATE: Error saving changes: %s", err); 
+						return nil, errors.New("Error saving changes") }
+	
+	} else {
+															return nil, errors.New("Permission denied")
+	}
+	return nil,nil
+}
+*/
+//=================================================================================================================================
+//	 Template rules - rules kept on the template and applied to the cards issued from it
+//=================================================================================================================================
+//	 strip_template_rules - a new card is a copy of its template, the rules stay on the template only
+//=================================================================================================================================
+func (t *CardTransactionChaincode) strip_template_rules(card Card) (Card) {
+	card.Earnrule = nil
+	card.Tierrules = nil
+	card.Pointexpiredays = 0
+	card.Limits = nil
+	return card
+}
+
+//=================================================================================================================================
+//	 retrieve_template_for_rules - template of the caller's shop whose rules the caller may change
+//=================================================================================================================================
+func (t *CardTransactionChaincode) retrieve_template_for_rules(stub shim.ChaincodeStubInterface, caller string, caller_affiliation int, templateId string) (Card, error) {
+
+	template, err := t.retrieve_card(stub, templateId)
+	if err != nil { return template, errors.New("Failed to retrieve card template: " + templateId) }
+
+	if t.checkCardId(template.Cardid) == true {
+		return template, errors.New(templateId + " is a card, not a template")
+	}
+
+	if caller_affiliation != KAKACENTER {
+		shopid, err := t.check_shop_permission(stub, caller, caller_affiliation, PERM_MANAGE_TEMPLATE)
+		if err != nil { return template, err }
+
+		if template.Shopid != shopid {
+			return template, errors.New("Permission Denied: template " + templateId + " belongs to another shop")
+		}
+	}
+	return template, nil
+}
+
+//=================================================================================================================================
+//	 set_earn_rule - sets the point earning rule of a template, an empty JSON object removes it
+//=================================================================================================================================
+func (t *CardTransactionChaincode) set_earn_rule(stub shim.ChaincodeStubInterface, caller string, caller_affiliation int, templateId string, ruleJson string) ([]byte, error) {
+
+	template, err := t.retrieve_template_for_rules(stub, caller, caller_affiliation, templateId)
+	if err != nil { return nil, err }
+
+	var rule EarnRule
+	err = json.Unmarshal([]byte(ruleJson), &rule)
+	if err != nil { return nil, errors.New("Invalid earn rule JSON object") }
+
+	if rule.Moneyunit < 0 || rule.Points < 0 || rule.Maxpoints < 0 {
+		return nil, errors.New("Invalid earn rule: negative value")
+	}
+	for level, rate := range rule.Levelrates {
+		if rate < 0 { return nil, errors.New("Invalid earn rule: negative rate for level " + level) }
+	}
+
+	if rule.Moneyunit == 0 {
+		template.Earnrule = nil
+	} else {
+		template.Earnrule = &rule
+	}
+
+	_, err = t.save_template(stub, template, templateId)
+	if err != nil { return nil, errors.New("Error saving changes") }
+
+	return nil, nil
+}
+
+//=================================================================================================================================
+//	 set_tier_rules - sets the card level rules of a template from a JSON array, an empty array removes them
+//=================================================================================================================================
+func (t *CardTransactionChaincode) set_tier_rules(stub shim.ChaincodeStubInterface, caller string, caller_affiliation int, templateId string, rulesJson string) ([]byte, error) {
+
+	template, err := t.retrieve_template_for_rules(stub, caller, caller_affiliation, templateId)
+	if err != nil { return nil, err }
+
+	var rules []TierRule
+	err = json.Unmarshal([]byte(rulesJson), &rules)
+	if err != nil { return nil, errors.New("Invalid tier rules JSON array") }
+
+	for _, rule := range rules {
+		if rule.Level == "" || rule.Minspend < 0 || rule.Minpoint < 0 {
+			return nil, errors.New("Invalid tier rule for level: " + rule.Level)
+		}
+	}
+	template.Tierrules = rules
+
+	_, err = t.save_template(stub, template, templateId)
+	if err != nil { return nil, errors.New("Error saving changes") }
+
+	return nil, nil
+}
+
+//=================================================================================================================================
+//	 apply_tier_rules - promotes or demotes the card to the highest level whose rule it meets. A card meeting no
+//						rule falls back to the base level, the level of the template. Level changes are logged in the
+//						card history
+//=================================================================================================================================
+func (t *CardTransactionChaincode) apply_tier_rules(stub shim.ChaincodeStubInterface, template Card, card Card) (Card, error) {
+
+	if len(template.Tierrules) == 0 { return card, nil }
+
+	level := template.Cardlevel
+	for _, rule := range template.Tierrules {
+		if card.Totalspend >= rule.Minspend && card.Point >= rule.Minpoint {
+			level = rule.Level
+		}
+	}
+
+	if level != card.Cardlevel {
+		fmt.Printf("card " + card.Cardid + " level " + card.Cardlevel + " -> " + level)
+		_, err := t.add_card_history(stub, card.Cardid, "cardlevel", card.Cardlevel + " -> " + level)
+		if err != nil { return card, err }
+		card.Cardlevel = level
+	}
+	return card, nil
+}
+
+//=================================================================================================================================
+//	 set_point_expiry - days points earned or deposited on cards of the template stay valid, 0 means forever
+//=================================================================================================================================
+func (t *CardTransactionChaincode) set_point_expiry(stub shim.ChaincodeStubInterface, caller string, caller_affiliation int, templateId string, days int) ([]byte, error) {
+
+	template, err := t.retrieve_template_for_rules(stub, caller, caller_affiliation, templateId)
+	if err != nil { return nil, err }
+
+	if days < 0 { return nil, errors.New("Invalid point expiry days") }
+	template.Pointexpiredays = days
+
+	_, err = t.save_template(stub, template, templateId)
+	if err != nil { return nil, errors.New("Error saving changes") }
+
+	return nil, nil
+}
+
+//=================================================================================================================================
+//	 expire_points - sweeps the cards of a template, removes the overdue point lots and records them as
+//					 breakage in the ShopLedger
+//=================================================================================================================================
+func (t *CardTransactionChaincode) expire_points(stub shim.ChaincodeStubInterface, caller string, caller_affiliation int, templateId string) ([]byte, error) {
+
+	template, err := t.retrieve_template_for_rules(stub, caller, caller_affiliation, templateId)
+	if err != nil { return nil, err }
+
+	shopLedger, err := t.retrieve_shopLedger(stub, template.Shopid, templateId)
+	if err != nil { return nil, err }
+
+	cards, err := t.get_template_cards(stub, templateId)
+	if err != nil { return nil, err }
+
+	now, err := t.get_tx_time(stub)
+	if err != nil { return nil, err }
+	total := 0
+	for _, card := range cards {
+		if card.Scrapped == true || card.Point == 0 { continue }
+
+		pointLots, err := t.retrieve_point_lots(stub, card)
+		if err != nil { return nil, err }
+
+		expired := 0
+		var lots []PointLot
+		for _, lot := range pointLots.Lots {
+			expdate, err := time.Parse(TIME_FORMAT, lot.Expdate)
+			if lot.Expdate != "" && err == nil && expdate.Before(now) {
+				expired = expired + lot.Points
+			} else {
+				lots = append(lots, lot)
+			}
+		}
+		if expired == 0 { continue }
+
+		pointLots.Lots = lots
+		_, err = t.save_point_lots(stub, pointLots)
+		if err != nil { return nil, err }
+
+		_, err = t.post_journal(stub, "point_expiry", card.Cardid, []JournalLine{
+			t.card_line(card, 0, expired),
+			t.shop_line(ACCOUNT_BREAKAGE, card.Shopid, card.Currency, 0, -expired),
+		})
+		if err != nil { return nil, err }
+
+		card.Point = card.Point - expired
+		_, err = t.save_card(stub, card)
+		if err != nil { return nil, err }
+
+		_, err = t.add_card_history(stub, card.Cardid, "point_expiry", strconv.Itoa(expired) + " points expired")
+		if err != nil { return nil, err }
+
+		total = total + expired
+	}
+
+	shopLedger.ExpiredPoint = shopLedger.ExpiredPoint + total
+	_, err = t.update_shopLedger(stub, template.Shopid, templateId, shopLedger)
+	if err != nil { return nil, err }
+
+	fmt.Printf("expire_points " + templateId + ": %d points expired", total)
+	return []byte(strconv.Itoa(total)), nil
+}
+
+//=================================================================================================================================
+//	 calc_earn_points - points earned by spending money with a card of the given level
+//=================================================================================================================================
+func (t *CardTransactionChaincode) calc_earn_points(rule *EarnRule, cardlevel string, money int64) (int) {
+
+	if rule == nil || rule.Moneyunit <= 0 || money <= 0 {
+		return 0
+	}
+
+	points := int(money / rule.Moneyunit) * rule.Points
+	rate, ok := rule.Levelrates[cardlevel]
+	if ok {
+		points = points * rate / 100
+	}
+	if rule.Maxpoints > 0 && points > rule.Maxpoints {
+		points = rule.Maxpoints
+	}
+	return points
+}
+
+//=================================================================================================================================									
+//	 Create Card Template- 								
+//=================================================================================================================================
+func (t *CardTransactionChaincode) generate_card_id(cardTemplate_KakaIDs string, pos int) (string) {
+	basenum := 1000000
+
+	return cardTemplate_KakaIDs + "-" +"A" + strconv.Itoa(basenum + pos)
+}
+
+func (t *CardTransactionChaincode) checkCardId(cardId string) (bool) {
+	return strings.Contains(cardId, "-")
+}
+
+//	get_card_key - key the card is saved under by save_card
+func (t *CardTransactionChaincode) get_card_key(card Card) (string) {
+	if t.checkCardId(card.Cardid) == false {
+		return card.Kakaid
+	}
+	return card.Cardid
+}
+
+func (t *CardTransactionChaincode) create_batch_card_by_template(stub shim.ChaincodeStubInterface, caller string, caller_affiliation int, cardTemplate_KakaIDs string, cardNum int) ([]byte, error) {								
+
+	shopid, err := t.check_shop_permission(stub, caller, caller_affiliation, PERM_ISSUE_CARD)
+	if 	err != nil {							// Only shop staff allowed to issue cards
+		return nil, err
+	}
+
+	//matched, err := regexp.Match("^[A-z][A-z][A-z]", []byte(cardTemplate_KakaIDs))  	// 2 char + 5 digits
+	//	if err != nil   || matched ==false { fmt.Printf("CREATE_CARD: Invalid cardID: %s", err); return nil, errors.New("Invalid v5cID") }
+	
+	cardTemplateBytes, err := stub.GetState(cardTemplate_KakaIDs) 			// check if card template exists
+		if cardTemplateBytes == nil { return nil, errors.New("Card temaplte is not exists") }
+	
+	var cardTemplate Card	
+		err = json.Unmarshal(cardTemplateBytes, &cardTemplate)		//  new card json -> Card Object
+			if err != nil { return nil, errors.New("------------Invalid cardTemplateBytes JSON object") }
+
+	
+	if 		cardTemplate.Shopid 	 	== "" || 					
+			cardTemplate.Shop  			== "" || 
+			cardTemplate.Cardclass 		== "" || 
+			cardTemplate.Expdate		 == ""  {					//If key part of the card is empty it has not been fully manufacturered so cannot be sent
+															fmt.Printf("SHOP_TO_CONSUMER: Car template not fully defined")
+															return nil, errors.New("Car template not fully defined")
+	}
+
+	if cardTemplate.Shopid != shopid {
+		return nil, errors.New("Permission Denied: template " + cardTemplate_KakaIDs + " belongs to another shop")
+	}
+
+	err = t.check_shop_active(stub, shopid)
+	if err != nil { return nil, err }
+	
+	// create new Card by template
+	//var card Card	
+	//err = json.Unmarshal(cardTemplateBytes, &card)		//  new card json -> Card Object
+	//	if err != nil { return nil, errors.New("Invalid JSON object") }
+
+
+	//once create new card, create or update shop ledger, 
+	var	shopLedger ShopLedger
+	shopLedgerBytes ,err := t.get_shopLedger_internal(stub,  shopid, cardTemplate_KakaIDs)
+	if shopLedgerBytes == nil {
+		shopLedgerBytes ,err = t.add_new_shopLedger(stub, shopid, cardTemplate_KakaIDs)
+	}
+
+	err = json.Unmarshal([]byte(shopLedgerBytes), &shopLedger)	
+	if err != nil { return nil, errors.New("------------Invalid shopLedgerBytes JSON object") }
+
+
+	// get Card_Holder
+	var card_holder Card_Holder
+	bytes, err := stub.GetState(CARD_HOLDER)
+		if err != nil { return nil, errors.New("Unable to get cardKakaIDs") }	
+
+	if len(bytes) != 0 {
+		err = json.Unmarshal(bytes, &card_holder)
+		if err != nil {	return nil, errors.New("Corrupt Card_Template_Holder record") }
+	}															
+	
+
+	// value the cards are issued with
+	issueLines := []JournalLine{}
+	for cardindex := shopLedger.CardIdIndex;  cardindex < shopLedger.CardIdIndex + cardNum ;cardindex++ {
+		//create new card from template
+		var card Card	
+		err = json.Unmarshal(cardTemplateBytes, &card)		//  new card json -> Card Object
+			if err != nil { return nil, errors.New("Invalid JSON object") }
+
+		//err = json.Unmarshal(cardTemplateBytes, &card)		//  new card json -> Card Object
+		//	if err != nil { return nil, errors.New("Invalid JSON object") }
+		card.Cardid = t.generate_card_id(cardTemplate_KakaIDs, cardindex + 1 )
+
+		fmt.Printf("CREATE_CARD cardid:  %s", card.Cardid);
+		card.Kakaid 		 = 	cardTemplate_KakaIDs	
+		card = t.strip_template_rules(card)
+		fmt.Printf("CREATE_CARD Kakaid: %s", card.Kakaid);
+
+		//save card to state
+		_, err  = t.save_card(stub, card)									
+		if err != nil { fmt.Printf("CREATE_CARD_TEMPLATE: Error saving changes: %s", err); 
+						return nil, errors.New("Error saving changes") }
+		
+		//add to card_holder
+		card_holder.Cards = append(card_holder.Cards, card.Cardid)
+		fmt.Printf("Append 1 cardid  \n");
+		issueLines = append(issueLines, t.card_line(card, -card.Money, -card.Point))
+	}
+
+	issueLines = append(issueLines, t.shop_line(ACCOUNT_SHOP_CASH, cardTemplate.Shopid, cardTemplate.Currency, cardTemplate.Money * int64(cardNum), 0))
+	issueLines = append(issueLines, t.shop_line(ACCOUNT_PROMOTION, cardTemplate.Shopid, cardTemplate.Currency, 0, cardTemplate.Point * cardNum))
+	_, err = t.post_journal(stub, "issue", cardTemplate_KakaIDs, issueLines)
+	if err != nil { return nil, err }
+	fmt.Printf("Marshal card holder to bytes");
+	//save cardIDs in CARD_HOLDER
+	bytes, err = json.Marshal(card_holder)
+		if err != nil { fmt.Print("Error creating Card_Holder record") }
+
+	fmt.Printf("PutState card to card_holder");
+	err = stub.PutState(CARD_HOLDER, bytes)
+		if err != nil { return nil, errors.New("Unable to put the CARD_HOLDER state") }
+	fmt.Printf("PutState ok");
+
+
+	//update shop ledger
+	shopLedger.Shopid = shopid 
+	shopLedger.Qty = shopLedger.Qty + cardNum
+	shopLedger.CardIdIndex = shopLedger.CardIdIndex + cardNum
+	shopLedger.InitMoney = shopLedger.InitMoney + cardTemplate.Money * int64(cardNum)
+	shopLedger.InitPoint = shopLedger.InitPoint + cardTemplate.Point * cardNum
+	_, err = t.update_shopLedger(stub, caller, cardTemplate_KakaIDs, shopLedger)
+	if err != nil { return nil, err }
+
+	fmt.Printf("Put ShopLedger ok");
+
+	return nil, nil
+
+}
+
+//=================================================================================================================================
+//	 manufacturer_to_private
+//=================================================================================================================================
+
+func (t *CardTransactionChaincode) request_card_by_template(stub shim.ChaincodeStubInterface, caller string, caller_affiliation int, cardTemplate_KakaIDs string) ([]byte, error) {								
+	if 	caller_affiliation !=  CONSUMER {							// Only the regulator can create a new v5c
+		return nil, errors.New("Permission Denied")
+	}
+	return t.new_card_by_template(stub, caller, cardTemplate_KakaIDs)
+}
+
+func (t *CardTransactionChaincode) push_card_by_template(stub shim.ChaincodeStubInterface, caller string, caller_affiliation int, ownerId string, cardTemplate_KakaIDs string) ([]byte, error) {								
+	shopid, err := t.check_shop_permission(stub, caller, caller_affiliation, PERM_ISSUE_CARD)
+	if 	err != nil {							// Only shop staff allowed to issue cards
+		return nil, err
+	}
+
+	template, err := t.retrieve_card(stub, cardTemplate_KakaIDs)
+		if err != nil { return nil, errors.New("Card temaplte is not exists") }
+	if template.Shopid != shopid {
+		return nil, errors.New("Permission Denied: template " + cardTemplate_KakaIDs + " belongs to another shop")
+	}
+	return t.new_card_by_template(stub, ownerId,cardTemplate_KakaIDs)
+}
+
+func (t *CardTransactionChaincode) new_card_by_template(stub shim.ChaincodeStubInterface,  ownerId string , cardTemplate_KakaIDs string) ([]byte, error) {								
+	return t.new_card_by_template_internal(stub, ownerId, cardTemplate_KakaIDs, true)
+}
+
+//=================================================================================================================================
+//	 new_card_by_template_internal - mints a card of the template for ownerId. Without initValue the card starts empty
+//									 instead of with the template's money and points
+//=================================================================================================================================
+func (t *CardTransactionChaincode) new_card_by_template_internal(stub shim.ChaincodeStubInterface,  ownerId string , cardTemplate_KakaIDs string, initValue bool) ([]byte, error) {								
+
+	
+	//matched, err := regexp.Match("^[A-z][A-z][A-z]", []byte(cardTemplate_KakaIDs))  	// 2 char + 5 digits
+	//	if err != nil   || matched ==false { fmt.Printf("CREATE_CARD: Invalid cardID: %s", err); return nil, errors.New("Invalid v5cID") }
+	
+	cardTemplateBytes, err := stub.GetState(cardTemplate_KakaIDs) 			// check if card template exists
+		if cardTemplateBytes == nil { return nil, errors.New("Card temaplte is not exists") }
+	var template Card
+	err = json.Unmarshal(cardTemplateBytes, &template)	
+	if err != nil { return nil, errors.New("------------Invalid template JSON object") }
+
+	err = t.check_shop_active(stub, template.Shopid)
+	if err != nil { return nil, err }
+
+
+	//once create new card, create or update shop ledger, 
+	var	shopLedger ShopLedger
+	//shopid := t.get_Shopid(stub, caller)
+	shopid := template.Shopid
+	shopLedgerBytes ,err := t.get_shopLedger_internal(stub, shopid, cardTemplate_KakaIDs)
+	if shopLedgerBytes == nil {
+		shopLedgerBytes ,err = t.add_new_shopLedger(stub, shopid, cardTemplate_KakaIDs)
+	}
+
+	err = json.Unmarshal([]byte(shopLedgerBytes), &shopLedger)	
+	if err != nil { return nil, errors.New("------------Invalid shopLedgerBytes JSON object") }
+
+
+	// get Card_Holder
+	var card_holder Card_Holder
+	bytes, err := stub.GetState(CARD_HOLDER)
+		if err != nil { return nil, errors.New("Unable to get cardKakaIDs") }	
+
+	if len(bytes) != 0 {
+		err = json.Unmarshal(bytes, &card_holder)
+		if err != nil {	return nil, errors.New("Corrupt Card_Template_Holder record") }
+	}															
+	
+
+	//create new card from template
+	var card Card	
+	err = json.Unmarshal(cardTemplateBytes, &card)		//  new card json -> Card Object
+		if err != nil { return nil, errors.New("Invalid JSON object") }
+
+	//err = json.Unmarshal(cardTemplateBytes, &card)		//  new card json -> Card Object
+	//	if err != nil { return nil, errors.New("Invalid JSON object") }
+	card.Cardid = t.generate_card_id(cardTemplate_KakaIDs, shopLedger.CardIdIndex + 1 )
+
+	fmt.Printf("CREATE_CARD cardid:  %s", card.Cardid);
+	card.Kakaid 		 = 	cardTemplate_KakaIDs	
+	fmt.Printf("CREATE_CARD Kakaid: %s", card.Kakaid);
+	card = t.strip_template_rules(card)
+	if initValue == false {
+		card.Money = 0
+		card.Point = 0
+	}
+
+	card.Owner = ownerId
+	card.Status = STATE_CONSUMER_OWNERSHIP
+
+	now, err := t.get_tx_time(stub)
+	if err != nil { return nil, err }
+	timestamp := now.Unix()
+	tm := time.Unix(timestamp, 0)
+	card.Releasedate = tm.Format("2006-01-02 03:04:05 PM")  //  str to timestmap: tm2, _ := time.Parse("01/02/2006", releasedate)
+	card.Getdate = card.Releasedate
+
+	
+	//save card to state
+	_, err  = t.save_card(stub, card)									
+	if err != nil { fmt.Printf("CREATE_CARD_TEMPLATE: Error saving changes: %s", err); 
+					return nil, errors.New("Error saving changes") }
+
+	_, err = t.post_journal(stub, "issue", card.Cardid, []JournalLine{
+		t.card_line(card, -card.Money, -card.Point),
+		t.shop_line(ACCOUNT_SHOP_CASH, shopid, card.Currency, card.Money, 0),
+		t.shop_line(ACCOUNT_PROMOTION, shopid, card.Currency, 0, card.Point),
+	})
+	if err != nil { return nil, err }
+	
+	//add to card_holder
+	card_holder.Cards = append(card_holder.Cards, card.Cardid)
+
+	fmt.Printf("Marshal card holder to bytes");
+	//save cardIDs in CARD_HOLDER
+	bytes, err = json.Marshal(card_holder)
+		if err != nil { fmt.Print("Error creating Card_Holder record") }
+
+	fmt.Printf("PutState card to card_holder");
+	err = stub.PutState(CARD_HOLDER, bytes)
+		if err != nil { return nil, errors.New("Unable to put the CARD_HOLDER state") }
+	fmt.Printf("PutState ok");
+
+
+	//update shop ledger
+	shopLedger.Shopid = shopid
+	shopLedger.Qty = shopLedger.Qty + 1
+	shopLedger.CardIdIndex = shopLedger.CardIdIndex + 1
+	shopLedger.InitMoney = shopLedger.InitMoney + card.Money
+	shopLedger.InitPoint = shopLedger.InitPoint + card.Point
+	_, err = t.update_shopLedger(stub, shopid, cardTemplate_KakaIDs, shopLedger)
+	if err != nil { return nil, err }
+
+	fmt.Printf("Put ShopLedger ok");
+
+	return []byte(card.Cardid), nil
+
+}
+
+//=================================================================================================================================
+//	 manufacturer_to_private
+//=================================================================================================================================
+func (t *CardTransactionChaincode) transfer_card_shop_to_consumer(stub shim.ChaincodeStubInterface, v Card, caller string, caller_affiliation int, recipient_name string, recipient_affiliation int) ([]byte, error) {
+
+
+	if 		v.Shop 	 	== "" || 					
+			v.Cardid  	== "" || 
+			v.Cardlevel == "" || 
+			v.Cardclass == "" || 
+			v.Expdate == ""  {					//If key part of the card is empty it has not been fully manufacturered so cannot be sent
+															fmt.Printf("SHOP_TO_CONSUMER: Car not fully defined")
+															return nil, errors.New("Car not fully defined")
+	}
+	
+	shopid, permErr := t.check_shop_permission(stub, caller, caller_affiliation, PERM_ISSUE_CARD)
+	if permErr == nil {
+		permErr = t.check_shop_active(stub, v.Shopid)
+		if permErr != nil { return nil, permErr }
+	}
+
+	if 		v.Status				== STATE_SHOP	&& 
+			(v.Owner == caller || v.Owner == shopid)	&& 
+			permErr					== nil			&&
+			recipient_affiliation	== CONSUMER		&& 
+			v.Scrapped     == false							{
+			
+					v.Owner = recipient_name
+					v.Status = STATE_CONSUMER_OWNERSHIP
+
+					now, err := t.get_tx_time(stub)
+					if err != nil { return nil, err }
+					timestamp := now.Unix()
+					tm := time.Unix(timestamp, 0)
+					v.Releasedate = tm.Format("2006-01-02 03:04:05 PM")  //  str to timestmap: tm2, _ := time.Parse("01/02/2006", releasedate)
+					v.Getdate = v.Releasedate
+	} else {
+															return nil, errors.New("Permission denied")
+	}
+	
+	_, err := t.save_card(stub, v)
+	
+															if err != nil { fmt.Printf("SHOP_TO_CONSUMER: Error saving changes: %s", err); return nil, errors.New("Error saving changes") }
+	
+	return nil, nil
+	
+}
+
+//=================================================================================================================================
+//	 private_to_private
+//=================================================================================================================================
+func (t *CardTransactionChaincode) transfer_card_consumer_to_consumer(stub shim.ChaincodeStubInterface, v Card, caller string, caller_affiliation int, recipient_name string, recipient_affiliation int) ([]byte, error) {
+	
+
+	if 		v.Status				== STATE_CONSUMER_OWNERSHIP	&&
+			v.Owner					== caller					&&
+			caller_affiliation		== CONSUMER			&& 
+			recipient_affiliation	== CONSUMER			&&
+			v.Scrapped				== false					{
+			
+					v.Owner = recipient_name
+					now, err := t.get_tx_time(stub)
+					if err != nil { return nil, err }
+					timestamp := now.Unix()
+					tm := time.Unix(timestamp, 0)
+					v.Getdate = tm.Format("2006-01-02 03:04:05 PM")  //  str to timestmap: tm2, _ := time.Parse("01/02/2006", releasedate)
+					
+					
+	} else {
+		
+															return nil, errors.New("Permission denied")
+	
+	}
+	
+	_, err := t.save_card(stub, v)
+	
+															if err != nil { fmt.Printf("CONSUMER_TO_CONSUMER: Error saving changes: %s", err); return nil, errors.New("Error saving changes") }
+	
+	return nil, nil
+	
+}
+
+//=================================================================================================================================
+//	 private_to_lease_company
+//=================================================================================================================================
+func (t *CardTransactionChaincode) transfer_card_consumer_to_shop(stub shim.ChaincodeStubInterface, v Card, caller string, caller_affiliation int, recipient_name string, recipient_affiliation int) ([]byte, error) {
+
+	if 		v.Status				== STATE_CONSUMER_OWNERSHIP	&& 
+			v.Owner					== caller					&& 
+			caller_affiliation		== CONSUMER					&& 
+			recipient_affiliation	== SHOP						&& 
+			v.Scrapped     			== false					{
+		
+					v.Owner = recipient_name
+					now, err := t.get_tx_time(stub)
+					if err != nil { return nil, err }
+					timestamp := now.Unix()
+					tm := time.Unix(timestamp, 0)
+					v.Getdate = tm.Format("2006-01-02 03:04:05 PM")  //  str to timestmap: tm2, _ := time.Parse("01/02/2006", releasedate)
+					
+					
+	} else {
+															return nil, errors.New("Permission denied")
+	}
+	
+	_, err := t.save_card(stub, v)
+															if err != nil { fmt.Printf("consumer_identityCard_to_shop: Error saving changes: %s", err); return nil, errors.New("Error saving changes") }
+	
+	return nil, nil
+	
+}
+
+
+func (t *CardTransactionChaincode) transfer_mp_shop_to_consumer(stub shim.ChaincodeStubInterface, money int64, point int, caller string, sc Card, receiver string, tc Card) ([]byte, error) {
+
+		return nil, errors.New("not implemented")
+}
+
+func (t *CardTransactionChaincode) transfer_mp_consumer_to_shop(stub shim.ChaincodeStubInterface, money int64, point int, caller string, sc Card, receiver string, tc Card) ([]byte, error) {
+
+		return nil, errors.New("not implemented")
+}
+//=================================================================================================================================
+//	 Transfer Functions
+//=================================================================================================================================
+//	 transfer_mp_consumer_to_consumer
+//=================================================================================================================================
+func (t *CardTransactionChaincode) transfer_mp_consumer_to_consumer(stub shim.ChaincodeStubInterface, money int64, point int, caller string, sc Card, receiver string, tc Card) ([]byte, error) {
+fmt.Printf("start transfer_mp_consumer_to_consumer")
+	if sc.Money < money || sc.Point < point{
+		fmt.Printf("money or point is not enough")
+		return nil, errors.New("card asset is not enough")
+	}
+fmt.Printf("test 1")
+	caller_affiliation , _ := t.check_affiliation(stub, caller)
+	fmt.Printf("test 2")
+	receiver_affiliation , _ := t.check_affiliation(stub, receiver)
+	fmt.Printf("test 3")
+
+	if money != 0 && sc.Currency != tc.Currency {
+		return nil, errors.New("cannot transfer " + sc.Currency + " money to a " + tc.Currency + " card")
+	}
+
+	if sc.Shopid != tc.Shopid && money != 0 {
+		return nil, errors.New("only points can be transferred to a card of an allied shop")
+	}
+
+	if		sc.Status				== STATE_CONSUMER_OWNERSHIP	&&
+			sc.Owner  				== caller					&& 
+			sc.Scrapped  			== false					&& 
+			sc.Expired  			== false					&& 
+			sc.Frozen  				== false					&& 
+
+			tc.Status				== STATE_CONSUMER_OWNERSHIP	&&
+			tc.Owner  				== receiver					&& 
+			tc.Scrapped  			== false					&& 
+			tc.Expired  			== false					&&
+			tc.Frozen  				== false					&&
+
+			caller_affiliation		== CONSUMER			&& 
+			receiver_affiliation	== CONSUMER			{
+		
+				fmt.Printf("add and substract")
+				tc.Money = tc.Money + money
+				sc.Money = sc.Money - money
+				//add event to triger the shop db update
+	
+	} else {
+			fmt.Printf("Permission denied----------------------------")
+			return nil, errors.New("Permission denied")
+	}
+
+	_, err := t.count_spend_limits(stub, sc, money)
+	if err != nil { return nil, err }
+
+	// points move with their lots, so they keep their expiry
+	sc, lots, err := t.debit_points(stub, sc, point)
+	if err != nil { return nil, err }
+
+	tc, converted, err := t.credit_transferred_points(stub, sc, tc, point, lots)
+	if err != nil { return nil, err }
+
+	_, err = t.post_template_transfer(stub, sc, tc, money, point, converted)
+	if err != nil { return nil, err }
+
+	_, err = t.post_journal(stub, "transfer", sc.Cardid + " " + tc.Cardid, t.card_to_card_lines(sc, tc, money, point, converted))
+	if err != nil { return nil, err }
+
+	sc, err = t.record_card_activity(stub, sc, ACTIVITY_TRANSFER_OUT, receiver, money, point)
+	if err != nil { return nil, err }
+	tc, err = t.record_card_activity(stub, tc, ACTIVITY_TRANSFER_IN, caller, money, point)
+	if err != nil { return nil, err }
+	
+	fmt.Printf("---------------save_card sc---------------------------")
+    _, err1 := t.save_card(stub, sc)
+   fmt.Printf("---------------save_card tc---------------------------")
+    _, err2 := t.save_card(stub, tc)
+		fmt.Printf("---------------save_card ok---------------------------")		
+		if err1 != nil || err2 != nil { fmt.Printf("transactionCard_consumer_to_consumer: Error saving changes: %s", err1); return nil, errors.New("Error saving changes") }
+	
+	return nil, nil
+	
+}
+
+//=================================================================================================================================
+//	 post_template_transfer - books money and points moving from a card of one template to a card of another on the
+//							  shop ledgers of both templates. converted is what tc got for point
+//=================================================================================================================================
+func (t *CardTransactionChaincode) post_template_transfer(stub shim.ChaincodeStubInterface, sc Card, tc Card, money int64, point int, converted int) ([]byte, error) {
+
+	if sc.Kakaid == tc.Kakaid { return nil, nil }
+
+	sLedger, err := t.retrieve_shopLedger(stub, sc.Shopid, sc.Kakaid)
+	if err != nil { return nil, err }
+	sLedger.TransferOutMoney = sLedger.TransferOutMoney + money
+	sLedger.TransferOutPoint = sLedger.TransferOutPoint + point
+	_, err = t.update_shopLedger(stub, sc.Shopid, sc.Kakaid, sLedger)
+	if err != nil { return nil, err }
+
+	tLedger, err := t.retrieve_shopLedger(stub, tc.Shopid, tc.Kakaid)
+	if err != nil { return nil, err }
+	tLedger.TransferInMoney = tLedger.TransferInMoney + money
+	tLedger.TransferInPoint = tLedger.TransferInPoint + converted
+	return t.update_shopLedger(stub, tc.Shopid, tc.Kakaid, tLedger)
+}
+
+//=================================================================================================================================
+//	 credit_transferred_points - credits points debited from sc with their lots to tc. Points going to a card of an
+//								 allied shop are converted at the alliance rates and cleared between the shops.
+//								 Returns tc and the points it got
+//=================================================================================================================================
+func (t *CardTransactionChaincode) credit_transferred_points(stub shim.ChaincodeStubInterface, sc Card, tc Card, point int, lots []PointLot) (Card, int, error) {
+
+	if tc.Shopid == sc.Shopid {
+		tc, err := t.credit_point_lots(stub, tc, lots)
+		return tc, point, err
+	}
+
+	alliance, err := t.find_alliance(stub, sc.Shopid, tc.Shopid)
+	if err != nil { return tc, 0, err }
+
+	ttemplate, err := t.retrieve_card(stub, tc.Kakaid)
+	if err != nil { return tc, 0, errors.New("Failed to retrieve card template: " + tc.Kakaid) }
+
+	converted, err := t.convert_alliance_points(alliance, sc.Shopid, tc.Shopid, point)
+	if err != nil { return tc, 0, err }
+	tc, err = t.credit_points(stub, ttemplate, tc, converted)
+	if err != nil { return tc, 0, err }
+
+	_, err = t.post_clearing(stub, alliance, sc.Shopid, tc.Shopid, point * alliance.Rates[sc.Shopid])
+	if err != nil { return tc, 0, err }
+
+	return tc, converted, nil
+}
+
+
+//=================================================================================================================================
+//	 deposit_mp_shop_to_consumer
+//=================================================================================================================================
+func (t *CardTransactionChaincode) deposit_mp_shop_to_consumer(stub shim.ChaincodeStubInterface, money int64, point int, caller string, receiver string, tc Card) ([]byte, error) {
+
+	fmt.Printf("start deposit_mp_shop_to_consumer")
+
+	caller_affiliation , _ := t.check_affiliation(stub, caller)
+	receiver_affiliation , _ := t.check_affiliation(stub, receiver)
+	fmt.Printf("test 3")
+
+	shopid, err := t.check_shop_permission(stub, caller, caller_affiliation, PERM_DEPOSIT)
+	if err != nil { return nil, err }
+
+	err = t.check_shop_active(stub, shopid)			// no deposits to suspended shops
+	if err != nil { return nil, err }
+	// update shop ledger, 
+			var	shopLedger ShopLedger
+			shopLedgerBytes ,err := t.get_shopLedger_internal(stub, shopid, tc.Kakaid)
+			if shopLedgerBytes == nil {
+				fmt.Printf("Permission denied----------------------------")
+					return nil, errors.New("Permission denied")
+			}
+
+			err = json.Unmarshal([]byte(shopLedgerBytes), &shopLedger)	
+			if err != nil { return nil, errors.New("------------Invalid shopLedgerBytes JSON object") }
+
+
+
+	if		tc.Status				== STATE_CONSUMER_OWNERSHIP	&&
+			tc.Owner  				== receiver					&& 
+			tc.Scrapped  			== false					&& 
+			tc.Expired  			== false					&&
+
+			tc.Shopid 				== shopLedger.Shopid 			&&
+
+			caller_affiliation		== SHOP			&& 
+			receiver_affiliation	== CONSUMER			{
+		
+				fmt.Printf("add and substract")
+				tc.Money = tc.Money + money
+	} else {
+			fmt.Printf("Permission denied----------------------------")
+			return nil, errors.New("Permission denied")
+	}
+
+	template, err := t.retrieve_card(stub, tc.Kakaid)
+	if err != nil { return nil, errors.New("Failed to retrieve card template: " + tc.Kakaid) }
+
+	tc, err = t.credit_points(stub, template, tc, point)
+	if err != nil { return nil, err }
+
+	tc, bonusMoney, bonusPoint, err := t.apply_campaigns(stub, CAMPAIGN_DEPOSIT, template, tc, money)
+	if err != nil { return nil, err }
+
+	tc, err = t.apply_tier_rules(stub, template, tc)
+	if err != nil { return nil, err }
+
+	tc, err = t.record_card_activity(stub, tc, ACTIVITY_DEPOSIT, shopid, money, point)
+	if err != nil { return nil, err }
+
+	eventId, err := t.add_card_transaction(stub, tc, CardEvent{ Action: ACTIVITY_DEPOSIT, Shopid: shopid, Money: money, Point: point })
+	if err != nil { return nil, err }
+
+	_, err = t.post_journal(stub, ACTIVITY_DEPOSIT, eventId, []JournalLine{
+		t.card_line(tc, -money - bonusMoney, -point - bonusPoint),
+		t.shop_line(ACCOUNT_SHOP_CASH, shopid, tc.Currency, money, 0),
+		t.shop_line(ACCOUNT_PROMOTION, shopid, tc.Currency, bonusMoney, point + bonusPoint),
+	})
+	if err != nil { return nil, err }
+
+   fmt.Printf("---------------save_card tc---------------------------")
+    _, err = t.save_card(stub, tc)
+
+	//save shop ledger
+			shopLedger.DepositMoney = shopLedger.DepositMoney + money
+			shopLedger.DepositPoint = shopLedger.DepositPoint + point
+			shopLedger.BonusMoney = shopLedger.BonusMoney + bonusMoney
+			shopLedger.BonusPoint = shopLedger.BonusPoint + bonusPoint
+			_, lerr := t.update_shopLedger(stub, shopid, tc.Kakaid, shopLedger)
+			if lerr != nil { return nil, lerr }
+
+			fmt.Printf("Put ShopLedger ok");
+
+		fmt.Printf("---------------save_card ok---------------------------")		
+		if err != nil  { fmt.Printf("transactionCard_consumer_to_consumer: Error saving changes: %s", err); return nil, errors.New("Error saving changes") }
+	
+	return nil, nil
+	
+}
+
+//=================================================================================================================================
+//	 spend_mp_consumer_to_consumer
+//=================================================================================================================================
+func (t *CardTransactionChaincode) spend_mp_consumer_to_shop(stub shim.ChaincodeStubInterface, money int64, point int, caller string, sc Card, shopid string) ([]byte, error) {
+	
+	fmt.Printf("start spend_mp_consumer_to_consumer")
+	if sc.Money + sc.Bonusmoney < money || sc.Point < point{
+		fmt.Printf("money or point is not enough")
+		return nil, errors.New("card asset is not enough")
+	}
+
+// update shop ledger of the card, spent at its own shop or at an allied shop
+			var	shopLedger ShopLedger
+			shopLedgerBytes ,err := t.get_shopLedger_internal(stub, sc.Shopid, sc.Kakaid)
+			if shopLedgerBytes == nil {
+				fmt.Printf("pay to wrong shop ,please check shop name--")
+					return nil, errors.New("pay to wrong shop ,please check shop name ")
+			}
+
+			err = json.Unmarshal([]byte(shopLedgerBytes), &shopLedger)	
+			if err != nil { return nil, errors.New("------------Invalid shopLedgerBytes JSON object") }
+
+	err = t.check_shop_open(stub, shopid)			// cards of suspended shops can still be spent down
+	if err != nil { return nil, err }
+
+	// points of a card from an allied shop, their value is cleared between the shops
+	var alliance Alliance
+	crossShop := shopid != sc.Shopid
+	if crossShop {
+		alliance, err = t.find_alliance(stub, sc.Shopid, shopid)
+		if err != nil { return nil, err }
+		if money != 0 { return nil, errors.New("only points can be spent at an allied shop") }
+	}
+
+	template, err := t.retrieve_card(stub, sc.Kakaid)
+	if err != nil { return nil, errors.New("Failed to retrieve card template: " + sc.Kakaid) }
+
+
+	fmt.Printf("test 1")
+	caller_affiliation , _ := t.check_affiliation(stub, caller)
+	fmt.Printf("test 3")
+
+			
+
+	if		sc.Status				== STATE_CONSUMER_OWNERSHIP	&&
+			sc.Owner  				== caller					&& 
+			sc.Scrapped  			== false					&& 
+			sc.Expired  			== false					&& 
+			sc.Frozen  				== false					&& 
+
+			sc.Shopid 				== shopLedger.Shopid 			&&
+
+			caller_affiliation		== CONSUMER		{
+		
+				fmt.Printf("add and substract")
+	} else {
+			fmt.Printf("Permission denied----------------------------")
+			return nil, errors.New("Permission denied")
+	}
+
+	_, err = t.count_spend_limits(stub, sc, money)
+	if err != nil { return nil, err }
+
+	// principal is spent first, then campaign bonus
+	principal := money
+	if principal > sc.Money { principal = sc.Money }
+	bonusSpent := money - principal
+	sc.Money = sc.Money - principal
+	sc.Bonusmoney = sc.Bonusmoney - bonusSpent
+
+	sc, _, err = t.debit_points(stub, sc, point)
+	if err != nil { return nil, err }
+	
+	// points earned by this spend
+	earned := t.calc_earn_points(template.Earnrule, sc.Cardlevel, money)
+	sc, err = t.credit_points(stub, template, sc, earned)
+	if err != nil { return nil, err }
+	sc.Totalspend = sc.Totalspend + money
+
+	var bonusMoney int64
+	bonusPoint := 0
+	if crossShop == false {
+		// spent campaign bonus does not earn more bonus
+		sc, bonusMoney, bonusPoint, err = t.apply_campaigns(stub, CAMPAIGN_SPEND, template, sc, principal)
+		if err != nil { return nil, err }
+	}
+
+	sc, err = t.apply_tier_rules(stub, template, sc)
+	if err != nil { return nil, err }
+
+	if crossShop {
+		_, err = t.post_clearing(stub, alliance, sc.Shopid, shopid, point * alliance.Rates[sc.Shopid])
+		if err != nil { return nil, err }
+	}
+
+	// KAKACENTER commission, a template rule only applies at the template's own shop
+	commissionTemplate := sc.Kakaid
+	if crossShop { commissionTemplate = "" }
+	commission, err := t.charge_commission(stub, commissionTemplate, shopid, principal, sc.Currency)
+	if err != nil { return nil, err }
+
+	sc, err = t.record_card_activity(stub, sc, ACTIVITY_SPEND, shopid, money, point)
+	if err != nil { return nil, err }
+
+	// returned to reference the spend in a dispute, which reverses each part of it
+	eventId, err := t.add_card_transaction(stub, sc, CardEvent{ Action: ACTIVITY_SPEND, Shopid: shopid, Money: money, Point: point,
+		Principal: principal, Bonusspent: bonusSpent, Earnpoint: earned, Bonusmoney: bonusMoney, Bonuspoint: bonusPoint, Commission: commission })
+	if err != nil { return nil, err }
+
+	// spent points go back to the spending shop, earned and bonus points come from the card's shop
+	_, err = t.post_journal(stub, ACTIVITY_SPEND, eventId, []JournalLine{
+		t.card_line(sc, money - bonusMoney, point - earned - bonusPoint),
+		t.shop_line(ACCOUNT_SHOP_CASH, shopid, sc.Currency, commission - money, 0),
+		t.shop_line(ACCOUNT_PROMOTION, shopid, sc.Currency, 0, -point),
+		t.shop_line(ACCOUNT_PROMOTION, sc.Shopid, sc.Currency, bonusMoney, earned + bonusPoint),
+		t.shop_line(ACCOUNT_COMMISSION, shopid, sc.Currency, -commission, 0),
+	})
+	if err != nil { return nil, err }
+
+	fmt.Printf("---------------save_card sc---------------------------")
+    _, err = t.save_card(stub, sc)
+  
+  			shopLedger.ConsumeMoney = shopLedger.ConsumeMoney + principal
+			shopLedger.ConsumeBonus = shopLedger.ConsumeBonus + bonusSpent
+			shopLedger.ConsumePoint = shopLedger.ConsumePoint + point
+			shopLedger.EarnPoint = shopLedger.EarnPoint + earned
+			shopLedger.BonusMoney = shopLedger.BonusMoney + bonusMoney
+			shopLedger.BonusPoint = shopLedger.BonusPoint + bonusPoint
+			_, lerr := t.update_shopLedger(stub, sc.Shopid, sc.Kakaid, shopLedger)
+			if lerr != nil { return nil, lerr }
+
+			fmt.Printf("Put ShopLedger ok");
+		fmt.Printf("---------------save_card ok---------------------------")		
+		if err != nil { fmt.Printf("transactionCard_consumer_to_consumer: Error saving changes: %s", err); return nil, errors.New("Error saving changes") }
+	
+	return []byte(eventId), nil
+	
+}
+
+//=================================================================================================================================
+//	 Update Functions
+//=================================================================================================================================
+//	 update_money
+//=================================================================================================================================
+
+func (t *CardTransactionChaincode) update_ct_money(stub shim.ChaincodeStubInterface, v Card, caller string, caller_affiliation int, new_value string) ([]byte, error) {
+	
+	new_money, err := t.parse_money(new_value, v.Currency) 		                // will return an error if the new value is not a decimal amount
+		if err != nil  { return nil, errors.New("Invalid value passed for money: " + err.Error()) }
+
+	shopid, err := t.check_shop_permission(stub, caller, caller_affiliation, PERM_ADJUST)
+	if err != nil { return nil, err }
+	
+	if 		//v.status			== STATE_SHOP	&& 
+			//v.owner				== caller				&&
+			v.Shopid			== shopid		&&
+			//v.VIN				== 0					&&			// Can't change the VIN after its initial assignment
+			v.Scrapped			== false				{
+			
+					_, err = t.post_journal(stub, "adjustment", v.Cardid, []JournalLine{
+						t.card_line(v, v.Money - new_money, 0),
+						t.shop_line(ACCOUNT_ADJUSTMENT, v.Shopid, v.Currency, new_money - v.Money, 0),
+					})
+					if err != nil { return nil, err }
+
+					shopLedger, err := t.retrieve_shopLedger(stub, v.Shopid, v.Kakaid)
+					if err != nil { return nil, err }
+					shopLedger.AdjustMoney = shopLedger.AdjustMoney + new_money - v.Money
+					_, err = t.update_shopLedger(stub, v.Shopid, v.Kakaid, shopLedger)
+					if err != nil { return nil, err }
+
+					v.Money = new_money					// Update to the new value
+	} else {
+	
+															return nil, errors.New("Permission denied")
+		
+	}
+	
+	_, err  = t.save_card(stub, v)						// Save the changes in the blockchain
+	
+															if err != nil { fmt.Printf("update_money: Error saving changes: %s", err); return nil, errors.New("Error saving changes") } 
+	
+	return nil, nil
+	
+}
+
+
+
+//=================================================================================================================================
+//	 update_point
+//=================================================================================================================================
+
+func (t *CardTransactionChaincode) update_ct_point(stub shim.ChaincodeStubInterface, v Card, caller string, caller_affiliation int, new_value string) ([]byte, error) {
+	
+	new_point, err := strconv.Atoi(new_value)		                // will return an error if the new vin contains non numerical chars
+	if err != nil { return nil, errors.New("Invalid value passed for point") }
+
+	shopid, err := t.check_shop_permission(stub, caller, caller_affiliation, PERM_ADJUST)
+	if err != nil { return nil, err }
+	
+	if 		//v.status			== STATE_SHOP	&& 
+			//v.owner				== caller				&&
+			v.Shopid			== shopid		&&
+			//v.VIN				== 0					&&			// Can't change the VIN after its initial assignment
+			v.Scrapped			== false				{
+			
+					_, err = t.post_journal(stub, "adjustment", v.Cardid, []JournalLine{
+						t.card_line(v, 0, v.Point - new_point),
+						t.shop_line(ACCOUNT_ADJUSTMENT, v.Shopid, v.Currency, 0, new_point - v.Point),
+					})
+					if err != nil { return nil, err }
+
+					shopLedger, err := t.retrieve_shopLedger(stub, v.Shopid, v.Kakaid)
+					if err != nil { return nil, err }
+					shopLedger.AdjustPoint = shopLedger.AdjustPoint + new_point - v.Point
+					_, err = t.update_shopLedger(stub, v.Shopid, v.Kakaid, shopLedger)
+					if err != nil { return nil, err }
+
+					// Update to the new value through the point lots
+					if new_point > v.Point {
+						template, err := t.retrieve_card(stub, v.Kakaid)
+						if err != nil { return nil, errors.New("Failed to retrieve card template: " + v.Kakaid) }
+						v, err = t.credit_points(stub, template, v, new_point - v.Point)
+						if err != nil { return nil, err }
+					} else {
+						v, _, err = t.debit_points(stub, v, v.Point - new_point)
+						if err != nil { return nil, err }
+					}
+	} else {
+	
+															return nil, errors.New("Permission denied")
+		
+	}
+	
+	_, err  = t.save_card(stub, v)						// Save the changes in the blockchain
+	
+															if err != nil { fmt.Printf("update_point: Error saving changes: %s", err); return nil, errors.New("Error saving changes") } 
+	
+	return nil, nil
+	
+}
+
+
+//	 only can be update by shop
+//=================================================================================================================================
+//	 update_shop
+//=================================================================================================================================
+
+func (t *CardTransactionChaincode) update_ct_shopid(stub shim.ChaincodeStubInterface, v Card, caller string, caller_affiliation int, new_value string) ([]byte, error) {
+	
+	if 		v.Status			== STATE_SHOP	&&
+			v.Owner				== caller				&& 
+			caller_affiliation	== SHOP			&&
+			v.Scrapped			== false				{
+			
+					v.Shopid = new_value
+	} else {
+	
+															return nil, errors.New("Permission denied")
+	
+	}
+	
+	_, err := t.save_card(stub, v)
+	
+															if err != nil { fmt.Printf("update_shopid: Error saving changes: %s", err); return nil, errors.New("Error saving changes") }
+	
+	return nil, nil
+	
+}
+
+
+//=================================================================================================================================
+//	 update_shop
+//=================================================================================================================================
+
+func (t *CardTransactionChaincode) update_ct_shopname(stub shim.ChaincodeStubInterface, v Card, caller string, caller_affiliation int, new_value string) ([]byte, error) {
+	
+	if 		v.Status			== STATE_SHOP	&&
+			v.Owner				== caller				&& 
+			caller_affiliation	== SHOP			&&
+			v.Scrapped			== false				{
+			
+					v.Shop = new_value
+	} else {
+	
+															return nil, errors.New("Permission denied")
+	
+	}
+	
+	_, err := t.save_card(stub, v)
+	
+															if err != nil { fmt.Printf("update_shop: Error saving changes: %s", err); return nil, errors.New("Error saving changes") }
+	
+	return nil, nil
+	
+}
+
+//=================================================================================================================================
+//	 update_cardid
+//=================================================================================================================================
+
+func (t *CardTransactionChaincode) update_ct_cardid(stub shim.ChaincodeStubInterface, v Card, caller string, caller_affiliation int, new_value string) ([]byte, error) {
+	
+	if 		v.Status			== STATE_SHOP	&&
+			v.Owner				== caller				&& 
+			caller_affiliation	== SHOP			&&
+			v.Scrapped			== false				{
+			
+					v.Cardid = new_value
+	} else {
+	
+															return nil, errors.New("Permission denied")
+	
+	}
+	
+	_, err := t.save_card(stub, v)
+	
+															if err != nil { fmt.Printf("update_cardid: Error saving changes: %s", err); return nil, errors.New("Error saving changes") }
+	
+	return nil, nil
+	
+}
+
+//=================================================================================================================================
+//	 update_cardlevel
+//=================================================================================================================================
+
+
+func (t *CardTransactionChaincode) update_ct_cardlevel(stub shim.ChaincodeStubInterface, v Card, caller string, caller_affiliation int, new_value string) ([]byte, error) {
+	
+	if 		v.Status			== STATE_SHOP	&&
+			v.Owner				== caller				&& 
+			caller_affiliation	== SHOP			&&
+			v.Scrapped			== false				{
+			
+					v.Cardlevel = new_value
+	} else {
+	
+															return nil, errors.New("Permission denied")
+	
+	}
+	
+	_, err := t.save_card(stub, v)
+	
+															if err != nil { fmt.Printf("update_cardlevel: Error saving changes: %s", err); return nil, errors.New("Error saving changes") }
+	
+	return nil, nil
+	
+}
+
+//=================================================================================================================================
+//	 update_cardclass
+//=================================================================================================================================
+
+func (t *CardTransactionChaincode) update_ct_cardclass(stub shim.ChaincodeStubInterface, v Card, caller string, caller_affiliation int, new_value string) ([]byte, error) {
+	
+	if 		v.Status			== STATE_SHOP	&&
+			v.Owner				== caller				&& 
+			caller_affiliation	== SHOP			&&
+			v.Scrapped			== false				{
+			
+					v.Cardclass = new_value
+	} else {
+	
+															return nil, errors.New("Permission denied")
+	
+	}
+	
+	_, err := t.save_card(stub, v)
+	
+															if err != nil { fmt.Printf("update_cardclass: Error saving changes: %s", err); return nil, errors.New("Error saving changes") }
+	
+	return nil, nil
+	
+}
+
+//=================================================================================================================================
+//	 update_password
+//=================================================================================================================================
+
+func (t *CardTransactionChaincode) update_ct_password(stub shim.ChaincodeStubInterface, v Card, caller string, caller_affiliation int, new_value string) ([]byte, error) {
+	
+	if 		v.Owner				== caller				&& 
+			v.Scrapped			== false				{
+			
+					v.Password = new_value
+	} else {
+	
+															return nil, errors.New("Permission denied")
+	
+	}
+	
+	_, err := t.save_card(stub, v)
+	
+															if err != nil { fmt.Printf("update_password: Error saving changes: %s", err); return nil, errors.New("Error saving changes") }
+	
+	return nil, nil
+	
+}
+
+
+//=================================================================================================================================
+//	 update_expdate
+//=================================================================================================================================
+func (t *CardTransactionChaincode) update_ct_expdate(stub shim.ChaincodeStubInterface, v Card, caller string, caller_affiliation int, new_value string) ([]byte, error) {
+
+	if		v.Status			== STATE_SHOP	&&
+			v.Owner				== caller		&& 
+			caller_affiliation	== SHOP			&&
+			v.Scrapped			== false				{
+		
+					v.Expdate = new_value
+				
+	} else {
+		return nil, errors.New("Permission denied")
+	}
+	
+	_, err := t.save_card(stub, v)
+	
+	if err != nil { fmt.Printf("update_expdate: Error saving changes: %s", err); 
+		return nil, errors.New(" update_expdate: Error saving changes ") }
+	
+	return nil, nil
+	
+}
+
+
+// all role can do this
+//=================================================================================================================================
+//	 scrap_card
+//=================================================================================================================================
+func (t *CardTransactionChaincode) scrap_card(stub shim.ChaincodeStubInterface, v Card, caller string) ([]byte, error) {
+
+	if		v.Owner				== caller				&& 
+			v.Scrapped			== false				{
+		
+					v.Scrapped = true
+				
+	} else {
+		return nil, errors.New("Permission denied")
+	}
+	
+	_, err := t.save_card(stub, v)
+	
+															if err != nil { fmt.Printf("SCRAP_CARD: Error saving changes: %s", err); return nil, errors.New("SCRAP_CARD Error saving changes") }
+	
+	return nil, nil
+	
+}
+
+//=================================================================================================================================
+//	 update_expired
+//=================================================================================================================================
+func (t *CardTransactionChaincode) update_ct_expired(stub shim.ChaincodeStubInterface, v Card, caller string, caller_affiliation int, isexpired string) ([]byte, error) {
+
+	if		v.Owner				== caller				&& 
+			v.Scrapped			== false {
+				if(isexpired =="true"){
+					v.Expired = true
+				}else if(isexpired =="false"){
+					v.Expired = false
+				}else { fmt.Printf("update_expired: value is not true or false"); 
+						return nil, errors.New("update_expired: value is not true or false") }
+	
+					
+				
+	} else {
+		return nil, errors.New("Permission denied")
+	}
+	
+	_, err := t.save_card(stub, v)
+		if err != nil { fmt.Printf("update_expired: Error saving changes: %s", err); return nil, errors.New("SCRAP_CARD Error saving changes") }
+	
+	return nil, nil
+	
+}
+
+
+//=================================================================================================================================
+//	 update_category
+//=================================================================================================================================
+func (t *CardTransactionChaincode) update_ct_category(stub shim.ChaincodeStubInterface, v Card, caller string, caller_affiliation int, new_value string) ([]byte, error) {
+
+	if		v.Status			== STATE_CONSUMER_OWNERSHIP	&&
+			v.Owner				== caller			&& 
+			caller_affiliation	== CONSUMER			&&
+			v.Scrapped			== false				{
+		
+					v.Category = new_value
+				
+	} else {
+		return nil, errors.New("Permission denied")
+	}
+	
+	_, err := t.save_card(stub, v)
+	
+															if err != nil { fmt.Printf("update_category: Error saving changes: %s", err); return nil, errors.New("SCRAP_CARD Error saving changes") }
+	
+	return nil, nil
+	
+}
+
+
+//=================================================================================================================================
+//	 update_tel
+//=================================================================================================================================
+func (t *CardTransactionChaincode) update_ct_tel(stub shim.ChaincodeStubInterface, v Card, caller string, caller_affiliation int, new_value string) ([]byte, error) {
+
+	if		v.Status			== STATE_CONSUMER_OWNERSHIP	&&
+			v.Owner				== caller		&& 
+			caller_affiliation	== CONSUMER			&&
+			v.Scrapped			== false				{
+		
+					v.Tel = new_value
+				
+	} else {
+		return nil, errors.New("Permission denied")
+	}
+	
+	_, err := t.save_card(stub, v)
+	
+															if err != nil { fmt.Printf("update_tel: Error saving changes: %s", err); return nil, errors.New("SCRAP_CARD Error saving changes") }
+	
+	return nil, nil
+	
+}
+
+//=================================================================================================================================
+// these 4 item can not been update seperatly. they should be changed in transaction func
+//  update_owner
+//  update_releasedate
+//  update_getdate
+//  update_status
+//=================================================================================================================================
+
+
+//=================================================================================================================================
+//	 Read Functions
+//=================================================================================================================================
+//	 get_card_details
+//=================================================================================================================================
+func (t *CardTransactionChaincode) get_card_details(stub shim.ChaincodeStubInterface, v Card, caller string, caller_affiliation int) ([]byte, error) {
+	
+	bytes, err := json.Marshal(v)
+	
+																if err != nil { return nil, errors.New("GET_CARD_DETAILS: Invalid card object") }
+																
+	if 		v.Owner				== caller		||
+			caller_affiliation	== KAKACENTER	||
+			caller_affiliation	== SHOP 	{
+			
+					return bytes, nil		
+	} else {
+																return nil, errors.New("Permission Denied")	
+	}
+
+}
+
+
+//=================================================================================================================================
+//	 get_card_history - same permission as get_card_details
+//=================================================================================================================================
+func (t *CardTransactionChaincode) get_card_history(stub shim.ChaincodeStubInterface, v Card, caller string, caller_affiliation int) ([]byte, error) {
+
+	_, err := t.get_card_details(stub, v, caller, caller_affiliation)
+	if err != nil { return nil, err }
+
+	history, err := t.retrieve_card_history(stub, t.get_card_key(v))
+	if err != nil { return nil, err }
+
+	return json.Marshal(history)
+}
+
+//=================================================================================================================================
+//	 get_card_templates
+//=================================================================================================================================
+
+func (t *CardTransactionChaincode) get_card_templates(stub shim.ChaincodeStubInterface, caller string, caller_affiliation int) ([]byte, error) {
+
+	bytes, err := stub.GetState(CARD_TEMPLATE_HOLDER)
+		
+																			if err != nil { return nil, errors.New("Unable to get v5cIDs") }
+																	
+	var card_template_holder Card_Holder
+	
+	err = json.Unmarshal(bytes, &card_template_holder)						
+	
+																			if err != nil {	return nil, errors.New("Corrupt V5C_Holder") }
+	
+	result := "["
+	
+	var temp []byte
+	var v Card
+	
+	for _, cardId := range card_template_holder.Cards {
+		
+		v, err = t.retrieve_card(stub, cardId)
+		
+		if err != nil {return nil, errors.New("Failed to retrieve V5C")}
+		
+		temp, err = t.get_card_details(stub, v, caller, caller_affiliation)
+		
+		if err == nil {
+			result += string(temp) + ","	
+		}
+	}
+	
+	if len(result) == 1 {
+		result = "[]"
+	} else {
+		result = result[:len(result)-1] + "]"
+	}
+	
+	return []byte(result), nil
+}
+
+//=================================================================================================================================
+//	 get_cards
+//=================================================================================================================================
+
+func (t *CardTransactionChaincode) get_cards(stub shim.ChaincodeStubInterface, caller string, caller_affiliation int) ([]byte, error) {
+
+	bytes, err := stub.GetState(CARD_HOLDER)
+		
+																			if err != nil { return nil, errors.New("Unable to get v5cIDs") }
+																	
+	var cardKakaIDs Card_Holder
+	
+	err = json.Unmarshal(bytes, &cardKakaIDs)						
+	
+																			if err != nil {	return nil, errors.New("Corrupt V5C_Holder") }
+	
+	result := "["
+	
+	var temp []byte
+	var v Card
+	
+	for _, card := range cardKakaIDs.Cards {
+		
+		v, err = t.retrieve_card(stub, card)
+		
+		if err != nil {return nil, errors.New("Failed to retrieve V5C")}
+		
+		temp, err = t.get_card_details(stub, v, caller, caller_affiliation)
+		
+		if err == nil {
+			result += string(temp) + ","	
+		}
+	}
+	
+	if len(result) == 1 {
+		result = "[]"
+	} else {
+		result = result[:len(result)-1] + "]"
+	}
+	
+	return []byte(result), nil
+}
+
+//=================================================================================================================================
+//	 get_shop_templates - all card templates of a shop
+//=================================================================================================================================
+func (t *CardTransactionChaincode) get_shop_templates(stub shim.ChaincodeStubInterface, shopId string) ([]Card, error) {
+
+	var templates []Card
+
+	bytes, err := stub.GetState(CARD_TEMPLATE_HOLDER)
+		if err != nil { return nil, errors.New("Unable to get card templates") }
+
+	var card_template_holder Card_Holder
+	if len(bytes) != 0 {
+		err = json.Unmarshal(bytes, &card_template_holder)
+		if err != nil {	return nil, errors.New("Corrupt Card_Template_Holder record") }
+	}
+
+	for _, templateId := range card_template_holder.Cards {
+		template, err := t.retrieve_card(stub, templateId)
+		if err != nil {return nil, errors.New("Failed to retrieve card template " + templateId)}
+
+		if template.Shopid == shopId {
+			templates = append(templates, template)
+		}
+	}
+	return templates, nil
+}
+
+//=================================================================================================================================
+//	 get_template_cards - all cards issued from a template
+//=================================================================================================================================
+func (t *CardTransactionChaincode) get_template_cards(stub shim.ChaincodeStubInterface, templateId string) ([]Card, error) {
+
+	var cards []Card
+
+	bytes, err := stub.GetState(CARD_HOLDER)
+		if err != nil { return nil, errors.New("Unable to get cards") }
+
+	var card_holder Card_Holder
+	if len(bytes) != 0 {
+		err = json.Unmarshal(bytes, &card_holder)
+		if err != nil {	return nil, errors.New("Corrupt Card_Holder record") }
+	}
+
+	for _, cardId := range card_holder.Cards {
+		card, err := t.retrieve_card(stub, cardId)
+		if err != nil {return nil, errors.New("Failed to retrieve card " + cardId)}
+
+		if card.Kakaid == templateId {
+			cards = append(cards, card)
+		}
+	}
+	return cards, nil
+}
+
+//=================================================================================================================================
+//	 Alliance Functions - cross-shop points, defined by KAKACENTER
+//=================================================================================================================================
+func (t *CardTransactionChaincode) get_allianceID(allianceId string) (string) {
+	return "alliance-" + allianceId
+}
+
+func (t *CardTransactionChaincode) get_alliance_holder(stub shim.ChaincodeStubInterface) (Alliance_Holder, error) {
+
+	var alliance_holder Alliance_Holder
+	bytes, err := stub.GetState(ALLIANCE_HOLDER)
+	if err != nil { return alliance_holder, errors.New("Unable to get alliance_holder") }
+
+	if len(bytes) != 0 {
+		err = json.Unmarshal(bytes, &alliance_holder)
+		if err != nil {	return alliance_holder, errors.New("Corrupt Alliance_Holder record") }
+	}
+	return alliance_holder, nil
+}
+
+func (t *CardTransactionChaincode) retrieve_alliance(stub shim.ChaincodeStubInterface, allianceId string) (Alliance, error) {
+
+	var alliance Alliance
+	bytes, err := stub.GetState(t.get_allianceID(allianceId))
+	if err != nil { return alliance, errors.New("Error retrieving alliance " + allianceId) }
+	if bytes == nil { return alliance, errors.New("Error: no alliance " + allianceId + " in world state") }
+
+	err = json.Unmarshal(bytes, &alliance)
+	if err != nil { fmt.Printf("RETRIEVE_ALLIANCE: Corrupt alliance record "+string(bytes)+": %s", err); return alliance, errors.New("Corrupt alliance record " + allianceId) }
+
+	if alliance.Rates == nil { alliance.Rates = make(map[string]int) }
+	if alliance.Clearing == nil { alliance.Clearing = make(map[string]int) }
+	return alliance, nil
+}
+
+func (t *CardTransactionChaincode) save_alliance(stub shim.ChaincodeStubInterface, alliance Alliance) ([]byte, error) {
+
+	bytes, err := json.Marshal(alliance)
+	if err != nil { return nil, errors.New("Error converting alliance record") }
+
+	err = stub.PutState(t.get_allianceID(alliance.Allianceid), bytes)
+	if err != nil { fmt.Printf("SAVE_ALLIANCE: Error storing alliance: %s", err); return nil, errors.New("Error storing alliance") }
+
+	return bytes, nil
+}
+
+func (t *CardTransactionChaincode) create_alliance(stub shim.ChaincodeStubInterface, caller string, caller_affiliation int, allianceId string, name string) ([]byte, error) {
+
+	if caller_affiliation != KAKACENTER {
+		return nil, errors.New("Permission denied: only KAKACENTER can create alliance")
+	}
+
+	record, err := stub.GetState(t.get_allianceID(allianceId))
+	if err != nil { return nil, err }
+	if record != nil { return nil, errors.New("alliance " + allianceId + " already exists") }
+
+	var alliance Alliance
+	alliance.Allianceid = allianceId
+	alliance.Name = name
+	alliance.Rates = make(map[string]int)
+	alliance.Clearing = make(map[string]int)
+
+	_, err = t.save_alliance(stub, alliance)
+	if err != nil { return nil, err }
+
+	alliance_holder, err := t.get_alliance_holder(stub)
+	if err != nil { return nil, err }
+	alliance_holder.Alliances = append(alliance_holder.Alliances, allianceId)
+
+	bytes, err := json.Marshal(alliance_holder)
+	if err != nil { return nil, errors.New("Error creating Alliance_Holder record") }
+	err = stub.PutState(ALLIANCE_HOLDER, bytes)
+	if err != nil { return nil, errors.New("Unable to put the ALLIANCE_HOLDER state") }
+
+	_, err = t.add_admin_audit(stub, caller, "create_alliance", allianceId, name)
+	if err != nil { return nil, err }
+
+	return nil, nil
+}
+
+//=================================================================================================================================
+//	 set_alliance_shop - adds a shop to the alliance or changes its exchange rate. Rate 0 removes the shop, which is
+//						 only possible when it has no open clearing balance
+//=================================================================================================================================
+func (t *CardTransactionChaincode) set_alliance_shop(stub shim.ChaincodeStubInterface, caller string, caller_affiliation int, allianceId string, shopId string, rate int) ([]byte, error) {
+
+	if caller_affiliation != KAKACENTER {
+		return nil, errors.New("Permission denied: only KAKACENTER can change alliance")
+	}
+	if rate < 0 { return nil, errors.New("Invalid exchange rate") }
+
+	alliance, err := t.retrieve_alliance(stub, allianceId)
+	if err != nil { return nil, err }
+
+	if rate == 0 {
+		for key, value := range alliance.Clearing {
+			shops := strings.Split(key, ">")
+			if value != 0 && (shops[0] == shopId || shops[1] == shopId) {
+				return nil, errors.New("shop " + shopId + " has open clearing balance in alliance " + allianceId)
+			}
+		}
+		delete(alliance.Rates, shopId)
+	} else {
+		err = t.check_shop_active(stub, shopId)
+		if err != nil { return nil, err }
+		alliance.Rates[shopId] = rate
+	}
+
+	_, err = t.save_alliance(stub, alliance)
+	if err != nil { return nil, err }
+
+	_, err = t.add_admin_audit(stub, caller, "set_alliance_shop", allianceId, shopId + " rate " + strconv.Itoa(rate))
+	if err != nil { return nil, err }
+
+	return nil, nil
+}
+
+//=================================================================================================================================
+//	 find_alliance - the alliance both shops are members of
+//=================================================================================================================================
+func (t *CardTransactionChaincode) find_alliance(stub shim.ChaincodeStubInterface, shopA string, shopB string) (Alliance, error) {
+
+	var alliance Alliance
+	alliance_holder, err := t.get_alliance_holder(stub)
+	if err != nil { return alliance, err }
+
+	for _, allianceId := range alliance_holder.Alliances {
+		alliance, err = t.retrieve_alliance(stub, allianceId)
+		if err != nil { return alliance, err }
+
+		_, okA := alliance.Rates[shopA]
+		_, okB := alliance.Rates[shopB]
+		if okA && okB {
+			return alliance, nil
+		}
+	}
+	return alliance, errors.New("shop " + shopA + " and shop " + shopB + " are not in the same alliance")
+}
+
+//=================================================================================================================================
+//	 convert_alliance_points - points of shopFrom expressed in points of shopTo. Only whole points of shopTo can be
+//							   credited, so amounts whose value does not convert exactly are refused
+//=================================================================================================================================
+func (t *CardTransactionChaincode) convert_alliance_points(alliance Alliance, shopFrom string, shopTo string, points int) (int, error) {
+
+	value := points * alliance.Rates[shopFrom]
+	if alliance.Rates[shopTo] <= 0 || value % alliance.Rates[shopTo] != 0 {
+		return 0, errors.New(strconv.Itoa(points) + " points of " + shopFrom + " do not convert to whole points of " + shopTo)
+	}
+	return value / alliance.Rates[shopTo], nil
+}
+
+//=================================================================================================================================
+//	 post_clearing - payer owes payee value more alliance units, netted against what payee owes payer
+//=================================================================================================================================
+func (t *CardTransactionChaincode) post_clearing(stub shim.ChaincodeStubInterface, alliance Alliance, payer string, payee string, value int) (Alliance, error) {
+
+	alliance = t.net_clearing(alliance, payer, payee, value)
+
+	_, err := t.save_alliance(stub, alliance)
+	if err != nil { return alliance, err }
+
+	// keep the movement for the settlement batches
+	clearing, err := t.retrieve_clearing_entries(stub, alliance.Allianceid)
+	if err != nil { return alliance, err }
+
+	var entry ClearingEntry
+	entry.Payer = payer
+	entry.Payee = payee
+	entry.Value = value
+	now, err := t.get_tx_time(stub)
+	if err != nil { return alliance, err }
+	entry.Day = now.Format(DAY_FORMAT)
+	clearing.Entries = append(clearing.Entries, entry)
+
+	_, err = t.save_clearing_entries(stub, clearing)
+	return alliance, err
+}
+
+func (t *CardTransactionChaincode) net_clearing(alliance Alliance, payer string, payee string, value int) (Alliance) {
+
+	key := payer + ">" + payee
+	reverse := payee + ">" + payer
+
+	net := alliance.Clearing[key] - alliance.Clearing[reverse] + value
+	delete(alliance.Clearing, key)
+	delete(alliance.Clearing, reverse)
+	if net > 0 {
+		alliance.Clearing[key] = net
+	} else if net < 0 {
+		alliance.Clearing[reverse] = -net
+	}
+	return alliance
+}
+
+//=================================================================================================================================
+//	 get_alliances - KAKACENTER sees all alliances, a shop the alliances it is member of
+//=================================================================================================================================
+func (t *CardTransactionChaincode) get_alliances(stub shim.ChaincodeStubInterface, caller string, caller_affiliation int) ([]byte, error) {
+
+	if caller_affiliation != KAKACENTER && caller_affiliation != SHOP {
+		return nil, errors.New("Permission Denied")
+	}
+	shopid := t.get_Shopid(stub, caller)
+
+	alliance_holder, err := t.get_alliance_holder(stub)
+	if err != nil { return nil, err }
+
+	var alliances []Alliance
+	for _, allianceId := range alliance_holder.Alliances {
+		alliance, err := t.retrieve_alliance(stub, allianceId)
+		if err != nil { return nil, err }
+
+		_, member := alliance.Rates[shopid]
+		if caller_affiliation == KAKACENTER || member {
+			alliances = append(alliances, alliance)
+		}
+	}
+	if alliances == nil { return []byte("[]"), nil }
+	return json.Marshal(alliances)
+}
+
+//=================================================================================================================================
+//	 Settlement Functions - cross-shop clearing entries netted per shop pair and period into settlement batches
+//=================================================================================================================================
+func (t *CardTransactionChaincode) get_clearingEntriesID(allianceId string) (string) {
+	return "clearing-entries-" + allianceId
+}
+
+func (t *CardTransactionChaincode) get_settlementID(batchId string) (string) {
+	return "settlement-" + batchId
+}
+
+func (t *CardTransactionChaincode) retrieve_clearing_entries(stub shim.ChaincodeStubInterface, allianceId string) (Clearing_Entries, error) {
+
+	var clearing Clearing_Entries
+	clearing.Allianceid = allianceId
+
+	bytes, err := stub.GetState(t.get_clearingEntriesID(allianceId))
+	if err != nil { return clearing, errors.New("Error retrieving clearing entries of alliance " + allianceId) }
+
+	if len(bytes) != 0 {
+		err = json.Unmarshal(bytes, &clearing)
+		if err != nil { return clearing, errors.New("Corrupt clearing entries record of alliance " + allianceId) }
+	}
+	return clearing, nil
+}
+
+func (t *CardTransactionChaincode) save_clearing_entries(stub shim.ChaincodeStubInterface, clearing Clearing_Entries) ([]byte, error) {
+
+	bytes, err := json.Marshal(clearing)
+	if err != nil { return nil, errors.New("Error converting clearing entries record") }
+
+	err = stub.PutState(t.get_clearingEntriesID(clearing.Allianceid), bytes)
+	if err != nil { fmt.Printf("SAVE_CLEARING_ENTRIES: %s", err); return nil, errors.New("Error storing clearing entries") }
+
+	return bytes, nil
+}
+
+func (t *CardTransactionChaincode) get_settlement_holder(stub shim.ChaincodeStubInterface) (Settlement_Holder, error) {
+
+	var settlement_holder Settlement_Holder
+	bytes, err := stub.GetState(SETTLEMENT_HOLDER)
+	if err != nil { return settlement_holder, errors.New("Unable to get settlement_holder") }
+
+	if len(bytes) != 0 {
+		err = json.Unmarshal(bytes, &settlement_holder)
+		if err != nil {	return settlement_holder, errors.New("Corrupt Settlement_Holder record") }
+	}
+	return settlement_holder, nil
+}
+
+func (t *CardTransactionChaincode) retrieve_settlement(stub shim.ChaincodeStubInterface, batchId string) (SettlementBatch, error) {
+
+	var batch SettlementBatch
+	bytes, err := stub.GetState(t.get_settlementID(batchId))
+	if err != nil { return batch, errors.New("Error retrieving settlement batch " + batchId) }
+	if bytes == nil { return batch, errors.New("Error: no settlement batch " + batchId + " in world state") }
+
+	err = json.Unmarshal(bytes, &batch)
+	if err != nil { return batch, errors.New("Corrupt settlement batch record " + batchId) }
+
+	return batch, nil
+}
+
+func (t *CardTransactionChaincode) save_settlement(stub shim.ChaincodeStubInterface, batch SettlementBatch) ([]byte, error) {
+
+	bytes, err := json.Marshal(batch)
+	if err != nil { return nil, errors.New("Error converting settlement batch record") }
+
+	err = stub.PutState(t.get_settlementID(batch.Batchid), bytes)
+	if err != nil { fmt.Printf("SAVE_SETTLEMENT: %s", err); return nil, errors.New("Error storing settlement batch") }
+
+	return bytes, nil
+}
+
+//=================================================================================================================================
+//	 create_settlement_batches - nets the unsettled clearing entries of the alliance between periodStart and
+//								 periodEnd (YYYY-MM-DD, inclusive) into one open batch per shop pair
+//=================================================================================================================================
+func (t *CardTransactionChaincode) create_settlement_batches(stub shim.ChaincodeStubInterface, caller string, caller_affiliation int, allianceId string, periodStart string, periodEnd string) ([]byte, error) {
+
+	if caller_affiliation != KAKACENTER {
+		return nil, errors.New("Permission denied: only KAKACENTER can create settlement batches")
+	}
+
+	_, err1 := time.Parse(DAY_FORMAT, periodStart)
+	_, err2 := time.Parse(DAY_FORMAT, periodEnd)
+	if err1 != nil || err2 != nil || periodStart > periodEnd {
+		return nil, errors.New("Invalid settlement period " + periodStart + " - " + periodEnd)
+	}
+
+	clearing, err := t.retrieve_clearing_entries(stub, allianceId)
+	if err != nil { return nil, err }
+
+	settlement_holder, err := t.get_settlement_holder(stub)
+	if err != nil { return nil, err }
+
+	// net value per shop pair, keyed by the pair in alphabetical order: positive means first owes second
+	net := make(map[string]int)
+	var pairs []string
+	var netted []int
+	for index, entry := range clearing.Entries {
+		if entry.Batchid != "" || entry.Day < periodStart || entry.Day > periodEnd { continue }
+
+		key := entry.Payer + ">" + entry.Payee
+		value := entry.Value
+		if entry.Payee < entry.Payer {
+			key = entry.Payee + ">" + entry.Payer
+			value = -value
+		}
+		_, seen := net[key]
+		if seen == false { pairs = append(pairs, key) }
+		net[key] = net[key] + value
+		netted = append(netted, index)
+	}
+
+	var batchIds []string
+	batchOfPair := make(map[string]string)
+	for _, key := range pairs {
+		shops := strings.Split(key, ">")
+
+		var batch SettlementBatch
+		batch.Batchid = allianceId + "-" + strconv.Itoa(len(settlement_holder.Batches) + 1)
+		batch.Allianceid = allianceId
+		batch.Payer = shops[0]
+		batch.Payee = shops[1]
+		batch.Amount = net[key]
+		if batch.Amount < 0 {
+			batch.Payer = shops[1]
+			batch.Payee = shops[0]
+			batch.Amount = -batch.Amount
+		}
+		if batch.Amount == 0 {
+			batchOfPair[key] = "netted"			// nothing to pay, the entries cancelled out
+			continue
+		}
+		batch.Periodstart = periodStart
+		batch.Periodend = periodEnd
+		batch.Status = SETTLEMENT_OPEN
+		batch.Createdate, err = t.get_timestamp(stub)
+		if err != nil { return nil, err }
+
+		_, err = t.save_settlement(stub, batch)
+		if err != nil { return nil, err }
+
+		settlement_holder.Batches = append(settlement_holder.Batches, batch.Batchid)
+		batchIds = append(batchIds, batch.Batchid)
+		batchOfPair[key] = batch.Batchid
+	}
+
+	// entries are settled by their batch
+	for _, index := range netted {
+		entry := clearing.Entries[index]
+		key := entry.Payer + ">" + entry.Payee
+		if entry.Payee < entry.Payer { key = entry.Payee + ">" + entry.Payer }
+		clearing.Entries[index].Batchid = batchOfPair[key]
+	}
+	_, err = t.save_clearing_entries(stub, clearing)
+	if err != nil { return nil, err }
+
+	bytes, err := json.Marshal(settlement_holder)
+	if err != nil { return nil, errors.New("Error creating Settlement_Holder record") }
+	err = stub.PutState(SETTLEMENT_HOLDER, bytes)
+	if err != nil { return nil, errors.New("Unable to put the SETTLEMENT_HOLDER state") }
+
+	_, err = t.add_admin_audit(stub, caller, "create_settlement_batches", allianceId, periodStart + " - " + periodEnd + ": " + strings.Join(batchIds, ","))
+	if err != nil { return nil, err }
+
+	return json.Marshal(batchIds)
+}
+
+//=================================================================================================================================
+//	 check_settlement_party - KAKACENTER or the staff of the given shop allowed to handle settlement
+//=================================================================================================================================
+func (t *CardTransactionChaincode) check_settlement_party(stub shim.ChaincodeStubInterface, caller string, caller_affiliation int, shopId string) (error) {
+
+	if caller_affiliation == KAKACENTER { return nil }
+
+	shopid, err := t.check_shop_permission(stub, caller, caller_affiliation, PERM_SETTLEMENT)
+	if err != nil { return err }
+	if shopid != shopId { return errors.New("Permission denied: settlement belongs to other shops") }
+	return nil
+}
+
+//=================================================================================================================================
+//	 confirm_settlement - the payer agrees the amount of an open batch
+//=================================================================================================================================
+func (t *CardTransactionChaincode) confirm_settlement(stub shim.ChaincodeStubInterface, caller string, caller_affiliation int, batchId string) ([]byte, error) {
+
+	batch, err := t.retrieve_settlement(stub, batchId)
+	if err != nil { return nil, err }
+
+	err = t.check_settlement_party(stub, caller, caller_affiliation, batch.Payer)
+	if err != nil { return nil, err }
+
+	if batch.Status != SETTLEMENT_OPEN {
+		return nil, errors.New("settlement batch " + batchId + " is not open, status: " + batch.Status)
+	}
+
+	batch.Status = SETTLEMENT_CONFIRMED
+	batch.Confirmdate, err = t.get_timestamp(stub)
+	if err != nil { return nil, err }
+	return t.save_settlement(stub, batch)
+}
+
+//=================================================================================================================================
+//	 pay_settlement - the payee acknowledges the payment of a confirmed batch, which clears the amount from the
+//					  alliance clearing balance
+//=================================================================================================================================
+func (t *CardTransactionChaincode) pay_settlement(stub shim.ChaincodeStubInterface, caller string, caller_affiliation int, batchId string) ([]byte, error) {
+
+	batch, err := t.retrieve_settlement(stub, batchId)
+	if err != nil { return nil, err }
+
+	err = t.check_settlement_party(stub, caller, caller_affiliation, batch.Payee)
+	if err != nil { return nil, err }
+
+	if batch.Status != SETTLEMENT_CONFIRMED {
+		return nil, errors.New("settlement batch " + batchId + " is not confirmed, status: " + batch.Status)
+	}
+
+	alliance, err := t.retrieve_alliance(stub, batch.Allianceid)
+	if err != nil { return nil, err }
+
+	alliance = t.net_clearing(alliance, batch.Payee, batch.Payer, batch.Amount)
+	_, err = t.save_alliance(stub, alliance)
+	if err != nil { return nil, err }
+
+	batch.Status = SETTLEMENT_PAID
+	batch.Paiddate, err = t.get_timestamp(stub)
+	if err != nil { return nil, err }
+	return t.save_settlement(stub, batch)
+}
+
+//=================================================================================================================================
+//	 get_settlement_statement - all settlement batches of a shop with what it has still to pay and to receive
+//=================================================================================================================================
+func (t *CardTransactionChaincode) get_settlement_statement(stub shim.ChaincodeStubInterface, caller string, caller_affiliation int, shopId string) ([]byte, error) {
+
+	if caller_affiliation != KAKACENTER {
+		shopid, err := t.check_shop_permission(stub, caller, caller_affiliation, PERM_VIEW_LEDGER)
+		if err != nil { return nil, err }
+		if shopid != shopId { return nil, errors.New("Permission denied: statement of other shop") }
+	}
+
+	settlement_holder, err := t.get_settlement_holder(stub)
+	if err != nil { return nil, err }
+
+	var statement SettlementStatement
+	statement.Shopid = shopId
+	statement.Batches = []SettlementBatch{}
+	for _, batchId := range settlement_holder.Batches {
+		batch, err := t.retrieve_settlement(stub, batchId)
+		if err != nil { return nil, err }
+
+		if batch.Payer != shopId && batch.Payee != shopId { continue }
+
+		statement.Batches = append(statement.Batches, batch)
+		if batch.Status != SETTLEMENT_PAID {
+			if batch.Payer == shopId {
+				statement.Payable = statement.Payable + batch.Amount
+			} else {
+				statement.Receivable = statement.Receivable + batch.Amount
+			}
+		}
+	}
+	return json.Marshal(statement)
+}
+
+//=================================================================================================================================
+//	 Money Functions - decimal amounts in and out of int64 minor units
+//=================================================================================================================================
+//	 parse_money - parses a decimal string like "12.50" into minor units of the currency. Amounts with more
+//				   decimals than the currency has are rejected
+//=================================================================================================================================
+func (t *CardTransactionChaincode) parse_money(value string, currency string) (int64, error) {
+
+	if currency == "" { return 0, errors.New("Money is kept in whole units, KAKACENTER must run migrate_money_minor_units first") }
+	exponent, ok := currency_exponents[currency]
+	if ok == false { return 0, errors.New("Unknown currency: " + currency) }
+
+	matched, err := regexp.Match("^[0-9]+([.][0-9]+)?$", []byte(value))
+	if err != nil || matched == false { return 0, errors.New("Invalid money amount: " + value) }
+
+	parts := strings.Split(value, ".")
+	decimals := ""
+	if len(parts) == 2 { decimals = strings.TrimRight(parts[1], "0") }
+	if len(decimals) > exponent {
+		return 0, errors.New("Invalid money amount " + value + ": " + currency + " has " + strconv.Itoa(exponent) + " decimals")
+	}
+	for len(decimals) < exponent { decimals = decimals + "0" }
+
+	minor, err := strconv.ParseInt(parts[0] + decimals, 10, 64)
+	if err != nil { return 0, errors.New("Invalid money amount: " + value) }
+
+	return minor, nil
+}
+
+//=================================================================================================================================
+//	 format_money - minor units of the currency as decimal string
+//=================================================================================================================================
+func (t *CardTransactionChaincode) format_money(minor int64, currency string) (string) {
+
+	exponent := currency_exponents[currency]
+	sign := ""
+	if minor < 0 { sign = "-"; minor = -minor }
+
+	digits := strconv.FormatInt(minor, 10)
+	if exponent == 0 { return sign + digits }
+
+	for len(digits) <= exponent { digits = "0" + digits }
+	return sign + digits[:len(digits) - exponent] + "." + digits[len(digits) - exponent:]
+}
+
+//=================================================================================================================================
+//	 check_currency - currency must be a known ISO 4217 code
+//=================================================================================================================================
+func (t *CardTransactionChaincode) check_currency(currency string) (error) {
+
+	_, ok := currency_exponents[currency]
+	if ok == false { return errors.New("Unknown currency: " + currency) }
+	return nil
+}
+
+//=================================================================================================================================
+//	 migrate_money_minor_units - converts templates kept in whole money units before currencies existed to minor
+//								 units of currency. Their cards, shop ledgers, earning and tier rules, and the
+//								 commission rules and ledgers of their shops are converted as well. KAKACENTER only,
+//								 templates already having a currency and ledgers marked Minorunits are left alone
+//=================================================================================================================================
+func (t *CardTransactionChaincode) migrate_money_minor_units(stub shim.ChaincodeStubInterface, caller string, caller_affiliation int, currency string) ([]byte, error) {
+
+	if caller_affiliation != KAKACENTER {
+		return nil, errors.New("Permission denied: only KAKACENTER can migrate money")
+	}
+	err := t.check_currency(currency)
+	if err != nil { return nil, err }
+
+	factor := int64(1)
+	for i := 0; i < currency_exponents[currency]; i++ { factor = factor * 10 }
+
+	bytes, err := stub.GetState(CARD_TEMPLATE_HOLDER)
+	if err != nil { return nil, errors.New("Unable to get card templates") }
+
+	var card_template_holder Card_Holder
+	if len(bytes) != 0 {
+		err = json.Unmarshal(bytes, &card_template_holder)
+		if err != nil {	return nil, errors.New("Corrupt Card_Template_Holder record") }
+	}
+
+	shopIds := make(map[string]bool)
+	var migrated []string
+	for _, templateId := range card_template_holder.Cards {
+		template, err := t.retrieve_card(stub, templateId)
+		if err != nil { return nil, errors.New("Failed to retrieve card template " + templateId) }
+
+		if template.Currency != "" { continue }
+
+		template.Currency = currency
+		template.Money = template.Money * factor
+		if template.Earnrule != nil { template.Earnrule.Moneyunit = template.Earnrule.Moneyunit * factor }
+		for i := range template.Tierrules { template.Tierrules[i].Minspend = template.Tierrules[i].Minspend * factor }
+
+		_, err = t.save_template(stub, template, templateId)
+		if err != nil { return nil, err }
+
+		cards, err := t.get_template_cards(stub, templateId)
+		if err != nil { return nil, err }
+		for _, card := range cards {
+			card.Currency = currency
+			card.Money = card.Money * factor
+			card.Totalspend = card.Totalspend * factor
+			_, err = t.save_card(stub, card)
+			if err != nil { return nil, err }
+		}
+
+		shopLedgerBytes, err := t.get_shopLedger_internal(stub, template.Shopid, templateId)
+		if err != nil { return nil, err }
+		var shopLedger ShopLedger
+		if shopLedgerBytes != nil {
+			err = json.Unmarshal(shopLedgerBytes, &shopLedger)
+			if err != nil { return nil, errors.New("Invalid shopLedgerBytes JSON object") }
+		}
+		if shopLedgerBytes != nil && shopLedger.Minorunits == false {		// ledgers created since currencies are in minor units already
+			shopLedger = t.scale_shopLedger_money(shopLedger, factor)
+			shopLedger.Minorunits = true
+			_, err = t.save_shopLedger(stub, template.Shopid, templateId, shopLedger)		// a conversion, not a posting
+			if err != nil { return nil, err }
+
+			_, err = t.migrate_ledger_buckets(stub, template.Shopid, templateId, factor)
+			if err != nil { return nil, err }
+		}
+
+		_, err = t.migrate_commission_rule(stub, COMMISSION_TEMPLATE, templateId, currency, factor)
+		if err != nil { return nil, err }
+
+		shopIds[template.Shopid] = true
+		migrated = append(migrated, templateId)
+	}
+
+	for shopId := range shopIds {
+		_, err = t.migrate_commission_rule(stub, COMMISSION_SHOP, shopId, currency, factor)
+		if err != nil { return nil, err }
+
+		ledger, err := t.retrieve_commission_ledger(stub, shopId)
+		if err != nil { return nil, err }
+		if ledger.Minorunits == false {
+			ledger.Minorunits = true
+			ledger.Currency = currency
+			ledger.Spendmoney = ledger.Spendmoney * factor
+			ledger.Commission = ledger.Commission * factor
+
+			lbytes, err := json.Marshal(ledger)
+			if err != nil { return nil, errors.New("Error converting commission ledger") }
+			err = stub.PutState(t.get_commissionLedgerID(shopId), lbytes)
+			if err != nil { return nil, errors.New("Error storing commission ledger") }
+		}
+	}
+
+	_, err = t.add_admin_audit(stub, caller, "migrate_money_minor_units", currency, strings.Join(migrated, ","))
+	if err != nil { return nil, err }
+
+	return json.Marshal(migrated)
+}
+
+//	scale_shopLedger_money - every money value of the ledger multiplied by factor
+func (t *CardTransactionChaincode) scale_shopLedger_money(ledger ShopLedger, factor int64) (ShopLedger) {
+
+	ledger.InitMoney = ledger.InitMoney * factor
+	ledger.DepositMoney = ledger.DepositMoney * factor
+	ledger.ConsumeMoney = ledger.ConsumeMoney * factor
+	ledger.RefundMoney = ledger.RefundMoney * factor
+	ledger.CouponDiscount = ledger.CouponDiscount * factor
+	ledger.BonusMoney = ledger.BonusMoney * factor
+	ledger.ConsumeBonus = ledger.ConsumeBonus * factor
+	ledger.ForfeitBonus = ledger.ForfeitBonus * factor
+	ledger.HeldMoney = ledger.HeldMoney * factor
+	ledger.ReversedMoney = ledger.ReversedMoney * factor
+	ledger.TransferInMoney = ledger.TransferInMoney * factor
+	ledger.TransferOutMoney = ledger.TransferOutMoney * factor
+	ledger.AdjustMoney = ledger.AdjustMoney * factor
+	return ledger
+}
+
+//	migrate_ledger_buckets - converts the day buckets of a template ledger kept in whole units, closed ones too as the
+//							 amounts do not change, only their unit
+func (t *CardTransactionChaincode) migrate_ledger_buckets(stub shim.ChaincodeStubInterface, shopId string, templateId string, factor int64) ([]byte, error) {
+
+	periods, err := t.retrieve_ledger_periods(stub, shopId)
+	if err != nil { return nil, err }
+	if periods.Firstday == "" { return nil, nil }
+
+	from, err := time.Parse(DAY_FORMAT, periods.Firstday)
+	if err != nil { return nil, errors.New("Corrupt ledger periods record of shop " + shopId) }
+
+	through, err := t.get_tx_time(stub)
+	if err != nil { return nil, err }
+	for day := from; !day.After(through); day = day.AddDate(0, 0, 1) {
+		bucket, ok, err := t.retrieve_ledger_bucket(stub, templateId, day.Format(DAY_FORMAT))
+		if err != nil { return nil, err }
+		if ok == false { continue }
+
+		bucket.Postings = t.scale_shopLedger_money(bucket.Postings, factor)
+		_, err = t.save_ledger_bucket(stub, bucket)
+		if err != nil { return nil, err }
+	}
+	return nil, nil
+}
+
+func (t *CardTransactionChaincode) migrate_commission_rule(stub shim.ChaincodeStubInterface, scope string, id string, currency string, factor int64) ([]byte, error) {
+
+	bytes, err := stub.GetState(t.get_commissionRuleID(scope, id))
+	if err != nil || bytes == nil { return nil, err }
+
+	var rule CommissionRule
+	err = json.Unmarshal(bytes, &rule)
+	if err != nil { return nil, errors.New("Corrupt commission rule record") }
+	if rule.Currency != "" { return nil, nil }
+
+	rule.Currency = currency
+	rule.Fixed = rule.Fixed * factor
+
+	bytes, err = json.Marshal(rule)
+	if err != nil { return nil, errors.New("Error converting commission rule") }
+	err = stub.PutState(t.get_commissionRuleID(scope, id), bytes)
+	if err != nil { return nil, errors.New("Error storing commission rule") }
+
+	return bytes, nil
+}
+
+//=================================================================================================================================
+//	 Commission Functions - KAKACENTER commission on spend
+//=================================================================================================================================
+func (t *CardTransactionChaincode) get_commissionRuleID(scope string, id string) (string) {
+	return "commissionrule-" + scope + "-" + id
+}
+
+func (t *CardTransactionChaincode) get_commissionLedgerID(shopId string) (string) {
+	return "commission-" + shopId
+}
+
+//=================================================================================================================================
+//	 set_commission_rule - rate 0 and fixed 0 removes the rule
+//=================================================================================================================================
+func (t *CardTransactionChaincode) set_commission_rule(stub shim.ChaincodeStubInterface, caller string, caller_affiliation int, scope string, id string, rate int, fixedStr string, currency string) ([]byte, error) {
+
+	if caller_affiliation != KAKACENTER {
+		return nil, errors.New("Permission denied: only KAKACENTER can set commission")
+	}
+	if scope != COMMISSION_SHOP && scope != COMMISSION_TEMPLATE {
+		return nil, errors.New("Invalid commission scope: " + scope)
+	}
+	fixed, err := t.parse_money(fixedStr, currency)
+	if err != nil { return nil, err }
+	if rate < 0 || rate > 10000 {
+		return nil, errors.New("Invalid commission rate")
+	}
+
+	ruleId := t.get_commissionRuleID(scope, id)
+	if rate == 0 && fixed == 0 {
+		err := stub.DelState(ruleId)
+		if err != nil { return nil, errors.New("Error removing commission rule") }
+	} else {
+		var rule CommissionRule
+		rule.Scope = scope
+		rule.Id = id
+		rule.Rate = rate
+		rule.Fixed = fixed
+		rule.Currency = currency
+
+		bytes, err := json.Marshal(rule)
+		if err != nil { return nil, errors.New("Error converting commission rule") }
+		err = stub.PutState(ruleId, bytes)
+		if err != nil { return nil, errors.New("Error storing commission rule") }
+	}
+
+	_, err = t.add_admin_audit(stub, caller, "set_commission_rule", scope + " " + id, "rate " + strconv.Itoa(rate) + " fixed " + fixedStr + " " + currency)
+	if err != nil { return nil, err }
+
+	return nil, nil
+}
+
+//=================================================================================================================================
+//	 find_commission_rule - rule of the template, otherwise rule of the shop. ok is false when there is none
+//=================================================================================================================================
+func (t *CardTransactionChaincode) find_commission_rule(stub shim.ChaincodeStubInterface, templateId string, shopId string) (CommissionRule, bool, error) {
+
+	var rule CommissionRule
+	bytes, err := stub.GetState(t.get_commissionRuleID(COMMISSION_TEMPLATE, templateId))
+	if err != nil { return rule, false, errors.New("Error retrieving commission rule") }
+
+	if bytes == nil {
+		bytes, err = stub.GetState(t.get_commissionRuleID(COMMISSION_SHOP, shopId))
+		if err != nil { return rule, false, errors.New("Error retrieving commission rule") }
+	}
+	if bytes == nil { return rule, false, nil }
+
+	err = json.Unmarshal(bytes, &rule)
+	if err != nil { return rule, false, errors.New("Corrupt commission rule record") }
+
+	return rule, true, nil
+}
+
+func (t *CardTransactionChaincode) retrieve_commission_ledger(stub shim.ChaincodeStubInterface, shopId string) (CommissionLedger, error) {
+
+	var ledger CommissionLedger
+	ledger.Shopid = shopId
+
+	bytes, err := stub.GetState(t.get_commissionLedgerID(shopId))
+	if err != nil { return ledger, errors.New("Error retrieving commission ledger of shop " + shopId) }
+
+	if len(bytes) == 0 {
+		ledger.Minorunits = true
+	} else {
+		err = json.Unmarshal(bytes, &ledger)
+		if err != nil { return ledger, errors.New("Corrupt commission ledger of shop " + shopId) }
+	}
+	return ledger, nil
+}
+
+//=================================================================================================================================
+//	 charge_commission - computes the commission of a spend of money at shopId and adds it to the shop's
+//						 commission ledger. Returns the commission. Money is the principal only, bonus money the shop
+//						 gave away and points are not charged, and spends without principal pay no fixed fee either
+//=================================================================================================================================
+func (t *CardTransactionChaincode) charge_commission(stub shim.ChaincodeStubInterface, templateId string, shopId string, money int64, currency string) (int64, error) {
+
+	if money <= 0 { return 0, nil }
+
+	rule, ok, err := t.find_commission_rule(stub, templateId, shopId)
+	if err != nil || ok == false { return 0, err }
+
+	if rule.Fixed != 0 && rule.Currency != currency {
+		return 0, errors.New("commission fee in " + rule.Currency + " cannot be charged on a " + currency + " spend")
+	}
+	commission := money * int64(rule.Rate) / 10000 + rule.Fixed
+
+	ledger, err := t.retrieve_commission_ledger(stub, shopId)
+	if err != nil { return 0, err }
+
+	if ledger.Minorunits == false {
+		return 0, errors.New("commission ledger of shop " + shopId + " is kept in whole units, KAKACENTER must run migrate_money_minor_units first")
+	}
+	if ledger.Currency == "" {
+		ledger.Currency = currency
+	} else if ledger.Currency != currency {
+		return 0, errors.New("commission ledger of shop " + shopId + " is kept in " + ledger.Currency + ", not " + currency)
+	}
+
+	ledger.Spendnum = ledger.Spendnum + 1
+	ledger.Spendmoney = ledger.Spendmoney + money
+	ledger.Commission = ledger.Commission + commission
+
+	bytes, err := json.Marshal(ledger)
+	if err != nil { return 0, errors.New("Error converting commission ledger") }
+	err = stub.PutState(t.get_commissionLedgerID(shopId), bytes)
+	if err != nil { return 0, errors.New("Error storing commission ledger") }
+
+	return commission, nil
+}
+
+//=================================================================================================================================
+//	 reverse_commission - takes the commission of a spend refunded by a dispute ruling off the shop's commission ledger
+//=================================================================================================================================
+func (t *CardTransactionChaincode) reverse_commission(stub shim.ChaincodeStubInterface, shopId string, money int64, commission int64) ([]byte, error) {
+
+	if commission == 0 { return nil, nil }
+
+	ledger, err := t.retrieve_commission_ledger(stub, shopId)
+	if err != nil { return nil, err }
+
+	ledger.Spendnum = ledger.Spendnum - 1
+	ledger.Spendmoney = ledger.Spendmoney - money
+	ledger.Commission = ledger.Commission - commission
+
+	bytes, err := json.Marshal(ledger)
+	if err != nil { return nil, errors.New("Error converting commission ledger") }
+	err = stub.PutState(t.get_commissionLedgerID(shopId), bytes)
+	if err != nil { return nil, errors.New("Error storing commission ledger") }
+
+	return bytes, nil
+}
+
+//=================================================================================================================================
+//	 get_commission_report - commission ledgers of all shops, or of one shop when shopId is given. KAKACENTER only
+//=================================================================================================================================
+func (t *CardTransactionChaincode) get_commission_report(stub shim.ChaincodeStubInterface, caller string, caller_affiliation int, shopId string) ([]byte, error) {
+
+	if caller_affiliation != KAKACENTER {
+		return nil, errors.New("Permission denied: you are not KAKACENTER users ")
+	}
+
+	var shopIds []string
+	if shopId != "" {
+		shopIds = append(shopIds, shopId)
+	} else {
+		shop_holder, err := t.get_shop_holder(stub)
+		if err != nil { return nil, err }
+
+		var shop Shop
+		for _, shopStr := range shop_holder.Shops {
+			err = json.Unmarshal([]byte(shopStr), &shop)
+			if err != nil { return nil, errors.New("Unmarshal_shopStr: Corrupt shop record"+shopStr) }
+			shopIds = append(shopIds, shop.ShopId)
+		}
+	}
+
+	ledgers := []CommissionLedger{}
+	for _, id := range shopIds {
+		ledger, err := t.retrieve_commission_ledger(stub, id)
+		if err != nil { return nil, err }
+		ledgers = append(ledgers, ledger)
+	}
+	return json.Marshal(ledgers)
+}
+
+//=================================================================================================================================
+//	 Coupon Functions - single-use coupons and vouchers of a shop, kept on the shop ledger of their coupon template
+//=================================================================================================================================
+func (t *CardTransactionChaincode) get_couponID(couponId string) (string) {
+	return "coupon-" + couponId
+}
+
+func (t *CardTransactionChaincode) generate_coupon_id(templateId string, pos int) (string) {
+	basenum := 1000000
+
+	return templateId + "-" + "C" + strconv.Itoa(basenum + pos)
+}
+
+func (t *CardTransactionChaincode) retrieve_coupon(stub shim.ChaincodeStubInterface, couponId string) (Coupon, error) {
+
+	var coupon Coupon
+	bytes, err := stub.GetState(t.get_couponID(couponId))
+	if err != nil { return coupon, errors.New("Error retrieving coupon " + couponId) }
+	if bytes == nil { return coupon, errors.New("Error: no coupon " + couponId + " in world state") }
+
+	err = json.Unmarshal(bytes, &coupon)
+	if err != nil { fmt.Printf("RETRIEVE_COUPON: Corrupt coupon record "+string(bytes)+": %s", err); return coupon, errors.New("Corrupt coupon record " + couponId) }
+
+	return coupon, nil
+}
 
-	} else if function == "update_shop" {  // same with add_shop
-		var shop Shop
-		shop.ShopId = args[cardIDPos]
-		shop.ShopName = args[cardIDPos + 1]
-		shop.LicenseNum = args[cardIDPos + 2]
-		shop.Category = args[cardIDPos + 3]
-		shop.Address = args[cardIDPos + 4]
-		shop.Contact = args[cardIDPos + 5]
-		return t.update_shop(stub, caller, caller_affiliation, shop)
+func (t *CardTransactionChaincode) save_coupon(stub shim.ChaincodeStubInterface, coupon Coupon, couponId string) ([]byte, error) {
+
+	bytes, err := json.Marshal(coupon)
+	if err != nil { return nil, errors.New("Error converting coupon record") }
+
+	err = stub.PutState(t.get_couponID(couponId), bytes)
+	if err != nil { fmt.Printf("SAVE_COUPON: Error storing coupon: %s", err); return nil, errors.New("Error storing coupon") }
+
+	return bytes, nil
+}
+
+func (t *CardTransactionChaincode) add_to_coupon_holder(stub shim.ChaincodeStubInterface, holderKey string, couponId string) ([]byte, error) {
+
+	var coupon_holder Coupon_Holder
+	bytes, err := stub.GetState(holderKey)
+	if err != nil { return nil, errors.New("Unable to get " + holderKey) }
+
+	if len(bytes) != 0 {
+		err = json.Unmarshal(bytes, &coupon_holder)
+		if err != nil {	return nil, errors.New("Corrupt Coupon_Holder record") }
+	}
+	coupon_holder.Coupons = append(coupon_holder.Coupons, couponId)
+
+	bytes, err = json.Marshal(coupon_holder)
+	if err != nil { return nil, errors.New("Error creating Coupon_Holder record") }
+	err = stub.PutState(holderKey, bytes)
+	if err != nil { return nil, errors.New("Unable to put the " + holderKey + " state") }
+
+	return bytes, nil
+}
+
+//=================================================================================================================================
+//	 check_coupon_valid - the coupon is inside its validity window today
+//=================================================================================================================================
+func (t *CardTransactionChaincode) check_coupon_valid(stub shim.ChaincodeStubInterface, coupon Coupon) (error) {
+
+	now, err := t.get_tx_time(stub)
+	if err != nil { return err }
+	today := now.Format(DAY_FORMAT)
+	if coupon.Startdate != "" && today < coupon.Startdate {
+		return errors.New("coupon " + coupon.Couponid + " is not valid before " + coupon.Startdate)
+	}
+	if coupon.Enddate != "" && today > coupon.Enddate {
+		return errors.New("coupon " + coupon.Couponid + " expired on " + coupon.Enddate)
+	}
+	return nil
+}
+
+//=================================================================================================================================
+//	 count_coupon_receiver - counts a coupon of the template received by the consumer against its per consumer limit
+//=================================================================================================================================
+func (t *CardTransactionChaincode) count_coupon_receiver(stub shim.ChaincodeStubInterface, template Coupon, consumer string) (Coupon, error) {
+
+	affiliation, err := t.check_affiliation(stub, consumer)
+	if err != nil || affiliation != CONSUMER {
+		return template, errors.New("coupons can only be given to consumers, " + consumer + " is not a consumer")
+	}
+
+	if template.Counts == nil { template.Counts = make(map[string]int) }
+	if template.Perconsumer > 0 && template.Counts[consumer] >= template.Perconsumer {
+		return template, errors.New("consumer " + consumer + " reached the limit of " + strconv.Itoa(template.Perconsumer) + " coupons of " + template.Templateid)
+	}
+	template.Counts[consumer] = template.Counts[consumer] + 1
+
+	_, err = t.save_coupon(stub, template, template.Templateid)
+	if err != nil { return template, err }
+
+	return template, nil
+}
+
+//=================================================================================================================================
+//	 calc_coupon_discount - money taken off a spend by the coupon
+//=================================================================================================================================
+func (t *CardTransactionChaincode) calc_coupon_discount(coupon Coupon, money int64) (int64) {
+
+	var discount int64
+	if coupon.Kind == COUPON_DISCOUNT {
+		discount = money * coupon.Value / 100
+	} else {
+		discount = coupon.Value
+	}
+	if discount > money { discount = money }		// a voucher worth more than the spend covers it all
+	return discount
+}
+
+//=================================================================================================================================
+//	 create_coupon_template - a shop with manage_template permission defines a coupon or voucher
+//=================================================================================================================================
+func (t *CardTransactionChaincode) create_coupon_template(stub shim.ChaincodeStubInterface, caller string, caller_affiliation int, templateId string, templateJson string) ([]byte, error) {
+
+	shopid, err := t.check_shop_permission(stub, caller, caller_affiliation, PERM_MANAGE_TEMPLATE)
+	if err != nil { return nil, err }
+
+	err = t.check_shop_active(stub, shopid)
+	if err != nil { return nil, err }
+
+	// amounts are decimal strings in the currency of the coupon, a discount is a whole percentage
+	var input struct {
+		Coupon
+		Value		string `json:"value"`
+		Minspend	string `json:"minspend"`
+	}
+	err = json.Unmarshal([]byte(templateJson), &input)
+	if err != nil { return nil, errors.New("Invalid JSON object") }
+	template := input.Coupon
+
+	if template.Currency == "" { template.Currency = DEFAULT_CURRENCY }
+	err = t.check_currency(template.Currency)
+	if err != nil { return nil, err }
+
+	if template.Kind == COUPON_DISCOUNT {
+		percent, err := strconv.Atoi(input.Value)
+		if err != nil || percent <= 0 || percent > 100 { return nil, errors.New("discount of a coupon must be 1 to 100 percent") }
+		template.Value = int64(percent)
+	} else if template.Kind == COUPON_VOUCHER {
+		template.Value, err = t.parse_money(input.Value, template.Currency)
+		if err != nil { return nil, err }
+		if template.Value <= 0 { return nil, errors.New("value of a voucher must be positive") }
+	} else {
+		return nil, errors.New("Invalid coupon kind: " + template.Kind)
+	}
+	if input.Minspend != "" {
+		template.Minspend, err = t.parse_money(input.Minspend, template.Currency)
+		if err != nil { return nil, err }
+	}
+	if template.Perconsumer < 0 { return nil, errors.New("Invalid coupon per consumer limit") }
+
+	if template.Startdate != "" {
+		_, err = time.Parse(DAY_FORMAT, template.Startdate)
+		if err != nil { return nil, errors.New("Invalid coupon start date: " + template.Startdate) }
+	}
+	if template.Enddate != "" {
+		_, err = time.Parse(DAY_FORMAT, template.Enddate)
+		if err != nil { return nil, errors.New("Invalid coupon end date: " + template.Enddate) }
+	}
+	if template.Startdate != "" && template.Enddate != "" && template.Enddate < template.Startdate {
+		return nil, errors.New("coupon ends before it starts")
+	}
+
+	record, err := stub.GetState(t.get_couponID(templateId))
+	if err != nil { return nil, err }
+	if record != nil { return nil, errors.New("coupon template " + templateId + " already exists") }
+
+	shopLedgerBytes, err := t.get_shopLedger_internal(stub, shopid, templateId)
+	if err != nil { return nil, err }
+	if shopLedgerBytes != nil { return nil, errors.New("template " + templateId + " already exists") }
+
+	template.Templateid = templateId
+	template.Couponid = ""
+	template.Shopid = shopid
+	template.Owner = caller
+	template.Issuedate = ""
+	template.Redeemed = false
+	template.Counts = make(map[string]int)
+
+	_, err = t.save_coupon(stub, template, templateId)
+	if err != nil { return nil, err }
+
+	_, err = t.add_to_coupon_holder(stub, COUPON_TEMPLATE_HOLDER, templateId)
+	if err != nil { return nil, err }
+
+	_, err = t.add_new_shopLedger(stub, shopid, templateId)
+	if err != nil { return nil, err }
+
+	return nil, nil
+}
+
+//=================================================================================================================================
+//	 issue_coupon - shop staff allowed to issue cards give a coupon of their shop's template to a consumer
+//=================================================================================================================================
+func (t *CardTransactionChaincode) issue_coupon(stub shim.ChaincodeStubInterface, caller string, caller_affiliation int, templateId string, consumer string) ([]byte, error) {
+
+	shopid, err := t.check_shop_permission(stub, caller, caller_affiliation, PERM_ISSUE_CARD)
+	if err != nil { return nil, err }
+
+	template, err := t.retrieve_coupon(stub, templateId)
+	if err != nil { return nil, err }
+	if template.Couponid != "" { return nil, errors.New(templateId + " is not a coupon template") }
+	if template.Shopid != shopid {
+		return nil, errors.New("Permission Denied: coupon template " + templateId + " belongs to another shop")
+	}
+
+	err = t.check_shop_active(stub, shopid)
+	if err != nil { return nil, err }
+
+	now, err := t.get_tx_time(stub)
+	if err != nil { return nil, err }
+	if template.Enddate != "" && now.Format(DAY_FORMAT) > template.Enddate {
+		return nil, errors.New("coupon template " + templateId + " expired on " + template.Enddate)
+	}
+
+	template, err = t.count_coupon_receiver(stub, template, consumer)
+	if err != nil { return nil, err }
+
+	shopLedger, err := t.retrieve_shopLedger(stub, shopid, templateId)
+	if err != nil { return nil, err }
+	shopLedger.CouponIssued = shopLedger.CouponIssued + 1
+
+	coupon := template
+	coupon.Couponid = t.generate_coupon_id(templateId, shopLedger.CouponIssued)
+	coupon.Owner = consumer
+	coupon.Issuedate, err = t.get_timestamp(stub)
+	if err != nil { return nil, err }
+	coupon.Counts = nil
+
+	_, err = t.save_coupon(stub, coupon, coupon.Couponid)
+	if err != nil { return nil, err }
+
+	_, err = t.add_to_coupon_holder(stub, COUPON_HOLDER, coupon.Couponid)
+	if err != nil { return nil, err }
+
+	_, err = t.update_shopLedger(stub, shopid, templateId, shopLedger)
+	if err != nil { return nil, err }
+
+	return []byte(coupon.Couponid), nil
+}
+
+//=================================================================================================================================
+//	 transfer_coupon - a consumer gives an unused coupon to another consumer
+//=================================================================================================================================
+func (t *CardTransactionChaincode) transfer_coupon(stub shim.ChaincodeStubInterface, caller string, caller_affiliation int, couponId string, receiver string) ([]byte, error) {
+
+	coupon, err := t.retrieve_coupon(stub, couponId)
+	if err != nil { return nil, err }
+
+	if caller_affiliation != CONSUMER || coupon.Couponid == "" || coupon.Owner != caller {
+		return nil, errors.New("Permission denied")
+	}
+	if coupon.Redeemed == true { return nil, errors.New("coupon " + couponId + " is already redeemed") }
+	if receiver == caller { return nil, errors.New("cannot transfer coupon to yourself") }
+
+	err = t.check_coupon_valid(stub, coupon)
+	if err != nil { return nil, err }
+
+	template, err := t.retrieve_coupon(stub, coupon.Templateid)
+	if err != nil { return nil, err }
+	_, err = t.count_coupon_receiver(stub, template, receiver)
+	if err != nil { return nil, err }
+
+	coupon.Owner = receiver
+	_, err = t.save_coupon(stub, coupon, couponId)
+	if err != nil { return nil, err }
+
+	shopLedger, err := t.retrieve_shopLedger(stub, coupon.Shopid, coupon.Templateid)
+	if err != nil { return nil, err }
+	shopLedger.CouponTransferred = shopLedger.CouponTransferred + 1
+	_, err = t.update_shopLedger(stub, coupon.Shopid, coupon.Templateid, shopLedger)
+	if err != nil { return nil, err }
+
+	return nil, nil
+}
+
+//=================================================================================================================================
+//	 redeem_coupon - the consumer uses the coupon on a spend of money at the coupon's shop. The card is charged the
+//					 money less the discount, the discount is booked on the coupon template's shop ledger
+//=================================================================================================================================
+func (t *CardTransactionChaincode) redeem_coupon(stub shim.ChaincodeStubInterface, caller string, caller_affiliation int, couponId string, money int64, point int, sc Card, shopid string) ([]byte, error) {
+
+	coupon, err := t.retrieve_coupon(stub, couponId)
+	if err != nil { return nil, err }
+
+	if caller_affiliation != CONSUMER || coupon.Couponid == "" || coupon.Owner != caller {
+		return nil, errors.New("Permission denied")
+	}
+	if coupon.Redeemed == true { return nil, errors.New("coupon " + couponId + " is already redeemed") }
+	if coupon.Shopid != shopid { return nil, errors.New("coupon " + couponId + " cannot be used at shop " + shopid) }
+
+	err = t.check_coupon_valid(stub, coupon)
+	if err != nil { return nil, err }
+
+	if sc.Currency != coupon.Currency && (coupon.Kind == COUPON_VOUCHER || coupon.Minspend > 0) {
+		return nil, errors.New("coupon in " + coupon.Currency + " cannot be used with a " + sc.Currency + " card")
+	}
+	if money < coupon.Minspend {
+		return nil, errors.New("spend is below the coupon minimum of " + t.format_money(coupon.Minspend, coupon.Currency))
+	}
+
+	discount := t.calc_coupon_discount(coupon, money)
+
+	_, err = t.spend_mp_consumer_to_shop(stub, money - discount, point, caller, sc, shopid)
+	if err != nil { return nil, err }
+
+	coupon.Redeemed = true
+	coupon.Redeemdate, err = t.get_timestamp(stub)
+	if err != nil { return nil, err }
+	coupon.Redeemcard = sc.Cardid
+	_, err = t.save_coupon(stub, coupon, couponId)
+	if err != nil { return nil, err }
+
+	shopLedger, err := t.retrieve_shopLedger(stub, coupon.Shopid, coupon.Templateid)
+	if err != nil { return nil, err }
+	shopLedger.CouponRedeemed = shopLedger.CouponRedeemed + 1
+	shopLedger.CouponDiscount = shopLedger.CouponDiscount + discount
+	_, err = t.update_shopLedger(stub, coupon.Shopid, coupon.Templateid, shopLedger)
+	if err != nil { return nil, err }
+
+	_, err = t.add_card_history(stub, sc.Cardid, "redeem_coupon", couponId + " discount " + t.format_money(discount, sc.Currency))
+	if err != nil { return nil, err }
+
+	return []byte(t.format_money(discount, sc.Currency)), nil
+}
+
+//=================================================================================================================================
+//	 get_coupons - coupons of the caller: all for KAKACENTER, the shop's coupons for shop users and the own coupons
+//				   for consumers
+//=================================================================================================================================
+func (t *CardTransactionChaincode) get_coupons(stub shim.ChaincodeStubInterface, caller string, caller_affiliation int) ([]byte, error) {
+
+	var coupon_holder Coupon_Holder
+	bytes, err := stub.GetState(COUPON_HOLDER)
+	if err != nil { return nil, errors.New("Unable to get coupons") }
+
+	if len(bytes) != 0 {
+		err = json.Unmarshal(bytes, &coupon_holder)
+		if err != nil {	return nil, errors.New("Corrupt Coupon_Holder record") }
+	}
+
+	shopid := ""
+	if caller_affiliation == SHOP { shopid = t.get_Shopid(stub, caller) }
+
+	coupons := []Coupon{}
+	for _, couponId := range coupon_holder.Coupons {
+		coupon, err := t.retrieve_coupon(stub, couponId)
+		if err != nil { return nil, err }
+
+		if caller_affiliation == KAKACENTER ||
+			(caller_affiliation == SHOP && coupon.Shopid == shopid) ||
+			(caller_affiliation == CONSUMER && coupon.Owner == caller) {
+			coupons = append(coupons, coupon)
+		}
+	}
+	return json.Marshal(coupons)
+}
+
+//=================================================================================================================================
+//	 Campaign Functions - promotions of a shop evaluated on deposit and spend
+//=================================================================================================================================
+func (t *CardTransactionChaincode) get_campaignID(campaignId string) (string) {
+	return "campaign-" + campaignId
+}
+
+func (t *CardTransactionChaincode) get_campaign_holder(stub shim.ChaincodeStubInterface) (Campaign_Holder, error) {
+
+	var campaign_holder Campaign_Holder
+	bytes, err := stub.GetState(CAMPAIGN_HOLDER)
+	if err != nil { return campaign_holder, errors.New("Unable to get campaign_holder") }
+
+	if len(bytes) != 0 {
+		err = json.Unmarshal(bytes, &campaign_holder)
+		if err != nil {	return campaign_holder, errors.New("Corrupt Campaign_Holder record") }
+	}
+	return campaign_holder, nil
+}
+
+func (t *CardTransactionChaincode) retrieve_campaign(stub shim.ChaincodeStubInterface, campaignId string) (Campaign, error) {
+
+	var campaign Campaign
+	bytes, err := stub.GetState(t.get_campaignID(campaignId))
+	if err != nil { return campaign, errors.New("Error retrieving campaign " + campaignId) }
+	if bytes == nil { return campaign, errors.New("Error: no campaign " + campaignId + " in world state") }
+
+	err = json.Unmarshal(bytes, &campaign)
+	if err != nil { fmt.Printf("RETRIEVE_CAMPAIGN: Corrupt campaign record "+string(bytes)+": %s", err); return campaign, errors.New("Corrupt campaign record " + campaignId) }
+
+	return campaign, nil
+}
+
+func (t *CardTransactionChaincode) save_campaign(stub shim.ChaincodeStubInterface, campaign Campaign) ([]byte, error) {
+
+	bytes, err := json.Marshal(campaign)
+	if err != nil { return nil, errors.New("Error converting campaign record") }
+
+	err = stub.PutState(t.get_campaignID(campaign.Campaignid), bytes)
+	if err != nil { fmt.Printf("SAVE_CAMPAIGN: Error storing campaign: %s", err); return nil, errors.New("Error storing campaign") }
+
+	return bytes, nil
+}
+
+//=================================================================================================================================
+//	 create_campaign - a shop with manage_template permission starts a promotion on its cards
+//=================================================================================================================================
+func (t *CardTransactionChaincode) create_campaign(stub shim.ChaincodeStubInterface, caller string, caller_affiliation int, campaignId string, campaignJson string) ([]byte, error) {
+
+	shopid, err := t.check_shop_permission(stub, caller, caller_affiliation, PERM_MANAGE_TEMPLATE)
+	if err != nil { return nil, err }
+
+	err = t.check_shop_active(stub, shopid)
+	if err != nil { return nil, err }
+
+	// amounts are decimal strings in the currency of the campaign
+	var input struct {
+		Campaign
+		Threshold		string `json:"threshold"`
+		Rewardmoney		string `json:"rewardmoney"`
+		Budget			string `json:"budget"`
+	}
+	err = json.Unmarshal([]byte(campaignJson), &input)
+	if err != nil { return nil, errors.New("Invalid JSON object") }
+	campaign := input.Campaign
+
+	if campaign.Trigger != CAMPAIGN_DEPOSIT && campaign.Trigger != CAMPAIGN_SPEND {
+		return nil, errors.New("Invalid campaign trigger: " + campaign.Trigger)
+	}
+
+	if campaign.Templateid != "" {
+		template, err := t.retrieve_card(stub, campaign.Templateid)
+		if err != nil { return nil, errors.New("Failed to retrieve card template: " + campaign.Templateid) }
+		if template.Shopid != shopid {
+			return nil, errors.New("Permission Denied: template " + campaign.Templateid + " belongs to another shop")
+		}
+		campaign.Currency = template.Currency
+	}
+	if campaign.Currency == "" { campaign.Currency = DEFAULT_CURRENCY }
+	err = t.check_currency(campaign.Currency)
+	if err != nil { return nil, err }
+
+	campaign.Threshold, err = t.parse_money(input.Threshold, campaign.Currency)
+	if err != nil { return nil, err }
+	if input.Rewardmoney != "" {
+		campaign.Rewardmoney, err = t.parse_money(input.Rewardmoney, campaign.Currency)
+		if err != nil { return nil, err }
+	}
+	if input.Budget != "" {
+		campaign.Budget, err = t.parse_money(input.Budget, campaign.Currency)
+		if err != nil { return nil, err }
+	}
+
+	if campaign.Threshold <= 0 { return nil, errors.New("campaign threshold must be positive") }
+	if campaign.Rewardmoney < 0 || campaign.Rewardpoint < 0 || campaign.Rewardmoney == 0 && campaign.Rewardpoint == 0 {
+		return nil, errors.New("Invalid campaign reward")
+	}
+	if campaign.Rewardmoney > 0 && campaign.Budget <= 0 || campaign.Rewardpoint > 0 && campaign.Pointbudget <= 0 {
+		return nil, errors.New("campaign needs a budget for its rewards")
+	}
+
+	_, err = time.Parse(DAY_FORMAT, campaign.Startdate)
+	if err != nil { return nil, errors.New("Invalid campaign start date: " + campaign.Startdate) }
+	_, err = time.Parse(DAY_FORMAT, campaign.Enddate)
+	if err != nil { return nil, errors.New("Invalid campaign end date: " + campaign.Enddate) }
+	if campaign.Enddate < campaign.Startdate { return nil, errors.New("campaign ends before it starts") }
+
+	record, err := stub.GetState(t.get_campaignID(campaignId))
+	if err != nil { return nil, err }
+	if record != nil { return nil, errors.New("campaign " + campaignId + " already exists") }
+
+	campaign.Campaignid = campaignId
+	campaign.Shopid = shopid
+	campaign.Usedmoney = 0
+	campaign.Usedpoint = 0
+	campaign.Status = CAMPAIGN_ACTIVE
+
+	_, err = t.save_campaign(stub, campaign)
+	if err != nil { return nil, err }
+
+	campaign_holder, err := t.get_campaign_holder(stub)
+	if err != nil { return nil, err }
+	campaign_holder.Campaigns = append(campaign_holder.Campaigns, campaignId)
+
+	bytes, err := json.Marshal(campaign_holder)
+	if err != nil { return nil, errors.New("Error creating Campaign_Holder record") }
+	err = stub.PutState(CAMPAIGN_HOLDER, bytes)
+	if err != nil { return nil, errors.New("Unable to put the CAMPAIGN_HOLDER state") }
+
+	return nil, nil
+}
+
+//=================================================================================================================================
+//	 stop_campaign - the shop ends a campaign before its end date, KAKACENTER can stop any campaign
+//=================================================================================================================================
+func (t *CardTransactionChaincode) stop_campaign(stub shim.ChaincodeStubInterface, caller string, caller_affiliation int, campaignId string) ([]byte, error) {
+
+	campaign, err := t.retrieve_campaign(stub, campaignId)
+	if err != nil { return nil, err }
+
+	if caller_affiliation != KAKACENTER {
+		shopid, err := t.check_shop_permission(stub, caller, caller_affiliation, PERM_MANAGE_TEMPLATE)
+		if err != nil { return nil, err }
+		if campaign.Shopid != shopid { return nil, errors.New("Permission denied") }
+	}
+	if campaign.Status != CAMPAIGN_ACTIVE { return nil, errors.New("campaign " + campaignId + " is " + campaign.Status) }
+
+	campaign.Status = CAMPAIGN_STOPPED
+	_, err = t.save_campaign(stub, campaign)
+	if err != nil { return nil, err }
+
+	return nil, nil
+}
+
+//=================================================================================================================================
+//	 apply_campaigns - grants the rewards of the active campaigns matching a deposit or spend of money on the card.
+//					   Bonus money goes to card.Bonusmoney, bonus points into the card's point lots
+//=================================================================================================================================
+func (t *CardTransactionChaincode) apply_campaigns(stub shim.ChaincodeStubInterface, trigger string, template Card, card Card, money int64) (Card, int64, int, error) {
+
+	var totalMoney int64
+	totalPoint := 0
+	if money <= 0 { return card, 0, 0, nil }
+
+	campaign_holder, err := t.get_campaign_holder(stub)
+	if err != nil { return card, 0, 0, err }
+
+	now, err := t.get_tx_time(stub)
+	if err != nil { return card, 0, 0, err }
+	today := now.Format(DAY_FORMAT)
+	for _, campaignId := range campaign_holder.Campaigns {
+		campaign, err := t.retrieve_campaign(stub, campaignId)
+		if err != nil { return card, 0, 0, err }
+
+		if campaign.Status != CAMPAIGN_ACTIVE || campaign.Trigger != trigger || campaign.Shopid != card.Shopid { continue }
+		if campaign.Templateid != "" && campaign.Templateid != card.Kakaid { continue }
+		if campaign.Currency != card.Currency || today < campaign.Startdate || today > campaign.Enddate { continue }
+		if money < campaign.Threshold { continue }
+
+		times := int64(1)
+		if campaign.Repeat { times = money / campaign.Threshold }
+
+		// the last reward of a campaign gets what is left of its budget
+		bonusMoney := campaign.Rewardmoney * times
+		if bonusMoney > campaign.Budget - campaign.Usedmoney { bonusMoney = campaign.Budget - campaign.Usedmoney }
+		bonusPoint := campaign.Rewardpoint * int(times)
+		if bonusPoint > campaign.Pointbudget - campaign.Usedpoint { bonusPoint = campaign.Pointbudget - campaign.Usedpoint }
+
+		campaign.Usedmoney = campaign.Usedmoney + bonusMoney
+		campaign.Usedpoint = campaign.Usedpoint + bonusPoint
+		if (campaign.Rewardmoney > 0 && campaign.Usedmoney >= campaign.Budget) ||
+			(campaign.Rewardpoint > 0 && campaign.Usedpoint >= campaign.Pointbudget) {
+			campaign.Status = CAMPAIGN_EXHAUSTED
+		}
+		_, err = t.save_campaign(stub, campaign)
+		if err != nil { return card, 0, 0, err }
+
+		card.Bonusmoney = card.Bonusmoney + bonusMoney
+		card, err = t.credit_points(stub, template, card, bonusPoint)
+		if err != nil { return card, 0, 0, err }
+
+		_, err = t.add_card_history(stub, card.Cardid, "campaign", campaignId + " bonus " + t.format_money(bonusMoney, card.Currency) + " and " + strconv.Itoa(bonusPoint) + " points")
+		if err != nil { return card, 0, 0, err }
+
+		totalMoney = totalMoney + bonusMoney
+		totalPoint = totalPoint + bonusPoint
+	}
+	return card, totalMoney, totalPoint, nil
+}
+
+//=================================================================================================================================
+//	 get_campaigns - all campaigns for KAKACENTER, the shop's campaigns for shop users
+//=================================================================================================================================
+func (t *CardTransactionChaincode) get_campaigns(stub shim.ChaincodeStubInterface, caller string, caller_affiliation int) ([]byte, error) {
+
+	if caller_affiliation != KAKACENTER && caller_affiliation != SHOP {
+		return nil, errors.New("Permission denied")
+	}
+	shopid := t.get_Shopid(stub, caller)
+
+	campaign_holder, err := t.get_campaign_holder(stub)
+	if err != nil { return nil, err }
+
+	campaigns := []Campaign{}
+	for _, campaignId := range campaign_holder.Campaigns {
+		campaign, err := t.retrieve_campaign(stub, campaignId)
+		if err != nil { return nil, err }
+
+		if caller_affiliation == KAKACENTER || campaign.Shopid == shopid {
+			campaigns = append(campaigns, campaign)
+		}
+	}
+	return json.Marshal(campaigns)
+}
+
+//=================================================================================================================================
+//	 Gift Functions - cards and amounts offered to a not yet known consumer, locked by a claim code
+//=================================================================================================================================
+func (t *CardTransactionChaincode) get_giftID(giftId string) (string) {
+	return "gift-" + giftId
+}
+
+//	 hash_claim_code - the code is salted with the gift id, so one hash can not be looked up for every gift
+func (t *CardTransactionChaincode) hash_claim_code(giftId string, code string) (string) {
+	sum := sha256.Sum256([]byte(giftId + ":" + code))
+	return hex.EncodeToString(sum[:])
+}
+
+func (t *CardTransactionChaincode) get_gift_holder(stub shim.ChaincodeStubInterface) (Gift_Holder, error) {
+
+	var gift_holder Gift_Holder
+	bytes, err := stub.GetState(GIFT_HOLDER)
+	if err != nil { return gift_holder, errors.New("Unable to get gift_holder") }
+
+	if len(bytes) != 0 {
+		err = json.Unmarshal(bytes, &gift_holder)
+		if err != nil {	return gift_holder, errors.New("Corrupt Gift_Holder record") }
+	}
+	return gift_holder, nil
+}
+
+func (t *CardTransactionChaincode) retrieve_gift(stub shim.ChaincodeStubInterface, giftId string) (GiftOffer, error) {
+
+	var gift GiftOffer
+	bytes, err := stub.GetState(t.get_giftID(giftId))
+	if err != nil { return gift, errors.New("Error retrieving gift " + giftId) }
+	if bytes == nil { return gift, errors.New("Error: no gift " + giftId + " in world state") }
+
+	err = json.Unmarshal(bytes, &gift)
+	if err != nil { fmt.Printf("RETRIEVE_GIFT: Corrupt gift record "+string(bytes)+": %s", err); return gift, errors.New("Corrupt gift record " + giftId) }
+
+	return gift, nil
+}
+
+func (t *CardTransactionChaincode) save_gift(stub shim.ChaincodeStubInterface, gift GiftOffer) ([]byte, error) {
+
+	bytes, err := json.Marshal(gift)
+	if err != nil { return nil, errors.New("Error converting gift record") }
+
+	err = stub.PutState(t.get_giftID(gift.Giftid), bytes)
+	if err != nil { fmt.Printf("SAVE_GIFT: Error storing gift: %s", err); return nil, errors.New("Error storing gift") }
+
+	return bytes, nil
+}
+
+//=================================================================================================================================
+//	 create_gift - the consumer offers the whole card (money and point 0) or an amount of money and points of it.
+//				   codeHash is the hex sha256 of "<giftId>:<claim code>", the sender hands the code to the recipient
+//				   off chain
+//=================================================================================================================================
+func (t *CardTransactionChaincode) create_gift(stub shim.ChaincodeStubInterface, caller string, caller_affiliation int, giftId string, card Card, money int64, point int, codeHash string, days int) ([]byte, error) {
+
+	if 		caller_affiliation	!= CONSUMER					||
+			card.Status			!= STATE_CONSUMER_OWNERSHIP	||
+			card.Owner			!= caller					||
+			card.Scrapped		== true						||
+			card.Expired		== true						||
+			card.Frozen			== true						{
+		return nil, errors.New("Permission denied")
+	}
+	if money < 0 || point < 0 || days <= 0 { return nil, errors.New("Invalid gift amount or validity days") }
+
+	matched, err := regexp.Match("^[0-9a-f]{64}$", []byte(codeHash))
+	if err != nil || matched == false { return nil, errors.New("claim code hash must be a hex sha256") }
+
+	record, err := stub.GetState(t.get_giftID(giftId))
+	if err != nil { return nil, err }
+	if record != nil { return nil, errors.New("gift " + giftId + " already exists") }
+
+	var gift GiftOffer
+	gift.Giftid = giftId
+	gift.Sender = caller
+	gift.Cardid = card.Cardid
+	gift.Templateid = card.Kakaid
+	gift.Currency = card.Currency
+	gift.Codehash = codeHash
+	now, err := t.get_tx_time(stub)
+	if err != nil { return nil, err }
+	gift.Createdate = now.Format(TIME_FORMAT)
+	gift.Expdate = now.AddDate(0, 0, days).Format(TIME_FORMAT)
+	gift.Status = GIFT_OPEN
+
+	if money == 0 && point == 0 {
+		_, err = t.count_spend_limits(stub, card, card.Money + card.Bonusmoney)
+		if err != nil { return nil, err }
+
+		gift.Wholecard = true
+		card.Status = STATE_ESCROW
+	} else {
+		if card.Money < money || card.Point < point { return nil, errors.New("card asset is not enough") }
+
+		_, err = t.count_spend_limits(stub, card, money)
+		if err != nil { return nil, err }
+
+		gift.Money = money
+		gift.Point = point
+		card.Money = card.Money - money
+		card, gift.Lots, err = t.debit_points(stub, card, point)
+		if err != nil { return nil, err }
+
+		_, err = t.post_journal(stub, "gift_offer", giftId, []JournalLine{
+			t.card_line(card, money, point),
+			t.escrow_line(t.get_giftID(giftId), card, -money, -point),
+		})
+		if err != nil { return nil, err }
+	}
+
+	if gift.Wholecard {
+		card, err = t.record_card_activity(stub, card, ACTIVITY_GIFT_OUT, giftId, card.Money, card.Point)
+	} else {
+		card, err = t.record_card_activity(stub, card, ACTIVITY_GIFT_OUT, giftId, money, point)
+	}
+	if err != nil { return nil, err }
+
+	_, err = t.save_card(stub, card)
+	if err != nil { return nil, errors.New("Error saving changes") }
+
+	_, err = t.save_gift(stub, gift)
+	if err != nil { return nil, err }
+
+	gift_holder, err := t.get_gift_holder(stub)
+	if err != nil { return nil, err }
+	gift_holder.Gifts = append(gift_holder.Gifts, giftId)
+
+	bytes, err := json.Marshal(gift_holder)
+	if err != nil { return nil, errors.New("Error creating Gift_Holder record") }
+	err = stub.PutState(GIFT_HOLDER, bytes)
+	if err != nil { return nil, errors.New("Unable to put the GIFT_HOLDER state") }
+
+	_, err = t.add_card_history(stub, card.Cardid, "gift_offer", giftId + " " + t.format_money(money, card.Currency) + " and " + strconv.Itoa(point) + " points")
+	if err != nil { return nil, err }
+
+	return nil, nil
+}
+
+//=================================================================================================================================
+//	 claim_gift - a registered consumer with the claim code takes the gift. An amount goes to cardId, a card of the
+//				  same template owned by the claimer, or to a new card issued from the template when cardId is empty
+//=================================================================================================================================
+func (t *CardTransactionChaincode) claim_gift(stub shim.ChaincodeStubInterface, caller string, caller_affiliation int, giftId string, code string, cardId string) ([]byte, error) {
+
+	if caller_affiliation != CONSUMER { return nil, errors.New("Permission denied: only consumers can claim gifts") }
+
+	gift, err := t.retrieve_gift(stub, giftId)
+	if err != nil { return nil, err }
+
+	if gift.Status != GIFT_OPEN { return nil, errors.New("gift " + giftId + " is " + gift.Status) }
+	if t.hash_claim_code(giftId, code) != gift.Codehash { return nil, errors.New("Invalid claim code") }
+
+	now, err := t.get_tx_time(stub)
+	if err != nil { return nil, err }
+	expdate, err := time.Parse(TIME_FORMAT, gift.Expdate)
+	if err == nil && expdate.Before(now) { return nil, errors.New("gift " + giftId + " expired on " + gift.Expdate) }
+
+	card, err := t.retrieve_card(stub, gift.Cardid)
+	if err != nil { return nil, err }
+
+	if gift.Wholecard {
+		card.Owner = caller
+		card.Status = STATE_CONSUMER_OWNERSHIP
+		card.Getdate, err = t.get_timestamp(stub)
+		if err != nil { return nil, err }
+		gift.Claimcard = card.Cardid
+	} else {
+		if cardId == "" {
+			cardBytes, err := t.new_card_by_template(stub, caller, gift.Templateid)
+			if err != nil { return nil, err }
+			cardId = string(cardBytes)
+		}
 
-	} else if function == "delete_shop" {  // same with add_shop
-		delShopId := args[cardIDPos]
-		return t.delete_shop(stub, caller, caller_affiliation, delShopId)
+		card, err = t.retrieve_card(stub, cardId)
+		if err != nil { return nil, err }
 
+		if 		card.Kakaid		!= gift.Templateid			||
+				card.Status		!= STATE_CONSUMER_OWNERSHIP	||
+				card.Owner		!= caller					||
+				card.Scrapped	== true						||
+				card.Expired	== true						{
+			return nil, errors.New("gift " + giftId + " can only be claimed to your own card of template " + gift.Templateid)
+		}
 
+		card.Money = card.Money + gift.Money
+		card, err = t.credit_point_lots(stub, card, gift.Lots)
+		if err != nil { return nil, err }
+		gift.Claimcard = card.Cardid
 
+		_, err = t.post_journal(stub, "gift_claim", giftId, []JournalLine{
+			t.escrow_line(t.get_giftID(giftId), card, gift.Money, gift.Point),
+			t.card_line(card, -gift.Money, -gift.Point),
+		})
+		if err != nil { return nil, err }
+	}
 
+	if gift.Wholecard {
+		card, err = t.record_card_activity(stub, card, ACTIVITY_GIFT_IN, gift.Sender, card.Money, card.Point)
+	} else {
+		card, err = t.record_card_activity(stub, card, ACTIVITY_GIFT_IN, gift.Sender, gift.Money, gift.Point)
+	}
+	if err != nil { return nil, err }
 
-	} else if function == "create_card_template_by_shop" { 
-		fmt.Printf("------------create create_card_template_by_shop function----------");
-		templateId := args[cardIDPos]
-		templateJson := args[cardIDPos + 1]
-		return t.create_card_template_by_shop(stub, caller, caller_affiliation, templateId, templateJson)
+	_, err = t.save_card(stub, card)
+	if err != nil { return nil, errors.New("Error saving changes") }
 
-	} else if function == "request_card_by_template" { 
-		fmt.Printf("------------request_card_by_template function----------");
-		templateId := args[cardIDPos]
-		return t.request_card_by_template(stub, caller, caller_affiliation, templateId)
+	gift.Status = GIFT_CLAIMED
+	gift.Claimer = caller
+	gift.Closedate, err = t.get_timestamp(stub)
+	if err != nil { return nil, err }
+	_, err = t.save_gift(stub, gift)
+	if err != nil { return nil, err }
 
-	} else if function == "push_card_by_template" { 
-		fmt.Printf("------------push_card_by_template function----------");
-		ownerId := args[cardIDPos]
-		templateId := args[cardIDPos + 1]
-		return t.push_card_by_template(stub, caller, caller_affiliation, ownerId, templateId)
+	_, err = t.add_card_history(stub, card.Cardid, "gift_claim", giftId + " from " + gift.Sender)
+	if err != nil { return nil, err }
 
+	return []byte(card.Cardid), nil
+}
 
+//=================================================================================================================================
+//	 return_escrow - gives a whole card, or an amount held in escrow under escrowKey, back to the card it was taken from
+//=================================================================================================================================
+func (t *CardTransactionChaincode) return_escrow(stub shim.ChaincodeStubInterface, cardId string, escrowKey string, wholecard bool, money int64, point int, lots []PointLot, action string, reference string) (Card, error) {
 
-	} else if function == "create_card_template" { 
-		fmt.Printf("------------create template function----------");
-		return t.create_card_template(stub, caller, caller_affiliation, args[cardIDPos])
+	card, err := t.retrieve_card(stub, cardId)
+	if err != nil { return card, err }
 
-	} else if function == "transfer_template_to_shop" {
+	if wholecard {
+		card.Status = STATE_CONSUMER_OWNERSHIP
+	} else {
+		card.Money = card.Money + money
+		card, err = t.credit_point_lots(stub, card, lots)
+		if err != nil { return card, err }
+
+		_, err = t.post_journal(stub, action, reference, []JournalLine{
+			t.escrow_line(escrowKey, card, money, point),
+			t.card_line(card, -money, -point),
+		})
+		if err != nil { return card, err }
+	}
 
-		cardTemplateId := args[1]
-		cardTemplate, err := t.retrieve_card(stub, cardTemplateId)
-		if err != nil { fmt.Printf("INVOKE: Error retrieving v5c: %s", err); 
-						return nil, errors.New("Error retrieving v5c") }
+	_, err = t.save_card(stub, card)
+	if err != nil { return card, errors.New("Error saving changes") }
 
-		rec_user := args[2]
-		rec_affiliation , err := t.check_affiliation(stub, rec_user)
-			if err != nil  { return nil, errors.New("Invalid rec_affiliation value passed") }
-		return t.transfer_template_to_shop(stub, cardTemplate, caller, caller_affiliation, rec_user, rec_affiliation)
+	return card, nil
+}
 
-	//} else if function == "update_template" {
-	//	cardTemplateId := args[1]
-	//	updatedCardJson := args[2]
+//=================================================================================================================================
+//	 return_gift - gives the card or the amount of an open gift back to the sender's card
+//=================================================================================================================================
+func (t *CardTransactionChaincode) return_gift(stub shim.ChaincodeStubInterface, gift GiftOffer, status string) ([]byte, error) {
 
-	//	return t.update_template(stub, caller, caller_affiliation, cardTemplateId, updatedCardJson)
+	card, err := t.return_escrow(stub, gift.Cardid, t.get_giftID(gift.Giftid), gift.Wholecard, gift.Money, gift.Point, gift.Lots, "gift_" + status, gift.Giftid)
+	if err != nil { return nil, err }
 
-	} else if function == "create_batch_card_by_template" { 
-		cardTemplateId := args[1]
-		cardNum, err := strconv.Atoi(args[2])
-		if err != nil { fmt.Printf("strconv.Atoi(args[2]) card number error: ", err); 
-						return nil, errors.New("strconv.Atoi(args[3]) card number error") }
+	gift.Status = status
+	gift.Closedate, err = t.get_timestamp(stub)
+	if err != nil { return nil, err }
+	_, err = t.save_gift(stub, gift)
+	if err != nil { return nil, err }
 
-		//create_batch_card_by_template(stub , caller string, caller_affiliation int, 
-		//							cardTemplate_KakaIDs string, initCard Card, cardIDPrefix string, cardNum int)
-		return t.create_batch_card_by_template(stub, caller, caller_affiliation, cardTemplateId, cardNum)
+	_, err = t.add_card_history(stub, card.Cardid, "gift_" + status, gift.Giftid)
+	if err != nil { return nil, err }
 
-	} else if function == "scrap_card" {
-		
-		cardid := args[1]
-		card, err := t.retrieve_card(stub, cardid)
-		if err != nil { fmt.Printf("INVOKE: Error retrieving v5c: %s", err); 
-						return nil, errors.New("Error retrieving v5c") }
-		return t.scrap_card(stub, card, caller)
+	return nil, nil
+}
 
-	} else if strings.Contains(function, "update") == true{
+//=================================================================================================================================
+//	 revoke_gift - the sender takes back a gift that is not claimed yet
+//=================================================================================================================================
+func (t *CardTransactionChaincode) revoke_gift(stub shim.ChaincodeStubInterface, caller string, caller_affiliation int, giftId string) ([]byte, error) {
 
-		cardid := args[1]
-		newValue := args[2]
-		card, err := t.retrieve_card(stub, cardid)
-		if err != nil { fmt.Printf("INVOKE: Error retrieving v5c: %s", err); 
-						return nil, errors.New("Error retrieving v5c") }
+	gift, err := t.retrieve_gift(stub, giftId)
+	if err != nil { return nil, err }
 
-		if function == "update_ct_shopname"  	    { return t.update_ct_shopname(stub, card, caller, caller_affiliation, newValue)
-		} else if function == "update_ct_shopid"       { return t.update_ct_shopid(stub, card, caller, caller_affiliation, newValue)
-		} else if function == "update_ct_cardid"       { return t.update_ct_cardid(stub, card, caller, caller_affiliation, newValue)
-		} else if function == "update_ct_category" 	{ return t.update_ct_category(stub, card, caller, caller_affiliation, newValue)
-		} else if function == "update_ct_cardlevel" 	{ return t.update_ct_cardlevel(stub, card, caller, caller_affiliation, newValue)
-		} else if function == "update_ct_cardclass" 	{ return t.update_ct_cardclass(stub, card, caller, caller_affiliation, newValue)
-		} else if function == "update_ct_tel" 			{ return t.update_ct_tel(stub, card, caller, caller_affiliation, newValue)
-		} else if function == "update_ct_password" 	{ return t.update_ct_password(stub, card, caller, caller_affiliation, newValue)
-		} else if function == "update_ct_money" 		{ return t.update_ct_money(stub, card, caller, caller_affiliation, newValue)
-		} else if function == "update_ct_point" 		{ return t.update_ct_point(stub, card, caller, caller_affiliation, newValue)
-		} else if function == "update_ct_expdate" 		{ return t.update_ct_expdate(stub, card, caller, caller_affiliation, newValue)
-		} else if function == "update_ct_expired" 		{ return t.update_ct_expired(stub, card, caller, caller_affiliation, newValue)}
+	if gift.Sender != caller { return nil, errors.New("Permission denied") }
+	if gift.Status != GIFT_OPEN { return nil, errors.New("gift " + giftId + " is " + gift.Status) }
 
-	} else if strings.Contains(function, "transfer_card") == true{
-		
-		cardid := args[1]
-		card, err := t.retrieve_card(stub, cardid)
-		if err != nil { fmt.Printf("INVOKE: Error retrieving v5c: %s", err); 
-						return nil, errors.New("Error retrieving v5c") }
+	return t.return_gift(stub, gift, GIFT_REVOKED)
+}
 
-		rec_user := args[2]
-		rec_affiliation , err := t.check_affiliation(stub, rec_user)
-			if err != nil  { return nil, errors.New("Invalid rec_affiliation value passed") }
-												
-		vbytes, err := json.Marshal(card)
-			if err != nil { return nil, errors.New("ERROR: Invalid card object,cannot Marshal to bytes") }
-		fmt.Printf("Card Content: %s", string(vbytes)); 
+//=================================================================================================================================
+//	 expire_gifts - returns all open gifts past their expiry date to their senders. Any registered user can run it
+//=================================================================================================================================
+func (t *CardTransactionChaincode) expire_gifts(stub shim.ChaincodeStubInterface, caller string, caller_affiliation int) ([]byte, error) {
 
+	gift_holder, err := t.get_gift_holder(stub)
+	if err != nil { return nil, err }
 
-		if  function == "transfer_card_shop_to_consumer"   { return t.transfer_card_shop_to_consumer(stub, card, caller, caller_affiliation, rec_user, rec_affiliation)
-		} else if  function == "transfer_card_consumer_to_consumer" 	   { return t.transfer_card_consumer_to_consumer(stub, card, caller, caller_affiliation, rec_user, rec_affiliation)
-		} else if  function == "transfer_card_consumer_to_shop"  { return t.transfer_card_consumer_to_shop(stub, card, caller, caller_affiliation, rec_user, rec_affiliation) }
-	
-	} else if strings.Contains(function, "_mp_") == true{
+	now, err := t.get_tx_time(stub)
+	if err != nil { return nil, err }
+	total := 0
+	for _, giftId := range gift_holder.Gifts {
+		gift, err := t.retrieve_gift(stub, giftId)
+		if err != nil { return nil, err }
+		if gift.Status != GIFT_OPEN { continue }
 
-		money, err := strconv.Atoi(args[1])
-		if err != nil { fmt.Printf("strconv.Atoi args4 money error: ", err); 
-						return nil, errors.New("strconv.Atoi args4 money error") }
+		expdate, err := time.Parse(TIME_FORMAT, gift.Expdate)
+		if err != nil || expdate.After(now) { continue }
 
-		point, err := strconv.Atoi(args[2])
-		if err != nil { fmt.Printf("strconv.Atoi args4 point error: ", err); 
-						return nil, errors.New("strconv.Atoi args4 point error") }
+		_, err = t.return_gift(stub, gift, GIFT_EXPIRED)
+		if err != nil { return nil, err }
+		total = total + 1
+	}
 
-		fmt.Printf("transfer mp start ")
-		if  function == "transfer_mp_consumer_to_consumer"   {    //(caller, money, point, sccardid, receiver, tcardid)
-				
-			sccardid := args[3]
-			scard, err := t.retrieve_card(stub, sccardid)
-			if err != nil { fmt.Printf("INVOKE: Error retrieving v5c: %s", err); 
-							return nil, errors.New("Error retrieving v5c") }
+	fmt.Printf("expire_gifts: %d gifts returned", total)
+	return []byte(strconv.Itoa(total)), nil
+}
 
-			receiver := args[4]		
-			tcardid := args[5]
-			tcard, err := t.retrieve_card(stub, tcardid)
-			if err != nil { fmt.Printf("INVOKE: Error retrieving v5c: %s", err); 
-							return nil, errors.New("Error retrieving v5c") }
-			
-			return t.transfer_mp_consumer_to_consumer(stub, money , point , caller , scard, receiver , tcard )
+//=================================================================================================================================
+//	 return_template_escrows - returns the open gifts and pending transfers of cards of a template to their senders
+//							   before the template is scrapped
+//=================================================================================================================================
+func (t *CardTransactionChaincode) return_template_escrows(stub shim.ChaincodeStubInterface, templateId string) ([]byte, error) {
 
-		} else if  function == "deposit_mp_shop_to_consumer" 	   { //(caller, money, point, receiver, tcardid)
+	gift_holder, err := t.get_gift_holder(stub)
+	if err != nil { return nil, err }
 
-			fmt.Printf("deposit_mp_shop_to_consumer 1")
-			receiver := args[3]		
-			tcardid := args[4]
-			tcard, err := t.retrieve_card(stub, tcardid)
-			fmt.Printf("deposit_mp_shop_to_consumer 2")
-			if err != nil { fmt.Printf("INVOKE: Error retrieving v5c: %s", err); 
-							return nil, errors.New("Error retrieving v5c") }
+	for _, giftId := range gift_holder.Gifts {
+		gift, err := t.retrieve_gift(stub, giftId)
+		if err != nil { return nil, err }
+		if gift.Templateid != templateId || gift.Status != GIFT_OPEN { continue }
 
-			fmt.Printf("get into deposit_mp_shop_to_consumer 3");
-			return t.deposit_mp_shop_to_consumer(stub, money , point , caller, receiver , tcard)
+		_, err = t.return_gift(stub, gift, GIFT_RETURNED)
+		if err != nil { return nil, err }
+	}
 
-		} else if  function == "spend_mp_consumer_to_shop"  {  //(caller, money, point, sccardid, shopid)
-			
-			fmt.Printf("spend_mp_consumer_to_shop 1")
-			sccardid := args[3]
-			scard, err := t.retrieve_card(stub, sccardid)
-			fmt.Printf("spend_mp_consumer_to_shop 2")
-			if err != nil { fmt.Printf("INVOKE: Error retrieving v5c: %s", err); 
-							return nil, errors.New("Error retrieving v5c") }
-fmt.Printf("spend_mp_consumer_to_shop 13")
+	transfer_holder, err := t.get_pending_transfer_holder(stub)
+	if err != nil { return nil, err }
 
-			shopid := args[4]
-			fmt.Printf("get into spend_mp_consumer_to_shop");
-			return t.spend_mp_consumer_to_shop(stub, money , point , caller , scard, shopid) }
-	
-	} 
+	for _, transferId := range transfer_holder.Transfers {
+		transfer, err := t.retrieve_pending_transfer(stub, transferId)
+		if err != nil { return nil, err }
+		if transfer.Status != TRANSFER_PENDING { continue }
 
-	return nil, errors.New("Function of that name doesn't exist.")
+		card, err := t.retrieve_card(stub, transfer.Cardid)
+		if err != nil { return nil, err }
+		if card.Kakaid != templateId { continue }
 
+		_, err = t.close_pending_transfer(stub, transfer, TRANSFER_RETURNED)
+		if err != nil { return nil, err }
+	}
+	return nil, nil
 }
 
-//=================================================================================================================================	
-//	Query - Called on chaincode query. Takes a function name passed and calls that function. Passes the
-//  		initial arguments passed are passed on to the called function.
-//=================================================================================================================================	
-func (t *CardTransactionChaincode) Query(stub shim.ChaincodeStubInterface, function string, args []string) ([]byte, error) {
-													
-	//caller, caller_affiliation, err := t.get_caller_data(stub)
-	//if err != nil { fmt.Printf("QUERY: Error retrieving caller details", err); return nil, errors.New("QUERY: Error retrieving caller details: "+err.Error()) }
-	caller := args[0]
- 	caller_affiliation , err := t.check_affiliation(stub, caller)
-	if err != nil  { return nil, errors.New("Invalid caller_affiliation value") }
-															
-	if function == "get_users" { 
-		fmt.Printf("exec function:  get_users "); 
-		return t.get_users(stub, caller)
+//=================================================================================================================================
+//	 get_gifts - all gifts for KAKACENTER, the gifts a consumer sent or claimed. Claim code hashes are not returned
+//=================================================================================================================================
+func (t *CardTransactionChaincode) get_gifts(stub shim.ChaincodeStubInterface, caller string, caller_affiliation int) ([]byte, error) {
 
-	} else if function == "get_user_detail" { 
-		fmt.Printf("exec function:  get_user_detail "); 
-		userId := args[1]
-		ubytes,err :=  t.get_user_detail(stub, caller, caller_affiliation, userId)
-		if err != nil { fmt.Printf("get_user_detail error: ", err); 
-						return nil, errors.New("get_user_detail error") }
+	gift_holder, err := t.get_gift_holder(stub)
+	if err != nil { return nil, err }
 
-		return ubytes, nil
+	gifts := []GiftOffer{}
+	for _, giftId := range gift_holder.Gifts {
+		gift, err := t.retrieve_gift(stub, giftId)
+		if err != nil { return nil, err }
 
+		if caller_affiliation == KAKACENTER || gift.Sender == caller || gift.Claimer == caller {
+			gift.Codehash = ""
+			gifts = append(gifts, gift)
+		}
+	}
+	return json.Marshal(gifts)
+}
 
+//=================================================================================================================================
+//	 Pending Transfer Functions - transfers the receiver has to accept, the value is held in escrow meanwhile
+//=================================================================================================================================
+func (t *CardTransactionChaincode) get_pendingTransferID(transferId string) (string) {
+	return "pendingtransfer-" + transferId
+}
 
+func (t *CardTransactionChaincode) get_pending_transfer_holder(stub shim.ChaincodeStubInterface) (PendingTransfer_Holder, error) {
 
-	} else if function == "get_shops" { 
-		fmt.Printf("exec function:  get_shops "); 
-		return t.get_shops(stub, caller)
+	var transfer_holder PendingTransfer_Holder
+	bytes, err := stub.GetState(PENDING_TRANSFER_HOLDER)
+	if err != nil { return transfer_holder, errors.New("Unable to get pending_transfer_holder") }
 
-	} else if function == "get_shop_detail" { 
-		fmt.Printf("exec function:  get_shop_detail "); 
-		shopId := args[1]
-		shopbytes,err :=  t.get_shop_detail(stub, caller, caller_affiliation, shopId)
-		if err != nil { fmt.Printf("get_shop_detail error: ", err); 
-						return nil, errors.New("get_shop_detail error") }
+	if len(bytes) != 0 {
+		err = json.Unmarshal(bytes, &transfer_holder)
+		if err != nil {	return transfer_holder, errors.New("Corrupt PendingTransfer_Holder record") }
+	}
+	return transfer_holder, nil
+}
 
-		return shopbytes, nil
+func (t *CardTransactionChaincode) retrieve_pending_transfer(stub shim.ChaincodeStubInterface, transferId string) (PendingTransfer, error) {
 
+	var transfer PendingTransfer
+	bytes, err := stub.GetState(t.get_pendingTransferID(transferId))
+	if err != nil { return transfer, errors.New("Error retrieving transfer " + transferId) }
+	if bytes == nil { return transfer, errors.New("Error: no transfer " + transferId + " in world state") }
 
+	err = json.Unmarshal(bytes, &transfer)
+	if err != nil { fmt.Printf("RETRIEVE_PENDING_TRANSFER: Corrupt transfer record "+string(bytes)+": %s", err); return transfer, errors.New("Corrupt transfer record " + transferId) }
 
+	return transfer, nil
+}
 
-	} else if function == "get_card_details" { 
-		fmt.Printf("exec function:  get_user_detail "); 
-		
-			if len(args) != 2 { fmt.Printf("Incorrect number of arguments passed"); 
-				return nil, errors.New("QUERY: Incorrect number of arguments passed") }
-	
-			v, err := t.retrieve_card(stub, args[1])
-			if err != nil { fmt.Printf("QUERY: Error retrieving v5c: %s", err); 
-				return nil, errors.New("QUERY: Error retrieving v5c "+err.Error()) }
-	
-			return t.get_card_details(stub, v, caller, caller_affiliation)
-			
-	} else if function == "get_cards" {
-			return t.get_cards(stub, caller, caller_affiliation)
+func (t *CardTransactionChaincode) save_pending_transfer(stub shim.ChaincodeStubInterface, transfer PendingTransfer) ([]byte, error) {
 
-	} else if function == "get_card_templates" {
-			return t.get_card_templates(stub, caller, caller_affiliation)
-	} else if function == "get_shopLedger" {
-			shopid := args[1]
-			templateid := args[2]
-			return t.get_shopLedger(stub, caller, caller_affiliation, shopid, templateid)
-	}   
+	bytes, err := json.Marshal(transfer)
+	if err != nil { return nil, errors.New("Error converting transfer record") }
 
-	return nil, errors.New("Received unknown function invocation")
-}
+	err = stub.PutState(t.get_pendingTransferID(transfer.Transferid), bytes)
+	if err != nil { fmt.Printf("SAVE_PENDING_TRANSFER: Error storing transfer: %s", err); return nil, errors.New("Error storing transfer") }
 
+	return bytes, nil
+}
 
 //=================================================================================================================================
-//	 Transfer Functions
-//=================================================================================================================================
-//	 authority_to_manufacturer
+//	 propose_transfer - the consumer proposes the whole card (money and point 0) or an amount of money and points of
+//						it to another registered consumer, who can accept it for days
 //=================================================================================================================================
-/*
-func (t *CardTransactionChaincode) kakacenter_to_shop(stub shim.ChaincodeStubInterface, v Card, caller string, caller_affiliation int, recipient_name string, recipient_affiliation int) ([]byte, error) {
-	
-	if     	v.status				== STATE_TEMPLATE	&&
-			v.owner					== caller			&&
-			caller_affiliation		== KAKACENTER		&&
-			recipient_affiliation	== SHOP				&&
-			v.scrapped				== false			{		// If the roles and users are ok 
-	
-					v.owner  = recipient_name		// then make the owner the new owner
-					v.status = STATE_SHOP			// and mark it in the state of manufacture
-	
-	} else {									// Otherwise if there is an error
-	
-															fmt.Printf("KAKACENTER_TO_SHOP: Permission Denied");
-															return nil, errors.New("Permission Denied")
-	
+func (t *CardTransactionChaincode) propose_transfer(stub shim.ChaincodeStubInterface, caller string, caller_affiliation int, transferId string, card Card, receiver string, money int64, point int, days int) ([]byte, error) {
+
+	if 		caller_affiliation	!= CONSUMER					||
+			card.Status			!= STATE_CONSUMER_OWNERSHIP	||
+			card.Owner			!= caller					||
+			card.Scrapped		== true						||
+			card.Expired		== true						||
+			card.Frozen			== true						{
+		return nil, errors.New("Permission denied")
 	}
-	
-	_, err := t.save_card(stub, v)						// Write new state
+	if money < 0 || point < 0 || days <= 0 { return nil, errors.New("Invalid transfer amount or validity days") }
+	if receiver == caller { return nil, errors.New("cannot transfer to yourself") }
+
+	receiver_affiliation, err := t.check_affiliation(stub, receiver)
+	if err != nil || receiver_affiliation != CONSUMER {
+		return nil, errors.New("receiver " + receiver + " is not a registered consumer")
+	}
+
+	record, err := stub.GetState(t.get_pendingTransferID(transferId))
+	if err != nil { return nil, err }
+	if record != nil { return nil, errors.New("transfer " + transferId + " already exists") }
+
+	var transfer PendingTransfer
+	transfer.Transferid = transferId
+	transfer.Sender = caller
+	transfer.Receiver = receiver
+	transfer.Cardid = card.Cardid
+	transfer.Currency = card.Currency
+	now, err := t.get_tx_time(stub)
+	if err != nil { return nil, err }
+	transfer.Createdate = now.Format(TIME_FORMAT)
+	transfer.Expdate = now.AddDate(0, 0, days).Format(TIME_FORMAT)
+	transfer.Status = TRANSFER_PENDING
+
+	if money == 0 && point == 0 {
+		_, err = t.count_spend_limits(stub, card, card.Money + card.Bonusmoney)
+		if err != nil { return nil, err }
+
+		transfer.Wholecard = true
+		card.Status = STATE_ESCROW
+	} else {
+		if card.Money < money || card.Point < point { return nil, errors.New("card asset is not enough") }
+
+		_, err = t.count_spend_limits(stub, card, money)
+		if err != nil { return nil, err }
+
+		transfer.Money = money
+		transfer.Point = point
+		card.Money = card.Money - money
+		card, transfer.Lots, err = t.debit_points(stub, card, point)
+		if err != nil { return nil, err }
+
+		_, err = t.post_journal(stub, "transfer_proposal", transferId, []JournalLine{
+			t.card_line(card, money, point),
+			t.escrow_line(t.get_pendingTransferID(transferId), card, -money, -point),
+		})
+		if err != nil { return nil, err }
+	}
+
+	if transfer.Wholecard {
+		card, err = t.record_card_activity(stub, card, ACTIVITY_TRANSFER_OUT, receiver, card.Money, card.Point)
+	} else {
+		card, err = t.record_card_activity(stub, card, ACTIVITY_TRANSFER_OUT, receiver, money, point)
+	}
+	if err != nil { return nil, err }
+
+	_, err = t.save_card(stub, card)
+	if err != nil { return nil, errors.New("Error saving changes") }
+
+	_, err = t.save_pending_transfer(stub, transfer)
+	if err != nil { return nil, err }
+
+	transfer_holder, err := t.get_pending_transfer_holder(stub)
+	if err != nil { return nil, err }
+	transfer_holder.Transfers = append(transfer_holder.Transfers, transferId)
 
-															if err != nil {	fmt.Printf("KAKACENTER_TO_SHOP: Error saving changes: %s", err); return nil, errors.New("Error saving changes")	}
-														
-	return nil, nil									// We are Done
-	
-}
-*/
+	bytes, err := json.Marshal(transfer_holder)
+	if err != nil { return nil, errors.New("Error creating PendingTransfer_Holder record") }
+	err = stub.PutState(PENDING_TRANSFER_HOLDER, bytes)
+	if err != nil { return nil, errors.New("Unable to put the PENDING_TRANSFER_HOLDER state") }
 
+	return nil, nil
+}
 
 //=================================================================================================================================
-//	 card base functions
+//	 accept_transfer - the receiver takes the card, or takes the amount on one of its cards. Like an immediate transfer,
+//					   only points can go to a card of an allied shop and they are converted at the alliance rates
 //=================================================================================================================================
-//   save_card - Writes to the ledger the Card struct passed in a JSON format. Uses the shim file's 
-//				  method 'PutState'.
-//==============================================================================================================================
-func (t *CardTransactionChaincode) save_template(stub shim.ChaincodeStubInterface, v Card, templateId string) (bool, error) {
-	 
-	bytes, err := json.Marshal(v)
-	if err != nil { fmt.Printf("SAVE_CHANGES: Error converting card card record: %s", err); return false, errors.New("Error converting card record") }
+func (t *CardTransactionChaincode) accept_transfer(stub shim.ChaincodeStubInterface, caller string, caller_affiliation int, transferId string, cardId string) ([]byte, error) {
 
-	err = stub.PutState(templateId, bytes)
-	if err != nil { fmt.Printf("SAVE_CHANGES: Error storing  card record: %s", err); return false, errors.New("Error storing card record") }
+	transfer, err := t.retrieve_pending_transfer(stub, transferId)
+	if err != nil { return nil, err }
 
-	return true, nil
-}
+	if caller_affiliation != CONSUMER || transfer.Receiver != caller { return nil, errors.New("Permission denied") }
+	if transfer.Status != TRANSFER_PENDING { return nil, errors.New("transfer " + transferId + " is " + transfer.Status) }
 
-//==============================================================================================================================
-// save_card - Writes to the ledger the Card struct passed in a JSON format. Uses the shim file's 
-//				  method 'PutState'.
-//==============================================================================================================================
-func (t *CardTransactionChaincode) save_card(stub shim.ChaincodeStubInterface, v Card) (bool, error) {
-	 
-	bytes, err := json.Marshal(v)
-	if err != nil { fmt.Printf("SAVE_CHANGES: Error converting card card record: %s", err); return false, errors.New("Error converting card record") }
+	now, err := t.get_tx_time(stub)
+	if err != nil { return nil, err }
+	expdate, err := time.Parse(TIME_FORMAT, transfer.Expdate)
+	if err == nil && expdate.Before(now) { return nil, errors.New("transfer " + transferId + " expired on " + transfer.Expdate) }
 
-	if( t.checkCardId(v.Cardid) == false ){
-		err = stub.PutState(v.Kakaid, bytes)
-	}else{
-		err = stub.PutState(v.Cardid, bytes)
-	}
-	
-	if err != nil { fmt.Printf("SAVE_CHANGES: Error storing  card record: %s", err); return false, errors.New("Error storing card record") }
+	sc, err := t.retrieve_card(stub, transfer.Cardid)
+	if err != nil { return nil, err }
 
-	return true, nil
-}
+	var tc Card
+	if transfer.Wholecard {
+		tc = sc
+		tc.Owner = caller
+		tc.Status = STATE_CONSUMER_OWNERSHIP
+		tc.Getdate, err = t.get_timestamp(stub)
+		if err != nil { return nil, err }
+	} else {
+		tc, err = t.retrieve_card(stub, cardId)
+		if err != nil { return nil, err }
+
+		if 		tc.Status		!= STATE_CONSUMER_OWNERSHIP	||
+				tc.Owner		!= caller					||
+				tc.Scrapped		== true						||
+				tc.Expired		== true						{
+			return nil, errors.New("transfer " + transferId + " can only be accepted to your own card")
+		}
+		if transfer.Money != 0 && tc.Currency != transfer.Currency {
+			return nil, errors.New("cannot transfer " + transfer.Currency + " money to a " + tc.Currency + " card")
+		}
 
-//==============================================================================================================================
-//	 retrieve_card - Gets the state of the data at v5cID in the ledger then converts it from the stored 
-//					JSON into the Card struct for use in the contract. Returns the Card struct.
-//					Returns empty v if it errors.
-//==============================================================================================================================
-func (t *CardTransactionChaincode) retrieve_card(stub shim.ChaincodeStubInterface, cardID string) (Card, error) {
-	
-	var v Card
+		if tc.Shopid != sc.Shopid && transfer.Money != 0 {
+			return nil, errors.New("only points can be transferred to a card of an allied shop")
+		}
 
-	bytes, err := stub.GetState(cardID);					
-	if err != nil {	fmt.Printf("RETRIEVE_CARD: Failed to invoke Card_code_cardID: %s", err); return v, errors.New("RETRIEVE_CARD: Error retrieving card with v5cID = " + cardID) }
+		var converted int
+		tc, converted, err = t.credit_transferred_points(stub, sc, tc, transfer.Point, transfer.Lots)
+		if err != nil { return nil, err }
 
-	err = json.Unmarshal(bytes, &v);						
-	if err != nil {	fmt.Printf("RETRIEVE_CARD: Corrupt card record "+string(bytes)+": %s", err); return v, errors.New("RETRIEVE_CARD: Corrupt card record"+string(bytes))	}
-	
-	return v, nil
-}
+		_, err = t.post_template_transfer(stub, sc, tc, transfer.Money, transfer.Point, converted)
+		if err != nil { return nil, err }
+		tc.Money = tc.Money + transfer.Money
 
-//==============================================================================================================================
-//	 retrieve_card - Gets the state of the data at v5cID in the ledger then converts it from the stored 
-//					JSON into the Card struct for use in the contract. Returns the Card struct.
-//					Returns empty v if it errors.
-//==============================================================================================================================
-func (t *CardTransactionChaincode) get_Shopid(stub shim.ChaincodeStubInterface, caller string) (string) {
+		// the escrow stands in for the sender's card
+		lines := t.card_to_card_lines(sc, tc, transfer.Money, transfer.Point, converted)
+		lines[0] = t.escrow_line(t.get_pendingTransferID(transferId), sc, transfer.Money, transfer.Point)
+		_, err = t.post_journal(stub, "transfer_accept", transferId, lines)
+		if err != nil { return nil, err }
+
+		tc, err = t.record_card_activity(stub, tc, ACTIVITY_TRANSFER_IN, transfer.Sender, transfer.Money, transfer.Point)
+		if err != nil { return nil, err }
+	}
 
-	return caller
+	_, err = t.save_card(stub, tc)
+	if err != nil { return nil, errors.New("Error saving changes") }
+
+	transfer.Status = TRANSFER_ACCEPTED
+	transfer.Targetcard = tc.Cardid
+	transfer.Closedate, err = t.get_timestamp(stub)
+	if err != nil { return nil, err }
+	_, err = t.save_pending_transfer(stub, transfer)
+	if err != nil { return nil, err }
+
+	return nil, nil
 }
 
 //=================================================================================================================================
-//	 Create Function
-//=================================================================================================================================									
-//	 Create Card Template- 								
+//	 close_pending_transfer - gives the card or the amount of a pending transfer back to the sender's card
 //=================================================================================================================================
+func (t *CardTransactionChaincode) close_pending_transfer(stub shim.ChaincodeStubInterface, transfer PendingTransfer, status string) ([]byte, error) {
 
-func (t *CardTransactionChaincode) create_card_template(stub shim.ChaincodeStubInterface, caller string, caller_affiliation int, templateID string) ([]byte, error) {								
+	card, err := t.return_escrow(stub, transfer.Cardid, t.get_pendingTransferID(transfer.Transferid), transfer.Wholecard, transfer.Money, transfer.Point, transfer.Lots, "transfer_" + status, transfer.Transferid)
+	if err != nil { return nil, err }
 
-	fmt.Printf("start  create_card_template \n ");
+	transfer.Status = status
+	transfer.Closedate, err = t.get_timestamp(stub)
+	if err != nil { return nil, err }
+	_, err = t.save_pending_transfer(stub, transfer)
+	if err != nil { return nil, err }
 
-	// build Card obejct by json
-	var v Card																																									
+	_, err = t.add_card_history(stub, card.Cardid, "transfer_" + status, transfer.Transferid)
+	if err != nil { return nil, err }
 
-	kakaid          := "\"Kakaid\":\""+templateID+"\", "	
-	cardid          := "\"Cardid\":\"\", "							
-	shop            := "\"Shop\":\"\", "
-	shopid          := "\"Shopid\":\"\", "
-	category        := "\"Category\":\"\", "
-	cardlevel       := "\"Cardlevel\":\"\", "
-	cardclass       := "\"Cardclass\":\"\", "
-	owner           := "\"Owner\":\""+caller+"\", "
-	tel             := "\"Tel\":\"\", "
-	password   	    := "\"Password\":\"\", "
-	money           := "\"Money\":0, "
-	point           := "\"Point\":0, "
-	releasedate     := "\"Releasedate\":\"\", "
-	expdate         := "\"Expdate\":\"\", "
-	getdate         := "\"Getdate\":\"\", "
-	expired			:= "\"Expired\":false, "
-	scrapped       	:= "\"Scrapped\":false, "
-	status       	:= "\"Status\":0 "
+	return nil, nil
+}
 
-	card_json := "{"+kakaid+cardid+shop+shopid+category+cardlevel+cardclass+owner+tel+password+money+point+releasedate+expdate+getdate+expired+scrapped+status+"}" 	// Concatenates the variables to create the total JSON object
-	
-	fmt.Printf("test json: %s ",card_json);
+//=================================================================================================================================
+//	 expire_transfers - returns all pending transfers past their expiry date to their senders. Any registered user can run it
+//=================================================================================================================================
+func (t *CardTransactionChaincode) expire_transfers(stub shim.ChaincodeStubInterface, caller string, caller_affiliation int) ([]byte, error) {
 
-	err := json.Unmarshal([]byte(card_json), &v)		//  new card json -> Card Object
-	fmt.Printf("test 04 ");
-		if err != nil { 
-			fmt.Printf("test err is not nil , err is : %s",err);
-			return nil, errors.New("Invalid JSON object") 
-			
-			}
+	transfer_holder, err := t.get_pending_transfer_holder(stub)
+	if err != nil { return nil, err }
 
-	fmt.Printf("json to card tempalte object ");
-	fmt.Printf("json to card tempalte object :  kakaid = %s", v.Kakaid);
-	fmt.Printf("json to card tempalte object :  cardid = %s", v.Cardid);
-	fmt.Printf("json to card tempalte object :  owner = %s", v.Owner);
+	now, err := t.get_tx_time(stub)
+	if err != nil { return nil, err }
+	total := 0
+	for _, transferId := range transfer_holder.Transfers {
+		transfer, err := t.retrieve_pending_transfer(stub, transferId)
+		if err != nil { return nil, err }
+		if transfer.Status != TRANSFER_PENDING { continue }
 
-	//if auth to create template
-	if 	caller_affiliation != KAKACENTER {							// Only the regulator can create a new v5c
-		return nil, errors.New("Permission Denied")
+		expdate, err := time.Parse(TIME_FORMAT, transfer.Expdate)
+		if err != nil || expdate.After(now) { continue }
+
+		_, err = t.close_pending_transfer(stub, transfer, TRANSFER_EXPIRED)
+		if err != nil { return nil, err }
+		total = total + 1
 	}
 
-	matched, err := regexp.Match("^[A-z][A-z][A-z]", []byte(templateID))  	// 2 char + 5 digits
-		if err != nil  || matched ==false { fmt.Printf("CREATE_CARD: Invalid cardID: %s", err); return nil, errors.New("Invalid v5cID") }
-	
-	fmt.Printf("test 0 : %s",templateID);
-	fmt.Printf("test 0 ");
-	record, err := stub.GetState(templateID) 			// check if card already exists
-	fmt.Printf("test 1 ");
-		if record != nil { return nil, errors.New("Card already exists") }
-	fmt.Printf("test 2 ");
+	fmt.Printf("expire_transfers: %d transfers returned", total)
+	return []byte(strconv.Itoa(total)), nil
+}
 
-	//save template
-	_, err  = t.save_template(stub, v, templateID)									
-		if err != nil { fmt.Printf("CREATE_CARD_TEMPLATE: Error saving changes: %s", err); 
-						return nil, errors.New("Error saving changes") }
-	
-	fmt.Printf("save tamplate ok");
+func (t *CardTransactionChaincode) decline_transfer(stub shim.ChaincodeStubInterface, caller string, caller_affiliation int, transferId string) ([]byte, error) {
 
-	//save cardID in CARD_TEMPLATE_HOLDER
-	bytes, err := stub.GetState(CARD_TEMPLATE_HOLDER)
-		if err != nil { return nil, errors.New("Unable to get cardKakaIDs") }
-	
-	fmt.Print("get state this template  : %s", string(bytes))
-																	
-	var card_template_holder Card_Holder
-	
-	if len(bytes)!=0 {
-		fmt.Print(" template holder have data : %s", string(bytes))
-		
-		err = json.Unmarshal(bytes, &card_template_holder)
-		if err != nil {	return nil, errors.New("Corrupt Card_Template_Holder record") }
-	}
-	
+	transfer, err := t.retrieve_pending_transfer(stub, transferId)
+	if err != nil { return nil, err }
 
-	card_template_holder.Cards = append(card_template_holder.Cards, templateID)
-	
-	fmt.Print("Marshal, holder num: %s ", string(len(card_template_holder.Cards)))
-	bytes, err = json.Marshal(card_template_holder)
-		if err != nil { fmt.Print("Error creating Card_Template_Holder record") }
+	if transfer.Receiver != caller { return nil, errors.New("Permission denied") }
+	if transfer.Status != TRANSFER_PENDING { return nil, errors.New("transfer " + transferId + " is " + transfer.Status) }
 
-	fmt.Print("put state this template : %s", string(bytes))
+	return t.close_pending_transfer(stub, transfer, TRANSFER_DECLINED)
+}
 
-	err = stub.PutState(CARD_TEMPLATE_HOLDER, bytes)
-		if err != nil { return nil, errors.New("Unable to put the CARD_TEMPLATE_HOLDER state") }
-	
-	return nil, nil
+func (t *CardTransactionChaincode) cancel_transfer(stub shim.ChaincodeStubInterface, caller string, caller_affiliation int, transferId string) ([]byte, error) {
 
-}
+	transfer, err := t.retrieve_pending_transfer(stub, transferId)
+	if err != nil { return nil, err }
 
+	if transfer.Sender != caller { return nil, errors.New("Permission denied") }
+	if transfer.Status != TRANSFER_PENDING { return nil, errors.New("transfer " + transferId + " is " + transfer.Status) }
+
+	return t.close_pending_transfer(stub, transfer, TRANSFER_CANCELLED)
+}
 
 //=================================================================================================================================
-//	 transfer temaplte from kakacenter to shop
+//	 get_pending_transfers - all transfers for KAKACENTER, the transfers a consumer sent or received
 //=================================================================================================================================
-func (t *CardTransactionChaincode) transfer_template_to_shop(stub shim.ChaincodeStubInterface, v Card, caller string, caller_affiliation int, recipient_name string, recipient_affiliation int) ([]byte, error) {
+func (t *CardTransactionChaincode) get_pending_transfers(stub shim.ChaincodeStubInterface, caller string, caller_affiliation int) ([]byte, error) {
 
+	transfer_holder, err := t.get_pending_transfer_holder(stub)
+	if err != nil { return nil, err }
 
-	if      v.Kakaid	== "" {					//If key part of the card is empty it has not been fully manufacturered so cannot be sent
-					fmt.Printf("SHOP_TO_CONSUMER: Car not fully defined")
-					return nil, errors.New("Car not fully defined")
+	transfers := []PendingTransfer{}
+	for _, transferId := range transfer_holder.Transfers {
+		transfer, err := t.retrieve_pending_transfer(stub, transferId)
+		if err != nil { return nil, err }
+
+		if caller_affiliation == KAKACENTER || transfer.Sender == caller || transfer.Receiver == caller {
+			transfers = append(transfers, transfer)
+		}
 	}
-	
-	if 		v.Status				== STATE_TEMPLATE	&& 
-			v.Owner					== caller		&& 
-			caller_affiliation		== KAKACENTER	&&
-			recipient_affiliation	== SHOP			&& 
-			v.Scrapped     == false							{
-			
-					v.Owner = recipient_name
-					v.Status = STATE_SHOP
+	return json.Marshal(transfers)
+}
 
-					timestamp := time.Now().Unix()
-					tm := time.Unix(timestamp, 0)
-					v.Releasedate = tm.Format("2006-01-02 03:04:05 PM")  //  str to timestmap: tm2, _ := time.Parse("01/02/2006", releasedate)
-					v.Getdate = v.Releasedate
-	} else {
-															return nil, errors.New("Permission denied")
+//=================================================================================================================================
+//	 get_template_escrows - open gifts and pending transfers of an amount of cards of a template, the value they hold
+//							in escrow is on none of the cards
+//=================================================================================================================================
+func (t *CardTransactionChaincode) get_template_escrows(stub shim.ChaincodeStubInterface, templateId string) ([]GiftOffer, []PendingTransfer, error) {
+
+	var gifts []GiftOffer
+	var transfers []PendingTransfer
+
+	gift_holder, err := t.get_gift_holder(stub)
+	if err != nil { return nil, nil, err }
+	for _, giftId := range gift_holder.Gifts {
+		gift, err := t.retrieve_gift(stub, giftId)
+		if err != nil { return nil, nil, err }
+		if gift.Templateid != templateId || gift.Wholecard || gift.Status != GIFT_OPEN { continue }
+		gifts = append(gifts, gift)
 	}
-	
-	_, err := t.save_template(stub, v, v.Kakaid)
-	
-															if err != nil { fmt.Printf("SHOP_TO_CONSUMER: Error saving changes: %s", err); return nil, errors.New("Error saving changes") }
-	
-	return nil, nil
-	
+
+	transfer_holder, err := t.get_pending_transfer_holder(stub)
+	if err != nil { return nil, nil, err }
+	for _, transferId := range transfer_holder.Transfers {
+		transfer, err := t.retrieve_pending_transfer(stub, transferId)
+		if err != nil { return nil, nil, err }
+		if transfer.Wholecard || transfer.Status != TRANSFER_PENDING { continue }
+
+		card, err := t.retrieve_card(stub, transfer.Cardid)
+		if err != nil { return nil, nil, err }
+		if card.Kakaid != templateId { continue }
+		transfers = append(transfers, transfer)
+	}
+	return gifts, transfers, nil
 }
 
+//=================================================================================================================================
+//	 Merge and Split Functions - move balance between cards of one template and owner, the shop ledger only counts
+//								 the retired and minted cards
+//=================================================================================================================================
+//	 check_card_owned - the card is in use by the consumer
+//=================================================================================================================================
+func (t *CardTransactionChaincode) check_card_owned(card Card, caller string) (error) {
+
+	if 		card.Status		!= STATE_CONSUMER_OWNERSHIP	||
+			card.Owner		!= caller					||
+			card.Scrapped	== true						||
+			card.Expired	== true						{
+		return errors.New("card " + card.Cardid + " is not in use by " + caller)
+	}
+	if card.Frozen == true { return errors.New("card " + card.Cardid + " is frozen") }
+	return nil
+}
 
-//=================================================================================================================================									
-//	 Create Card Template  by Shop						
 //=================================================================================================================================
+//	 check_card_unencumbered - a card with an open gift, a pending transfer or an open dispute has value coming back to
+//							   it and can not be retired
+//=================================================================================================================================
+func (t *CardTransactionChaincode) check_card_unencumbered(stub shim.ChaincodeStubInterface, cardId string) (error) {
+
+	gift_holder, err := t.get_gift_holder(stub)
+	if err != nil { return err }
+	for _, giftId := range gift_holder.Gifts {
+		gift, err := t.retrieve_gift(stub, giftId)
+		if err != nil { return err }
+		if gift.Cardid == cardId && gift.Status == GIFT_OPEN { return errors.New("card " + cardId + " has open gift " + giftId) }
+	}
 
-func (t *CardTransactionChaincode) create_card_template_by_shop(stub shim.ChaincodeStubInterface, caller string, caller_affiliation int, templateID string, templateJson string) ([]byte, error) {								
+	transfer_holder, err := t.get_pending_transfer_holder(stub)
+	if err != nil { return err }
+	for _, transferId := range transfer_holder.Transfers {
+		transfer, err := t.retrieve_pending_transfer(stub, transferId)
+		if err != nil { return err }
+		if transfer.Cardid == cardId && transfer.Status == TRANSFER_PENDING { return errors.New("card " + cardId + " has pending transfer " + transferId) }
+	}
 
-	fmt.Printf("start  create_card_template_by_shop \n ");
+	dispute_holder, err := t.get_dispute_holder(stub)
+	if err != nil { return err }
+	for _, disputeId := range dispute_holder.Disputes {
+		dispute, err := t.retrieve_dispute(stub, disputeId)
+		if err != nil { return err }
+		if dispute.Cardid == cardId && (dispute.Status == DISPUTE_OPEN || dispute.Status == DISPUTE_RESPONDED) {
+			return errors.New("card " + cardId + " has open dispute " + disputeId)
+		}
+	}
+	return nil
+}
 
-	// build Card obejct by json
-	var v Card																																									
-	
-	fmt.Printf("test json: %s ",templateJson);
+//=================================================================================================================================
+//	 merge_cards - moves money, bonus money, points and spend of the source cards to the target card and retires them.
+//				   Source cards with open gifts, transfers or disputes are refused
+//=================================================================================================================================
+func (t *CardTransactionChaincode) merge_cards(stub shim.ChaincodeStubInterface, caller string, caller_affiliation int, tcardId string, scardIds []string) ([]byte, error) {
 
-	err := json.Unmarshal([]byte(templateJson), &v)		//  new card json -> Card Object
-	fmt.Printf("test 04 ");
-		if err != nil { 
-			fmt.Printf("test err is not nil , err is : %s",err);
-			return nil, errors.New("Invalid JSON object") 
-			
-			}
+	if caller_affiliation != CONSUMER { return nil, errors.New("Permission denied") }
 
-	fmt.Printf("json to card tempalte object ");
-	fmt.Printf("json to card tempalte object :  kakaid = %s", v.Kakaid);
-	fmt.Printf("json to card tempalte object :  cardid = %s", v.Cardid);
-	fmt.Printf("json to card tempalte object :  owner = %s", v.Owner);
+	tc, err := t.retrieve_card(stub, tcardId)
+	if err != nil { return nil, err }
+	err = t.check_card_owned(tc, caller)
+	if err != nil { return nil, err }
 
-	//if auth to create template
-	if 	caller_affiliation != KAKACENTER && caller_affiliation != SHOP{							// Only the regulator can create a new v5c
-		return nil, errors.New("Permission Denied")
-	}
+	template, err := t.retrieve_card(stub, tc.Kakaid)
+	if err != nil { return nil, errors.New("Failed to retrieve card template: " + tc.Kakaid) }
 
+	shopLedger, err := t.retrieve_shopLedger(stub, tc.Shopid, tc.Kakaid)
+	if err != nil { return nil, err }
 
-	//matched, err := regexp.Match("^[A-z][A-z][A-z]", []byte(templateID))  	// 2 char + 5 digits
-	//	if err != nil  || matched ==false { fmt.Printf("CREATE_CARD: Invalid cardID: %s", err); return nil, errors.New("Invalid v5cID") }
-	
-	fmt.Printf("test 0 : %s",templateID);
-	record, err := stub.GetState(templateID) 			// check if template already exists
-	fmt.Printf("test 1 ");
-		if record != nil { return nil, errors.New("template already exists") }
-	fmt.Printf("test 2 ");
+	merged := make(map[string]bool)
+	for _, scardId := range scardIds {
+		if scardId == tcardId || merged[scardId] { return nil, errors.New("card " + scardId + " listed twice") }
+		merged[scardId] = true
 
-	//save template
-	_, err  = t.save_template(stub, v, templateID)									
-		if err != nil { fmt.Printf("CREATE_CARD_TEMPLATE: Error saving changes: %s", err); 
-						return nil, errors.New("Error saving changes") }
-	
-	fmt.Printf("save tamplate ok");
+		sc, err := t.retrieve_card(stub, scardId)
+		if err != nil { return nil, err }
+		err = t.check_card_owned(sc, caller)
+		if err != nil { return nil, err }
+		if sc.Kakaid != tc.Kakaid { return nil, errors.New("card " + scardId + " is not of template " + tc.Kakaid) }
+		err = t.check_card_unencumbered(stub, scardId)
+		if err != nil { return nil, err }
 
-	//save cardID in CARD_TEMPLATE_HOLDER
-	bytes, err := stub.GetState(CARD_TEMPLATE_HOLDER)
-		if err != nil { return nil, errors.New("Unable to get cardKakaIDs") }
-	
-	fmt.Print("get state this template  : %s", string(bytes))
-																	
-	var card_template_holder Card_Holder
-	
-	if len(bytes)!=0 {
-		fmt.Print(" template holder have data : %s", string(bytes))
-		
-		err = json.Unmarshal(bytes, &card_template_holder)
-		if err != nil {	return nil, errors.New("Corrupt Card_Template_Holder record") }
+		_, err = t.post_journal(stub, "merge", sc.Cardid + " " + tc.Cardid, t.card_to_card_lines(sc, tc, sc.Money + sc.Bonusmoney, sc.Point, sc.Point))
+		if err != nil { return nil, err }
+
+		sc, lots, err := t.debit_points(stub, sc, sc.Point)
+		if err != nil { return nil, err }
+		tc, err = t.credit_point_lots(stub, tc, lots)
+		if err != nil { return nil, err }
+
+		tc.Money = tc.Money + sc.Money
+		tc.Bonusmoney = tc.Bonusmoney + sc.Bonusmoney
+		tc.Totalspend = tc.Totalspend + sc.Totalspend
+
+		sc.Money = 0
+		sc.Bonusmoney = 0
+		sc.Scrapped = true
+		_, err = t.save_card(stub, sc)
+		if err != nil { return nil, errors.New("Error saving changes") }
+
+		_, err = t.add_card_history(stub, sc.Cardid, "merge", "merged into " + tcardId)
+		if err != nil { return nil, err }
+
+		shopLedger.ScrapNum = shopLedger.ScrapNum + 1
 	}
-	
 
-	card_template_holder.Cards = append(card_template_holder.Cards, templateID)
-	
-	fmt.Print("Marshal, holder num: %s ", string(len(card_template_holder.Cards)))
-	bytes, err = json.Marshal(card_template_holder)
-		if err != nil { fmt.Print("Error creating Card_Template_Holder record") }
+	tc, err = t.apply_tier_rules(stub, template, tc)
+	if err != nil { return nil, err }
 
-	fmt.Print("put state this template : %s", string(bytes))
+	_, err = t.save_card(stub, tc)
+	if err != nil { return nil, errors.New("Error saving changes") }
+
+	_, err = t.add_card_history(stub, tc.Cardid, "merge", "merged " + strings.Join(scardIds, ","))
+	if err != nil { return nil, err }
+
+	_, err = t.update_shopLedger(stub, tc.Shopid, tc.Kakaid, shopLedger)
+	if err != nil { return nil, err }
 
-	err = stub.PutState(CARD_TEMPLATE_HOLDER, bytes)
-		if err != nil { return nil, errors.New("Unable to put the CARD_TEMPLATE_HOLDER state") }
-	
 	return nil, nil
+}
 
+//=================================================================================================================================
+//	 split_card - mints an empty card of the same template for the owner and moves money and points to it. Points
+//				  keep their lots. Bonus money stays on the original card
+//=================================================================================================================================
+func (t *CardTransactionChaincode) split_card(stub shim.ChaincodeStubInterface, caller string, caller_affiliation int, sc Card, money int64, point int) ([]byte, error) {
+
+	if caller_affiliation != CONSUMER { return nil, errors.New("Permission denied") }
+
+	err := t.check_card_owned(sc, caller)
+	if err != nil { return nil, err }
+	if money < 0 || point < 0 || money == 0 && point == 0 { return nil, errors.New("Invalid split amount") }
+	if sc.Money < money || sc.Point < point { return nil, errors.New("card asset is not enough") }
+
+	// a split card can be given away whole, so the amount counts against the limits here
+	_, err = t.count_spend_limits(stub, sc, money)
+	if err != nil { return nil, err }
+
+	cardBytes, err := t.new_card_by_template_internal(stub, caller, sc.Kakaid, false)
+	if err != nil { return nil, err }
+
+	tc, err := t.retrieve_card(stub, string(cardBytes))
+	if err != nil { return nil, err }
+	tc.Limits = sc.Limits		// the owner's limits hold on the new card too
+
+	_, err = t.post_journal(stub, "split", sc.Cardid + " " + tc.Cardid, t.card_to_card_lines(sc, tc, money, point, point))
+	if err != nil { return nil, err }
+
+	sc.Money = sc.Money - money
+	sc, lots, err := t.debit_points(stub, sc, point)
+	if err != nil { return nil, err }
+
+	tc.Money = tc.Money + money
+	tc, err = t.credit_point_lots(stub, tc, lots)
+	if err != nil { return nil, err }
+
+	_, err = t.save_card(stub, sc)
+	if err != nil { return nil, errors.New("Error saving changes") }
+	_, err = t.save_card(stub, tc)
+	if err != nil { return nil, errors.New("Error saving changes") }
+
+	detail := t.format_money(money, sc.Currency) + " and " + strconv.Itoa(point) + " points"
+	_, err = t.add_card_history(stub, sc.Cardid, "split", detail + " to " + tc.Cardid)
+	if err != nil { return nil, err }
+	_, err = t.add_card_history(stub, tc.Cardid, "split", detail + " from " + sc.Cardid)
+	if err != nil { return nil, err }
+
+	return []byte(tc.Cardid), nil
 }
 
-/*
-func (t *CardTransactionChaincode) update_template(stub shim.ChaincodeStubInterface, caller string, caller_affiliation int,cardTemplateId string, updatedCardJson string)([]byte, error) {
-	
-	if 		v.Status				== STATE_TEMPLATE	&& 
-			v.Owner					== caller		&& 
-			(caller_affiliation		== KAKACENTER || caller_affiliation		== SHOP	) 	&&
-			v.Scrapped     == false							{
-			
-			
-			cardTemplate, err := t.retrieve_card(stub, cardTemplateId)
-		
-				if err != nil {return nil, errors.New("Failed to retrieve V5C")}
+//=================================================================================================================================
+//	 Spending Limit Functions - template and owner-set limits on money leaving a card
+//=================================================================================================================================
+func (t *CardTransactionChaincode) get_spendCounterID(owner string, templateId string) (string) {
+	return "spendcounter-" + owner + "-" + templateId
+}
 
-			err = json.Unmarshal([]byte(updatedCardJson), &cardTemplate)		//  new card json -> Card Object
-				if err != nil { return nil, errors.New("Invalid JSON object") }
+//	parse_spend_limits - limits from JSON, an empty JSON object removes the limits
+func (t *CardTransactionChaincode) parse_spend_limits(limitsJson string) (*SpendLimits, error) {
 
-			_, err  = t.save_template(stub, cardTemplate)									
-				if err != nil { fmt.Printf("CREATE_CARD_TEMPLATE: Error saving changes: %s", err); 
-						return nil, errors.New("Error saving changes") }
-	
-	} else {
-															return nil, errors.New("Permission denied")
+	var limits SpendLimits
+	err := json.Unmarshal([]byte(limitsJson), &limits)
+	if err != nil { return nil, errors.New("Invalid limits JSON object") }
+
+	if limits.Pertransaction < 0 || limits.Daily < 0 || limits.Monthly < 0 {
+		return nil, errors.New("Invalid limits: negative value")
 	}
-	return nil,nil
+	if limits.Pertransaction == 0 && limits.Daily == 0 && limits.Monthly == 0 { return nil, nil }
+	return &limits, nil
 }
-*/
-//=================================================================================================================================									
-//	 Create Card Template- 								
-//=================================================================================================================================
-func (t *CardTransactionChaincode) generate_card_id(cardTemplate_KakaIDs string, pos int) (string) {
-	basenum := 1000000
 
-	return cardTemplate_KakaIDs + "-" +"A" + strconv.Itoa(basenum + pos)
+//	lower_limit - the lower of two limits where 0 means no limit
+func (t *CardTransactionChaincode) lower_limit(a int64, b int64) (int64) {
+	if a == 0 || (b != 0 && b < a) { return b }
+	return a
 }
 
-func (t *CardTransactionChaincode) checkCardId(cardId string) (bool) {
-	return strings.Contains(cardId, "-")
+//=================================================================================================================================
+//	 set_template_limits - limits for all cards of a template, set by KAKACENTER or the template's shop
+//=================================================================================================================================
+func (t *CardTransactionChaincode) set_template_limits(stub shim.ChaincodeStubInterface, caller string, caller_affiliation int, templateId string, limitsJson string) ([]byte, error) {
+
+	template, err := t.retrieve_template_for_rules(stub, caller, caller_affiliation, templateId)
+	if err != nil { return nil, err }
+
+	template.Limits, err = t.parse_spend_limits(limitsJson)
+	if err != nil { return nil, err }
+
+	_, err = t.save_template(stub, template, templateId)
+	if err != nil { return nil, errors.New("Error saving changes") }
+
+	return nil, nil
 }
 
-func (t *CardTransactionChaincode) create_batch_card_by_template(stub shim.ChaincodeStubInterface, caller string, caller_affiliation int, cardTemplate_KakaIDs string, cardNum int) ([]byte, error) {								
+//=================================================================================================================================
+//	 set_card_limits - the owner sets limits on a card. Limits above the template's are rejected, a card limit of 0
+//					   leaves the template limit in force
+//=================================================================================================================================
+func (t *CardTransactionChaincode) set_card_limits(stub shim.ChaincodeStubInterface, caller string, caller_affiliation int, card Card, limitsJson string) ([]byte, error) {
 
-	if 	caller_affiliation != SHOP {							// Only the regulator can create a new v5c
-		return nil, errors.New("Permission Denied")
+	if caller_affiliation != CONSUMER { return nil, errors.New("Permission denied") }
+	err := t.check_card_owned(card, caller)
+	if err != nil { return nil, err }
+
+	limits, err := t.parse_spend_limits(limitsJson)
+	if err != nil { return nil, err }
+
+	template, err := t.retrieve_card(stub, card.Kakaid)
+	if err != nil { return nil, errors.New("Failed to retrieve card template: " + card.Kakaid) }
+
+	if limits != nil && template.Limits != nil {
+		if (limits.Pertransaction > 0 && t.lower_limit(template.Limits.Pertransaction, limits.Pertransaction) != limits.Pertransaction) ||
+			(limits.Daily > 0 && t.lower_limit(template.Limits.Daily, limits.Daily) != limits.Daily) ||
+			(limits.Monthly > 0 && t.lower_limit(template.Limits.Monthly, limits.Monthly) != limits.Monthly) {
+			return nil, errors.New("card limits cannot be above the limits of template " + card.Kakaid)
+		}
 	}
+	card.Limits = limits
 
-	//matched, err := regexp.Match("^[A-z][A-z][A-z]", []byte(cardTemplate_KakaIDs))  	// 2 char + 5 digits
-	//	if err != nil   || matched ==false { fmt.Printf("CREATE_CARD: Invalid cardID: %s", err); return nil, errors.New("Invalid v5cID") }
-	
-	cardTemplateBytes, err := stub.GetState(cardTemplate_KakaIDs) 			// check if card template exists
-		if cardTemplateBytes == nil { return nil, errors.New("Card temaplte is not exists") }
-	
-	var cardTemplate Card	
-		err = json.Unmarshal(cardTemplateBytes, &cardTemplate)		//  new card json -> Card Object
-			if err != nil { return nil, errors.New("------------Invalid cardTemplateBytes JSON object") }
+	_, err = t.save_card(stub, card)
+	if err != nil { return nil, errors.New("Error saving changes") }
 
-	
-	if 		cardTemplate.Shopid 	 	== "" || 					
-			cardTemplate.Shop  			== "" || 
-			cardTemplate.Cardclass 		== "" || 
-			cardTemplate.Expdate		 == ""  {					//If key part of the card is empty it has not been fully manufacturered so cannot be sent
-															fmt.Printf("SHOP_TO_CONSUMER: Car template not fully defined")
-															return nil, errors.New("Car template not fully defined")
+	return nil, nil
+}
+
+//=================================================================================================================================
+//	 count_spend_limits - counts money leaving the card against the lower of the template and the card limits. The
+//						  counter is kept per owner and template, so splitting a card does not reset it
+//=================================================================================================================================
+func (t *CardTransactionChaincode) count_spend_limits(stub shim.ChaincodeStubInterface, card Card, money int64) (SpendCounter, error) {
+
+	var counter SpendCounter
+	counter.Owner = card.Owner
+	counter.Templateid = card.Kakaid
+	if money <= 0 { return counter, nil }
+
+	template, err := t.retrieve_card(stub, card.Kakaid)
+	if err != nil { return counter, errors.New("Failed to retrieve card template: " + card.Kakaid) }
+
+	var limits SpendLimits
+	if template.Limits != nil { limits = *template.Limits }
+	if card.Limits != nil {
+		limits.Pertransaction = t.lower_limit(limits.Pertransaction, card.Limits.Pertransaction)
+		limits.Daily = t.lower_limit(limits.Daily, card.Limits.Daily)
+		limits.Monthly = t.lower_limit(limits.Monthly, card.Limits.Monthly)
 	}
-	
-	// create new Card by template
-	//var card Card	
-	//err = json.Unmarshal(cardTemplateBytes, &card)		//  new card json -> Card Object
-	//	if err != nil { return nil, errors.New("Invalid JSON object") }
+	if limits.Pertransaction == 0 && limits.Daily == 0 && limits.Monthly == 0 { return counter, nil }
 
+	if limits.Pertransaction > 0 && money > limits.Pertransaction {
+		return counter, errors.New("amount is above the per transaction limit of " + t.format_money(limits.Pertransaction, card.Currency))
+	}
 
-	//once create new card, create or update shop ledger, 
-	var	shopLedger ShopLedger
-	shopid := t.get_Shopid(stub, caller)
-	shopLedgerBytes ,err := t.get_shopLedger_internal(stub,  shopid, cardTemplate_KakaIDs)
-	if shopLedgerBytes == nil {
-		shopLedgerBytes ,err = t.add_new_shopLedger(stub, shopid, cardTemplate_KakaIDs)
+	counterId := t.get_spendCounterID(card.Owner, card.Kakaid)
+	bytes, err := stub.GetState(counterId)
+	if err != nil { return counter, errors.New("Error retrieving spend counter of " + card.Owner) }
+	if len(bytes) != 0 {
+		err = json.Unmarshal(bytes, &counter)
+		if err != nil { return counter, errors.New("Corrupt spend counter record") }
 	}
 
-	err = json.Unmarshal([]byte(shopLedgerBytes), &shopLedger)	
-	if err != nil { return nil, errors.New("------------Invalid shopLedgerBytes JSON object") }
+	// spends older than the monthly window are dropped
+	now, err := t.get_tx_time(stub)
+	if err != nil { return counter, err }
+	dayStart := now.Add(-24 * time.Hour)
+	monthStart := now.AddDate(0, 0, -30)
+	daymoney := money
+	monthmoney := money
+	var spends []CountedSpend
+	for _, spend := range counter.Spends {
+		at, err := time.Parse(TIME_FORMAT, spend.Timestamp)
+		if err != nil || !at.After(monthStart) { continue }
+
+		spends = append(spends, spend)
+		monthmoney = monthmoney + spend.Money
+		if at.After(dayStart) { daymoney = daymoney + spend.Money }
+	}
 
+	if limits.Daily > 0 && daymoney > limits.Daily {
+		return counter, errors.New("amount is above the daily limit of " + t.format_money(limits.Daily, card.Currency))
+	}
+	if limits.Monthly > 0 && monthmoney > limits.Monthly {
+		return counter, errors.New("amount is above the monthly limit of " + t.format_money(limits.Monthly, card.Currency))
+	}
+	counter.Spends = append(spends, CountedSpend{ Timestamp: now.Format(TIME_FORMAT), Money: money })
 
-	// get Card_Holder
-	var card_holder Card_Holder
-	bytes, err := stub.GetState(CARD_HOLDER)
-		if err != nil { return nil, errors.New("Unable to get cardKakaIDs") }	
+	bytes, err = json.Marshal(counter)
+	if err != nil { return counter, errors.New("Error converting spend counter") }
+	err = stub.PutState(counterId, bytes)
+	if err != nil { return counter, errors.New("Error storing spend counter") }
 
-	if len(bytes) != 0 {
-		err = json.Unmarshal(bytes, &card_holder)
-		if err != nil {	return nil, errors.New("Corrupt Card_Template_Holder record") }
-	}															
-	
+	return counter, nil
+}
 
-	for cardindex := shopLedger.CardIdIndex;  cardindex < shopLedger.CardIdIndex + cardNum ;cardindex++ {
-		//create new card from template
-		var card Card	
-		err = json.Unmarshal(cardTemplateBytes, &card)		//  new card json -> Card Object
-			if err != nil { return nil, errors.New("Invalid JSON object") }
+//=================================================================================================================================
+//	 Fraud Functions - velocity rules on card activity, flagged cards are reviewed by KAKACENTER
+//=================================================================================================================================
+func (t *CardTransactionChaincode) get_cardActivityID(cardID string) (string) {
+	return "cardactivity-" + cardID
+}
 
-		//err = json.Unmarshal(cardTemplateBytes, &card)		//  new card json -> Card Object
-		//	if err != nil { return nil, errors.New("Invalid JSON object") }
-		card.Cardid = t.generate_card_id(cardTemplate_KakaIDs, cardindex + 1 )
+func (t *CardTransactionChaincode) get_fraudFlagID(flagId string) (string) {
+	return "fraudflag-" + flagId
+}
 
-		fmt.Printf("CREATE_CARD cardid:  %s", card.Cardid);
-		card.Kakaid 		 = 	cardTemplate_KakaIDs	
-		fmt.Printf("CREATE_CARD Kakaid: %s", card.Kakaid);
+func (t *CardTransactionChaincode) retrieve_fraud_rules(stub shim.ChaincodeStubInterface) (FraudRules, error) {
 
-		//save card to state
-		_, err  = t.save_card(stub, card)									
-		if err != nil { fmt.Printf("CREATE_CARD_TEMPLATE: Error saving changes: %s", err); 
-						return nil, errors.New("Error saving changes") }
-		
-		//add to card_holder
-		card_holder.Cards = append(card_holder.Cards, card.Cardid)
-		fmt.Printf("Append 1 cardid  \n");
+	var rules FraudRules
+	bytes, err := stub.GetState(FRAUD_RULES)
+	if err != nil { return rules, errors.New("Unable to get fraud rules") }
+
+	if len(bytes) != 0 {
+		err = json.Unmarshal(bytes, &rules)
+		if err != nil { return rules, errors.New("Corrupt fraud rules record") }
 	}
-	fmt.Printf("Marshal card holder to bytes");
-	//save cardIDs in CARD_HOLDER
-	bytes, err = json.Marshal(card_holder)
-		if err != nil { fmt.Print("Error creating Card_Holder record") }
+	return rules, nil
+}
 
-	fmt.Printf("PutState card to card_holder");
-	err = stub.PutState(CARD_HOLDER, bytes)
-		if err != nil { return nil, errors.New("Unable to put the CARD_HOLDER state") }
-	fmt.Printf("PutState ok");
+func (t *CardTransactionChaincode) set_fraud_rules(stub shim.ChaincodeStubInterface, caller string, caller_affiliation int, rulesJson string) ([]byte, error) {
 
+	if caller_affiliation != KAKACENTER {
+		return nil, errors.New("Permission denied: only KAKACENTER can set fraud rules")
+	}
 
-	//update shop ledger
-	shopLedger.Shopid = shopid 
-	shopLedger.Qty = shopLedger.Qty + cardNum
-	shopLedger.CardIdIndex = shopLedger.CardIdIndex + cardNum
-	shopLedger.InitMoney = shopLedger.InitMoney + cardTemplate.Money * cardNum
-	shopLedger.InitPoint = shopLedger.InitPoint + cardTemplate.Point * cardNum
-	t.update_shopLedger(stub, caller, cardTemplate_KakaIDs, shopLedger)
+	var rules FraudRules
+	err := json.Unmarshal([]byte(rulesJson), &rules)
+	if err != nil { return nil, errors.New("Invalid fraud rules JSON object") }
 
-	fmt.Printf("Put ShopLedger ok");
+	if rules.Burstcount < 0 || rules.Burstminutes < 0 || rules.Roundtripminutes < 0 || rules.Depositminutes < 0 {
+		return nil, errors.New("Invalid fraud rules: negative value")
+	}
+	if rules.Burstminutes > 0 && rules.Burstcount < 2 {
+		return nil, errors.New("Invalid fraud rules: a burst is at least 2 transfers")
+	}
 
-	return nil, nil
+	bytes, err := json.Marshal(rules)
+	if err != nil { return nil, errors.New("Error converting fraud rules") }
+	err = stub.PutState(FRAUD_RULES, bytes)
+	if err != nil { return nil, errors.New("Error storing fraud rules") }
+
+	_, err = t.add_admin_audit(stub, caller, "set_fraud_rules", FRAUD_RULES, rulesJson)
+	if err != nil { return nil, err }
 
+	return nil, nil
 }
 
 //=================================================================================================================================
-//	 manufacturer_to_private
+//	 record_card_activity - logs a value movement of the card and, for value going out, evaluates the fraud rules.
+//							Rules flag the card instead of failing the transaction, the returned card is frozen when
+//							a rule hit and Autofreeze is set. Activities older than every rule window are dropped
 //=================================================================================================================================
+func (t *CardTransactionChaincode) record_card_activity(stub shim.ChaincodeStubInterface, card Card, action string, counterparty string, money int64, point int) (Card, error) {
 
-func (t *CardTransactionChaincode) request_card_by_template(stub shim.ChaincodeStubInterface, caller string, caller_affiliation int, cardTemplate_KakaIDs string) ([]byte, error) {								
-	if 	caller_affiliation !=  CONSUMER {							// Only the regulator can create a new v5c
-		return nil, errors.New("Permission Denied")
-	}
-	return t.new_card_by_template(stub, caller, cardTemplate_KakaIDs)
-}
+	rules, err := t.retrieve_fraud_rules(stub)
+	if err != nil { return card, err }
 
-func (t *CardTransactionChaincode) push_card_by_template(stub shim.ChaincodeStubInterface, caller string, caller_affiliation int, ownerId string, cardTemplate_KakaIDs string) ([]byte, error) {								
-	if 	caller_affiliation !=  SHOP {							// Only the regulator can create a new v5c
-		return nil, errors.New("Permission Denied")
+	window := rules.Burstminutes
+	if rules.Roundtripminutes > window { window = rules.Roundtripminutes }
+	if rules.Depositminutes > window { window = rules.Depositminutes }
+	if window == 0 { return card, nil }			// no rules, nothing to keep
+
+	var activity Card_Activity
+	activity.Cardid = card.Cardid
+	bytes, err := stub.GetState(t.get_cardActivityID(card.Cardid))
+	if err != nil { return card, errors.New("Error retrieving activity of card " + card.Cardid) }
+	if len(bytes) != 0 {
+		err = json.Unmarshal(bytes, &activity)
+		if err != nil { return card, errors.New("Corrupt card activity record") }
 	}
-	return t.new_card_by_template(stub, ownerId,cardTemplate_KakaIDs)
-}
 
-func (t *CardTransactionChaincode) new_card_by_template(stub shim.ChaincodeStubInterface,  ownerId string , cardTemplate_KakaIDs string) ([]byte, error) {								
+	timestamp, err := t.get_timestamp(stub)
+	if err != nil { return card, err }
+	now, _ := time.Parse(TIME_FORMAT, timestamp)
+	within := func(a CardActivity, minutes int) (bool) {
+		at, err := time.Parse(TIME_FORMAT, a.Timestamp)
+		return err == nil && now.Sub(at) <= time.Duration(minutes) * time.Minute
+	}
 
-	
-	//matched, err := regexp.Match("^[A-z][A-z][A-z]", []byte(cardTemplate_KakaIDs))  	// 2 char + 5 digits
-	//	if err != nil   || matched ==false { fmt.Printf("CREATE_CARD: Invalid cardID: %s", err); return nil, errors.New("Invalid v5cID") }
-	
-	cardTemplateBytes, err := stub.GetState(cardTemplate_KakaIDs) 			// check if card template exists
-		if cardTemplateBytes == nil { return nil, errors.New("Card temaplte is not exists") }
-	var template Card
-	err = json.Unmarshal(cardTemplateBytes, &template)	
-	if err != nil { return nil, errors.New("------------Invalid template JSON object") }
+	var kept []CardActivity
+	for _, a := range activity.Activities {
+		if within(a, window) { kept = append(kept, a) }
+	}
 
+	outgoing := func(action string) (bool) {
+		return action == ACTIVITY_TRANSFER_OUT || action == ACTIVITY_GIFT_OUT || action == ACTIVITY_SPEND
+	}
+	toConsumer := action == ACTIVITY_TRANSFER_OUT || action == ACTIVITY_GIFT_OUT		// spends go to the shop
+
+	var hits []string
+	if outgoing(action) {
+		bursts := 1
+		roundtrip := false
+		deposited := false
+		for _, a := range kept {
+			if outgoing(a.Action) && rules.Burstminutes > 0 && within(a, rules.Burstminutes) { bursts = bursts + 1 }
+			if (a.Action == ACTIVITY_TRANSFER_IN || a.Action == ACTIVITY_GIFT_IN) && a.Counterparty == counterparty && toConsumer && rules.Roundtripminutes > 0 && within(a, rules.Roundtripminutes) { roundtrip = true }
+			if a.Action == ACTIVITY_DEPOSIT && toConsumer && rules.Depositminutes > 0 && within(a, rules.Depositminutes) { deposited = true }
+		}
+		if rules.Burstminutes > 0 && bursts >= rules.Burstcount {
+			hits = append(hits, "burst:" + strconv.Itoa(bursts) + " movements out within " + strconv.Itoa(rules.Burstminutes) + " minutes")
+		}
+		if roundtrip {
+			hits = append(hits, "roundtrip:transfer back to " + counterparty + " within " + strconv.Itoa(rules.Roundtripminutes) + " minutes")
+		}
+		if deposited {
+			hits = append(hits, "deposit:" + action + " within " + strconv.Itoa(rules.Depositminutes) + " minutes of a deposit")
+		}
+	}
 
-	//once create new card, create or update shop ledger, 
-	var	shopLedger ShopLedger
-	//shopid := t.get_Shopid(stub, caller)
-	shopid := template.Shopid
-	shopLedgerBytes ,err := t.get_shopLedger_internal(stub, shopid, cardTemplate_KakaIDs)
-	if shopLedgerBytes == nil {
-		shopLedgerBytes ,err = t.add_new_shopLedger(stub, shopid, cardTemplate_KakaIDs)
+	var a CardActivity
+	a.Action = action
+	a.Counterparty = counterparty
+	a.Money = money
+	a.Point = point
+	a.Timestamp = timestamp
+	activity.Activities = append(kept, a)
+
+	bytes, err = json.Marshal(activity)
+	if err != nil { return card, errors.New("Error converting card activity") }
+	err = stub.PutState(t.get_cardActivityID(card.Cardid), bytes)
+	if err != nil { return card, errors.New("Error storing card activity") }
+
+	for _, hit := range hits {
+		parts := strings.SplitN(hit, ":", 2)
+		_, err = t.add_fraud_flag(stub, card, parts[0], parts[1] + ", " + t.format_money(money, card.Currency) + " and " + strconv.Itoa(point) + " points to " + counterparty, rules.Autofreeze)
+		if err != nil { return card, err }
 	}
+	if len(hits) > 0 && rules.Autofreeze { card.Frozen = true }
 
-	err = json.Unmarshal([]byte(shopLedgerBytes), &shopLedger)	
-	if err != nil { return nil, errors.New("------------Invalid shopLedgerBytes JSON object") }
+	return card, nil
+}
 
+func (t *CardTransactionChaincode) get_fraud_flag_holder(stub shim.ChaincodeStubInterface) (FraudFlag_Holder, error) {
 
-	// get Card_Holder
-	var card_holder Card_Holder
-	bytes, err := stub.GetState(CARD_HOLDER)
-		if err != nil { return nil, errors.New("Unable to get cardKakaIDs") }	
+	var flag_holder FraudFlag_Holder
+	bytes, err := stub.GetState(FRAUD_FLAG_HOLDER)
+	if err != nil { return flag_holder, errors.New("Unable to get fraud_flag_holder") }
 
 	if len(bytes) != 0 {
-		err = json.Unmarshal(bytes, &card_holder)
-		if err != nil {	return nil, errors.New("Corrupt Card_Template_Holder record") }
-	}															
-	
+		err = json.Unmarshal(bytes, &flag_holder)
+		if err != nil {	return flag_holder, errors.New("Corrupt FraudFlag_Holder record") }
+	}
+	return flag_holder, nil
+}
 
-	//create new card from template
-	var card Card	
-	err = json.Unmarshal(cardTemplateBytes, &card)		//  new card json -> Card Object
-		if err != nil { return nil, errors.New("Invalid JSON object") }
+func (t *CardTransactionChaincode) retrieve_fraud_flag(stub shim.ChaincodeStubInterface, flagId string) (FraudFlag, error) {
 
-	//err = json.Unmarshal(cardTemplateBytes, &card)		//  new card json -> Card Object
-	//	if err != nil { return nil, errors.New("Invalid JSON object") }
-	card.Cardid = t.generate_card_id(cardTemplate_KakaIDs, shopLedger.CardIdIndex + 1 )
+	var flag FraudFlag
+	bytes, err := stub.GetState(t.get_fraudFlagID(flagId))
+	if err != nil { return flag, errors.New("Error retrieving fraud flag " + flagId) }
+	if bytes == nil { return flag, errors.New("Error: no fraud flag " + flagId + " in world state") }
 
-	fmt.Printf("CREATE_CARD cardid:  %s", card.Cardid);
-	card.Kakaid 		 = 	cardTemplate_KakaIDs	
-	fmt.Printf("CREATE_CARD Kakaid: %s", card.Kakaid);
+	err = json.Unmarshal(bytes, &flag)
+	if err != nil { return flag, errors.New("Corrupt fraud flag record " + flagId) }
 
-	card.Owner = ownerId
-	card.Status = STATE_CONSUMER_OWNERSHIP
+	return flag, nil
+}
 
-	timestamp := time.Now().Unix()
-	tm := time.Unix(timestamp, 0)
-	card.Releasedate = tm.Format("2006-01-02 03:04:05 PM")  //  str to timestmap: tm2, _ := time.Parse("01/02/2006", releasedate)
-	card.Getdate = card.Releasedate
+func (t *CardTransactionChaincode) save_fraud_flag(stub shim.ChaincodeStubInterface, flag FraudFlag) ([]byte, error) {
 
-	
-	//save card to state
-	_, err  = t.save_card(stub, card)									
-	if err != nil { fmt.Printf("CREATE_CARD_TEMPLATE: Error saving changes: %s", err); 
-					return nil, errors.New("Error saving changes") }
-	
-	//add to card_holder
-	card_holder.Cards = append(card_holder.Cards, card.Cardid)
+	bytes, err := json.Marshal(flag)
+	if err != nil { return nil, errors.New("Error converting fraud flag") }
 
-	fmt.Printf("Marshal card holder to bytes");
-	//save cardIDs in CARD_HOLDER
-	bytes, err = json.Marshal(card_holder)
-		if err != nil { fmt.Print("Error creating Card_Holder record") }
+	err = stub.PutState(t.get_fraudFlagID(flag.Flagid), bytes)
+	if err != nil { fmt.Printf("SAVE_FRAUD_FLAG: Error storing fraud flag: %s", err); return nil, errors.New("Error storing fraud flag") }
 
-	fmt.Printf("PutState card to card_holder");
-	err = stub.PutState(CARD_HOLDER, bytes)
-		if err != nil { return nil, errors.New("Unable to put the CARD_HOLDER state") }
-	fmt.Printf("PutState ok");
+	return bytes, nil
+}
 
+func (t *CardTransactionChaincode) add_fraud_flag(stub shim.ChaincodeStubInterface, card Card, rule string, detail string, frozen bool) ([]byte, error) {
 
-	//update shop ledger
-	shopLedger.Shopid = shopid
-	shopLedger.Qty = shopLedger.Qty + 1
-	shopLedger.CardIdIndex = shopLedger.CardIdIndex + 1
-	shopLedger.InitMoney = shopLedger.InitMoney + card.Money
-	shopLedger.InitPoint = shopLedger.InitPoint + card.Point
-	t.update_shopLedger(stub, shopid, cardTemplate_KakaIDs, shopLedger)
+	flag_holder, err := t.get_fraud_flag_holder(stub)
+	if err != nil { return nil, err }
 
-	fmt.Printf("Put ShopLedger ok");
+	var flag FraudFlag
+	flag.Flagid = "FLAG" + strconv.Itoa(len(flag_holder.Flags) + 1)
+	flag.Cardid = card.Cardid
+	flag.Owner = card.Owner
+	flag.Rule = rule
+	flag.Detail = detail
+	flag.Timestamp, err = t.get_timestamp(stub)
+	if err != nil { return nil, err }
+	flag.Frozen = frozen
+	flag.Status = FLAG_OPEN
 
-	return nil, nil
+	_, err = t.save_fraud_flag(stub, flag)
+	if err != nil { return nil, err }
+
+	flag_holder.Flags = append(flag_holder.Flags, flag.Flagid)
+	bytes, err := json.Marshal(flag_holder)
+	if err != nil { return nil, errors.New("Error creating FraudFlag_Holder record") }
+	err = stub.PutState(FRAUD_FLAG_HOLDER, bytes)
+	if err != nil { return nil, errors.New("Unable to put the FRAUD_FLAG_HOLDER state") }
 
+	_, err = t.add_card_history(stub, card.Cardid, "fraud_flag", flag.Flagid + " " + rule)
+	if err != nil { return nil, err }
+
+	return []byte(flag.Flagid), nil
 }
 
 //=================================================================================================================================
-//	 manufacturer_to_private
+//	 review_fraud_flag - KAKACENTER clears a flag, unfreezing the card when no other open flag is left on it, or
+//						 confirms it, freezing the card
 //=================================================================================================================================
-func (t *CardTransactionChaincode) transfer_card_shop_to_consumer(stub shim.ChaincodeStubInterface, v Card, caller string, caller_affiliation int, recipient_name string, recipient_affiliation int) ([]byte, error) {
-
+func (t *CardTransactionChaincode) review_fraud_flag(stub shim.ChaincodeStubInterface, caller string, caller_affiliation int, flagId string, decision string, reason string) ([]byte, error) {
 
-	if 		v.Shop 	 	== "" || 					
-			v.Cardid  	== "" || 
-			v.Cardlevel == "" || 
-			v.Cardclass == "" || 
-			v.Expdate == ""  {					//If key part of the card is empty it has not been fully manufacturered so cannot be sent
-															fmt.Printf("SHOP_TO_CONSUMER: Car not fully defined")
-															return nil, errors.New("Car not fully defined")
+	if caller_affiliation != KAKACENTER {
+		return nil, errors.New("Permission denied: only KAKACENTER can review fraud flags")
+	}
+	if decision != FLAG_CLEARED && decision != FLAG_CONFIRMED {
+		return nil, errors.New("Invalid review decision: " + decision)
 	}
-	
-	if 		v.Status				== STATE_SHOP	&& 
-			v.Owner					== caller		&& 
-			caller_affiliation		== SHOP			&&
-			recipient_affiliation	== CONSUMER		&& 
-			v.Scrapped     == false							{
-			
-					v.Owner = recipient_name
-					v.Status = STATE_CONSUMER_OWNERSHIP
 
-					timestamp := time.Now().Unix()
-					tm := time.Unix(timestamp, 0)
-					v.Releasedate = tm.Format("2006-01-02 03:04:05 PM")  //  str to timestmap: tm2, _ := time.Parse("01/02/2006", releasedate)
-					v.Getdate = v.Releasedate
-	} else {
-															return nil, errors.New("Permission denied")
+	flag, err := t.retrieve_fraud_flag(stub, flagId)
+	if err != nil { return nil, err }
+	if flag.Status != FLAG_OPEN { return nil, errors.New("fraud flag " + flagId + " is " + flag.Status) }
+
+	flag.Status = decision
+	flag.Reviewer = caller
+	flag.Reviewdate, err = t.get_timestamp(stub)
+	if err != nil { return nil, err }
+	flag.Reason = reason
+	_, err = t.save_fraud_flag(stub, flag)
+	if err != nil { return nil, err }
+
+	card, err := t.retrieve_card(stub, flag.Cardid)
+	if err != nil { return nil, err }
+
+	frozen := decision == FLAG_CONFIRMED
+	if frozen == false {
+		flag_holder, err := t.get_fraud_flag_holder(stub)
+		if err != nil { return nil, err }
+		for _, otherId := range flag_holder.Flags {
+			other, err := t.retrieve_fraud_flag(stub, otherId)
+			if err != nil { return nil, err }
+			if other.Cardid == card.Cardid && (other.Status == FLAG_CONFIRMED || other.Status == FLAG_OPEN && other.Frozen) {
+				frozen = true
+			}
+		}
 	}
-	
-	_, err := t.save_card(stub, v)
-	
-															if err != nil { fmt.Printf("SHOP_TO_CONSUMER: Error saving changes: %s", err); return nil, errors.New("Error saving changes") }
-	
+	card.Frozen = frozen
+
+	_, err = t.save_card(stub, card)
+	if err != nil { return nil, errors.New("Error saving changes") }
+
+	_, err = t.add_card_history(stub, card.Cardid, "fraud_review", flagId + " " + decision)
+	if err != nil { return nil, err }
+
+	_, err = t.add_admin_audit(stub, caller, "review_fraud_flag", flagId, decision + " " + reason)
+	if err != nil { return nil, err }
+
 	return nil, nil
-	
 }
 
 //=================================================================================================================================
-//	 private_to_private
+//	 get_fraud_flags - fraud flags for KAKACENTER review, all or those of one status
 //=================================================================================================================================
-func (t *CardTransactionChaincode) transfer_card_consumer_to_consumer(stub shim.ChaincodeStubInterface, v Card, caller string, caller_affiliation int, recipient_name string, recipient_affiliation int) ([]byte, error) {
-	
+func (t *CardTransactionChaincode) get_fraud_flags(stub shim.ChaincodeStubInterface, caller string, caller_affiliation int, status string) ([]byte, error) {
 
-	if 		v.Status				== STATE_CONSUMER_OWNERSHIP	&&
-			v.Owner					== caller					&&
-			caller_affiliation		== CONSUMER			&& 
-			recipient_affiliation	== CONSUMER			&&
-			v.Scrapped				== false					{
-			
-					v.Owner = recipient_name
-					timestamp := time.Now().Unix()
-					tm := time.Unix(timestamp, 0)
-					v.Getdate = tm.Format("2006-01-02 03:04:05 PM")  //  str to timestmap: tm2, _ := time.Parse("01/02/2006", releasedate)
-					
-					
-	} else {
-		
-															return nil, errors.New("Permission denied")
-	
+	if caller_affiliation != KAKACENTER {
+		return nil, errors.New("Permission denied: you are not KAKACENTER users ")
 	}
-	
-	_, err := t.save_card(stub, v)
-	
-															if err != nil { fmt.Printf("CONSUMER_TO_CONSUMER: Error saving changes: %s", err); return nil, errors.New("Error saving changes") }
-	
-	return nil, nil
-	
+
+	flag_holder, err := t.get_fraud_flag_holder(stub)
+	if err != nil { return nil, err }
+
+	flags := []FraudFlag{}
+	for _, flagId := range flag_holder.Flags {
+		flag, err := t.retrieve_fraud_flag(stub, flagId)
+		if err != nil { return nil, err }
+
+		if status == "" || flag.Status == status {
+			flags = append(flags, flag)
+		}
+	}
+	return json.Marshal(flags)
 }
 
 //=================================================================================================================================
-//	 private_to_lease_company
+//	 Dispute Functions - contested spends, answered by the shop and ruled by KAKACENTER
 //=================================================================================================================================
-func (t *CardTransactionChaincode) transfer_card_consumer_to_shop(stub shim.ChaincodeStubInterface, v Card, caller string, caller_affiliation int, recipient_name string, recipient_affiliation int) ([]byte, error) {
+func (t *CardTransactionChaincode) get_disputeID(disputeId string) (string) {
+	return "dispute-" + disputeId
+}
 
-	if 		v.Status				== STATE_CONSUMER_OWNERSHIP	&& 
-			v.Owner					== caller					&& 
-			caller_affiliation		== CONSUMER					&& 
-			recipient_affiliation	== SHOP						&& 
-			v.Scrapped     			== false					{
-		
-					v.Owner = recipient_name
-					timestamp := time.Now().Unix()
-					tm := time.Unix(timestamp, 0)
-					v.Getdate = tm.Format("2006-01-02 03:04:05 PM")  //  str to timestmap: tm2, _ := time.Parse("01/02/2006", releasedate)
-					
-					
-	} else {
-															return nil, errors.New("Permission denied")
+func (t *CardTransactionChaincode) get_dispute_holder(stub shim.ChaincodeStubInterface) (Dispute_Holder, error) {
+
+	var dispute_holder Dispute_Holder
+	bytes, err := stub.GetState(DISPUTE_HOLDER)
+	if err != nil { return dispute_holder, errors.New("Unable to get dispute_holder") }
+
+	if len(bytes) != 0 {
+		err = json.Unmarshal(bytes, &dispute_holder)
+		if err != nil {	return dispute_holder, errors.New("Corrupt Dispute_Holder record") }
 	}
-	
-	_, err := t.save_card(stub, v)
-															if err != nil { fmt.Printf("consumer_identityCard_to_shop: Error saving changes: %s", err); return nil, errors.New("Error saving changes") }
-	
-	return nil, nil
-	
+	return dispute_holder, nil
 }
 
+func (t *CardTransactionChaincode) retrieve_dispute(stub shim.ChaincodeStubInterface, disputeId string) (Dispute, error) {
 
-func (t *CardTransactionChaincode) transfer_mp_shop_to_consumer(stub shim.ChaincodeStubInterface, money int, point int, caller string, sc Card, receiver string, tc Card) ([]byte, error) {
+	var dispute Dispute
+	bytes, err := stub.GetState(t.get_disputeID(disputeId))
+	if err != nil { return dispute, errors.New("Error retrieving dispute " + disputeId) }
+	if bytes == nil { return dispute, errors.New("Error: no dispute " + disputeId + " in world state") }
 
-		return nil, errors.New("not implemented")
+	err = json.Unmarshal(bytes, &dispute)
+	if err != nil { fmt.Printf("RETRIEVE_DISPUTE: Corrupt dispute record "+string(bytes)+": %s", err); return dispute, errors.New("Corrupt dispute record " + disputeId) }
+
+	return dispute, nil
 }
 
-func (t *CardTransactionChaincode) transfer_mp_consumer_to_shop(stub shim.ChaincodeStubInterface, money int, point int, caller string, sc Card, receiver string, tc Card) ([]byte, error) {
+func (t *CardTransactionChaincode) save_dispute(stub shim.ChaincodeStubInterface, dispute Dispute) ([]byte, error) {
 
-		return nil, errors.New("not implemented")
+	bytes, err := json.Marshal(dispute)
+	if err != nil { return nil, errors.New("Error converting dispute record") }
+
+	err = stub.PutState(t.get_disputeID(dispute.Disputeid), bytes)
+	if err != nil { fmt.Printf("SAVE_DISPUTE: Error storing dispute: %s", err); return nil, errors.New("Error storing dispute") }
+
+	return bytes, nil
 }
+
 //=================================================================================================================================
-//	 Transfer Functions
+//	 open_dispute - the card owner contests a spend of the card. The amount is held on the shop ledger of the card,
+//					and the value of a spend at an allied shop is cleared back until the ruling
 //=================================================================================================================================
-//	 transfer_mp_consumer_to_consumer
+func (t *CardTransactionChaincode) open_dispute(stub shim.ChaincodeStubInterface, caller string, caller_affiliation int, disputeId string, cardId string, eventId string, reason string) ([]byte, error) {
+
+	card, err := t.retrieve_card(stub, cardId)
+	if err != nil { return nil, err }
+
+	if caller_affiliation != CONSUMER || card.Owner != caller || card.Status != STATE_CONSUMER_OWNERSHIP || card.Scrapped == true {
+		return nil, errors.New("Permission denied")
+	}
+
+	record, err := stub.GetState(t.get_disputeID(disputeId))
+	if err != nil { return nil, err }
+	if record != nil { return nil, errors.New("dispute " + disputeId + " already exists") }
+
+	history, err := t.retrieve_card_history(stub, cardId)
+	if err != nil { return nil, err }
+
+	pos := -1
+	for i, event := range history.Events {
+		if event.Eventid == eventId { pos = i }
+	}
+	if pos < 0 || history.Events[pos].Action != ACTIVITY_SPEND {
+		return nil, errors.New("no spend " + eventId + " on card " + cardId)
+	}
+	if history.Events[pos].Disputeid != "" {
+		return nil, errors.New("spend " + eventId + " is already disputed in " + history.Events[pos].Disputeid)
+	}
+	event := history.Events[pos]
+
+	history.Events[pos].Disputeid = disputeId
+	_, err = t.save_card_history(stub, history)
+	if err != nil { return nil, err }
+
+	var dispute Dispute
+	dispute.Disputeid = disputeId
+	dispute.Cardid = cardId
+	dispute.Eventid = eventId
+	dispute.Consumer = caller
+	dispute.Shopid = event.Shopid
+	dispute.Templateid = card.Kakaid
+	dispute.Money = event.Money
+	dispute.Currency = card.Currency
+	dispute.Point = event.Point
+	dispute.Spend = event
+	dispute.Reason = reason
+	dispute.Opendate, err = t.get_timestamp(stub)
+	if err != nil { return nil, err }
+	dispute.Status = DISPUTE_OPEN
+
+	_, err = t.save_dispute(stub, dispute)
+	if err != nil { return nil, err }
+
+	dispute_holder, err := t.get_dispute_holder(stub)
+	if err != nil { return nil, err }
+	dispute_holder.Disputes = append(dispute_holder.Disputes, disputeId)
+
+	bytes, err := json.Marshal(dispute_holder)
+	if err != nil { return nil, errors.New("Error creating Dispute_Holder record") }
+	err = stub.PutState(DISPUTE_HOLDER, bytes)
+	if err != nil { return nil, errors.New("Unable to put the DISPUTE_HOLDER state") }
+
+	// spends are booked on the ledger of the card's own shop, also at an allied shop
+	shopLedger, err := t.retrieve_shopLedger(stub, card.Shopid, card.Kakaid)
+	if err != nil { return nil, err }
+	shopLedger.HeldMoney = shopLedger.HeldMoney + dispute.Money
+	shopLedger.HeldPoint = shopLedger.HeldPoint + dispute.Point
+	_, err = t.update_shopLedger(stub, card.Shopid, card.Kakaid, shopLedger)
+	if err != nil { return nil, err }
+
+	// the allied shop is not paid for the spend while it is disputed
+	_, err = t.post_dispute_clearing(stub, dispute, dispute.Shopid, card.Shopid)
+	if err != nil { return nil, err }
+
+	return nil, nil
+}
+
 //=================================================================================================================================
-func (t *CardTransactionChaincode) transfer_mp_consumer_to_consumer(stub shim.ChaincodeStubInterface, money int, point int, caller string, sc Card, receiver string, tc Card) ([]byte, error) {
-fmt.Printf("start transfer_mp_consumer_to_consumer")
-	if sc.Money < money || sc.Point < point{
-		fmt.Printf("money or point is not enough")
-		return nil, errors.New("card asset is not enough")
+//	 post_dispute_clearing - clears the value of the points of a disputed spend at an allied shop from payer to payee
+//=================================================================================================================================
+func (t *CardTransactionChaincode) post_dispute_clearing(stub shim.ChaincodeStubInterface, dispute Dispute, payer string, payee string) ([]byte, error) {
+
+	cardShopid := payer
+	if dispute.Shopid == payer { cardShopid = payee }
+	if dispute.Shopid == cardShopid { return nil, nil }
+
+	alliance, err := t.find_alliance(stub, cardShopid, dispute.Shopid)
+	if err != nil { return nil, err }
+
+	_, err = t.post_clearing(stub, alliance, payer, payee, dispute.Point * alliance.Rates[cardShopid])
+	return nil, err
+}
+
+//=================================================================================================================================
+//	 check_no_open_disputes - a shop with open disputes against it or against spends of its cards can not be terminated
+//=================================================================================================================================
+func (t *CardTransactionChaincode) check_no_open_disputes(stub shim.ChaincodeStubInterface, shopId string, templates []Card) (error) {
+
+	templateIds := make(map[string]bool)
+	for _, template := range templates { templateIds[template.Kakaid] = true }
+
+	dispute_holder, err := t.get_dispute_holder(stub)
+	if err != nil { return err }
+	for _, disputeId := range dispute_holder.Disputes {
+		dispute, err := t.retrieve_dispute(stub, disputeId)
+		if err != nil { return err }
+		if dispute.Status != DISPUTE_OPEN && dispute.Status != DISPUTE_RESPONDED { continue }
+
+		if dispute.Shopid == shopId || templateIds[dispute.Templateid] {
+			return errors.New("shop " + shopId + " has open dispute " + disputeId)
+		}
 	}
-fmt.Printf("test 1")
-	caller_affiliation , _ := t.check_affiliation(stub, caller)
-	fmt.Printf("test 2")
-	receiver_affiliation , _ := t.check_affiliation(stub, receiver)
-	fmt.Printf("test 3")
+	return nil
+}
 
-	if		sc.Status				== STATE_CONSUMER_OWNERSHIP	&&
-			sc.Owner  				== caller					&& 
-			sc.Scrapped  			== false					&& 
-			sc.Expired  			== false					&& 
+//=================================================================================================================================
+//	 respond_dispute - staff of the shop the spend was made at answers the dispute
+//=================================================================================================================================
+func (t *CardTransactionChaincode) respond_dispute(stub shim.ChaincodeStubInterface, caller string, caller_affiliation int, disputeId string, response string) ([]byte, error) {
 
-			tc.Status				== STATE_CONSUMER_OWNERSHIP	&&
-			tc.Owner  				== receiver					&& 
-			sc.Scrapped  			== false					&& 
-			sc.Expired  			== false					&&
+	shopid, err := t.check_shop_permission(stub, caller, caller_affiliation, PERM_REFUND)
+	if err != nil { return nil, err }
 
-			sc.Shopid 				== tc.Shopid 					&&
+	dispute, err := t.retrieve_dispute(stub, disputeId)
+	if err != nil { return nil, err }
 
-			caller_affiliation		== CONSUMER			&& 
-			receiver_affiliation	== CONSUMER			{
-		
-				fmt.Printf("add and substract")
-				tc.Money = tc.Money + money
-				sc.Money = sc.Money - money
-				tc.Point = tc.Point + point
-				sc.Point = sc.Point - point
-				//add event to triger the shop db update
-	
-	} else {
-			fmt.Printf("Permission denied----------------------------")
-			return nil, errors.New("Permission denied")
+	if dispute.Shopid != shopid { return nil, errors.New("Permission denied") }
+	if dispute.Status != DISPUTE_OPEN && dispute.Status != DISPUTE_RESPONDED {
+		return nil, errors.New("dispute " + disputeId + " is " + dispute.Status)
 	}
-	
-	fmt.Printf("---------------save_card sc---------------------------")
-    _, err1 := t.save_card(stub, sc)
-   fmt.Printf("---------------save_card tc---------------------------")
-    _, err2 := t.save_card(stub, tc)
-		fmt.Printf("---------------save_card ok---------------------------")		
-		if err1 != nil || err2 != nil { fmt.Printf("transactionCard_consumer_to_consumer: Error saving changes: %s", err1); return nil, errors.New("Error saving changes") }
-	
+
+	dispute.Response = response
+	dispute.Responder = caller
+	dispute.Responsedate, err = t.get_timestamp(stub)
+	if err != nil { return nil, err }
+	dispute.Status = DISPUTE_RESPONDED
+	_, err = t.save_dispute(stub, dispute)
+	if err != nil { return nil, err }
+
 	return nil, nil
-	
 }
 
-
 //=================================================================================================================================
-//	 deposit_mp_shop_to_consumer
+//	 resolve_dispute - KAKACENTER rules. A refund reverses each part of the spend: principal and bonus money and the
+//					   spent points go back to the card, the points earned, the campaign bonus granted, the spend
+//					   counted for the tier and the commission are taken back. Bonus money and points the card no longer
+//					   has are left to it. A release leaves the spend as it was and clears it to the allied shop again.
+//					   Either way the hold ends. Refunds to scrapped cards are refused
 //=================================================================================================================================
-func (t *CardTransactionChaincode) deposit_mp_shop_to_consumer(stub shim.ChaincodeStubInterface, money int, point int, caller string, receiver string, tc Card) ([]byte, error) {
+func (t *CardTransactionChaincode) resolve_dispute(stub shim.ChaincodeStubInterface, caller string, caller_affiliation int, disputeId string, ruling string, reason string) ([]byte, error) {
 
-	fmt.Printf("start deposit_mp_shop_to_consumer")
+	if caller_affiliation != KAKACENTER {
+		return nil, errors.New("Permission denied: only KAKACENTER can resolve disputes")
+	}
+	if ruling != DISPUTE_REFUNDED && ruling != DISPUTE_RELEASED {
+		return nil, errors.New("Invalid dispute ruling: " + ruling)
+	}
 
-	caller_affiliation , _ := t.check_affiliation(stub, caller)
-	receiver_affiliation , _ := t.check_affiliation(stub, receiver)
-	fmt.Printf("test 3")
+	dispute, err := t.retrieve_dispute(stub, disputeId)
+	if err != nil { return nil, err }
+	if dispute.Status != DISPUTE_OPEN && dispute.Status != DISPUTE_RESPONDED {
+		return nil, errors.New("dispute " + disputeId + " is " + dispute.Status)
+	}
 
-	shopid := t.get_Shopid(stub, caller)
-	// update shop ledger, 
-			var	shopLedger ShopLedger
-			shopLedgerBytes ,err := t.get_shopLedger_internal(stub, shopid, tc.Kakaid)
-			if shopLedgerBytes == nil {
-				fmt.Printf("Permission denied----------------------------")
-					return nil, errors.New("Permission denied")
-			}
+	card, err := t.retrieve_card(stub, dispute.Cardid)
+	if err != nil { return nil, err }
 
-			err = json.Unmarshal([]byte(shopLedgerBytes), &shopLedger)	
-			if err != nil { return nil, errors.New("------------Invalid shopLedgerBytes JSON object") }
+	shopLedger, err := t.retrieve_shopLedger(stub, card.Shopid, card.Kakaid)
+	if err != nil { return nil, err }
+	shopLedger.HeldMoney = shopLedger.HeldMoney - dispute.Money
+	shopLedger.HeldPoint = shopLedger.HeldPoint - dispute.Point
 
+	if ruling == DISPUTE_REFUNDED {
+		if card.Scrapped == true { return nil, errors.New("card " + card.Cardid + " is scrapped, the spend can not be refunded to it") }
 
+		template, err := t.retrieve_card(stub, card.Kakaid)
+		if err != nil { return nil, errors.New("Failed to retrieve card template: " + card.Kakaid) }
 
-	if		tc.Status				== STATE_CONSUMER_OWNERSHIP	&&
-			tc.Owner  				== receiver					&& 
-			tc.Scrapped  			== false					&& 
-			tc.Expired  			== false					&&
+		spend := dispute.Spend
 
-			tc.Shopid 				== shopLedger.Shopid 			&&
+		bonusDelta := spend.Bonusspent - spend.Bonusmoney
+		if card.Bonusmoney + bonusDelta < 0 { bonusDelta = -card.Bonusmoney }
+		bonusBack := spend.Bonusspent - bonusDelta				// campaign bonus taken back
+		card.Money = card.Money + spend.Principal
+		card.Bonusmoney = card.Bonusmoney + bonusDelta
 
-			caller_affiliation		== SHOP			&& 
-			receiver_affiliation	== CONSUMER			{
-		
-				fmt.Printf("add and substract")
-				tc.Money = tc.Money + money
-				tc.Point = tc.Point + point
+		pointDelta := spend.Point - spend.Earnpoint - spend.Bonuspoint
+		if card.Point + pointDelta < 0 { pointDelta = -card.Point }
+		pointBack := spend.Point - pointDelta					// earned and bonus points taken back
+		if pointDelta > 0 {
+			card, err = t.credit_points(stub, template, card, pointDelta)
+		} else {
+			card, _, err = t.debit_points(stub, card, -pointDelta)
+		}
+		if err != nil { return nil, err }
+		earnBack := pointBack
+		if earnBack > spend.Earnpoint { earnBack = spend.Earnpoint }
+
+		card.Totalspend = card.Totalspend - spend.Money
+		if card.Totalspend < 0 { card.Totalspend = 0 }
+		card, err = t.apply_tier_rules(stub, template, card)
+		if err != nil { return nil, err }
+
+		_, err = t.reverse_commission(stub, dispute.Shopid, spend.Principal, spend.Commission)
+		if err != nil { return nil, err }
+
+		_, err = t.post_journal(stub, "dispute_" + ruling, disputeId, []JournalLine{
+			t.card_line(card, -spend.Principal - bonusDelta, -pointDelta),
+			t.shop_line(ACCOUNT_SHOP_CASH, dispute.Shopid, card.Currency, spend.Money - spend.Commission, 0),
+			t.shop_line(ACCOUNT_PROMOTION, dispute.Shopid, card.Currency, 0, spend.Point),
+			t.shop_line(ACCOUNT_PROMOTION, card.Shopid, card.Currency, -bonusBack, -pointBack),
+			t.shop_line(ACCOUNT_COMMISSION, dispute.Shopid, card.Currency, spend.Commission, 0),
+		})
+		if err != nil { return nil, err }
+
+		_, err = t.save_card(stub, card)
+		if err != nil { return nil, errors.New("Error saving changes") }
+
+		shopLedger.ConsumeMoney = shopLedger.ConsumeMoney - spend.Principal
+		shopLedger.ConsumeBonus = shopLedger.ConsumeBonus - spend.Bonusspent
+		shopLedger.ConsumePoint = shopLedger.ConsumePoint - spend.Point
+		shopLedger.BonusMoney = shopLedger.BonusMoney - bonusBack
+		shopLedger.EarnPoint = shopLedger.EarnPoint - earnBack
+		shopLedger.BonusPoint = shopLedger.BonusPoint - (pointBack - earnBack)
+		shopLedger.ReversedMoney = shopLedger.ReversedMoney + dispute.Money
+		shopLedger.ReversedPoint = shopLedger.ReversedPoint + dispute.Point
 	} else {
-			fmt.Printf("Permission denied----------------------------")
-			return nil, errors.New("Permission denied")
+		// the spend at an allied shop is cleared to it again
+		_, err = t.post_dispute_clearing(stub, dispute, card.Shopid, dispute.Shopid)
+		if err != nil { return nil, err }
 	}
 
-   fmt.Printf("---------------save_card tc---------------------------")
-    _, err = t.save_card(stub, tc)
+	_, err = t.update_shopLedger(stub, card.Shopid, card.Kakaid, shopLedger)
+	if err != nil { return nil, err }
 
-	//save shop ledger
-			shopLedger.DepositMoney = shopLedger.DepositMoney + money
-			shopLedger.DepositPoint = shopLedger.DepositPoint + point
-			t.update_shopLedger(stub, shopid, tc.Kakaid, shopLedger)
+	dispute.Status = ruling
+	dispute.Ruler = caller
+	dispute.Ruling = reason
+	dispute.Closedate, err = t.get_timestamp(stub)
+	if err != nil { return nil, err }
+	_, err = t.save_dispute(stub, dispute)
+	if err != nil { return nil, err }
 
-			fmt.Printf("Put ShopLedger ok");
+	_, err = t.add_card_history(stub, card.Cardid, "dispute_" + ruling, disputeId + " " + dispute.Eventid)
+	if err != nil { return nil, err }
+
+	_, err = t.add_admin_audit(stub, caller, "resolve_dispute", disputeId, ruling + " " + reason)
+	if err != nil { return nil, err }
 
-		fmt.Printf("---------------save_card ok---------------------------")		
-		if err != nil  { fmt.Printf("transactionCard_consumer_to_consumer: Error saving changes: %s", err); return nil, errors.New("Error saving changes") }
-	
 	return nil, nil
-	
 }
 
 //=================================================================================================================================
-//	 spend_mp_consumer_to_consumer
+//	 get_disputes - all disputes for KAKACENTER, those against the shop for shop users, the own ones for consumers
 //=================================================================================================================================
-func (t *CardTransactionChaincode) spend_mp_consumer_to_shop(stub shim.ChaincodeStubInterface, money int, point int, caller string, sc Card, shopid string) ([]byte, error) {
-	
-	fmt.Printf("start spend_mp_consumer_to_consumer")
-	if sc.Money < money || sc.Point < point{
-		fmt.Printf("money or point is not enough")
-		return nil, errors.New("card asset is not enough")
+func (t *CardTransactionChaincode) get_disputes(stub shim.ChaincodeStubInterface, caller string, caller_affiliation int) ([]byte, error) {
+
+	dispute_holder, err := t.get_dispute_holder(stub)
+	if err != nil { return nil, err }
+
+	shopid := ""
+	if caller_affiliation == SHOP { shopid = t.get_Shopid(stub, caller) }
+
+	disputes := []Dispute{}
+	for _, disputeId := range dispute_holder.Disputes {
+		dispute, err := t.retrieve_dispute(stub, disputeId)
+		if err != nil { return nil, err }
+
+		if caller_affiliation == KAKACENTER ||
+			(caller_affiliation == SHOP && dispute.Shopid == shopid) ||
+			(caller_affiliation == CONSUMER && dispute.Consumer == caller) {
+			disputes = append(disputes, dispute)
+		}
+	}
+	return json.Marshal(disputes)
+}
+
+//=================================================================================================================================
+//	 Report Functions
+//=================================================================================================================================
+//	 get_shop_report - card counts and balances of every template of a shop, with the deposits and spends from
+//					   periodstart to periodend (DAY_FORMAT, both included). KAKACENTER or shop staff allowed to
+//					   view the ledger
+//=================================================================================================================================
+func (t *CardTransactionChaincode) get_shop_report(stub shim.ChaincodeStubInterface, caller string, caller_affiliation int, shopId string, periodStart string, periodEnd string) ([]byte, error) {
+
+	err := t.check_ledger_viewer(stub, caller, caller_affiliation, shopId)
+	if err != nil { return nil, err }
+
+	_, err = time.Parse(DAY_FORMAT, periodStart)
+	if err != nil { return nil, errors.New("Invalid period start: " + periodStart) }
+	_, err = time.Parse(DAY_FORMAT, periodEnd)
+	if err != nil { return nil, errors.New("Invalid period end: " + periodEnd) }
+
+	templates, err := t.get_shop_templates(stub, shopId)
+	if err != nil { return nil, err }
+
+	var report ShopReport
+	report.Shopid = shopId
+	report.Periodstart = periodStart
+	report.Periodend = periodEnd
+	report.Templates = []TemplateReport{}
+	report.Totals = make(map[string]TemplateReport)
+
+	for _, template := range templates {
+		shopLedger, err := t.retrieve_shopLedger(stub, shopId, template.Kakaid)
+		if err != nil { return nil, err }
+
+		var tr TemplateReport
+		tr.Templateid = template.Kakaid
+		tr.Currency = template.Currency
+		tr.Issued = shopLedger.Qty
+		tr.DepositMoney = shopLedger.DepositMoney
+		tr.DepositPoint = shopLedger.DepositPoint
+		tr.ConsumeMoney = shopLedger.ConsumeMoney
+		tr.ConsumePoint = shopLedger.ConsumePoint
+
+		cards, err := t.get_template_cards(stub, template.Kakaid)
+		if err != nil { return nil, err }
+
+		for _, card := range cards {
+			if card.Scrapped == true {
+				tr.Scrapped = tr.Scrapped + 1
+			} else if card.Expired == true {
+				tr.Expired = tr.Expired + 1
+			} else {
+				tr.Active = tr.Active + 1
+				tr.OutstandingMoney = tr.OutstandingMoney + card.Money
+				tr.OutstandingBonus = tr.OutstandingBonus + card.Bonusmoney
+				tr.OutstandingPoint = tr.OutstandingPoint + card.Point
+			}
+
+			history, err := t.retrieve_card_history(stub, card.Cardid)
+			if err != nil { return nil, err }
+
+			for _, event := range history.Events {
+				if event.Eventid == "" { continue }
+				at, err := time.Parse(TIME_FORMAT, event.Timestamp)
+				if err != nil { continue }
+				day := at.Format(DAY_FORMAT)
+				if day < periodStart || day > periodEnd { continue }
+
+				if event.Action == ACTIVITY_DEPOSIT {
+					tr.RangeDepositMoney = tr.RangeDepositMoney + event.Money
+					tr.RangeDepositPoint = tr.RangeDepositPoint + event.Point
+				} else if event.Action == ACTIVITY_SPEND {
+					tr.RangeConsumeMoney = tr.RangeConsumeMoney + event.Money
+					tr.RangeConsumePoint = tr.RangeConsumePoint + event.Point
+				}
+			}
+		}
+
+		report.Templates = append(report.Templates, tr)
+		report.Totals[tr.Currency] = t.add_template_report(report.Totals[tr.Currency], tr)
+	}
+
+	return json.Marshal(report)
+}
+
+//	add_template_report - sums the counts and balances of two template reports in the same currency
+func (t *CardTransactionChaincode) add_template_report(total TemplateReport, tr TemplateReport) (TemplateReport) {
+
+	total.Currency = tr.Currency
+	total.Issued = total.Issued + tr.Issued
+	total.Active = total.Active + tr.Active
+	total.Expired = total.Expired + tr.Expired
+	total.Scrapped = total.Scrapped + tr.Scrapped
+	total.DepositMoney = total.DepositMoney + tr.DepositMoney
+	total.DepositPoint = total.DepositPoint + tr.DepositPoint
+	total.ConsumeMoney = total.ConsumeMoney + tr.ConsumeMoney
+	total.ConsumePoint = total.ConsumePoint + tr.ConsumePoint
+	total.OutstandingMoney = total.OutstandingMoney + tr.OutstandingMoney
+	total.OutstandingBonus = total.OutstandingBonus + tr.OutstandingBonus
+	total.OutstandingPoint = total.OutstandingPoint + tr.OutstandingPoint
+	total.RangeDepositMoney = total.RangeDepositMoney + tr.RangeDepositMoney
+	total.RangeDepositPoint = total.RangeDepositPoint + tr.RangeDepositPoint
+	total.RangeConsumeMoney = total.RangeConsumeMoney + tr.RangeConsumeMoney
+	total.RangeConsumePoint = total.RangeConsumePoint + tr.RangeConsumePoint
+	return total
+}
+
+//=================================================================================================================================
+//	 Ledger Period Functions - shop ledger postings bucketed by day, periods closed against further postings
+//=================================================================================================================================
+func (t *CardTransactionChaincode) get_ledgerBucketID(templateID string, day string) (string) {
+	return "ledgerday-" + templateID + "-" + day
+}
+
+func (t *CardTransactionChaincode) get_ledgerPeriodsID(shopId string) (string) {
+	return "ledgerperiods-" + shopId
+}
+
+//	combine_shopLedger - a + sign * b for every count and value of the ledgers
+func (t *CardTransactionChaincode) combine_shopLedger(a ShopLedger, b ShopLedger, sign int) (ShopLedger) {
+
+	m := int64(sign)
+	a.CardIdIndex = a.CardIdIndex + sign * b.CardIdIndex
+	a.Qty = a.Qty + sign * b.Qty
+	a.ExpiredNum = a.ExpiredNum + sign * b.ExpiredNum
+	a.ScrapNum = a.ScrapNum + sign * b.ScrapNum
+	a.BackNum = a.BackNum + sign * b.BackNum
+	a.InitMoney = a.InitMoney + m * b.InitMoney
+	a.InitPoint = a.InitPoint + sign * b.InitPoint
+	a.DepositMoney = a.DepositMoney + m * b.DepositMoney
+	a.DepositPoint = a.DepositPoint + sign * b.DepositPoint
+	a.ConsumeMoney = a.ConsumeMoney + m * b.ConsumeMoney
+	a.ConsumePoint = a.ConsumePoint + sign * b.ConsumePoint
+	a.RefundMoney = a.RefundMoney + m * b.RefundMoney
+	a.RefundPoint = a.RefundPoint + sign * b.RefundPoint
+	a.EarnPoint = a.EarnPoint + sign * b.EarnPoint
+	a.ExpiredPoint = a.ExpiredPoint + sign * b.ExpiredPoint
+	a.CouponIssued = a.CouponIssued + sign * b.CouponIssued
+	a.CouponTransferred = a.CouponTransferred + sign * b.CouponTransferred
+	a.CouponRedeemed = a.CouponRedeemed + sign * b.CouponRedeemed
+	a.CouponDiscount = a.CouponDiscount + m * b.CouponDiscount
+	a.BonusMoney = a.BonusMoney + m * b.BonusMoney
+	a.BonusPoint = a.BonusPoint + sign * b.BonusPoint
+	a.ConsumeBonus = a.ConsumeBonus + m * b.ConsumeBonus
+	a.ForfeitBonus = a.ForfeitBonus + m * b.ForfeitBonus
+	a.HeldMoney = a.HeldMoney + m * b.HeldMoney
+	a.HeldPoint = a.HeldPoint + sign * b.HeldPoint
+	a.ReversedMoney = a.ReversedMoney + m * b.ReversedMoney
+	a.ReversedPoint = a.ReversedPoint + sign * b.ReversedPoint
+	a.TransferInMoney = a.TransferInMoney + m * b.TransferInMoney
+	a.TransferInPoint = a.TransferInPoint + sign * b.TransferInPoint
+	a.TransferOutMoney = a.TransferOutMoney + m * b.TransferOutMoney
+	a.TransferOutPoint = a.TransferOutPoint + sign * b.TransferOutPoint
+	a.AdjustMoney = a.AdjustMoney + m * b.AdjustMoney
+	a.AdjustPoint = a.AdjustPoint + sign * b.AdjustPoint
+	return a
+}
+
+func (t *CardTransactionChaincode) retrieve_ledger_periods(stub shim.ChaincodeStubInterface, shopId string) (LedgerPeriods, error) {
+
+	var periods LedgerPeriods
+	periods.Shopid = shopId
+
+	bytes, err := stub.GetState(t.get_ledgerPeriodsID(shopId))
+	if err != nil { return periods, errors.New("Error retrieving ledger periods of shop " + shopId) }
+	if len(bytes) != 0 {
+		err = json.Unmarshal(bytes, &periods)
+		if err != nil { return periods, errors.New("Corrupt ledger periods record") }
 	}
+	return periods, nil
+}
 
-// update shop ledger, 
-			var	shopLedger ShopLedger
-			shopLedgerBytes ,err := t.get_shopLedger_internal(stub, shopid, sc.Kakaid)
-			if shopLedgerBytes == nil {
-				fmt.Printf("pay to wrong shop ,please check shop name--")
-					return nil, errors.New("pay to wrong shop ,please check shop name ")
-			}
+func (t *CardTransactionChaincode) save_ledger_periods(stub shim.ChaincodeStubInterface, periods LedgerPeriods) ([]byte, error) {
 
-			err = json.Unmarshal([]byte(shopLedgerBytes), &shopLedger)	
-			if err != nil { return nil, errors.New("------------Invalid shopLedgerBytes JSON object") }
+	bytes, err := json.Marshal(periods)
+	if err != nil { return nil, errors.New("Error converting ledger periods") }
 
+	err = stub.PutState(t.get_ledgerPeriodsID(periods.Shopid), bytes)
+	if err != nil { return nil, errors.New("Error storing ledger periods") }
 
-	fmt.Printf("test 1")
-	caller_affiliation , _ := t.check_affiliation(stub, caller)
-	fmt.Printf("test 3")
+	return bytes, nil
+}
 
-			
+func (t *CardTransactionChaincode) retrieve_ledger_bucket(stub shim.ChaincodeStubInterface, templateID string, day string) (LedgerBucket, bool, error) {
 
-	if		sc.Status				== STATE_CONSUMER_OWNERSHIP	&&
-			sc.Owner  				== caller					&& 
-			sc.Scrapped  			== false					&& 
-			sc.Expired  			== false					&& 
+	var bucket LedgerBucket
+	bucket.Templateid = templateID
+	bucket.Day = day
 
-			sc.Shopid 				== shopLedger.Shopid 			&&
+	bytes, err := stub.GetState(t.get_ledgerBucketID(templateID, day))
+	if err != nil { return bucket, false, errors.New("Error retrieving ledger bucket " + templateID + " " + day) }
+	if len(bytes) == 0 { return bucket, false, nil }
 
-			caller_affiliation		== CONSUMER		{
-		
-				fmt.Printf("add and substract")
-				sc.Money = sc.Money - money
-				sc.Point = sc.Point - point	
-	} else {
-			fmt.Printf("Permission denied----------------------------")
-			return nil, errors.New("Permission denied")
-	}
-	
-	fmt.Printf("---------------save_card sc---------------------------")
-    _, err = t.save_card(stub, sc)
-  
-  			shopLedger.ConsumeMoney = shopLedger.ConsumeMoney + money
-			shopLedger.ConsumePoint = shopLedger.ConsumePoint + point
-			t.update_shopLedger(stub, shopid, sc.Kakaid, shopLedger)
+	err = json.Unmarshal(bytes, &bucket)
+	if err != nil { return bucket, false, errors.New("Corrupt ledger bucket record") }
+	return bucket, true, nil
+}
 
-			fmt.Printf("Put ShopLedger ok");
-		fmt.Printf("---------------save_card ok---------------------------")		
-		if err != nil { fmt.Printf("transactionCard_consumer_to_consumer: Error saving changes: %s", err); return nil, errors.New("Error saving changes") }
-	
-	return nil, nil
-	
+func (t *CardTransactionChaincode) save_ledger_bucket(stub shim.ChaincodeStubInterface, bucket LedgerBucket) ([]byte, error) {
+
+	bytes, err := json.Marshal(bucket)
+	if err != nil { return nil, errors.New("Error converting ledger bucket") }
+
+	err = stub.PutState(t.get_ledgerBucketID(bucket.Templateid, bucket.Day), bytes)
+	if err != nil { return nil, errors.New("Error storing ledger bucket") }
+
+	return bytes, nil
 }
 
 //=================================================================================================================================
-//	 Update Functions
-//=================================================================================================================================
-//	 update_money
+//	 post_ledger_bucket - adds the difference between the stored and the new shop ledger to today's bucket. Fails when
+//						  today is in a closed period of the shop
 //=================================================================================================================================
+func (t *CardTransactionChaincode) post_ledger_bucket(stub shim.ChaincodeStubInterface, shopid string, templateID string, shopLedger ShopLedger) ([]byte, error) {
+
+	var old ShopLedger
+	oldBytes, err := t.get_shopLedger_internal(stub, shopid, templateID)
+	if err != nil { return nil, err }
+	if oldBytes != nil {
+		err = json.Unmarshal(oldBytes, &old)
+		if err != nil { return nil, errors.New("Invalid shopLedgerBytes JSON object") }
+	}
 
-func (t *CardTransactionChaincode) update_ct_money(stub shim.ChaincodeStubInterface, v Card, caller string, caller_affiliation int, new_value string) ([]byte, error) {
-	
-	new_money, err := strconv.Atoi(new_value) 		                // will return an error if the new vin contains non numerical chars
-		if err != nil  { return nil, errors.New("Invalid value passed for money") }
-	
-	if 		//v.status			== STATE_SHOP	&& 
-			//v.owner				== caller				&&
-			caller_affiliation	== SHOP			&&
-			//v.VIN				== 0					&&			// Can't change the VIN after its initial assignment
-			v.Scrapped			== false				{
-			
-					v.Money = new_money					// Update to the new value
-	} else {
-	
-															return nil, errors.New("Permission denied")
-		
+	delta := t.combine_shopLedger(shopLedger, old, -1)
+	delta.Templateid = ""
+	delta.Shopid = ""
+	delta.Minorunits = false
+	if delta == (ShopLedger{}) { return nil, nil }
+
+	if shopLedger.Shopid != "" { shopid = shopLedger.Shopid }
+	now, err := t.get_tx_time(stub)
+	if err != nil { return nil, err }
+	day := now.Format(DAY_FORMAT)
+
+	periods, err := t.retrieve_ledger_periods(stub, shopid)
+	if err != nil { return nil, err }
+	if periods.Closedthrough != "" && day <= periods.Closedthrough {
+		return nil, errors.New("ledger of shop " + shopid + " is closed through " + periods.Closedthrough)
 	}
-	
-	_, err  = t.save_card(stub, v)						// Save the changes in the blockchain
-	
-															if err != nil { fmt.Printf("update_money: Error saving changes: %s", err); return nil, errors.New("Error saving changes") } 
-	
-	return nil, nil
-	
-}
+	if periods.Firstday == "" {
+		periods.Firstday = day
+		_, err = t.save_ledger_periods(stub, periods)
+		if err != nil { return nil, err }
+	}
+
+	bucket, _, err := t.retrieve_ledger_bucket(stub, templateID, day)
+	if err != nil { return nil, err }
+	if bucket.Closed { return nil, errors.New("ledger bucket " + templateID + " " + day + " is closed") }
 
+	bucket.Shopid = shopid
+	bucket.Postings = t.combine_shopLedger(bucket.Postings, delta, 1)
+	bucket.Postings.Templateid = templateID
+	bucket.Postings.Shopid = shopid
 
+	return t.save_ledger_bucket(stub, bucket)
+}
 
 //=================================================================================================================================
-//	 update_point
+//	 get_ledger_buckets - the buckets with postings of a template from periodStart to periodEnd, at most a year
 //=================================================================================================================================
-
-func (t *CardTransactionChaincode) update_ct_point(stub shim.ChaincodeStubInterface, v Card, caller string, caller_affiliation int, new_value string) ([]byte, error) {
-	
-	new_point, err := strconv.Atoi(new_value)		                // will return an error if the new vin contains non numerical chars
-	if err != nil { return nil, errors.New("Invalid value passed for point") }
-	
-	if 		//v.status			== STATE_SHOP	&& 
-			//v.owner				== caller				&&
-			caller_affiliation	== SHOP			&&
-			//v.VIN				== 0					&&			// Can't change the VIN after its initial assignment
-			v.Scrapped			== false				{
-			
-					v.Point = new_point					// Update to the new value
-	} else {
-	
-															return nil, errors.New("Permission denied")
-		
+func (t *CardTransactionChaincode) get_ledger_buckets(stub shim.ChaincodeStubInterface, templateID string, periodStart string, periodEnd string) ([]LedgerBucket, error) {
+
+	start, err := time.Parse(DAY_FORMAT, periodStart)
+	if err != nil { return nil, errors.New("Invalid period start: " + periodStart) }
+	end, err := time.Parse(DAY_FORMAT, periodEnd)
+	if err != nil { return nil, errors.New("Invalid period end: " + periodEnd) }
+	if end.Before(start) { return nil, errors.New("period ends before it starts") }
+	if end.Sub(start) > 366 * 24 * time.Hour { return nil, errors.New("period is longer than a year") }
+
+	buckets := []LedgerBucket{}
+	for day := start; !day.After(end); day = day.AddDate(0, 0, 1) {
+		bucket, ok, err := t.retrieve_ledger_bucket(stub, templateID, day.Format(DAY_FORMAT))
+		if err != nil { return nil, err }
+		if ok { buckets = append(buckets, bucket) }
 	}
-	
-	_, err  = t.save_card(stub, v)						// Save the changes in the blockchain
-	
-															if err != nil { fmt.Printf("update_point: Error saving changes: %s", err); return nil, errors.New("Error saving changes") } 
-	
-	return nil, nil
-	
+	return buckets, nil
 }
 
-
-//	 only can be update by shop
 //=================================================================================================================================
-//	 update_shop
+//	 get_shop_ledger_templates - ids of the card and coupon templates of a shop, the templates shop ledgers are kept for
 //=================================================================================================================================
+func (t *CardTransactionChaincode) get_shop_ledger_templates(stub shim.ChaincodeStubInterface, shopId string) ([]string, error) {
 
-func (t *CardTransactionChaincode) update_ct_shopid(stub shim.ChaincodeStubInterface, v Card, caller string, caller_affiliation int, new_value string) ([]byte, error) {
-	
-	if 		v.Status			== STATE_SHOP	&&
-			v.Owner				== caller				&& 
-			caller_affiliation	== SHOP			&&
-			v.Scrapped			== false				{
-			
-					v.Shopid = new_value
-	} else {
-	
-															return nil, errors.New("Permission denied")
-	
+	var templateIds []string
+
+	templates, err := t.get_shop_templates(stub, shopId)
+	if err != nil { return nil, err }
+	for _, template := range templates {
+		templateIds = append(templateIds, template.Kakaid)
 	}
-	
-	_, err := t.save_card(stub, v)
-	
-															if err != nil { fmt.Printf("update_shopid: Error saving changes: %s", err); return nil, errors.New("Error saving changes") }
-	
-	return nil, nil
-	
-}
 
+	var coupon_holder Coupon_Holder
+	bytes, err := stub.GetState(COUPON_TEMPLATE_HOLDER)
+	if err != nil { return nil, errors.New("Unable to get coupon templates") }
+	if len(bytes) != 0 {
+		err = json.Unmarshal(bytes, &coupon_holder)
+		if err != nil {	return nil, errors.New("Corrupt Coupon_Holder record") }
+	}
+	for _, templateId := range coupon_holder.Coupons {
+		coupon, err := t.retrieve_coupon(stub, templateId)
+		if err != nil { return nil, err }
+		if coupon.Shopid == shopId { templateIds = append(templateIds, templateId) }
+	}
+	return templateIds, nil
+}
 
 //=================================================================================================================================
-//	 update_shop
+//	 check_ledger_viewer - KAKACENTER or staff of the shop allowed to view its ledger
 //=================================================================================================================================
+func (t *CardTransactionChaincode) check_ledger_viewer(stub shim.ChaincodeStubInterface, caller string, caller_affiliation int, shopId string) (error) {
 
-func (t *CardTransactionChaincode) update_ct_shopname(stub shim.ChaincodeStubInterface, v Card, caller string, caller_affiliation int, new_value string) ([]byte, error) {
-	
-	if 		v.Status			== STATE_SHOP	&&
-			v.Owner				== caller				&& 
-			caller_affiliation	== SHOP			&&
-			v.Scrapped			== false				{
-			
-					v.Shop = new_value
-	} else {
-	
-															return nil, errors.New("Permission denied")
-	
-	}
-	
-	_, err := t.save_card(stub, v)
-	
-															if err != nil { fmt.Printf("update_shop: Error saving changes: %s", err); return nil, errors.New("Error saving changes") }
-	
-	return nil, nil
-	
+	if caller_affiliation == KAKACENTER { return nil }
+
+	callerShopid, err := t.check_shop_permission(stub, caller, caller_affiliation, PERM_VIEW_LEDGER)
+	if err != nil { return err }
+	if callerShopid != shopId { return errors.New("Permission denied") }
+	return nil
 }
 
 //=================================================================================================================================
-//	 update_cardid
+//	 get_ledger_statement - the daily postings of every ledger of a shop from periodStart to periodEnd with their totals
 //=================================================================================================================================
-
-func (t *CardTransactionChaincode) update_ct_cardid(stub shim.ChaincodeStubInterface, v Card, caller string, caller_affiliation int, new_value string) ([]byte, error) {
-	
-	if 		v.Status			== STATE_SHOP	&&
-			v.Owner				== caller				&& 
-			caller_affiliation	== SHOP			&&
-			v.Scrapped			== false				{
-			
-					v.Cardid = new_value
-	} else {
-	
-															return nil, errors.New("Permission denied")
-	
+func (t *CardTransactionChaincode) get_ledger_statement(stub shim.ChaincodeStubInterface, caller string, caller_affiliation int, shopId string, periodStart string, periodEnd string) ([]byte, error) {
+
+	err := t.check_ledger_viewer(stub, caller, caller_affiliation, shopId)
+	if err != nil { return nil, err }
+
+	periods, err := t.retrieve_ledger_periods(stub, shopId)
+	if err != nil { return nil, err }
+
+	templateIds, err := t.get_shop_ledger_templates(stub, shopId)
+	if err != nil { return nil, err }
+
+	var statement LedgerStatement
+	statement.Shopid = shopId
+	statement.Periodstart = periodStart
+	statement.Periodend = periodEnd
+	statement.Closedthrough = periods.Closedthrough
+	statement.Templates = []TemplateStatement{}
+
+	for _, templateId := range templateIds {
+		buckets, err := t.get_ledger_buckets(stub, templateId, periodStart, periodEnd)
+		if err != nil { return nil, err }
+
+		var ts TemplateStatement
+		ts.Templateid = templateId
+		ts.Days = buckets
+		ts.Total.Templateid = templateId
+		ts.Total.Shopid = shopId
+		for _, bucket := range buckets {
+			ts.Total = t.combine_shopLedger(ts.Total, bucket.Postings, 1)
+		}
+		statement.Templates = append(statement.Templates, ts)
 	}
-	
-	_, err := t.save_card(stub, v)
-	
-															if err != nil { fmt.Printf("update_cardid: Error saving changes: %s", err); return nil, errors.New("Error saving changes") }
-	
-	return nil, nil
-	
+
+	return json.Marshal(statement)
 }
 
 //=================================================================================================================================
-//	 update_cardlevel
+//	 close_period - closes the ledger of a shop through the given day, which must be before the transaction date.
+//					Buckets of closed days can not change and nothing can be posted to the shop ledgers on a closed
+//					day. KAKACENTER or staff with settlement permission of the shop, every close is audited
 //=================================================================================================================================
+func (t *CardTransactionChaincode) close_period(stub shim.ChaincodeStubInterface, caller string, caller_affiliation int, shopId string, throughDay string) ([]byte, error) {
 
+	if caller_affiliation != KAKACENTER {
+		callerShopid, err := t.check_shop_permission(stub, caller, caller_affiliation, PERM_SETTLEMENT)
+		if err != nil { return nil, err }
+		if callerShopid != shopId { return nil, errors.New("Permission denied") }
+	}
 
-func (t *CardTransactionChaincode) update_ct_cardlevel(stub shim.ChaincodeStubInterface, v Card, caller string, caller_affiliation int, new_value string) ([]byte, error) {
-	
-	if 		v.Status			== STATE_SHOP	&&
-			v.Owner				== caller				&& 
-			caller_affiliation	== SHOP			&&
-			v.Scrapped			== false				{
-			
-					v.Cardlevel = new_value
-	} else {
-	
-															return nil, errors.New("Permission denied")
-	
+	through, err := time.Parse(DAY_FORMAT, throughDay)
+	if err != nil { return nil, errors.New("Invalid day: " + throughDay) }
+	now, err := t.get_tx_time(stub)
+	if err != nil { return nil, err }
+	today := now.Format(DAY_FORMAT)
+	if throughDay >= today { return nil, errors.New("only days before " + today + " can be closed") }
+
+	periods, err := t.retrieve_ledger_periods(stub, shopId)
+	if err != nil { return nil, err }
+	if periods.Closedthrough != "" && throughDay <= periods.Closedthrough {
+		return nil, errors.New("ledger of shop " + shopId + " is already closed through " + periods.Closedthrough)
 	}
-	
-	_, err := t.save_card(stub, v)
-	
-															if err != nil { fmt.Printf("update_cardlevel: Error saving changes: %s", err); return nil, errors.New("Error saving changes") }
-	
+
+	templateIds, err := t.get_shop_ledger_templates(stub, shopId)
+	if err != nil { return nil, err }
+
+	// buckets only exist from the first posting of the shop on
+	if periods.Firstday != "" {
+		from, _ := time.Parse(DAY_FORMAT, periods.Firstday)
+		if periods.Closedthrough != "" {
+			closed, _ := time.Parse(DAY_FORMAT, periods.Closedthrough)
+			from = closed.AddDate(0, 0, 1)
+		}
+		for day := from; !day.After(through); day = day.AddDate(0, 0, 1) {
+			for _, templateId := range templateIds {
+				bucket, ok, err := t.retrieve_ledger_bucket(stub, templateId, day.Format(DAY_FORMAT))
+				if err != nil { return nil, err }
+				if ok == false { continue }
+
+				bucket.Closed = true
+				_, err = t.save_ledger_bucket(stub, bucket)
+				if err != nil { return nil, err }
+			}
+		}
+	}
+
+	periods.Closedthrough = throughDay
+	_, err = t.save_ledger_periods(stub, periods)
+	if err != nil { return nil, err }
+
+	_, err = t.add_admin_audit(stub, caller, "close_period", shopId, throughDay)
+	if err != nil { return nil, err }
+
 	return nil, nil
-	
 }
 
 //=================================================================================================================================
-//	 update_cardclass
+//	 Journal Functions - every value movement posted as a balanced double-entry journal entry
 //=================================================================================================================================
+func (t *CardTransactionChaincode) get_journalEntryID(entryId string) (string) {
+	return "journal-" + entryId
+}
 
-func (t *CardTransactionChaincode) update_ct_cardclass(stub shim.ChaincodeStubInterface, v Card, caller string, caller_affiliation int, new_value string) ([]byte, error) {
-	
-	if 		v.Status			== STATE_SHOP	&&
-			v.Owner				== caller				&& 
-			caller_affiliation	== SHOP			&&
-			v.Scrapped			== false				{
-			
-					v.Cardclass = new_value
-	} else {
-	
-															return nil, errors.New("Permission denied")
-	
-	}
-	
-	_, err := t.save_card(stub, v)
-	
-															if err != nil { fmt.Printf("update_cardclass: Error saving changes: %s", err); return nil, errors.New("Error saving changes") }
-	
-	return nil, nil
-	
+func (t *CardTransactionChaincode) get_journalAccountID(accountId string) (string) {
+	return "account-" + accountId
+}
+
+func (t *CardTransactionChaincode) get_journalPostingID(accountId string, posting int) (string) {
+	return "posting-" + accountId + "-" + strconv.Itoa(posting)
+}
+
+//	card_line - debits the card liability, a negative amount credits it
+func (t *CardTransactionChaincode) card_line(card Card, money int64, point int) (JournalLine) {
+	return JournalLine{ Account: ACCOUNT_CARD + "-" + card.Cardid, Templateid: card.Kakaid, Currency: card.Currency, Money: money, Point: point }
+}
+
+func (t *CardTransactionChaincode) shop_line(kind string, shopId string, currency string, money int64, point int) (JournalLine) {
+	return JournalLine{ Account: kind + "-" + shopId + "-" + currency, Currency: currency, Money: money, Point: point }
+}
+
+//	escrow_line - the escrow of a gift or pending transfer, by its state key, for the amount taken from card
+func (t *CardTransactionChaincode) escrow_line(escrowKey string, card Card, money int64, point int) (JournalLine) {
+	return JournalLine{ Account: ACCOUNT_ESCROW + "-" + escrowKey, Templateid: card.Kakaid, Currency: card.Currency, Money: money, Point: point }
 }
 
 //=================================================================================================================================
-//	 update_password
+//	 card_to_card_lines - money and points from sc to tc. Points going to a card of an allied shop are released by the
+//						  shop of sc and issued again, converted, by the shop of tc
 //=================================================================================================================================
+func (t *CardTransactionChaincode) card_to_card_lines(sc Card, tc Card, money int64, point int, converted int) ([]JournalLine) {
 
-func (t *CardTransactionChaincode) update_ct_password(stub shim.ChaincodeStubInterface, v Card, caller string, caller_affiliation int, new_value string) ([]byte, error) {
-	
-	if 		v.Owner				== caller				&& 
-			v.Scrapped			== false				{
-			
-					v.Password = new_value
-	} else {
-	
-															return nil, errors.New("Permission denied")
-	
+	lines := []JournalLine{ t.card_line(sc, money, point), t.card_line(tc, -money, -converted) }
+	if sc.Shopid != tc.Shopid {
+		lines = append(lines, t.shop_line(ACCOUNT_PROMOTION, sc.Shopid, sc.Currency, 0, -point))
+		lines = append(lines, t.shop_line(ACCOUNT_PROMOTION, tc.Shopid, tc.Currency, 0, converted))
+	}
+	return lines
+}
+
+//	next_journal_entry_id - counts the entry in JOURNAL_COUNTER and returns its id
+func (t *CardTransactionChaincode) next_journal_entry_id(stub shim.ChaincodeStubInterface) (string, error) {
+
+	count := 0
+	bytes, err := stub.GetState(JOURNAL_COUNTER)
+	if err != nil { return "", errors.New("Unable to get the journal counter") }
+	if len(bytes) != 0 {
+		count, err = strconv.Atoi(string(bytes))
+		if err != nil { return "", errors.New("Corrupt journal counter record") }
+	}
+	count = count + 1
+
+	err = stub.PutState(JOURNAL_COUNTER, []byte(strconv.Itoa(count)))
+	if err != nil { return "", errors.New("Unable to put the JOURNAL_COUNTER state") }
+	return "J" + strconv.Itoa(count), nil
+}
+
+func (t *CardTransactionChaincode) retrieve_journal_entry(stub shim.ChaincodeStubInterface, entryId string) (JournalEntry, error) {
+
+	var entry JournalEntry
+	bytes, err := stub.GetState(t.get_journalEntryID(entryId))
+	if err != nil || len(bytes) == 0 { return entry, errors.New("journal entry " + entryId + " not found") }
+
+	err = json.Unmarshal(bytes, &entry)
+	if err != nil { return entry, errors.New("Corrupt journal entry record") }
+	return entry, nil
+}
+
+//	retrieve_account_entry - the nth entry, counted from 1, posted to an account
+func (t *CardTransactionChaincode) retrieve_account_entry(stub shim.ChaincodeStubInterface, accountId string, posting int) (JournalEntry, error) {
+
+	bytes, err := stub.GetState(t.get_journalPostingID(accountId, posting))
+	if err != nil || len(bytes) == 0 { return JournalEntry{}, errors.New("posting " + strconv.Itoa(posting) + " of journal account " + accountId + " not found") }
+	return t.retrieve_journal_entry(stub, string(bytes))
+}
+
+//	retrieve_journal_account - an account nothing was posted to yet comes back empty
+func (t *CardTransactionChaincode) retrieve_journal_account(stub shim.ChaincodeStubInterface, accountId string) (JournalAccount, error) {
+
+	var account JournalAccount
+	bytes, err := stub.GetState(t.get_journalAccountID(accountId))
+	if err != nil { return account, errors.New("Error retrieving journal account " + accountId) }
+	if len(bytes) != 0 {
+		err = json.Unmarshal(bytes, &account)
+		if err != nil { return account, errors.New("Corrupt journal account record") }
 	}
-	
-	_, err := t.save_card(stub, v)
-	
-															if err != nil { fmt.Printf("update_password: Error saving changes: %s", err); return nil, errors.New("Error saving changes") }
-	
-	return nil, nil
-	
+	account.Accountid = accountId
+	return account, nil
 }
 
+func (t *CardTransactionChaincode) save_journal_account(stub shim.ChaincodeStubInterface, account JournalAccount) ([]byte, error) {
+
+	bytes, err := json.Marshal(account)
+	if err != nil { return nil, errors.New("Error converting journal account") }
+
+	err = stub.PutState(t.get_journalAccountID(account.Accountid), bytes)
+	if err != nil { return nil, errors.New("Error storing journal account") }
+
+	return bytes, nil
+}
 
 //=================================================================================================================================
-//	 update_expdate
+//	 post_journal - checks the entry balances and posts it to its accounts. Lines of 0 are left out, an entry without
+//					lines is not posted. Returns the entry id
 //=================================================================================================================================
-func (t *CardTransactionChaincode) update_ct_expdate(stub shim.ChaincodeStubInterface, v Card, caller string, caller_affiliation int, new_value string) ([]byte, error) {
+func (t *CardTransactionChaincode) post_journal(stub shim.ChaincodeStubInterface, action string, reference string, lines []JournalLine) (string, error) {
+
+	var entry JournalEntry
+	money := make(map[string]int64)
+	point := 0
+	for _, line := range lines {
+		if line.Money == 0 && line.Point == 0 { continue }
+		entry.Lines = append(entry.Lines, line)
+		money[line.Currency] = money[line.Currency] + line.Money
+		point = point + line.Point
+	}
+	if len(entry.Lines) == 0 { return "", nil }
 
-	if		v.Status			== STATE_SHOP	&&
-			v.Owner				== caller		&& 
-			caller_affiliation	== SHOP			&&
-			v.Scrapped			== false				{
-		
-					v.Expdate = new_value
-				
-	} else {
-		return nil, errors.New("Permission denied")
+	for currency, sum := range money {
+		if sum != 0 { return "", errors.New("journal entry " + action + " " + reference + " does not balance in " + currency) }
 	}
-	
-	_, err := t.save_card(stub, v)
-	
-	if err != nil { fmt.Printf("update_expdate: Error saving changes: %s", err); 
-		return nil, errors.New(" update_expdate: Error saving changes ") }
-	
-	return nil, nil
-	
+	if point != 0 { return "", errors.New("journal entry " + action + " " + reference + " does not balance in points") }
+
+	entryId, err := t.next_journal_entry_id(stub)
+	if err != nil { return "", err }
+
+	entry.Entryid = entryId
+	entry.Action = action
+	entry.Reference = reference
+	entry.Timestamp, err = t.get_timestamp(stub)
+	if err != nil { return "", err }
+
+	posted := make(map[string]bool)
+	for _, line := range entry.Lines {
+		account, err := t.retrieve_journal_account(stub, line.Account)
+		if err != nil { return "", err }
+
+		if account.Currency == "" {
+			account.Templateid = line.Templateid
+			account.Currency = line.Currency
+		} else if line.Money != 0 && account.Currency != line.Currency {
+			return "", errors.New("journal account " + line.Account + " is kept in " + account.Currency + ", not " + line.Currency)
+		}
+
+		account.Money = account.Money + line.Money
+		account.Point = account.Point + line.Point
+		if posted[line.Account] == false {
+			account.Postings = account.Postings + 1
+			err = stub.PutState(t.get_journalPostingID(line.Account, account.Postings), []byte(entry.Entryid))
+			if err != nil { return "", errors.New("Error storing journal posting") }
+			posted[line.Account] = true
+		}
+		_, err = t.save_journal_account(stub, account)
+		if err != nil { return "", err }
+	}
+
+	bytes, err := json.Marshal(entry)
+	if err != nil { return "", errors.New("Error converting journal entry") }
+	err = stub.PutState(t.get_journalEntryID(entry.Entryid), bytes)
+	if err != nil { return "", errors.New("Error storing journal entry") }
+
+	return entry.Entryid, nil
 }
 
+//=================================================================================================================================
+//	 sum_journal_entries - the balance of an account derived from its journal entries
+//=================================================================================================================================
+func (t *CardTransactionChaincode) sum_journal_entries(stub shim.ChaincodeStubInterface, account JournalAccount) (int64, int, error) {
+
+	var money int64
+	point := 0
+	for posting := 1; posting <= account.Postings; posting++ {
+		entry, err := t.retrieve_account_entry(stub, account.Accountid, posting)
+		if err != nil { return 0, 0, err }
+
+		for _, line := range entry.Lines {
+			if line.Account != account.Accountid { continue }
+			money = money + line.Money
+			point = point + line.Point
+		}
+	}
+	return money, point, nil
+}
 
-// all role can do this
 //=================================================================================================================================
-//	 scrap_card
+//	 ledger_outstanding - money and points the shop ledger of a template says are still on its cards
 //=================================================================================================================================
-func (t *CardTransactionChaincode) scrap_card(stub shim.ChaincodeStubInterface, v Card, caller string) ([]byte, error) {
+func (t *CardTransactionChaincode) ledger_outstanding(ledger ShopLedger) (int64, int) {
 
-	if		v.Owner				== caller				&& 
-			v.Scrapped			== false				{
-		
-					v.Scrapped = true
-				
-	} else {
-		return nil, errors.New("Permission denied")
-	}
-	
-	_, err := t.save_card(stub, v)
-	
-															if err != nil { fmt.Printf("SCRAP_CARD: Error saving changes: %s", err); return nil, errors.New("SCRAP_CARD Error saving changes") }
-	
-	return nil, nil
-	
+	money := ledger.InitMoney + ledger.DepositMoney + ledger.BonusMoney - ledger.ConsumeMoney - ledger.ConsumeBonus - ledger.RefundMoney - ledger.ForfeitBonus +
+		ledger.TransferInMoney - ledger.TransferOutMoney + ledger.AdjustMoney
+	point := ledger.InitPoint + ledger.DepositPoint + ledger.EarnPoint + ledger.BonusPoint - ledger.ConsumePoint - ledger.RefundPoint - ledger.ExpiredPoint +
+		ledger.TransferInPoint - ledger.TransferOutPoint + ledger.AdjustPoint
+	return money, point
 }
 
 //=================================================================================================================================
-//	 update_expired
+//	 get_escrow_accounts - the escrow accounts of the gifts and pending transfers of amounts, by card template
 //=================================================================================================================================
-func (t *CardTransactionChaincode) update_ct_expired(stub shim.ChaincodeStubInterface, v Card, caller string, caller_affiliation int, isexpired string) ([]byte, error) {
+func (t *CardTransactionChaincode) get_escrow_accounts(stub shim.ChaincodeStubInterface) (map[string][]string, error) {
 
-	if		v.Owner				== caller				&& 
-			v.Scrapped			== false {
-				if(isexpired =="true"){
-					v.Expired = true
-				}else if(isexpired =="false"){
-					v.Expired = false
-				}else { fmt.Printf("update_expired: value is not true or false"); 
-						return nil, errors.New("update_expired: value is not true or false") }
-	
-					
-				
-	} else {
-		return nil, errors.New("Permission denied")
+	escrows := make(map[string][]string)
+
+	gift_holder, err := t.get_gift_holder(stub)
+	if err != nil { return nil, err }
+	for _, giftId := range gift_holder.Gifts {
+		gift, err := t.retrieve_gift(stub, giftId)
+		if err != nil { return nil, err }
+		if gift.Wholecard { continue }
+		escrows[gift.Templateid] = append(escrows[gift.Templateid], ACCOUNT_ESCROW + "-" + t.get_giftID(giftId))
 	}
-	
-	_, err := t.save_card(stub, v)
-		if err != nil { fmt.Printf("update_expired: Error saving changes: %s", err); return nil, errors.New("SCRAP_CARD Error saving changes") }
-	
-	return nil, nil
-	
+
+	transfer_holder, err := t.get_pending_transfer_holder(stub)
+	if err != nil { return nil, err }
+	for _, transferId := range transfer_holder.Transfers {
+		transfer, err := t.retrieve_pending_transfer(stub, transferId)
+		if err != nil { return nil, err }
+		if transfer.Wholecard { continue }
+
+		card, err := t.retrieve_card(stub, transfer.Cardid)
+		if err != nil { return nil, err }
+		escrows[card.Kakaid] = append(escrows[card.Kakaid], ACCOUNT_ESCROW + "-" + t.get_pendingTransferID(transferId))
+	}
+	return escrows, nil
 }
 
+//=================================================================================================================================
+//	 open_journal_account - posts the part of a liability the journal does not know of, the balance from before the
+//							journal was kept, against the shop. Once per account
+//=================================================================================================================================
+func (t *CardTransactionChaincode) open_journal_account(stub shim.ChaincodeStubInterface, line JournalLine, shopId string) (error) {
+
+	account, err := t.retrieve_journal_account(stub, line.Account)
+	if err != nil { return err }
+	if account.Opened { return nil }
+
+	money := line.Money + account.Money
+	point := line.Point + account.Point
+	_, err = t.post_journal(stub, "opening", line.Account, []JournalLine{
+		{ Account: line.Account, Templateid: line.Templateid, Currency: line.Currency, Money: -money, Point: -point },
+		t.shop_line(ACCOUNT_SHOP_CASH, shopId, line.Currency, money, 0),
+		t.shop_line(ACCOUNT_PROMOTION, shopId, line.Currency, 0, point),
+	})
+	if err != nil { return err }
+
+	account, err = t.retrieve_journal_account(stub, line.Account)
+	if err != nil { return err }
+	account.Templateid = line.Templateid
+	account.Currency = line.Currency
+	account.Opened = true
+	_, err = t.save_journal_account(stub, account)
+	return err
+}
 
 //=================================================================================================================================
-//	 update_category
+//	 open_journal - opening balances of the cards of a template and of its gifts and transfers in escrow. KAKACENTER only
 //=================================================================================================================================
-func (t *CardTransactionChaincode) update_ct_category(stub shim.ChaincodeStubInterface, v Card, caller string, caller_affiliation int, new_value string) ([]byte, error) {
+func (t *CardTransactionChaincode) open_journal(stub shim.ChaincodeStubInterface, caller string, caller_affiliation int, templateId string) ([]byte, error) {
 
-	if		v.Status			== STATE_CONSUMER_OWNERSHIP	&&
-			v.Owner				== caller			&& 
-			caller_affiliation	== CONSUMER			&&
-			v.Scrapped			== false				{
-		
-					v.Category = new_value
-				
-	} else {
-		return nil, errors.New("Permission denied")
+	if caller_affiliation != KAKACENTER {
+		return nil, errors.New("Permission denied: only KAKACENTER can open the journal")
 	}
-	
-	_, err := t.save_card(stub, v)
-	
-															if err != nil { fmt.Printf("update_category: Error saving changes: %s", err); return nil, errors.New("SCRAP_CARD Error saving changes") }
-	
+
+	template, err := t.retrieve_card(stub, templateId)
+	if err != nil { return nil, errors.New("Failed to retrieve card template: " + templateId) }
+
+	cards, err := t.get_template_cards(stub, templateId)
+	if err != nil { return nil, err }
+
+	for _, card := range cards {
+		err = t.open_journal_account(stub, t.card_line(card, card.Money + card.Bonusmoney, card.Point), template.Shopid)
+		if err != nil { return nil, err }
+	}
+
+	gifts, transfers, err := t.get_template_escrows(stub, templateId)
+	if err != nil { return nil, err }
+	for _, gift := range gifts {
+		err = t.open_journal_account(stub, t.escrow_line(t.get_giftID(gift.Giftid), template, gift.Money, gift.Point), template.Shopid)
+		if err != nil { return nil, err }
+	}
+	for _, transfer := range transfers {
+		err = t.open_journal_account(stub, t.escrow_line(t.get_pendingTransferID(transfer.Transferid), template, transfer.Money, transfer.Point), template.Shopid)
+		if err != nil { return nil, err }
+	}
+
+	_, err = t.add_admin_audit(stub, caller, "open_journal", templateId, "")
+	if err != nil { return nil, err }
+
 	return nil, nil
-	
 }
 
-
 //=================================================================================================================================
-//	 update_tel
+//	 get_journal_account - an account with its entries. KAKACENTER, the owner of a card for its card account, staff
+//						   allowed to view the ledger for the accounts of their shop and its cards
 //=================================================================================================================================
-func (t *CardTransactionChaincode) update_ct_tel(stub shim.ChaincodeStubInterface, v Card, caller string, caller_affiliation int, new_value string) ([]byte, error) {
+func (t *CardTransactionChaincode) get_journal_account(stub shim.ChaincodeStubInterface, caller string, caller_affiliation int, accountId string) ([]byte, error) {
+
+	account, err := t.retrieve_journal_account(stub, accountId)
+	if err != nil { return nil, err }
+
+	if caller_affiliation != KAKACENTER {
+		allowed := false
+		if strings.HasPrefix(accountId, ACCOUNT_CARD + "-") {
+			card, err := t.retrieve_card(stub, strings.TrimPrefix(accountId, ACCOUNT_CARD + "-"))
+			if err != nil { return nil, err }
+			allowed = card.Owner == caller || t.check_ledger_viewer(stub, caller, caller_affiliation, card.Shopid) == nil
+		} else if caller_affiliation == SHOP {
+			shopid, err := t.check_shop_permission(stub, caller, caller_affiliation, PERM_VIEW_LEDGER)
+			if err != nil { return nil, err }
+			for _, kind := range []string{ ACCOUNT_SHOP_CASH, ACCOUNT_PROMOTION, ACCOUNT_BREAKAGE, ACCOUNT_COMMISSION, ACCOUNT_ADJUSTMENT } {
+				if strings.HasPrefix(accountId, kind + "-" + shopid + "-") { allowed = true }
+			}
+		}
+		if allowed == false { return nil, errors.New("Permission denied") }
+	}
 
-	if		v.Status			== STATE_CONSUMER_OWNERSHIP	&&
-			v.Owner				== caller		&& 
-			caller_affiliation	== CONSUMER			&&
-			v.Scrapped			== false				{
-		
-					v.Tel = new_value
-				
-	} else {
-		return nil, errors.New("Permission denied")
+	var statement JournalStatement
+	statement.Account = account
+	statement.Entries = []JournalEntry{}
+	for posting := 1; posting <= account.Postings; posting++ {
+		entry, err := t.retrieve_account_entry(stub, account.Accountid, posting)
+		if err != nil { return nil, err }
+		statement.Entries = append(statement.Entries, entry)
 	}
-	
-	_, err := t.save_card(stub, v)
-	
-															if err != nil { fmt.Printf("update_tel: Error saving changes: %s", err); return nil, errors.New("SCRAP_CARD Error saving changes") }
-	
-	return nil, nil
-	
+	return json.Marshal(statement)
 }
 
 //=================================================================================================================================
-// these 4 item can not been update seperatly. they should be changed in transaction func
-//  update_owner
-//  update_releasedate
-//  update_getdate
-//  update_status
+//	 get_journal_check - checks every card of a shop against its journal account and entries, and the journal of
+//						 each template against its shop ledger
 //=================================================================================================================================
+func (t *CardTransactionChaincode) get_journal_check(stub shim.ChaincodeStubInterface, caller string, caller_affiliation int, shopId string) ([]byte, error) {
+
+	err := t.check_ledger_viewer(stub, caller, caller_affiliation, shopId)
+	if err != nil { return nil, err }
+
+	templates, err := t.get_shop_templates(stub, shopId)
+	if err != nil { return nil, err }
+
+	escrows, err := t.get_escrow_accounts(stub)
+	if err != nil { return nil, err }
+
+	var result ShopJournalCheck
+	result.Shopid = shopId
+	result.Templates = []JournalCheck{}
+	result.Balanced = true
+
+	for _, template := range templates {
+		var check JournalCheck
+		check.Templateid = template.Kakaid
+		check.Unbalanced = []string{}
+
+		cards, err := t.get_template_cards(stub, template.Kakaid)
+		if err != nil { return nil, err }
+
+		for _, card := range cards {
+			account, err := t.retrieve_journal_account(stub, t.card_line(card, 0, 0).Account)
+			if err != nil { return nil, err }
+			money, point, err := t.sum_journal_entries(stub, account)
+			if err != nil { return nil, err }
+
+			check.Cards = check.Cards + 1
+			check.CardMoney = check.CardMoney + card.Money + card.Bonusmoney
+			check.CardPoint = check.CardPoint + card.Point
+			check.JournalMoney = check.JournalMoney - account.Money
+			check.JournalPoint = check.JournalPoint - account.Point
+
+			if 		card.Money + card.Bonusmoney	!= -account.Money	||
+					card.Point						!= -account.Point	||
+					money							!= account.Money	||
+					point							!= account.Point	{
+				check.Unbalanced = append(check.Unbalanced, card.Cardid)
+			}
+		}
+
+		for _, accountId := range escrows[template.Kakaid] {
+			account, err := t.retrieve_journal_account(stub, accountId)
+			if err != nil { return nil, err }
+			check.EscrowMoney = check.EscrowMoney - account.Money
+			check.EscrowPoint = check.EscrowPoint - account.Point
+		}
+		check.JournalMoney = check.JournalMoney + check.EscrowMoney
+		check.JournalPoint = check.JournalPoint + check.EscrowPoint
+
+		shopLedger, err := t.retrieve_shopLedger(stub, template.Shopid, template.Kakaid)
+		if err != nil { return nil, err }
+		check.LedgerMoney, check.LedgerPoint = t.ledger_outstanding(shopLedger)
 
+		check.Balanced = len(check.Unbalanced) == 0 && check.JournalMoney == check.LedgerMoney && check.JournalPoint == check.LedgerPoint
+		if check.Balanced == false { result.Balanced = false }
+		result.Templates = append(result.Templates, check)
+	}
+
+	return json.Marshal(result)
+}
 
 //=================================================================================================================================
-//	 Read Functions
+//	 Liability Report Functions - stored value still owed to consumers network-wide
 //=================================================================================================================================
-//	 get_card_details
+//	 get_age_bucket - the age bucket of a card released at releasedate
 //=================================================================================================================================
-func (t *CardTransactionChaincode) get_card_details(stub shim.ChaincodeStubInterface, v Card, caller string, caller_affiliation int) ([]byte, error) {
-	
-	bytes, err := json.Marshal(v)
-	
-																if err != nil { return nil, errors.New("GET_CARD_DETAILS: Invalid card object") }
-																
-	if 		v.Owner				== caller		||
-			caller_affiliation	== KAKACENTER	||
-			caller_affiliation	== SHOP 	{
-			
-					return bytes, nil		
-	} else {
-																return nil, errors.New("Permission Denied")	
-	}
+func (t *CardTransactionChaincode) get_age_bucket(releasedate string, now time.Time) (string) {
+
+	released, err := time.Parse(TIME_FORMAT, releasedate)
+	if err != nil { return AGE_UNKNOWN }
 
+	days := int(now.Sub(released).Hours() / 24)
+	lower := 0
+	for _, upper := range liability_age_buckets {
+		if days <= upper { return strconv.Itoa(lower) + "-" + strconv.Itoa(upper) }
+		lower = upper + 1
+	}
+	return strconv.Itoa(lower) + "+"
 }
 
+func (t *CardTransactionChaincode) add_liability(buckets []LiabilityBucket, bucket string, money int64, point int) ([]LiabilityBucket) {
+
+	for i := range buckets {
+		if buckets[i].Bucket == bucket {
+			buckets[i].Cards = buckets[i].Cards + 1
+			buckets[i].Money = buckets[i].Money + money
+			buckets[i].Point = buckets[i].Point + point
+			return buckets
+		}
+	}
+	return append(buckets, LiabilityBucket{ Bucket: bucket, Cards: 1, Money: money, Point: point })
+}
 
 //=================================================================================================================================
-//	 get_card_templates
+//	 get_template_liability - the liability of a template by card age, with the amounts its open gifts and pending
+//							  transfers hold in escrow, reconciled with its shop ledger
 //=================================================================================================================================
+func (t *CardTransactionChaincode) get_template_liability(stub shim.ChaincodeStubInterface, template Card, now time.Time) (TemplateLiability, error) {
+
+	var tl TemplateLiability
+	tl.Templateid = template.Kakaid
+	tl.Currency = template.Currency
+	tl.Buckets = []LiabilityBucket{}
+
+	cards, err := t.get_template_cards(stub, template.Kakaid)
+	if err != nil { return tl, err }
+
+	for _, card := range cards {
+		money := card.Money + card.Bonusmoney
+		if card.Scrapped == true || card.Expired == true {
+			tl.ExcludedMoney = tl.ExcludedMoney + money
+			tl.ExcludedPoint = tl.ExcludedPoint + card.Point
+			continue
+		}
+		if money == 0 && card.Point == 0 { continue }
 
-func (t *CardTransactionChaincode) get_card_templates(stub shim.ChaincodeStubInterface, caller string, caller_affiliation int) ([]byte, error) {
+		tl.Buckets = t.add_liability(tl.Buckets, t.get_age_bucket(card.Releasedate, now), money, card.Point)
+		tl.Money = tl.Money + money
+		tl.Point = tl.Point + card.Point
+	}
 
-	bytes, err := stub.GetState(CARD_TEMPLATE_HOLDER)
-		
-																			if err != nil { return nil, errors.New("Unable to get v5cIDs") }
-																	
-	var card_template_holder Card_Holder
-	
-	err = json.Unmarshal(bytes, &card_template_holder)						
-	
-																			if err != nil {	return nil, errors.New("Corrupt V5C_Holder") }
-	
-	result := "["
-	
-	var temp []byte
-	var v Card
-	
-	for _, cardId := range card_template_holder.Cards {
-		
-		v, err = t.retrieve_card(stub, cardId)
-		
-		if err != nil {return nil, errors.New("Failed to retrieve V5C")}
-		
-		temp, err = t.get_card_details(stub, v, caller, caller_affiliation)
-		
-		if err == nil {
-			result += string(temp) + ","	
-		}
+	gifts, transfers, err := t.get_template_escrows(stub, template.Kakaid)
+	if err != nil { return tl, err }
+	for _, gift := range gifts {
+		tl.Buckets = t.add_liability(tl.Buckets, AGE_ESCROW, gift.Money, gift.Point)
+		tl.Money = tl.Money + gift.Money
+		tl.Point = tl.Point + gift.Point
 	}
-	
-	if len(result) == 1 {
-		result = "[]"
-	} else {
-		result = result[:len(result)-1] + "]"
+
+	for _, transfer := range transfers {
+		tl.Buckets = t.add_liability(tl.Buckets, AGE_ESCROW, transfer.Money, transfer.Point)
+		tl.Money = tl.Money + transfer.Money
+		tl.Point = tl.Point + transfer.Point
 	}
-	
-	return []byte(result), nil
+
+	shopLedger, err := t.retrieve_shopLedger(stub, template.Shopid, template.Kakaid)
+	if err != nil { return tl, err }
+	tl.LedgerMoney, tl.LedgerPoint = t.ledger_outstanding(shopLedger)
+
+	tl.Reconciled = tl.Money + tl.ExcludedMoney == tl.LedgerMoney && tl.Point + tl.ExcludedPoint == tl.LedgerPoint
+	return tl, nil
 }
 
 //=================================================================================================================================
-//	 get_cards
+//	 get_liability_report - outstanding money and points of every shop by template and card age. Money is totalled
+//							by currency, points only per shop. KAKACENTER only
 //=================================================================================================================================
+func (t *CardTransactionChaincode) get_liability_report(stub shim.ChaincodeStubInterface, caller string, caller_affiliation int) ([]byte, error) {
 
-func (t *CardTransactionChaincode) get_cards(stub shim.ChaincodeStubInterface, caller string, caller_affiliation int) ([]byte, error) {
+	if caller_affiliation != KAKACENTER {
+		return nil, errors.New("Permission denied: you are not KAKACENTER users ")
+	}
 
-	bytes, err := stub.GetState(CARD_HOLDER)
-		
-																			if err != nil { return nil, errors.New("Unable to get v5cIDs") }
-																	
-	var cardKakaIDs Card_Holder
-	
-	err = json.Unmarshal(bytes, &cardKakaIDs)						
-	
-																			if err != nil {	return nil, errors.New("Corrupt V5C_Holder") }
-	
-	result := "["
-	
-	var temp []byte
-	var v Card
-	
-	for _, card := range cardKakaIDs.Cards {
-		
-		v, err = t.retrieve_card(stub, card)
-		
-		if err != nil {return nil, errors.New("Failed to retrieve V5C")}
-		
-		temp, err = t.get_card_details(stub, v, caller, caller_affiliation)
-		
-		if err == nil {
-			result += string(temp) + ","	
+	shop_holder, err := t.get_shop_holder(stub)
+	if err != nil { return nil, err }
+
+	now, err := t.get_tx_time(stub)
+	if err != nil { return nil, err }
+	var report LiabilityReport
+	report.Asof = now.Format(TIME_FORMAT)
+	report.Shops = []ShopLiability{}
+	report.Money = make(map[string]int64)
+
+	var shop Shop
+	for _, shopStr := range shop_holder.Shops {
+		err = json.Unmarshal([]byte(shopStr), &shop)
+		if err != nil { return nil, errors.New("Unmarshal_shopStr: Corrupt shop record"+shopStr) }
+
+		templates, err := t.get_shop_templates(stub, shop.ShopId)
+		if err != nil { return nil, err }
+		if len(templates) == 0 { continue }
+
+		var sl ShopLiability
+		sl.Shopid = shop.ShopId
+		sl.Templates = []TemplateLiability{}
+		sl.Money = make(map[string]int64)
+		sl.Reconciled = true
+
+		for _, template := range templates {
+			tl, err := t.get_template_liability(stub, template, now)
+			if err != nil { return nil, err }
+
+			sl.Templates = append(sl.Templates, tl)
+			sl.Money[tl.Currency] = sl.Money[tl.Currency] + tl.Money
+			sl.Point = sl.Point + tl.Point
+			if tl.Reconciled == false { sl.Reconciled = false }
 		}
+
+		for currency, money := range sl.Money {
+			report.Money[currency] = report.Money[currency] + money
+		}
+		report.Shops = append(report.Shops, sl)
 	}
-	
-	if len(result) == 1 {
-		result = "[]"
-	} else {
-		result = result[:len(result)-1] + "]"
-	}
-	
-	return []byte(result), nil
+
+	return json.Marshal(report)
 }
 
 //=================================================================================================================================
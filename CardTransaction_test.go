@@ -0,0 +1,1352 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/golang/protobuf/ptypes/timestamp"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+//==============================================================================================================================
+//	 MockTxStub - the MockStub with a transaction time, which the chaincode dates everything by. The MockStub itself has
+//				  none
+//==============================================================================================================================
+type MockTxStub struct {
+	*shim.MockStub
+	Now		int64
+}
+
+func (stub *MockTxStub) GetTxTimestamp() (*timestamp.Timestamp, error) {
+	return &timestamp.Timestamp{ Seconds: stub.Now }, nil
+}
+
+//==============================================================================================================================
+//	 Test fixtures - the chaincode runs on a stub kept inside one open transaction, so its functions can be called
+//					 directly as well as through Invoke
+//==============================================================================================================================
+func new_test_stub(t *testing.T) (*CardTransactionChaincode, *MockTxStub) {
+
+	cc := new(CardTransactionChaincode)
+	stub := &MockTxStub{ MockStub: shim.NewMockStub("cardtransaction", cc), Now: 1700000000 }		// 2023-11-14
+	stub.MockTransactionStart("tx1")
+
+	_, err := cc.Init(stub, "init", []string{})
+	if err != nil { t.Fatalf("Init: %s", err) }
+	return cc, stub
+}
+
+func invoke_ok(t *testing.T, cc *CardTransactionChaincode, stub shim.ChaincodeStubInterface, function string, args ...string) ([]byte) {
+
+	bytes, err := cc.Invoke(stub, function, args)
+	if err != nil { t.Fatalf("%s %v: %s", function, args, err) }
+	return bytes
+}
+
+func invoke_fails(t *testing.T, cc *CardTransactionChaincode, stub shim.ChaincodeStubInterface, function string, args ...string) (error) {
+
+	_, err := cc.Invoke(stub, function, args)
+	if err == nil { t.Fatalf("%s %v: expected an error", function, args) }
+	return err
+}
+
+//==============================================================================================================================
+//	 add_test_shop - shop shopId with staff shopId_owner, shopId_manager and shopId_cashier and a card template
+//					 shopId_T owned by the shop
+//==============================================================================================================================
+func add_test_shop(t *testing.T, cc *CardTransactionChaincode, stub shim.ChaincodeStubInterface, shopId string) {
+
+	invoke_ok(t, cc, stub, "add_shop", "admin", shopId, shopId + " shop", "L-" + shopId, "food", "street 1", "555")
+	for _, role := range []string{STAFF_OWNER, STAFF_MANAGER, STAFF_CASHIER} {
+		invoke_ok(t, cc, stub, "add_user", "admin", shopId + "_" + role, role, "ecert", "2", "auth", shopId, role)
+	}
+	invoke_ok(t, cc, stub, "create_card_template_by_shop", shopId + "_owner", shopId + "_T", `{"kakaid":"` + shopId + `_T","shopid":"` + shopId + `","shop":"` + shopId + ` shop"}`)
+}
+
+func add_test_consumer(t *testing.T, cc *CardTransactionChaincode, stub shim.ChaincodeStubInterface, name string) {
+	invoke_ok(t, cc, stub, "add_user", "admin", name, name, "ecert", "3", "auth")
+}
+
+//==============================================================================================================================
+//	 issue_test_card - the shop owner issues a card of the shop template to owner, returns the card id
+//==============================================================================================================================
+func issue_test_card(t *testing.T, cc *CardTransactionChaincode, stub shim.ChaincodeStubInterface, shopId string, owner string) (string) {
+
+	invoke_ok(t, cc, stub, "push_card_by_template", shopId + "_owner", owner, shopId + "_T")
+
+	bytes, err := cc.get_shopLedger_internal(stub, shopId, shopId + "_T")
+	if err != nil { t.Fatalf("shop ledger of %s: %s", shopId, err) }
+	var shopLedger ShopLedger
+	err = json.Unmarshal(bytes, &shopLedger)
+	if err != nil { t.Fatalf("shop ledger of %s: %s", shopId, err) }
+
+	return cc.generate_card_id(shopId + "_T", shopLedger.CardIdIndex)
+}
+
+func get_test_card(t *testing.T, cc *CardTransactionChaincode, stub shim.ChaincodeStubInterface, cardId string) (Card) {
+
+	card, err := cc.retrieve_card(stub, cardId)
+	if err != nil { t.Fatalf("card %s: %s", cardId, err) }
+	return card
+}
+
+//==============================================================================================================================
+//	 Shop staff
+//==============================================================================================================================
+func TestStaffActForTheirShop(t *testing.T) {
+
+	cc, stub := new_test_stub(t)
+	add_test_shop(t, cc, stub, "S1")
+	add_test_consumer(t, cc, stub, "alice")
+
+	if shopid := cc.get_Shopid(stub, "S1_cashier"); shopid != "S1" {
+		t.Fatalf("shop of S1_cashier is %s", shopid)
+	}
+
+	cardId := issue_test_card(t, cc, stub, "S1", "alice")
+	invoke_ok(t, cc, stub, "deposit_mp_shop_to_consumer", "S1_cashier", "100", "10", "alice", cardId)
+
+	card := get_test_card(t, cc, stub, cardId)
+	if card.Money != 10000 || card.Point != 10 { t.Fatalf("card holds %d money and %d points", card.Money, card.Point) }
+
+	invoke_ok(t, cc, stub, "update_ct_money", "S1_manager", cardId, "80")
+	if card = get_test_card(t, cc, stub, cardId); card.Money != 8000 { t.Fatalf("card holds %d money", card.Money) }
+}
+
+func TestStaffRoleLimitsPermissions(t *testing.T) {
+
+	cc, stub := new_test_stub(t)
+	add_test_shop(t, cc, stub, "S1")
+	add_test_shop(t, cc, stub, "S2")
+	add_test_consumer(t, cc, stub, "alice")
+	cardId := issue_test_card(t, cc, stub, "S1", "alice")
+
+	invoke_fails(t, cc, stub, "push_card_by_template", "S1_cashier", "alice", "S1_T")
+	invoke_fails(t, cc, stub, "push_card_by_template", "S2_owner", "alice", "S1_T")
+	invoke_fails(t, cc, stub, "update_ct_money", "S1_cashier", cardId, "500")
+	invoke_fails(t, cc, stub, "update_ct_point", "S2_owner", cardId, "500")
+	invoke_fails(t, cc, stub, "add_user", "admin", "S1_janitor", "janitor", "ecert", "2", "auth", "S1", "janitor")
+
+	if card := get_test_card(t, cc, stub, cardId); card.Money != 0 || card.Point != 0 {
+		t.Fatalf("card holds %d money and %d points", card.Money, card.Point)
+	}
+}
+
+//==============================================================================================================================
+//	 User and shop management
+//==============================================================================================================================
+func TestOwnerManagesOwnStaff(t *testing.T) {
+
+	cc, stub := new_test_stub(t)
+	add_test_shop(t, cc, stub, "S1")
+
+	invoke_ok(t, cc, stub, "add_user", "S1_owner", "S1_cashier2", "cashier", "ecert", "2", "auth", "S1", STAFF_CASHIER)
+	if shopid := cc.get_Shopid(stub, "S1_cashier2"); shopid != "S1" { t.Fatalf("shop of S1_cashier2 is %s", shopid) }
+
+	bytes, err := cc.Query(stub, "get_admin_audit", []string{"admin"})
+	if err != nil { t.Fatalf("get_admin_audit: %s", err) }
+	var audit_holder AdminAudit_Holder
+	err = json.Unmarshal(bytes, &audit_holder)
+	if err != nil { t.Fatalf("admin audit: %s", err) }
+
+	var last AdminAudit
+	err = json.Unmarshal([]byte(audit_holder.Audits[len(audit_holder.Audits) - 1]), &last)
+	if err != nil { t.Fatalf("admin audit: %s", err) }
+	if last.Actor != "S1_owner" || last.Action != "add_user" || last.Target != "S1_cashier2" || last.Timestamp == "" {
+		t.Fatalf("last audit entry is %+v", last)
+	}
+}
+
+func TestUserManagementIsRestricted(t *testing.T) {
+
+	cc, stub := new_test_stub(t)
+	add_test_shop(t, cc, stub, "S1")
+	add_test_shop(t, cc, stub, "S2")
+
+	invoke_fails(t, cc, stub, "add_user", "S1_manager", "S1_cashier2", "cashier", "ecert", "2", "auth", "S1", STAFF_CASHIER)
+	invoke_fails(t, cc, stub, "add_user", "S1_owner", "S2_cashier2", "cashier", "ecert", "2", "auth", "S2", STAFF_CASHIER)
+	invoke_fails(t, cc, stub, "add_shop", "S1_owner", "S3", "S3 shop", "L-S3", "food", "street 3", "555")
+
+	if _, err := cc.Query(stub, "get_admin_audit", []string{"S1_owner"}); err == nil { t.Fatalf("get_admin_audit: shop owner could read the audit") }
+}
+
+func TestNoTransactionTimeFails(t *testing.T) {
+
+	cc, stub := new_test_stub(t)
+	plain := stub.MockStub						// no transaction time
+
+	_, err := cc.Invoke(plain, "add_shop", []string{"admin", "S1", "S1 shop", "L-S1", "food", "street 1", "555"})
+	if err == nil { t.Fatalf("add_shop without transaction time succeeded") }
+}
+
+//==============================================================================================================================
+//	 Shop registration
+//==============================================================================================================================
+func TestRegisteredShopOpensOnApproval(t *testing.T) {
+
+	cc, stub := new_test_stub(t)
+
+	invoke_ok(t, cc, stub, "register_shop", "bob", "S9", "S9 shop", "L-S9", "food", "street 9", "555")
+	invoke_fails(t, cc, stub, "create_card_template_by_shop", "admin", "S9_T", `{"kakaid":"S9_T","shopid":"S9"}`)
+
+	invoke_ok(t, cc, stub, "approve_shop", "admin", "S9", "license checked")
+
+	shop, err := cc.get_shop_detail_Internal(stub, "S9")
+	if err != nil { t.Fatalf("shop S9: %s", err) }
+	if shop.Status != SHOP_APPROVED || shop.Reviewer != "admin" { t.Fatalf("shop S9 is %+v", shop) }
+
+	if shopid := cc.get_Shopid(stub, "bob"); shopid != "S9" { t.Fatalf("shop of bob is %s", shopid) }
+	invoke_ok(t, cc, stub, "create_card_template_by_shop", "bob", "S9_T", `{"kakaid":"S9_T","shopid":"S9"}`)
+}
+
+func TestRegisterShopChecksItsArguments(t *testing.T) {
+
+	cc, stub := new_test_stub(t)
+
+	invoke_fails(t, cc, stub, "register_shop", "bob", "S9", "S9 shop")
+	invoke_fails(t, cc, stub, "register_shop", "bob", "S 9", "S9 shop", "L-S9", "food", "street 9", "555")
+	invoke_fails(t, cc, stub, "register_shop", "bob", "S9", "S9 shop", "", "food", "street 9", "555")
+
+	invoke_ok(t, cc, stub, "register_shop", "bob", "S9", "S9 shop", "L-S9", "food", "street 9", "555")
+	invoke_fails(t, cc, stub, "approve_shop", "admin", "S9", "")
+	invoke_ok(t, cc, stub, "reject_shop", "admin", "S9", "no license")
+	invoke_fails(t, cc, stub, "approve_shop", "admin", "S9", "license checked")
+}
+
+//==============================================================================================================================
+//	 Shop suspension and termination
+//==============================================================================================================================
+func get_test_ledger(t *testing.T, cc *CardTransactionChaincode, stub shim.ChaincodeStubInterface, shopId string, templateId string) (ShopLedger) {
+
+	shopLedger, err := cc.retrieve_shopLedger(stub, shopId, templateId)
+	if err != nil { t.Fatalf("shop ledger of %s %s: %s", shopId, templateId, err) }
+	return shopLedger
+}
+
+func TestTerminateShopRefundsCardsAndScrapsStock(t *testing.T) {
+
+	cc, stub := new_test_stub(t)
+	add_test_shop(t, cc, stub, "S1")
+	add_test_consumer(t, cc, stub, "alice")
+
+	cardId := issue_test_card(t, cc, stub, "S1", "alice")
+	invoke_ok(t, cc, stub, "deposit_mp_shop_to_consumer", "S1_cashier", "100", "10", "alice", cardId)
+
+	// unsold stock of a template with an initial balance
+	invoke_ok(t, cc, stub, "create_card_template_by_shop", "S1_owner", "S1_B", `{"kakaid":"S1_B","shopid":"S1","shop":"S1 shop","cardclass":"gift","expdate":"2030-01-01 12:00:00 PM","status":1,"money":50}`)
+	invoke_ok(t, cc, stub, "create_batch_card_by_template", "S1_owner", "S1_B", "2")
+
+	invoke_ok(t, cc, stub, "suspend_shop", "admin", "S1", "license expired")
+	invoke_fails(t, cc, stub, "deposit_mp_shop_to_consumer", "S1_cashier", "100", "10", "alice", cardId)
+
+	invoke_ok(t, cc, stub, "terminate_shop", "admin", "S1", SETTLE_REFUND, "", "closed")
+
+	if card := get_test_card(t, cc, stub, cardId); card.Scrapped == false || card.Money != 0 || card.Point != 0 {
+		t.Fatalf("card after termination is %+v", card)
+	}
+	if shopLedger := get_test_ledger(t, cc, stub, "S1", "S1_T"); shopLedger.RefundMoney != 10000 || shopLedger.RefundPoint != 10 {
+		t.Fatalf("ledger of S1_T refunds %d money and %d points", shopLedger.RefundMoney, shopLedger.RefundPoint)
+	}
+	if shopLedger := get_test_ledger(t, cc, stub, "S1", "S1_B"); shopLedger.InitMoney != 0 || shopLedger.RefundMoney != 0 || shopLedger.ScrapNum != 2 {
+		t.Fatalf("ledger of unsold S1_B is %+v", shopLedger)
+	}
+}
+
+func TestTerminateShopNeedsSuspensionAndPlan(t *testing.T) {
+
+	cc, stub := new_test_stub(t)
+	add_test_shop(t, cc, stub, "S1")
+	add_test_consumer(t, cc, stub, "alice")
+
+	cardId := issue_test_card(t, cc, stub, "S1", "alice")
+	invoke_ok(t, cc, stub, "deposit_mp_shop_to_consumer", "S1_cashier", "100", "10", "alice", cardId)
+
+	invoke_fails(t, cc, stub, "terminate_shop", "admin", "S1", SETTLE_REFUND, "", "closed")
+	invoke_ok(t, cc, stub, "suspend_shop", "admin", "S1", "license expired")
+	invoke_fails(t, cc, stub, "terminate_shop", "admin", "S1", "", "", "closed")
+	invoke_fails(t, cc, stub, "terminate_shop", "S1_owner", "S1", SETTLE_REFUND, "", "closed")
+
+	if card := get_test_card(t, cc, stub, cardId); card.Scrapped == true || card.Money != 10000 {
+		t.Fatalf("card is %+v", card)
+	}
+}
+
+//==============================================================================================================================
+//	 In place updates of users and shops
+//==============================================================================================================================
+func TestUpdateShopChangesOnlyGivenFields(t *testing.T) {
+
+	cc, stub := new_test_stub(t)
+	add_test_shop(t, cc, stub, "S1")
+
+	invoke_ok(t, cc, stub, "update_shop", "admin", "S1", "1", `{"contact":"777"}`)
+
+	shop, err := cc.get_shop_detail_Internal(stub, "S1")
+	if err != nil { t.Fatalf("shop S1: %s", err) }
+	if shop.Contact != "777" || shop.ShopName != "S1 shop" || shop.Version != 2 { t.Fatalf("shop S1 is %+v", shop) }
+
+	shop_holder, err := cc.get_shop_holder(stub)
+	if err != nil { t.Fatalf("shop holder: %s", err) }
+	var held Shop
+	err = json.Unmarshal([]byte(shop_holder.Shops[0]), &held)
+	if err != nil { t.Fatalf("shop holder: %s", err) }
+	if held != shop { t.Fatalf("shop holder keeps %+v, state %+v", held, shop) }
+
+	invoke_ok(t, cc, stub, "update_user", "S1_owner", "S1_cashier", "1", `{"role":"manager"}`)
+	user, err := cc.get_user_detail_Internal(stub, "S1_cashier")
+	if err != nil { t.Fatalf("user S1_cashier: %s", err) }
+	if user.Role != STAFF_MANAGER || user.Shopid != "S1" || user.Version != 2 { t.Fatalf("user S1_cashier is %+v", user) }
+}
+
+func TestUpdateWithStaleVersionFails(t *testing.T) {
+
+	cc, stub := new_test_stub(t)
+	add_test_shop(t, cc, stub, "S1")
+
+	invoke_ok(t, cc, stub, "update_shop", "admin", "S1", "1", `{"contact":"777"}`)
+	invoke_fails(t, cc, stub, "update_shop", "admin", "S1", "1", `{"contact":"888"}`)
+	invoke_ok(t, cc, stub, "update_user", "S1_owner", "S1_cashier", "1", `{"name":"Ann"}`)
+	invoke_fails(t, cc, stub, "update_user", "S1_owner", "S1_cashier", "1", `{"name":"Bea"}`)
+
+	if shop, _ := cc.get_shop_detail_Internal(stub, "S1"); shop.Contact != "777" { t.Fatalf("shop S1 contact is %s", shop.Contact) }
+}
+
+//==============================================================================================================================
+//	 Consumer self registration
+//==============================================================================================================================
+func TestRegisterConsumer(t *testing.T) {
+
+	cc, stub := new_test_stub(t)
+
+	invoke_ok(t, cc, stub, "register_consumer", "carol", "Carol", "13800000001")
+
+	user, err := cc.get_user_detail_Internal(stub, "carol")
+	if err != nil { t.Fatalf("user carol: %s", err) }
+	if user.Affiliation != CONSUMER || user.Tel != "13800000001" { t.Fatalf("user carol is %+v", user) }
+}
+
+func TestRegisterConsumerNeedsUniqueTel(t *testing.T) {
+
+	cc, stub := new_test_stub(t)
+
+	invoke_ok(t, cc, stub, "register_consumer", "carol", "Carol", "13800000001")
+	invoke_fails(t, cc, stub, "register_consumer", "dave", "Dave", "13800000001")
+	invoke_fails(t, cc, stub, "register_consumer", "dave", "Dave", "call me")
+	invoke_fails(t, cc, stub, "register_consumer", "carol", "Carol", "13800000002")
+
+	if ifuserExist, _ := cc.check_user(stub, "dave"); ifuserExist > 0 { t.Fatalf("dave was registered") }
+}
+
+//==============================================================================================================================
+//	 Point earning rules
+//==============================================================================================================================
+func TestSpendEarnsPointsByRule(t *testing.T) {
+
+	cc, stub := new_test_stub(t)
+	add_test_shop(t, cc, stub, "S1")
+	add_test_consumer(t, cc, stub, "alice")
+	cardId := issue_test_card(t, cc, stub, "S1", "alice")
+	invoke_ok(t, cc, stub, "deposit_mp_shop_to_consumer", "S1_cashier", "100", "0", "alice", cardId)
+
+	invoke_ok(t, cc, stub, "set_earn_rule", "S1_manager", "S1_T", `{"moneyunit":1000,"points":1,"maxpoints":5}`)
+	invoke_ok(t, cc, stub, "spend_mp_consumer_to_shop", "alice", "40", "0", cardId, "S1")
+	invoke_ok(t, cc, stub, "spend_mp_consumer_to_shop", "alice", "60", "0", cardId, "S1")
+
+	if card := get_test_card(t, cc, stub, cardId); card.Money != 0 || card.Point != 9 {
+		t.Fatalf("card holds %d money and %d points", card.Money, card.Point)
+	}
+	if shopLedger := get_test_ledger(t, cc, stub, "S1", "S1_T"); shopLedger.EarnPoint != 9 || shopLedger.ConsumeMoney != 10000 {
+		t.Fatalf("ledger earned %d points on %d consumed", shopLedger.EarnPoint, shopLedger.ConsumeMoney)
+	}
+}
+
+func TestEarnRuleIsCheckedAndRestricted(t *testing.T) {
+
+	cc, stub := new_test_stub(t)
+	add_test_shop(t, cc, stub, "S1")
+	add_test_shop(t, cc, stub, "S2")
+
+	invoke_fails(t, cc, stub, "set_earn_rule", "S1_cashier", "S1_T", `{"moneyunit":10,"points":1}`)
+	invoke_fails(t, cc, stub, "set_earn_rule", "S2_owner", "S1_T", `{"moneyunit":10,"points":1}`)
+	invoke_fails(t, cc, stub, "set_earn_rule", "S1_owner", "S1_T", `{"moneyunit":10,"points":-1}`)
+
+	if template := get_test_card(t, cc, stub, "S1_T"); template.Earnrule != nil { t.Fatalf("template has earn rule %+v", *template.Earnrule) }
+}
+
+//==============================================================================================================================
+//	 Card level tiers
+//==============================================================================================================================
+func TestTierRulesPromoteAndDemote(t *testing.T) {
+
+	cc, stub := new_test_stub(t)
+	add_test_shop(t, cc, stub, "S1")
+	add_test_consumer(t, cc, stub, "alice")
+	cardId := issue_test_card(t, cc, stub, "S1", "alice")
+
+	invoke_ok(t, cc, stub, "set_tier_rules", "S1_manager", "S1_T", `[{"level":"silver","minspend":5000},{"level":"gold","minspend":5000,"minpoint":20}]`)
+
+	invoke_ok(t, cc, stub, "deposit_mp_shop_to_consumer", "S1_cashier", "100", "30", "alice", cardId)
+	invoke_ok(t, cc, stub, "spend_mp_consumer_to_shop", "alice", "60", "0", cardId, "S1")
+	if card := get_test_card(t, cc, stub, cardId); card.Cardlevel != "gold" { t.Fatalf("card level is %s", card.Cardlevel) }
+
+	invoke_ok(t, cc, stub, "spend_mp_consumer_to_shop", "alice", "0", "15", cardId, "S1")
+	if card := get_test_card(t, cc, stub, cardId); card.Cardlevel != "silver" { t.Fatalf("card level is %s", card.Cardlevel) }
+
+	history, err := cc.retrieve_card_history(stub, cardId)
+	if err != nil { t.Fatalf("history of %s: %s", cardId, err) }
+	var levels []string
+	for _, event := range history.Events {
+		if event.Action == "cardlevel" { levels = append(levels, event.Detail) }
+	}
+	if len(levels) != 2 || levels[1] != "gold -> silver" { t.Fatalf("level changes of %s are %v", cardId, levels) }
+}
+
+func TestTierRulesAreCheckedAndRestricted(t *testing.T) {
+
+	cc, stub := new_test_stub(t)
+	add_test_shop(t, cc, stub, "S1")
+
+	invoke_fails(t, cc, stub, "set_tier_rules", "S1_owner", "S1_T", `[{"level":"","minspend":50}]`)
+	invoke_fails(t, cc, stub, "set_tier_rules", "S1_owner", "S1_T", `[{"level":"gold","minspend":-1}]`)
+	invoke_fails(t, cc, stub, "set_tier_rules", "S1_cashier", "S1_T", `[{"level":"gold","minspend":50}]`)
+
+	if template := get_test_card(t, cc, stub, "S1_T"); len(template.Tierrules) != 0 { t.Fatalf("template has tier rules %+v", template.Tierrules) }
+}
+
+//==============================================================================================================================
+//	 Point lots
+//==============================================================================================================================
+const TEST_DAY = 24 * 60 * 60
+
+func TestSpendTakesOldestPointsAndSweepExpiresLots(t *testing.T) {
+
+	cc, stub := new_test_stub(t)
+	add_test_shop(t, cc, stub, "S1")
+	add_test_consumer(t, cc, stub, "alice")
+	cardId := issue_test_card(t, cc, stub, "S1", "alice")
+	invoke_ok(t, cc, stub, "set_point_expiry", "S1_manager", "S1_T", "30")
+
+	invoke_ok(t, cc, stub, "deposit_mp_shop_to_consumer", "S1_cashier", "0", "10", "alice", cardId)
+	stub.Now = stub.Now + 20 * TEST_DAY
+	invoke_ok(t, cc, stub, "deposit_mp_shop_to_consumer", "S1_cashier", "0", "10", "alice", cardId)
+	stub.Now = stub.Now + 5 * TEST_DAY
+	invoke_ok(t, cc, stub, "spend_mp_consumer_to_shop", "alice", "0", "4", cardId, "S1")
+
+	stub.Now = stub.Now + 10 * TEST_DAY			// the first lot is overdue, the second is not
+	bytes := invoke_ok(t, cc, stub, "expire_points", "S1_manager", "S1_T")
+	if string(bytes) != "6" { t.Fatalf("expire_points expired %s points", string(bytes)) }
+
+	card := get_test_card(t, cc, stub, cardId)
+	if card.Point != 10 { t.Fatalf("card holds %d points", card.Point) }
+	pointLots, err := cc.retrieve_point_lots(stub, card)
+	if err != nil { t.Fatalf("point lots of %s: %s", cardId, err) }
+	if len(pointLots.Lots) != 1 || pointLots.Lots[0].Points != 10 { t.Fatalf("point lots of %s are %+v", cardId, pointLots.Lots) }
+
+	if shopLedger := get_test_ledger(t, cc, stub, "S1", "S1_T"); shopLedger.ExpiredPoint != 6 { t.Fatalf("ledger breakage is %d", shopLedger.ExpiredPoint) }
+}
+
+func TestPointExpiryIsRestricted(t *testing.T) {
+
+	cc, stub := new_test_stub(t)
+	add_test_shop(t, cc, stub, "S1")
+
+	invoke_fails(t, cc, stub, "set_point_expiry", "S1_owner", "S1_T", "-1")
+	invoke_fails(t, cc, stub, "set_point_expiry", "S1_cashier", "S1_T", "30")
+	invoke_fails(t, cc, stub, "expire_points", "S1_cashier", "S1_T")
+
+	if template := get_test_card(t, cc, stub, "S1_T"); template.Pointexpiredays != 0 { t.Fatalf("template points expire after %d days", template.Pointexpiredays) }
+}
+
+//==============================================================================================================================
+//	 Alliances
+//==============================================================================================================================
+func add_test_alliance(t *testing.T, cc *CardTransactionChaincode, stub shim.ChaincodeStubInterface) {
+
+	invoke_ok(t, cc, stub, "create_alliance", "admin", "A1", "mall")
+	invoke_ok(t, cc, stub, "set_alliance_shop", "admin", "A1", "S1", "2")
+	invoke_ok(t, cc, stub, "set_alliance_shop", "admin", "A1", "S2", "1")
+}
+
+func TestAlliedShopsShareAndClearPoints(t *testing.T) {
+
+	cc, stub := new_test_stub(t)
+	add_test_shop(t, cc, stub, "S1")
+	add_test_shop(t, cc, stub, "S2")
+	add_test_consumer(t, cc, stub, "alice")
+	add_test_consumer(t, cc, stub, "bob")
+	add_test_alliance(t, cc, stub)
+
+	aliceCard := issue_test_card(t, cc, stub, "S1", "alice")
+	bobCard := issue_test_card(t, cc, stub, "S2", "bob")
+	invoke_ok(t, cc, stub, "deposit_mp_shop_to_consumer", "S1_cashier", "0", "10", "alice", aliceCard)
+
+	invoke_ok(t, cc, stub, "transfer_mp_consumer_to_consumer", "alice", "0", "3", aliceCard, "bob", bobCard)
+	if card := get_test_card(t, cc, stub, bobCard); card.Point != 6 { t.Fatalf("card of bob holds %d points", card.Point) }
+
+	invoke_ok(t, cc, stub, "spend_mp_consumer_to_shop", "alice", "0", "2", aliceCard, "S2")
+	if card := get_test_card(t, cc, stub, aliceCard); card.Point != 5 { t.Fatalf("card of alice holds %d points", card.Point) }
+
+	alliance, err := cc.retrieve_alliance(stub, "A1")
+	if err != nil { t.Fatalf("alliance A1: %s", err) }
+	if alliance.Clearing["S1>S2"] != 10 || len(alliance.Clearing) != 1 { t.Fatalf("clearing of A1 is %v", alliance.Clearing) }
+}
+
+func TestAlliancePointsAreChecked(t *testing.T) {
+
+	cc, stub := new_test_stub(t)
+	add_test_shop(t, cc, stub, "S1")
+	add_test_shop(t, cc, stub, "S2")
+	add_test_shop(t, cc, stub, "S3")
+	add_test_consumer(t, cc, stub, "alice")
+	add_test_consumer(t, cc, stub, "bob")
+	add_test_alliance(t, cc, stub)
+	invoke_fails(t, cc, stub, "set_alliance_shop", "S3_owner", "A1", "S3", "1")
+
+	aliceCard := issue_test_card(t, cc, stub, "S1", "alice")
+	bobCard := issue_test_card(t, cc, stub, "S2", "bob")
+	invoke_ok(t, cc, stub, "deposit_mp_shop_to_consumer", "S1_cashier", "50", "10", "alice", aliceCard)
+
+	invoke_fails(t, cc, stub, "transfer_mp_consumer_to_consumer", "alice", "0", "-3", aliceCard, "bob", bobCard)
+	invoke_fails(t, cc, stub, "transfer_mp_consumer_to_consumer", "alice", "5", "0", aliceCard, "bob", bobCard)
+	invoke_fails(t, cc, stub, "spend_mp_consumer_to_shop", "alice", "5", "0", aliceCard, "S2")
+	invoke_fails(t, cc, stub, "spend_mp_consumer_to_shop", "alice", "0", "2", aliceCard, "S3")
+
+	if card := get_test_card(t, cc, stub, aliceCard); card.Money != 5000 || card.Point != 10 {
+		t.Fatalf("card of alice holds %d money and %d points", card.Money, card.Point)
+	}
+}
+
+//==============================================================================================================================
+//	 Settlement batches
+//==============================================================================================================================
+func get_test_statement(t *testing.T, cc *CardTransactionChaincode, stub shim.ChaincodeStubInterface, caller string, shopId string) (SettlementStatement) {
+
+	bytes, err := cc.Query(stub, "get_settlement_statement", []string{caller, shopId})
+	if err != nil { t.Fatalf("statement of %s: %s", shopId, err) }
+	var statement SettlementStatement
+	err = json.Unmarshal(bytes, &statement)
+	if err != nil { t.Fatalf("statement of %s: %s", shopId, err) }
+	return statement
+}
+
+func TestSettlementBatchIsConfirmedAndPaid(t *testing.T) {
+
+	cc, stub := new_test_stub(t)
+	add_test_shop(t, cc, stub, "S1")
+	add_test_shop(t, cc, stub, "S2")
+	add_test_consumer(t, cc, stub, "alice")
+	add_test_alliance(t, cc, stub)
+
+	aliceCard := issue_test_card(t, cc, stub, "S1", "alice")
+	invoke_ok(t, cc, stub, "deposit_mp_shop_to_consumer", "S1_cashier", "0", "10", "alice", aliceCard)
+	invoke_ok(t, cc, stub, "spend_mp_consumer_to_shop", "alice", "0", "2", aliceCard, "S2")
+
+	bytes := invoke_ok(t, cc, stub, "create_settlement_batches", "admin", "A1", "2023-11-01", "2023-11-30")
+	var batchIds []string
+	err := json.Unmarshal(bytes, &batchIds)
+	if err != nil || len(batchIds) != 1 { t.Fatalf("settlement batches %s", string(bytes)) }
+
+	statement := get_test_statement(t, cc, stub, "S1_owner", "S1")
+	if len(statement.Batches) != 1 || statement.Batches[0].Payer != "S1" || statement.Payable != 4 {
+		t.Fatalf("statement of S1 is %+v", statement)
+	}
+
+	invoke_ok(t, cc, stub, "confirm_settlement", "S1_owner", batchIds[0])
+	invoke_ok(t, cc, stub, "pay_settlement", "S2_owner", batchIds[0])
+
+	statement = get_test_statement(t, cc, stub, "S2_owner", "S2")
+	if statement.Batches[0].Status != SETTLEMENT_PAID || statement.Receivable != 0 { t.Fatalf("statement of S2 is %+v", statement) }
+
+	alliance, err := cc.retrieve_alliance(stub, "A1")
+	if err != nil { t.Fatalf("alliance A1: %s", err) }
+	if alliance.Clearing["S1>S2"] != 0 { t.Fatalf("clearing of A1 is %v", alliance.Clearing) }
+}
+
+func TestSettlementFollowsItsSteps(t *testing.T) {
+
+	cc, stub := new_test_stub(t)
+	add_test_shop(t, cc, stub, "S1")
+	add_test_shop(t, cc, stub, "S2")
+	add_test_consumer(t, cc, stub, "alice")
+	add_test_alliance(t, cc, stub)
+
+	aliceCard := issue_test_card(t, cc, stub, "S1", "alice")
+	invoke_ok(t, cc, stub, "deposit_mp_shop_to_consumer", "S1_cashier", "0", "10", "alice", aliceCard)
+	invoke_ok(t, cc, stub, "spend_mp_consumer_to_shop", "alice", "0", "2", aliceCard, "S2")
+
+	invoke_fails(t, cc, stub, "create_settlement_batches", "S1_owner", "A1", "2023-11-01", "2023-11-30")
+	invoke_fails(t, cc, stub, "create_settlement_batches", "admin", "A1", "2023-11-30", "2023-11-01")
+	bytes := invoke_ok(t, cc, stub, "create_settlement_batches", "admin", "A1", "2023-11-01", "2023-11-30")
+	var batchIds []string
+	json.Unmarshal(bytes, &batchIds)
+
+	invoke_fails(t, cc, stub, "pay_settlement", "S2_owner", batchIds[0])
+	invoke_fails(t, cc, stub, "confirm_settlement", "S2_owner", batchIds[0])
+	if _, err := cc.Query(stub, "get_settlement_statement", []string{"S2_owner", "S1"}); err == nil { t.Fatalf("get_settlement_statement: S2 read the statement of S1") }
+
+	bytes = invoke_ok(t, cc, stub, "create_settlement_batches", "admin", "A1", "2023-11-01", "2023-11-30")
+	if string(bytes) != "null" { t.Fatalf("entries were settled twice: %s", string(bytes)) }
+}
+
+//==============================================================================================================================
+//	 KAKACENTER commission
+//==============================================================================================================================
+func TestSpendIsChargedCommission(t *testing.T) {
+
+	cc, stub := new_test_stub(t)
+	add_test_shop(t, cc, stub, "S1")
+	add_test_consumer(t, cc, stub, "alice")
+	card := issue_test_card(t, cc, stub, "S1", "alice")
+	invoke_ok(t, cc, stub, "deposit_mp_shop_to_consumer", "S1_cashier", "300", "0", "alice", card)
+
+	invoke_ok(t, cc, stub, "set_commission_rule", "admin", COMMISSION_SHOP, "S1", "500", "0.50", "CNY")
+	invoke_ok(t, cc, stub, "spend_mp_consumer_to_shop", "alice", "100", "0", card, "S1")
+	invoke_ok(t, cc, stub, "set_commission_rule", "admin", COMMISSION_TEMPLATE, "S1_T", "1000", "0", "CNY")
+	invoke_ok(t, cc, stub, "spend_mp_consumer_to_shop", "alice", "100", "0", card, "S1")
+
+	bytes, err := cc.Query(stub, "get_commission_report", []string{"admin", "S1"})
+	if err != nil { t.Fatalf("get_commission_report: %s", err) }
+	var ledgers []CommissionLedger
+	err = json.Unmarshal(bytes, &ledgers)
+	if err != nil || len(ledgers) != 1 { t.Fatalf("commission report %s", string(bytes)) }
+	if ledgers[0].Spendnum != 2 || ledgers[0].Spendmoney != 20000 || ledgers[0].Commission != 1550 {
+		t.Fatalf("commission ledger of S1 is %+v", ledgers[0])
+	}
+}
+
+func TestCommissionRuleIsCheckedAndRestricted(t *testing.T) {
+
+	cc, stub := new_test_stub(t)
+	add_test_shop(t, cc, stub, "S1")
+
+	invoke_fails(t, cc, stub, "set_commission_rule", "S1_owner", COMMISSION_SHOP, "S1", "0", "0", "CNY")
+	invoke_fails(t, cc, stub, "set_commission_rule", "admin", "card", "S1", "500", "0", "CNY")
+	invoke_fails(t, cc, stub, "set_commission_rule", "admin", COMMISSION_SHOP, "S1", "10001", "0", "CNY")
+	invoke_fails(t, cc, stub, "set_commission_rule", "admin", COMMISSION_SHOP, "S1", "500", "0.505", "CNY")
+	if _, err := cc.Query(stub, "get_commission_report", []string{"S1_owner", "S1"}); err == nil { t.Fatalf("get_commission_report: shop owner could read the report") }
+}
+
+//==============================================================================================================================
+//	 Money in minor units of the template currency
+//==============================================================================================================================
+func TestMoneyIsKeptInMinorUnits(t *testing.T) {
+
+	cc, stub := new_test_stub(t)
+	add_test_shop(t, cc, stub, "S1")
+	add_test_consumer(t, cc, stub, "alice")
+	cardId := issue_test_card(t, cc, stub, "S1", "alice")
+
+	invoke_ok(t, cc, stub, "deposit_mp_shop_to_consumer", "S1_cashier", "12.50", "0", "alice", cardId)
+	invoke_ok(t, cc, stub, "spend_mp_consumer_to_shop", "alice", "0.75", "0", cardId, "S1")
+	if card := get_test_card(t, cc, stub, cardId); card.Currency != DEFAULT_CURRENCY || card.Money != 1175 {
+		t.Fatalf("card holds %d %s", card.Money, card.Currency)
+	}
+
+	invoke_ok(t, cc, stub, "create_card_template_by_shop", "S1_owner", "S1_Y", `{"kakaid":"S1_Y","shopid":"S1","shop":"S1 shop","currency":"JPY"}`)
+	invoke_ok(t, cc, stub, "push_card_by_template", "S1_owner", "alice", "S1_Y")
+	yenCard := cc.generate_card_id("S1_Y", get_test_ledger(t, cc, stub, "S1", "S1_Y").CardIdIndex)
+	invoke_ok(t, cc, stub, "deposit_mp_shop_to_consumer", "S1_cashier", "500", "0", "alice", yenCard)
+	if card := get_test_card(t, cc, stub, yenCard); card.Currency != "JPY" || card.Money != 500 {
+		t.Fatalf("card holds %d %s", card.Money, card.Currency)
+	}
+}
+
+func TestMoneyAmountsAreChecked(t *testing.T) {
+
+	cc, stub := new_test_stub(t)
+	add_test_shop(t, cc, stub, "S1")
+	add_test_consumer(t, cc, stub, "alice")
+	cardId := issue_test_card(t, cc, stub, "S1", "alice")
+
+	invoke_fails(t, cc, stub, "deposit_mp_shop_to_consumer", "S1_cashier", "12.505", "0", "alice", cardId)
+	invoke_fails(t, cc, stub, "deposit_mp_shop_to_consumer", "S1_cashier", "1,5", "0", "alice", cardId)
+	invoke_fails(t, cc, stub, "create_card_template_by_shop", "S1_owner", "S1_X", `{"kakaid":"S1_X","shopid":"S1","shop":"S1 shop","currency":"XYZ"}`)
+	invoke_fails(t, cc, stub, "migrate_money_minor_units", "S1_owner", "CNY")
+	invoke_fails(t, cc, stub, "migrate_money_minor_units", "admin", "XYZ")
+
+	if card := get_test_card(t, cc, stub, cardId); card.Money != 0 { t.Fatalf("card holds %d money", card.Money) }
+}
+
+//==============================================================================================================================
+//	 Coupons and vouchers
+//==============================================================================================================================
+func TestVoucherIsTransferredAndRedeemed(t *testing.T) {
+
+	cc, stub := new_test_stub(t)
+	add_test_shop(t, cc, stub, "S1")
+	add_test_consumer(t, cc, stub, "alice")
+	add_test_consumer(t, cc, stub, "bob")
+	bobCard := issue_test_card(t, cc, stub, "S1", "bob")
+	invoke_ok(t, cc, stub, "deposit_mp_shop_to_consumer", "S1_cashier", "50", "0", "bob", bobCard)
+
+	invoke_ok(t, cc, stub, "create_coupon_template", "S1_manager", "S1_V", `{"name":"5.50 off","kind":"voucher","value":"5.50","minspend":"20","perconsumer":1}`)
+	couponId := string(invoke_ok(t, cc, stub, "issue_coupon", "S1_manager", "S1_V", "alice"))
+	invoke_ok(t, cc, stub, "transfer_coupon", "alice", couponId, "bob")
+
+	discount := invoke_ok(t, cc, stub, "redeem_coupon", "bob", couponId, "30", "0", bobCard, "S1")
+	if string(discount) != "5.50" { t.Fatalf("discount is %s", string(discount)) }
+	if card := get_test_card(t, cc, stub, bobCard); card.Money != 2550 { t.Fatalf("card of bob holds %d money", card.Money) }
+
+	shopLedger := get_test_ledger(t, cc, stub, "S1", "S1_V")
+	if shopLedger.CouponIssued != 1 || shopLedger.CouponTransferred != 1 || shopLedger.CouponRedeemed != 1 || shopLedger.CouponDiscount != 550 {
+		t.Fatalf("ledger of S1_V is %+v", shopLedger)
+	}
+}
+
+func TestCouponUseIsChecked(t *testing.T) {
+
+	cc, stub := new_test_stub(t)
+	add_test_shop(t, cc, stub, "S1")
+	add_test_consumer(t, cc, stub, "alice")
+	add_test_consumer(t, cc, stub, "bob")
+	aliceCard := issue_test_card(t, cc, stub, "S1", "alice")
+	invoke_ok(t, cc, stub, "deposit_mp_shop_to_consumer", "S1_cashier", "50", "0", "alice", aliceCard)
+
+	invoke_fails(t, cc, stub, "create_coupon_template", "S1_cashier", "S1_V", `{"kind":"voucher","value":"5"}`)
+	invoke_fails(t, cc, stub, "create_coupon_template", "S1_manager", "S1_V", `{"kind":"voucher","value":"5.555"}`)
+	invoke_fails(t, cc, stub, "create_coupon_template", "S1_manager", "S1_V", `{"kind":"discount","value":"120"}`)
+	invoke_ok(t, cc, stub, "create_coupon_template", "S1_manager", "S1_V", `{"kind":"voucher","value":"5","minspend":"20","perconsumer":1}`)
+
+	couponId := string(invoke_ok(t, cc, stub, "issue_coupon", "S1_manager", "S1_V", "alice"))
+	invoke_fails(t, cc, stub, "issue_coupon", "S1_manager", "S1_V", "alice")
+	invoke_fails(t, cc, stub, "redeem_coupon", "bob", couponId, "30", "0", aliceCard, "S1")
+	invoke_fails(t, cc, stub, "redeem_coupon", "alice", couponId, "10", "0", aliceCard, "S1")
+
+	invoke_ok(t, cc, stub, "redeem_coupon", "alice", couponId, "30", "0", aliceCard, "S1")
+	invoke_fails(t, cc, stub, "redeem_coupon", "alice", couponId, "30", "0", aliceCard, "S1")
+	if card := get_test_card(t, cc, stub, aliceCard); card.Money != 2500 { t.Fatalf("card of alice holds %d money", card.Money) }
+}
+
+//==============================================================================================================================
+//	 Campaigns
+//==============================================================================================================================
+func TestCampaignsGrantBonusWithinBudget(t *testing.T) {
+
+	cc, stub := new_test_stub(t)
+	add_test_shop(t, cc, stub, "S1")
+	add_test_consumer(t, cc, stub, "alice")
+	cardId := issue_test_card(t, cc, stub, "S1", "alice")
+
+	invoke_ok(t, cc, stub, "create_campaign", "S1_manager", "C1", `{"trigger":"deposit","threshold":"100","repeat":true,"rewardmoney":"10.50","budget":"15","startdate":"2023-11-01","enddate":"2023-11-30"}`)
+	invoke_ok(t, cc, stub, "create_campaign", "S1_manager", "C2", `{"trigger":"spend","threshold":"20","repeat":true,"rewardpoint":5,"pointbudget":100,"startdate":"2023-11-01","enddate":"2023-11-30"}`)
+
+	invoke_ok(t, cc, stub, "deposit_mp_shop_to_consumer", "S1_cashier", "250", "0", "alice", cardId)
+	if card := get_test_card(t, cc, stub, cardId); card.Money != 25000 || card.Bonusmoney != 1500 {
+		t.Fatalf("card holds %d money and %d bonus", card.Money, card.Bonusmoney)
+	}
+	if campaign, _ := cc.retrieve_campaign(stub, "C1"); campaign.Status != CAMPAIGN_EXHAUSTED || campaign.Usedmoney != 1500 {
+		t.Fatalf("campaign C1 is %+v", campaign)
+	}
+
+	// only the 250 principal of the spend counts, the 10 bonus spent earns nothing
+	invoke_ok(t, cc, stub, "spend_mp_consumer_to_shop", "alice", "260", "0", cardId, "S1")
+	if card := get_test_card(t, cc, stub, cardId); card.Money != 0 || card.Bonusmoney != 500 || card.Point != 60 {
+		t.Fatalf("card holds %d money, %d bonus and %d points", card.Money, card.Bonusmoney, card.Point)
+	}
+}
+
+func TestCampaignsAreCheckedAndRestricted(t *testing.T) {
+
+	cc, stub := new_test_stub(t)
+	add_test_shop(t, cc, stub, "S1")
+	add_test_shop(t, cc, stub, "S2")
+	add_test_consumer(t, cc, stub, "alice")
+	cardId := issue_test_card(t, cc, stub, "S1", "alice")
+
+	campaign := `{"trigger":"deposit","threshold":"100","rewardmoney":"10","budget":"50","startdate":"2023-11-01","enddate":"2023-11-30"}`
+	invoke_fails(t, cc, stub, "create_campaign", "S1_cashier", "C1", campaign)
+	invoke_fails(t, cc, stub, "create_campaign", "S1_manager", "C1", `{"trigger":"deposit","threshold":"100","rewardmoney":"10","startdate":"2023-11-01","enddate":"2023-11-30"}`)
+	invoke_fails(t, cc, stub, "create_campaign", "S1_manager", "C1", `{"trigger":"deposit","threshold":"0","rewardmoney":"10","budget":"50","startdate":"2023-11-01","enddate":"2023-11-30"}`)
+	invoke_fails(t, cc, stub, "create_campaign", "S1_manager", "C1", `{"trigger":"refund","threshold":"100","rewardmoney":"10","budget":"50","startdate":"2023-11-01","enddate":"2023-11-30"}`)
+
+	invoke_ok(t, cc, stub, "create_campaign", "S1_manager", "C1", campaign)
+	invoke_fails(t, cc, stub, "stop_campaign", "S2_owner", "C1")
+	invoke_ok(t, cc, stub, "stop_campaign", "S1_owner", "C1")
+	invoke_fails(t, cc, stub, "stop_campaign", "S1_owner", "C1")
+
+	invoke_ok(t, cc, stub, "deposit_mp_shop_to_consumer", "S1_cashier", "100", "0", "alice", cardId)
+	if card := get_test_card(t, cc, stub, cardId); card.Bonusmoney != 0 { t.Fatalf("stopped campaign gave %d bonus", card.Bonusmoney) }
+}
+
+//==============================================================================================================================
+//	 Gift offers
+//==============================================================================================================================
+func TestGiftIsClaimedWithItsCode(t *testing.T) {
+
+	cc, stub := new_test_stub(t)
+	add_test_shop(t, cc, stub, "S1")
+	add_test_consumer(t, cc, stub, "alice")
+	add_test_consumer(t, cc, stub, "bob")
+	aliceCard := issue_test_card(t, cc, stub, "S1", "alice")
+	invoke_ok(t, cc, stub, "deposit_mp_shop_to_consumer", "S1_cashier", "50", "10", "alice", aliceCard)
+
+	invoke_ok(t, cc, stub, "create_gift", "alice", "G1", aliceCard, "20", "4", cc.hash_claim_code("G1", "secret"), "7")
+	if card := get_test_card(t, cc, stub, aliceCard); card.Money != 3000 || card.Point != 6 {
+		t.Fatalf("card of alice holds %d money and %d points", card.Money, card.Point)
+	}
+
+	bobCard := string(invoke_ok(t, cc, stub, "claim_gift", "bob", "G1", "secret"))
+	if card := get_test_card(t, cc, stub, bobCard); card.Owner != "bob" || card.Money != 2000 || card.Point != 4 {
+		t.Fatalf("card of bob is %+v", card)
+	}
+
+	// a whole card offer that is not claimed goes back to its sender when it expires
+	invoke_ok(t, cc, stub, "create_gift", "alice", "G2", aliceCard, "0", "0", cc.hash_claim_code("G2", "secret"), "1")
+	if card := get_test_card(t, cc, stub, aliceCard); card.Status != STATE_ESCROW { t.Fatalf("card of alice has status %d", card.Status) }
+
+	stub.Now = stub.Now + 2 * TEST_DAY
+	if expired := invoke_ok(t, cc, stub, "expire_gifts", "admin"); string(expired) != "1" { t.Fatalf("expired %s gifts", string(expired)) }
+	if card := get_test_card(t, cc, stub, aliceCard); card.Owner != "alice" || card.Status != STATE_CONSUMER_OWNERSHIP {
+		t.Fatalf("card of alice is %+v", card)
+	}
+}
+
+func TestGiftNeedsCodeAndSender(t *testing.T) {
+
+	cc, stub := new_test_stub(t)
+	add_test_shop(t, cc, stub, "S1")
+	add_test_consumer(t, cc, stub, "alice")
+	add_test_consumer(t, cc, stub, "bob")
+	aliceCard := issue_test_card(t, cc, stub, "S1", "alice")
+	invoke_ok(t, cc, stub, "deposit_mp_shop_to_consumer", "S1_cashier", "50", "10", "alice", aliceCard)
+
+	invoke_fails(t, cc, stub, "create_gift", "bob", "G1", aliceCard, "20", "0", cc.hash_claim_code("G1", "secret"), "7")
+	invoke_fails(t, cc, stub, "create_gift", "alice", "G1", aliceCard, "20", "0", "secret", "7")
+	invoke_fails(t, cc, stub, "create_gift", "alice", "G1", aliceCard, "60", "0", cc.hash_claim_code("G1", "secret"), "7")
+
+	invoke_ok(t, cc, stub, "create_gift", "alice", "G1", aliceCard, "20", "0", cc.hash_claim_code("G1", "secret"), "7")
+	invoke_fails(t, cc, stub, "claim_gift", "bob", "G1", "guess")
+	invoke_fails(t, cc, stub, "revoke_gift", "bob", "G1")
+	invoke_ok(t, cc, stub, "revoke_gift", "alice", "G1")
+	invoke_fails(t, cc, stub, "claim_gift", "bob", "G1", "secret")
+
+	if card := get_test_card(t, cc, stub, aliceCard); card.Money != 5000 { t.Fatalf("card of alice holds %d money", card.Money) }
+}
+
+//==============================================================================================================================
+//	 Two-phase transfers
+//==============================================================================================================================
+func TestTransferIsHeldUntilAccepted(t *testing.T) {
+
+	cc, stub := new_test_stub(t)
+	add_test_shop(t, cc, stub, "S1")
+	add_test_consumer(t, cc, stub, "alice")
+	add_test_consumer(t, cc, stub, "bob")
+	aliceCard := issue_test_card(t, cc, stub, "S1", "alice")
+	bobCard := issue_test_card(t, cc, stub, "S1", "bob")
+	invoke_ok(t, cc, stub, "deposit_mp_shop_to_consumer", "S1_cashier", "50", "10", "alice", aliceCard)
+
+	invoke_ok(t, cc, stub, "propose_transfer", "alice", "P1", aliceCard, "bob", "15", "3", "7")
+	if card := get_test_card(t, cc, stub, aliceCard); card.Money != 3500 || card.Point != 7 {
+		t.Fatalf("card of alice holds %d money and %d points", card.Money, card.Point)
+	}
+	if card := get_test_card(t, cc, stub, bobCard); card.Money != 0 { t.Fatalf("card of bob holds %d money before accepting", card.Money) }
+
+	invoke_ok(t, cc, stub, "accept_transfer", "bob", "P1", bobCard)
+	if card := get_test_card(t, cc, stub, bobCard); card.Money != 1500 || card.Point != 3 {
+		t.Fatalf("card of bob holds %d money and %d points", card.Money, card.Point)
+	}
+
+	invoke_ok(t, cc, stub, "propose_transfer", "alice", "P2", aliceCard, "bob", "0", "0", "7")
+	invoke_fails(t, cc, stub, "spend_mp_consumer_to_shop", "alice", "5", "0", aliceCard, "S1")
+	invoke_ok(t, cc, stub, "accept_transfer", "bob", "P2")
+	if card := get_test_card(t, cc, stub, aliceCard); card.Owner != "bob" || card.Status != STATE_CONSUMER_OWNERSHIP || card.Money != 3500 {
+		t.Fatalf("card of alice is %+v", card)
+	}
+}
+
+func TestTransferIsDeclinedOrCancelledByItsParties(t *testing.T) {
+
+	cc, stub := new_test_stub(t)
+	add_test_shop(t, cc, stub, "S1")
+	add_test_consumer(t, cc, stub, "alice")
+	add_test_consumer(t, cc, stub, "bob")
+	aliceCard := issue_test_card(t, cc, stub, "S1", "alice")
+	invoke_ok(t, cc, stub, "deposit_mp_shop_to_consumer", "S1_cashier", "50", "10", "alice", aliceCard)
+
+	invoke_fails(t, cc, stub, "propose_transfer", "alice", "P1", aliceCard, "alice", "15", "0", "7")
+	invoke_fails(t, cc, stub, "propose_transfer", "alice", "P1", aliceCard, "S1_owner", "15", "0", "7")
+	invoke_fails(t, cc, stub, "propose_transfer", "alice", "P1", aliceCard, "bob", "60", "0", "7")
+
+	invoke_ok(t, cc, stub, "propose_transfer", "alice", "P1", aliceCard, "bob", "15", "3", "7")
+	invoke_fails(t, cc, stub, "accept_transfer", "alice", "P1", aliceCard)
+	invoke_fails(t, cc, stub, "cancel_transfer", "bob", "P1")
+	invoke_ok(t, cc, stub, "decline_transfer", "bob", "P1")
+	invoke_fails(t, cc, stub, "cancel_transfer", "alice", "P1")
+
+	if card := get_test_card(t, cc, stub, aliceCard); card.Money != 5000 || card.Point != 10 {
+		t.Fatalf("card of alice holds %d money and %d points", card.Money, card.Point)
+	}
+}
+
+//==============================================================================================================================
+//	 Merge and split
+//==============================================================================================================================
+func TestCardsAreSplitAndMerged(t *testing.T) {
+
+	cc, stub := new_test_stub(t)
+	add_test_shop(t, cc, stub, "S1")
+	add_test_consumer(t, cc, stub, "alice")
+	aliceCard := issue_test_card(t, cc, stub, "S1", "alice")
+	otherCard := issue_test_card(t, cc, stub, "S1", "alice")
+	invoke_ok(t, cc, stub, "deposit_mp_shop_to_consumer", "S1_cashier", "50", "10", "alice", aliceCard)
+	invoke_ok(t, cc, stub, "deposit_mp_shop_to_consumer", "S1_cashier", "20", "0", "alice", otherCard)
+
+	splitCard := string(invoke_ok(t, cc, stub, "split_card", "alice", aliceCard, "15", "3"))
+	if card := get_test_card(t, cc, stub, splitCard); card.Owner != "alice" || card.Money != 1500 || card.Point != 3 {
+		t.Fatalf("split card is %+v", card)
+	}
+
+	invoke_ok(t, cc, stub, "merge_cards", "alice", aliceCard, otherCard + "," + splitCard)
+	if card := get_test_card(t, cc, stub, aliceCard); card.Money != 7000 || card.Point != 10 {
+		t.Fatalf("card of alice holds %d money and %d points", card.Money, card.Point)
+	}
+	for _, cardId := range []string{otherCard, splitCard} {
+		if card := get_test_card(t, cc, stub, cardId); card.Scrapped == false || card.Money != 0 || card.Point != 0 {
+			t.Fatalf("merged card is %+v", card)
+		}
+	}
+}
+
+func TestMergeNeedsOwnFreeCards(t *testing.T) {
+
+	cc, stub := new_test_stub(t)
+	add_test_shop(t, cc, stub, "S1")
+	add_test_consumer(t, cc, stub, "alice")
+	add_test_consumer(t, cc, stub, "bob")
+	aliceCard := issue_test_card(t, cc, stub, "S1", "alice")
+	otherCard := issue_test_card(t, cc, stub, "S1", "alice")
+	bobCard := issue_test_card(t, cc, stub, "S1", "bob")
+	invoke_ok(t, cc, stub, "deposit_mp_shop_to_consumer", "S1_cashier", "20", "0", "alice", otherCard)
+
+	invoke_fails(t, cc, stub, "split_card", "alice", otherCard, "30", "0")
+	invoke_fails(t, cc, stub, "split_card", "bob", otherCard, "5", "0")
+	invoke_fails(t, cc, stub, "merge_cards", "alice", aliceCard, bobCard)
+
+	invoke_ok(t, cc, stub, "create_gift", "alice", "G1", otherCard, "5", "0", cc.hash_claim_code("G1", "secret"), "7")
+	invoke_fails(t, cc, stub, "merge_cards", "alice", aliceCard, otherCard)
+
+	if card := get_test_card(t, cc, stub, otherCard); card.Scrapped == true || card.Money != 1500 { t.Fatalf("card is %+v", card) }
+}
+
+//==============================================================================================================================
+//	 Spending limits
+//==============================================================================================================================
+func TestSpendsStayWithinLimits(t *testing.T) {
+
+	cc, stub := new_test_stub(t)
+	add_test_shop(t, cc, stub, "S1")
+	add_test_consumer(t, cc, stub, "alice")
+	cardId := issue_test_card(t, cc, stub, "S1", "alice")
+	invoke_ok(t, cc, stub, "deposit_mp_shop_to_consumer", "S1_cashier", "100", "0", "alice", cardId)
+
+	invoke_ok(t, cc, stub, "set_template_limits", "S1_manager", "S1_T", `{"pertransaction":3000,"daily":5000}`)
+	invoke_ok(t, cc, stub, "set_card_limits", "alice", cardId, `{"daily":4000}`)
+
+	invoke_ok(t, cc, stub, "spend_mp_consumer_to_shop", "alice", "20", "0", cardId, "S1")
+	invoke_fails(t, cc, stub, "spend_mp_consumer_to_shop", "alice", "30", "0", cardId, "S1")
+
+	stub.Now = stub.Now + TEST_DAY + 1
+	invoke_ok(t, cc, stub, "spend_mp_consumer_to_shop", "alice", "30", "0", cardId, "S1")
+	if card := get_test_card(t, cc, stub, cardId); card.Money != 5000 { t.Fatalf("card holds %d money", card.Money) }
+}
+
+func TestLimitsCoverOffersAndSplits(t *testing.T) {
+
+	cc, stub := new_test_stub(t)
+	add_test_shop(t, cc, stub, "S1")
+	add_test_consumer(t, cc, stub, "alice")
+	add_test_consumer(t, cc, stub, "bob")
+	cardId := issue_test_card(t, cc, stub, "S1", "alice")
+	invoke_ok(t, cc, stub, "deposit_mp_shop_to_consumer", "S1_cashier", "40", "0", "alice", cardId)
+
+	invoke_fails(t, cc, stub, "set_template_limits", "S1_cashier", "S1_T", `{"pertransaction":3000}`)
+	invoke_fails(t, cc, stub, "set_template_limits", "S1_manager", "S1_T", `{"pertransaction":-1}`)
+	invoke_ok(t, cc, stub, "set_template_limits", "S1_manager", "S1_T", `{"pertransaction":3000}`)
+	invoke_fails(t, cc, stub, "set_card_limits", "alice", cardId, `{"pertransaction":5000}`)
+
+	// a whole card offer moves all of its 40 money
+	invoke_fails(t, cc, stub, "create_gift", "alice", "G1", cardId, "0", "0", cc.hash_claim_code("G1", "secret"), "7")
+	invoke_fails(t, cc, stub, "propose_transfer", "alice", "P1", cardId, "bob", "0", "0", "7")
+	invoke_fails(t, cc, stub, "split_card", "alice", cardId, "35", "0")
+
+	if card := get_test_card(t, cc, stub, cardId); card.Status != STATE_CONSUMER_OWNERSHIP || card.Money != 4000 { t.Fatalf("card is %+v", card) }
+}
+
+//==============================================================================================================================
+//	 Fraud rules
+//==============================================================================================================================
+func get_test_flags(t *testing.T, cc *CardTransactionChaincode, stub shim.ChaincodeStubInterface) ([]FraudFlag) {
+
+	bytes, err := cc.Query(stub, "get_fraud_flags", []string{"admin"})
+	if err != nil { t.Fatalf("get_fraud_flags: %s", err) }
+	var flags []FraudFlag
+	err = json.Unmarshal(bytes, &flags)
+	if err != nil { t.Fatalf("get_fraud_flags: %s", err) }
+	return flags
+}
+
+func TestFlaggedCardIsFrozenUntilCleared(t *testing.T) {
+
+	cc, stub := new_test_stub(t)
+	add_test_shop(t, cc, stub, "S1")
+	add_test_consumer(t, cc, stub, "alice")
+	add_test_consumer(t, cc, stub, "bob")
+	aliceCard := issue_test_card(t, cc, stub, "S1", "alice")
+	bobCard := issue_test_card(t, cc, stub, "S1", "bob")
+	invoke_ok(t, cc, stub, "set_fraud_rules", "admin", `{"depositminutes":10,"autofreeze":true}`)
+
+	invoke_ok(t, cc, stub, "deposit_mp_shop_to_consumer", "S1_cashier", "50", "0", "alice", aliceCard)
+	invoke_ok(t, cc, stub, "transfer_mp_consumer_to_consumer", "alice", "10", "0", aliceCard, "bob", bobCard)
+
+	flags := get_test_flags(t, cc, stub)
+	if len(flags) != 1 || flags[0].Cardid != aliceCard || flags[0].Rule != "deposit" || flags[0].Frozen == false {
+		t.Fatalf("fraud flags are %+v", flags)
+	}
+	invoke_fails(t, cc, stub, "spend_mp_consumer_to_shop", "alice", "5", "0", aliceCard, "S1")
+
+	invoke_ok(t, cc, stub, "review_fraud_flag", "admin", flags[0].Flagid, FLAG_CLEARED, "known customer")
+	invoke_ok(t, cc, stub, "spend_mp_consumer_to_shop", "alice", "5", "0", aliceCard, "S1")
+	if card := get_test_card(t, cc, stub, aliceCard); card.Frozen == true || card.Money != 3500 { t.Fatalf("card of alice is %+v", card) }
+}
+
+func TestWholeCardOfferIsCheckedWithItsBalance(t *testing.T) {
+
+	cc, stub := new_test_stub(t)
+	add_test_shop(t, cc, stub, "S1")
+	add_test_consumer(t, cc, stub, "alice")
+	add_test_consumer(t, cc, stub, "bob")
+	aliceCard := issue_test_card(t, cc, stub, "S1", "alice")
+	invoke_ok(t, cc, stub, "set_fraud_rules", "admin", `{"depositminutes":10}`)
+
+	invoke_ok(t, cc, stub, "deposit_mp_shop_to_consumer", "S1_cashier", "50", "0", "alice", aliceCard)
+	invoke_ok(t, cc, stub, "propose_transfer", "alice", "P1", aliceCard, "bob", "0", "0", "7")
+
+	flags := get_test_flags(t, cc, stub)
+	if len(flags) != 1 || flags[0].Frozen == true || flags[0].Detail != "transfer_out within 10 minutes of a deposit, 50.00 and 0 points to bob" {
+		t.Fatalf("fraud flags are %+v", flags)
+	}
+}
+
+func TestFraudRulesAndReviewsAreRestricted(t *testing.T) {
+
+	cc, stub := new_test_stub(t)
+	add_test_shop(t, cc, stub, "S1")
+	add_test_consumer(t, cc, stub, "alice")
+	add_test_consumer(t, cc, stub, "bob")
+	aliceCard := issue_test_card(t, cc, stub, "S1", "alice")
+	otherCard := issue_test_card(t, cc, stub, "S1", "alice")
+	invoke_ok(t, cc, stub, "deposit_mp_shop_to_consumer", "S1_cashier", "50", "0", "alice", aliceCard)
+
+	invoke_fails(t, cc, stub, "set_fraud_rules", "S1_owner", `{"depositminutes":10}`)
+	invoke_fails(t, cc, stub, "set_fraud_rules", "admin", `{"burstcount":1,"burstminutes":10}`)
+	invoke_ok(t, cc, stub, "set_fraud_rules", "admin", `{"burstcount":2,"burstminutes":10}`)
+
+	// the target card must belong to the receiver
+	invoke_fails(t, cc, stub, "transfer_mp_consumer_to_consumer", "alice", "10", "0", aliceCard, "bob", otherCard)
+
+	invoke_ok(t, cc, stub, "spend_mp_consumer_to_shop", "alice", "5", "0", aliceCard, "S1")
+	invoke_ok(t, cc, stub, "spend_mp_consumer_to_shop", "alice", "5", "0", aliceCard, "S1")
+	flags := get_test_flags(t, cc, stub)
+	if len(flags) != 1 || flags[0].Rule != "burst" { t.Fatalf("fraud flags are %+v", flags) }
+
+	invoke_fails(t, cc, stub, "review_fraud_flag", "S1_owner", flags[0].Flagid, FLAG_CLEARED, "ok")
+	invoke_fails(t, cc, stub, "review_fraud_flag", "admin", flags[0].Flagid, "ignored", "ok")
+	invoke_ok(t, cc, stub, "review_fraud_flag", "admin", flags[0].Flagid, FLAG_CONFIRMED, "stolen card")
+	invoke_fails(t, cc, stub, "review_fraud_flag", "admin", flags[0].Flagid, FLAG_CLEARED, "ok")
+	if card := get_test_card(t, cc, stub, aliceCard); card.Frozen == false { t.Fatalf("confirmed card is not frozen") }
+}
+
+//==============================================================================================================================
+//	 Spend disputes
+//==============================================================================================================================
+func last_test_spend(t *testing.T, cc *CardTransactionChaincode, stub shim.ChaincodeStubInterface, cardId string) (string) {
+
+	history, err := cc.retrieve_card_history(stub, cardId)
+	if err != nil { t.Fatalf("history of %s: %s", cardId, err) }
+	eventId := ""
+	for _, event := range history.Events {
+		if event.Action == ACTIVITY_SPEND { eventId = event.Eventid }
+	}
+	if eventId == "" { t.Fatalf("no spend on %s", cardId) }
+	return eventId
+}
+
+func TestRefundedDisputeReversesTheSpend(t *testing.T) {
+
+	cc, stub := new_test_stub(t)
+	add_test_shop(t, cc, stub, "S1")
+	add_test_consumer(t, cc, stub, "alice")
+	cardId := issue_test_card(t, cc, stub, "S1", "alice")
+	invoke_ok(t, cc, stub, "set_earn_rule", "S1_manager", "S1_T", `{"moneyunit":1000,"points":1}`)
+	invoke_ok(t, cc, stub, "set_commission_rule", "admin", COMMISSION_SHOP, "S1", "1000", "0", "CNY")
+	invoke_ok(t, cc, stub, "deposit_mp_shop_to_consumer", "S1_cashier", "50", "0", "alice", cardId)
+	invoke_ok(t, cc, stub, "spend_mp_consumer_to_shop", "alice", "20", "0", cardId, "S1")
+
+	invoke_ok(t, cc, stub, "open_dispute", "alice", "D1", cardId, last_test_spend(t, cc, stub, cardId), "not delivered")
+	if shopLedger := get_test_ledger(t, cc, stub, "S1", "S1_T"); shopLedger.HeldMoney != 2000 { t.Fatalf("ledger holds %d money", shopLedger.HeldMoney) }
+
+	invoke_ok(t, cc, stub, "respond_dispute", "S1_manager", "D1", "delivered on monday")
+	invoke_ok(t, cc, stub, "resolve_dispute", "admin", "D1", DISPUTE_REFUNDED, "no proof of delivery")
+
+	if card := get_test_card(t, cc, stub, cardId); card.Money != 5000 || card.Point != 0 || card.Totalspend != 0 {
+		t.Fatalf("card holds %d money, %d points and %d spend", card.Money, card.Point, card.Totalspend)
+	}
+	shopLedger := get_test_ledger(t, cc, stub, "S1", "S1_T")
+	if shopLedger.HeldMoney != 0 || shopLedger.ConsumeMoney != 0 || shopLedger.EarnPoint != 0 || shopLedger.ReversedMoney != 2000 {
+		t.Fatalf("ledger of S1_T is %+v", shopLedger)
+	}
+	if commission, _ := cc.retrieve_commission_ledger(stub, "S1"); commission.Commission != 0 || commission.Spendmoney != 0 {
+		t.Fatalf("commission ledger of S1 is %+v", commission)
+	}
+}
+
+func TestDisputesAreRestricted(t *testing.T) {
+
+	cc, stub := new_test_stub(t)
+	add_test_shop(t, cc, stub, "S1")
+	add_test_shop(t, cc, stub, "S2")
+	add_test_consumer(t, cc, stub, "alice")
+	add_test_consumer(t, cc, stub, "bob")
+	cardId := issue_test_card(t, cc, stub, "S1", "alice")
+	invoke_ok(t, cc, stub, "deposit_mp_shop_to_consumer", "S1_cashier", "50", "0", "alice", cardId)
+	invoke_ok(t, cc, stub, "spend_mp_consumer_to_shop", "alice", "20", "0", cardId, "S1")
+	spendId := last_test_spend(t, cc, stub, cardId)
+
+	invoke_fails(t, cc, stub, "open_dispute", "bob", "D1", cardId, spendId, "not delivered")
+	invoke_fails(t, cc, stub, "open_dispute", "alice", "D1", cardId, cardId + "-E1", "not delivered")
+	invoke_ok(t, cc, stub, "open_dispute", "alice", "D1", cardId, spendId, "not delivered")
+	invoke_fails(t, cc, stub, "open_dispute", "alice", "D2", cardId, spendId, "not delivered")
+
+	invoke_fails(t, cc, stub, "respond_dispute", "S2_owner", "D1", "not ours")
+	invoke_fails(t, cc, stub, "resolve_dispute", "S1_owner", "D1", DISPUTE_RELEASED, "delivered")
+
+	// the shop can not be terminated while it has open disputes
+	invoke_ok(t, cc, stub, "suspend_shop", "admin", "S1", "closing")
+	invoke_fails(t, cc, stub, "terminate_shop", "admin", "S1", SETTLE_REFUND, "", "closed")
+
+	invoke_ok(t, cc, stub, "resolve_dispute", "admin", "D1", DISPUTE_RELEASED, "delivered")
+	invoke_fails(t, cc, stub, "resolve_dispute", "admin", "D1", DISPUTE_REFUNDED, "delivered")
+	if card := get_test_card(t, cc, stub, cardId); card.Money != 3000 { t.Fatalf("card holds %d money", card.Money) }
+	if shopLedger := get_test_ledger(t, cc, stub, "S1", "S1_T"); shopLedger.HeldMoney != 0 || shopLedger.ConsumeMoney != 2000 {
+		t.Fatalf("ledger of S1_T is %+v", shopLedger)
+	}
+}
+
+//==============================================================================================================================
+//	 Shop report
+//==============================================================================================================================
+func TestShopReportTotalsTemplatesAndPeriod(t *testing.T) {
+
+	cc, stub := new_test_stub(t)
+	add_test_shop(t, cc, stub, "S1")
+	add_test_consumer(t, cc, stub, "alice")
+	cardId := issue_test_card(t, cc, stub, "S1", "alice")
+	otherCard := issue_test_card(t, cc, stub, "S1", "alice")
+	invoke_ok(t, cc, stub, "deposit_mp_shop_to_consumer", "S1_cashier", "50", "0", "alice", cardId)
+	invoke_ok(t, cc, stub, "spend_mp_consumer_to_shop", "alice", "20", "0", cardId, "S1")
+	invoke_ok(t, cc, stub, "merge_cards", "alice", cardId, otherCard)
+
+	invoke_ok(t, cc, stub, "create_card_template_by_shop", "S1_owner", "S1_Y", `{"kakaid":"S1_Y","shopid":"S1","shop":"S1 shop","currency":"JPY"}`)
+	invoke_ok(t, cc, stub, "push_card_by_template", "S1_owner", "alice", "S1_Y")
+	yenCard := cc.generate_card_id("S1_Y", get_test_ledger(t, cc, stub, "S1", "S1_Y").CardIdIndex)
+	invoke_ok(t, cc, stub, "deposit_mp_shop_to_consumer", "S1_cashier", "500", "0", "alice", yenCard)
+
+	stub.Now = stub.Now + 40 * TEST_DAY
+	invoke_ok(t, cc, stub, "deposit_mp_shop_to_consumer", "S1_cashier", "10", "0", "alice", cardId)
+
+	bytes, err := cc.Query(stub, "get_shop_report", []string{"S1_manager", "S1", "2023-11-01", "2023-11-30"})
+	if err != nil { t.Fatalf("get_shop_report: %s", err) }
+	var report ShopReport
+	err = json.Unmarshal(bytes, &report)
+	if err != nil || len(report.Templates) != 2 { t.Fatalf("shop report %s", string(bytes)) }
+
+	cny := report.Totals["CNY"]
+	if cny.Issued != 2 || cny.Active != 1 || cny.Scrapped != 1 || cny.DepositMoney != 6000 || cny.OutstandingMoney != 4000 {
+		t.Fatalf("CNY totals are %+v", cny)
+	}
+	if cny.RangeDepositMoney != 5000 || cny.RangeConsumeMoney != 2000 { t.Fatalf("CNY period totals are %+v", cny) }
+	if jpy := report.Totals["JPY"]; jpy.Issued != 1 || jpy.OutstandingMoney != 500 { t.Fatalf("JPY totals are %+v", jpy) }
+}
+
+func TestShopReportIsRestricted(t *testing.T) {
+
+	cc, stub := new_test_stub(t)
+	add_test_shop(t, cc, stub, "S1")
+	add_test_shop(t, cc, stub, "S2")
+
+	for _, args := range [][]string{
+		{"S2_owner", "S1", "2023-11-01", "2023-11-30"},
+		{"S1_cashier", "S1", "2023-11-01", "2023-11-30"},
+		{"S1_owner", "S1", "2023-11-01", "november"},
+	} {
+		if _, err := cc.Query(stub, "get_shop_report", args); err == nil { t.Fatalf("get_shop_report %v: expected an error", args) }
+	}
+	if _, err := cc.Query(stub, "get_shop_report", []string{"admin", "S1", "2023-11-01", "2023-11-30"}); err != nil { t.Fatalf("get_shop_report: %s", err) }
+}
+
+//==============================================================================================================================
+//	 Daily ledger buckets
+//==============================================================================================================================
+func get_test_statement_of(t *testing.T, cc *CardTransactionChaincode, stub shim.ChaincodeStubInterface, caller string, shopId string, periodStart string, periodEnd string) (LedgerStatement) {
+
+	bytes, err := cc.Query(stub, "get_ledger_statement", []string{caller, shopId, periodStart, periodEnd})
+	if err != nil { t.Fatalf("ledger statement of %s: %s", shopId, err) }
+	var statement LedgerStatement
+	err = json.Unmarshal(bytes, &statement)
+	if err != nil { t.Fatalf("ledger statement of %s: %s", shopId, err) }
+	return statement
+}
+
+func TestLedgerIsBucketedByDayAndClosed(t *testing.T) {
+
+	cc, stub := new_test_stub(t)
+	add_test_shop(t, cc, stub, "S1")
+	add_test_consumer(t, cc, stub, "alice")
+	cardId := issue_test_card(t, cc, stub, "S1", "alice")
+	invoke_ok(t, cc, stub, "deposit_mp_shop_to_consumer", "S1_cashier", "50", "0", "alice", cardId)
+	stub.Now = stub.Now + TEST_DAY
+	invoke_ok(t, cc, stub, "spend_mp_consumer_to_shop", "alice", "20", "0", cardId, "S1")
+
+	statement := get_test_statement_of(t, cc, stub, "S1_manager", "S1", "2023-11-14", "2023-11-15")
+	if len(statement.Templates) != 1 || len(statement.Templates[0].Days) != 2 { t.Fatalf("ledger statement is %+v", statement) }
+	if total := statement.Templates[0].Total; total.DepositMoney != 5000 || total.ConsumeMoney != 2000 { t.Fatalf("statement total is %+v", total) }
+
+	statement = get_test_statement_of(t, cc, stub, "S1_manager", "S1", "2023-11-15", "2023-11-15")
+	if total := statement.Templates[0].Total; total.DepositMoney != 0 || total.ConsumeMoney != 2000 { t.Fatalf("statement total is %+v", total) }
+
+	invoke_ok(t, cc, stub, "close_period", "S1_owner", "S1", "2023-11-14")
+	statement = get_test_statement_of(t, cc, stub, "admin", "S1", "2023-11-14", "2023-11-15")
+	if statement.Closedthrough != "2023-11-14" || statement.Templates[0].Days[0].Closed == false || statement.Templates[0].Days[1].Closed == true {
+		t.Fatalf("ledger statement is %+v", statement)
+	}
+}
+
+func TestClosePeriodIsChecked(t *testing.T) {
+
+	cc, stub := new_test_stub(t)
+	add_test_shop(t, cc, stub, "S1")
+	add_test_shop(t, cc, stub, "S2")
+	stub.Now = stub.Now + TEST_DAY
+
+	invoke_fails(t, cc, stub, "close_period", "S1_cashier", "S1", "2023-11-14")
+	invoke_fails(t, cc, stub, "close_period", "S2_owner", "S1", "2023-11-14")
+	invoke_fails(t, cc, stub, "close_period", "S1_owner", "S1", "2023-11-15")
+	invoke_ok(t, cc, stub, "close_period", "S1_owner", "S1", "2023-11-14")
+	invoke_fails(t, cc, stub, "close_period", "S1_owner", "S1", "2023-11-14")
+
+	if _, err := cc.Query(stub, "get_ledger_statement", []string{"S2_owner", "S1", "2023-11-14", "2023-11-15"}); err == nil {
+		t.Fatalf("get_ledger_statement: S2 read the ledger of S1")
+	}
+}
+
+//==============================================================================================================================
+//	 Double-entry journal
+//==============================================================================================================================
+func TestJournalBalancesCardsAndLedger(t *testing.T) {
+
+	cc, stub := new_test_stub(t)
+	add_test_shop(t, cc, stub, "S1")
+	add_test_consumer(t, cc, stub, "alice")
+	add_test_consumer(t, cc, stub, "bob")
+	aliceCard := issue_test_card(t, cc, stub, "S1", "alice")
+	bobCard := issue_test_card(t, cc, stub, "S1", "bob")
+
+	invoke_ok(t, cc, stub, "deposit_mp_shop_to_consumer", "S1_cashier", "50", "10", "alice", aliceCard)
+	invoke_ok(t, cc, stub, "spend_mp_consumer_to_shop", "alice", "20", "3", aliceCard, "S1")
+	invoke_ok(t, cc, stub, "transfer_mp_consumer_to_consumer", "alice", "5", "0", aliceCard, "bob", bobCard)
+	invoke_ok(t, cc, stub, "propose_transfer", "alice", "P1", aliceCard, "bob", "5", "2", "7")
+	invoke_ok(t, cc, stub, "update_ct_money", "S1_manager", bobCard, "8")
+
+	bytes, err := cc.Query(stub, "get_journal_check", []string{"S1_manager", "S1"})
+	if err != nil { t.Fatalf("get_journal_check: %s", err) }
+	var check ShopJournalCheck
+	err = json.Unmarshal(bytes, &check)
+	if err != nil || len(check.Templates) != 1 { t.Fatalf("journal check %s", string(bytes)) }
+	if tc := check.Templates[0]; check.Balanced == false || tc.CardMoney != 2800 || tc.EscrowMoney != 500 || tc.JournalMoney != 3300 || tc.LedgerMoney != 3300 {
+		t.Fatalf("journal check of S1_T is %+v", tc)
+	}
+
+	bytes, err = cc.Query(stub, "get_journal_account", []string{"alice", ACCOUNT_CARD + "-" + aliceCard})
+	if err != nil { t.Fatalf("get_journal_account: %s", err) }
+	var statement JournalStatement
+	err = json.Unmarshal(bytes, &statement)
+	if err != nil || statement.Account.Money != -2000 || statement.Account.Point != -5 || len(statement.Entries) != 4 {
+		t.Fatalf("journal account of %s is %s", aliceCard, string(bytes))
+	}
+	for _, entry := range statement.Entries {
+		var money int64
+		point := 0
+		for _, line := range entry.Lines {
+			money = money + line.Money
+			point = point + line.Point
+		}
+		if money != 0 || point != 0 { t.Fatalf("journal entry %s does not balance: %+v", entry.Entryid, entry.Lines) }
+	}
+}
+
+func TestJournalIsRestricted(t *testing.T) {
+
+	cc, stub := new_test_stub(t)
+	add_test_shop(t, cc, stub, "S1")
+	add_test_shop(t, cc, stub, "S2")
+	add_test_consumer(t, cc, stub, "alice")
+	add_test_consumer(t, cc, stub, "bob")
+	aliceCard := issue_test_card(t, cc, stub, "S1", "alice")
+	invoke_ok(t, cc, stub, "deposit_mp_shop_to_consumer", "S1_cashier", "50", "0", "alice", aliceCard)
+
+	invoke_fails(t, cc, stub, "open_journal", "S1_owner", "S1_T")
+	for _, query := range [][]string{
+		{"get_journal_check", "S2_owner", "S1"},
+		{"get_journal_check", "alice", "S1"},
+		{"get_journal_account", "bob", ACCOUNT_CARD + "-" + aliceCard},
+		{"get_journal_account", "S2_owner", ACCOUNT_CARD + "-" + aliceCard},
+	} {
+		if _, err := cc.Query(stub, query[0], query[1:]); err == nil { t.Fatalf("%v: expected an error", query) }
+	}
+}
+
+//==============================================================================================================================
+//	 Liability report
+//==============================================================================================================================
+func TestLiabilityReportAgesAndReconcilesCards(t *testing.T) {
+
+	cc, stub := new_test_stub(t)
+	add_test_shop(t, cc, stub, "S1")
+	add_test_shop(t, cc, stub, "S2")
+	add_test_consumer(t, cc, stub, "alice")
+	add_test_consumer(t, cc, stub, "bob")
+	aliceCard := issue_test_card(t, cc, stub, "S1", "alice")
+	invoke_ok(t, cc, stub, "deposit_mp_shop_to_consumer", "S1_cashier", "50", "10", "alice", aliceCard)
+	invoke_ok(t, cc, stub, "propose_transfer", "alice", "P1", aliceCard, "bob", "5", "0", "7")
+
+	stub.Now = stub.Now + 100 * TEST_DAY
+	bobCard := issue_test_card(t, cc, stub, "S2", "bob")
+	invoke_ok(t, cc, stub, "deposit_mp_shop_to_consumer", "S2_cashier", "20", "0", "bob", bobCard)
+
+	bytes, err := cc.Query(stub, "get_liability_report", []string{"admin"})
+	if err != nil { t.Fatalf("get_liability_report: %s", err) }
+	var report LiabilityReport
+	err = json.Unmarshal(bytes, &report)
+	if err != nil || len(report.Shops) != 2 || report.Money["CNY"] != 7000 { t.Fatalf("liability report %s", string(bytes)) }
+
+	s1 := report.Shops[0]
+	if s1.Shopid != "S1" || s1.Reconciled == false || s1.Money["CNY"] != 5000 || s1.Point != 10 { t.Fatalf("liability of S1 is %+v", s1) }
+	buckets := make(map[string]int64)
+	for _, bucket := range s1.Templates[0].Buckets { buckets[bucket.Bucket] = bucket.Money }
+	if len(buckets) != 2 || buckets["91-180"] != 4500 || buckets[AGE_ESCROW] != 500 { t.Fatalf("buckets of S1_T are %+v", s1.Templates[0].Buckets) }
+
+	s2 := report.Shops[1]
+	if s2.Shopid != "S2" || s2.Reconciled == false || s2.Templates[0].Buckets[0].Bucket != "0-30" { t.Fatalf("liability of S2 is %+v", s2) }
+}
+
+func TestLiabilityReportIsForKakacenter(t *testing.T) {
+
+	cc, stub := new_test_stub(t)
+	add_test_shop(t, cc, stub, "S1")
+	add_test_consumer(t, cc, stub, "alice")
+
+	for _, caller := range []string{"S1_owner", "alice"} {
+		if _, err := cc.Query(stub, "get_liability_report", []string{caller}); err == nil { t.Fatalf("get_liability_report: %s read the report", caller) }
+	}
+}